@@ -0,0 +1,99 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {cloudBuildConfig} from './cloudbuild.ts';
+import type {Config} from './custard.ts';
+
+describe('cloudBuildConfig', () => {
+  const config: Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {'cloud-build': 'cloudbuild.json'},
+  };
+  const checkoutPath = testing.materialize({
+    'a/package.json': '{}',
+    'a/ci-setup.json': '{"env": {"A": "1"}}',
+    'a/cloudbuild.json': JSON.stringify({
+      steps: [
+        {id: 'install', name: 'node', args: ['npm', 'ci']},
+        {id: 'test', name: 'node', args: ['npm', 'test', '$PACKAGE']},
+      ],
+      images: ['gcr.io/$PROJECT_ID/${PACKAGE}'],
+    }),
+    'b/package.json': '{}',
+    'b/cloudbuild.json': JSON.stringify({
+      steps: [
+        {name: 'lint', waitFor: ['-']},
+        {name: 'build', dir: 'app', waitFor: ['-']},
+        {name: 'test', env: ['B=2']},
+      ],
+    }),
+    'c/package.json': '{}',
+    'c/ci-setup.json': '{"cloud-build": ""}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('combines package builds', () => {
+    const build = cloudBuildConfig(config, ['a', 'b', 'c'], checkoutPath);
+    expect(build).to.deep.equal({
+      steps: [
+        {
+          id: 'a:install',
+          name: 'node',
+          args: ['npm', 'ci'],
+          dir: 'a',
+          env: ['A=1'],
+          waitFor: ['-'],
+        },
+        {
+          id: 'a:test',
+          name: 'node',
+          args: ['npm', 'test', 'a'],
+          dir: 'a',
+          env: ['A=1'],
+          waitFor: ['a:install'],
+        },
+        {id: 'b:0', name: 'lint', dir: 'b', env: [], waitFor: ['-']},
+        {id: 'b:1', name: 'build', dir: 'b/app', env: [], waitFor: ['-']},
+        {
+          id: 'b:2',
+          name: 'test',
+          dir: 'b',
+          env: ['B=2'],
+          waitFor: ['b:0', 'b:1'],
+        },
+      ],
+      images: ['gcr.io/$PROJECT_ID/a'],
+    });
+  });
+
+  it('YAML build files', () => {
+    const yaml = {
+      ...config,
+      'ci-setup-defaults': {'cloud-build': 'cloudbuild.yaml'},
+    };
+    expect(() => cloudBuildConfig(yaml, ['b'], checkoutPath)).to.throw(
+      'b: Cloud Build file must be .json or .jsonc, got: cloudbuild.yaml',
+    );
+  });
+
+  it('no packages', () => {
+    expect(cloudBuildConfig(config, [], checkoutPath)).to.deep.equal({
+      steps: [],
+    });
+  });
+});
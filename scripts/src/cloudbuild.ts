@@ -0,0 +1,160 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Cloud Build config generation, combines the build files of the affected
+// packages into a single build where the packages run in parallel.
+//
+// The generated config is JSON, which is also valid YAML, so it can be
+// written to a `cloudbuild.yaml` file. The package build files must be JSON
+// or JSONC, there is no YAML parser without adding a dependency.
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+
+import * as path from 'node:path';
+import {
+  expandAllPackages,
+  loadJsonc,
+  loadPackage,
+  substitute,
+} from './custard.ts';
+import type {Config} from './custard.ts';
+import {message} from './log.ts';
+
+export type CloudBuildStep = {
+  id?: string;
+  name: string;
+  dir?: string;
+  env?: string[];
+  waitFor?: string[];
+  [k: string]: any;
+};
+
+export type CloudBuild = {
+  steps: CloudBuildStep[];
+  images?: string[];
+  [k: string]: any;
+};
+
+/**
+ * Generates a Cloud Build config to build the given packages.
+ *
+ * Each package declares its build file in the `cloud-build` field of its
+ * ci-setup file, packages without one are skipped.
+ * The build files can use `$PACKAGE` for the package path.
+ *
+ * Steps are prefixed with the package path and run in the package
+ * directory with the package's environment variables.
+ * Packages run in parallel, and steps within a package keep their order.
+ *
+ * @param config config object
+ * @param packages list of packages to build, or the all packages marker
+ * @param checkoutPath path to the repository checkout
+ * @returns Cloud Build config
+ */
+export function cloudBuildConfig(
+  config: Config,
+  packages: string[],
+  checkoutPath = '.',
+): CloudBuild {
+  const build: CloudBuild = {steps: []};
+  for (const pkg of expandAllPackages(config, packages, checkoutPath)) {
+    const {ciSetup} = loadPackage(config, pkg, checkoutPath);
+    const buildFile = ciSetup['cloud-build'];
+    if (!buildFile) {
+      console.error(
+        message('W005', `${pkg}: no 'cloud-build' file in ci-setup, skipping`),
+      );
+      continue;
+    }
+    if (!/\.jsonc?$/.test(buildFile)) {
+      throw new Error(
+        message(
+          'E054',
+          `${pkg}: Cloud Build file must be .json or .jsonc, got: ${buildFile}`,
+        ),
+      );
+    }
+    const pkgBuild: CloudBuild = substituteAll(
+      {PACKAGE: pkg},
+      loadJsonc(path.join(checkoutPath, pkg, buildFile)),
+    );
+    const env = Object.entries(ciSetup.env || {}).map(
+      ([key, value]) => `${key}=${value}`,
+    );
+    build.steps.push(...packageSteps(pkg, pkgBuild.steps || [], env));
+    if (pkgBuild.images) {
+      build.images = [...(build.images || []), ...pkgBuild.images];
+    }
+  }
+  return build;
+}
+
+/**
+ * Scopes the steps of a package build to run alongside other packages.
+ *
+ * @param pkg package path
+ * @param steps package build steps
+ * @param env package environment variables, as KEY=VALUE
+ * @returns scoped steps
+ */
+function packageSteps(
+  pkg: string,
+  steps: CloudBuildStep[],
+  env: string[],
+): CloudBuildStep[] {
+  const scopedId = (id: string) => `${pkg}:${id}`;
+  const ids: string[] = [];
+  return steps.map((step, i) => {
+    const id = scopedId(step.id || `${i}`);
+    // Steps without waitFor wait for all the previous steps,
+    // but only the ones from the same package.
+    const waitFor = step.waitFor
+      ? step.waitFor.map(dep => (dep === '-' ? dep : scopedId(dep)))
+      : ids.length > 0
+        ? [...ids]
+        : ['-'];
+    ids.push(id);
+    return {
+      ...step,
+      id,
+      dir: step.dir ? path.posix.join(pkg, step.dir) : pkg,
+      env: [...env, ...(step.env || [])],
+      waitFor,
+    };
+  });
+}
+
+/**
+ * Applies variable substitutions to all the strings in a value.
+ *
+ * @param subs variable substitutions
+ * @param value value with strings, arrays, and objects
+ * @returns value after substitutions
+ */
+function substituteAll(subs: {[k: string]: string}, value: any): any {
+  if (typeof value === 'string') {
+    return substitute(subs, value);
+  }
+  if (Array.isArray(value)) {
+    return value.map(x => substituteAll(subs, x));
+  }
+  if (typeof value === 'object' && value !== null) {
+    return Object.fromEntries(
+      Object.entries(value).map(([k, v]) => [k, substituteAll(subs, v)]),
+    );
+  }
+  return value;
+}
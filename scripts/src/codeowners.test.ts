@@ -0,0 +1,127 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {
+  affectedByOwner,
+  loadCodeowners,
+  ownersFor,
+  ownersSummary,
+  parseCodeowners,
+} from './codeowners.ts';
+
+describe('codeowners', () => {
+  const rules = parseCodeowners(
+    [
+      '# Default owners.',
+      '*       @org/maintainers',
+      '',
+      '/apps/  @org/apps  # Frontend apps.',
+      '/apps/legacy/',
+      'docs/*  docs@example.com',
+      '**/ml   @org/ml @data-lead',
+    ].join('\n'),
+  );
+
+  it('parseCodeowners', () => {
+    expect(rules).to.deep.equal([
+      {pattern: '*', owners: ['@org/maintainers'], line: 2},
+      {pattern: '/apps/', owners: ['@org/apps'], line: 4},
+      {pattern: '/apps/legacy/', owners: [], line: 5},
+      {pattern: 'docs/*', owners: ['docs@example.com'], line: 6},
+      {pattern: '**/ml', owners: ['@org/ml', '@data-lead'], line: 7},
+    ]);
+  });
+
+  it('ownersFor', () => {
+    expect(ownersFor(rules, 'lib')).to.deep.equal(['@org/maintainers']);
+    expect(ownersFor(rules, 'apps/web')).to.deep.equal(['@org/apps']);
+    expect(ownersFor(rules, './apps/web/')).to.deep.equal(['@org/apps']);
+    expect(ownersFor(rules, 'apps\\web')).to.deep.equal(['@org/apps']);
+    expect(ownersFor(rules, 'apps/legacy/old')).to.deep.equal([]);
+    expect(ownersFor(rules, 'docs/guide')).to.deep.equal(['docs@example.com']);
+    expect(ownersFor(rules, 'docs/guide/nested')).to.deep.equal([
+      '@org/maintainers',
+    ]);
+    expect(ownersFor(rules, 'ml')).to.deep.equal(['@org/ml', '@data-lead']);
+    expect(ownersFor(rules, 'apps/ml/train')).to.deep.equal([
+      '@org/ml',
+      '@data-lead',
+    ]);
+    expect(ownersFor([], 'lib')).to.deep.equal([]);
+  });
+
+  it('affectedByOwner', () => {
+    const groups = affectedByOwner(rules, ['apps/web', 'apps/ml', 'lib']);
+    expect(groups).to.deep.equal({
+      owners: {
+        '@org/apps': ['apps/web'],
+        '@org/ml': ['apps/ml'],
+        '@data-lead': ['apps/ml'],
+        '@org/maintainers': ['lib'],
+      },
+      unowned: [],
+    });
+    expect(affectedByOwner(rules, ['apps/legacy/old']).unowned).to.deep.equal(
+      ['apps/legacy/old'],
+    );
+  });
+
+  it('ownersSummary', () => {
+    const groups = {
+      owners: {'@org/b': ['b'], '@org/a': ['a', 'c']},
+      unowned: ['d'],
+    };
+    expect(ownersSummary(groups)).to.equal(
+      [
+        '## 🍮 Affected packages by owner',
+        '',
+        '### @org/a',
+        '',
+        '- `a`',
+        '- `c`',
+        '',
+        '### @org/b',
+        '',
+        '- `b`',
+        '',
+        '### No owners',
+        '',
+        '- `d`',
+        '',
+      ].join('\n'),
+    );
+    expect(ownersSummary({owners: {}, unowned: []})).to.equal(
+      '## 🍮 Affected packages by owner\n\nNo packages affected.\n',
+    );
+  });
+
+  it('loadCodeowners', () => {
+    const checkoutPath = testing.materialize({
+      '.github/CODEOWNERS': '* @org/github',
+      CODEOWNERS: '* @org/root',
+    });
+    try {
+      expect(loadCodeowners(checkoutPath)).to.deep.equal([
+        {pattern: '*', owners: ['@org/github'], line: 1},
+      ]);
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+    expect(loadCodeowners('/does/not/exist')).to.deep.equal([]);
+  });
+});
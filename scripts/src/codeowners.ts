@@ -0,0 +1,188 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// CODEOWNERS integration, to know which teams own the affected packages.
+// CI can then notify the right teams, and write a summary for each team.
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+
+export type CodeownersRule = {
+  // Path pattern, like /apps/ or *.go.
+  pattern: string;
+
+  // Owners, like @org/team or user@example.com.
+  // An empty list means the paths have no owners.
+  owners: string[];
+
+  // Line number in the CODEOWNERS file.
+  line: number;
+};
+
+export type OwnerGroups = {
+  // Packages of each owner, a package can have several owners.
+  owners: {[owner: string]: string[]};
+
+  // Packages without owners.
+  unowned: string[];
+};
+
+// Where GitHub looks for the CODEOWNERS file, in order.
+const codeownersPaths = [
+  path.join('.github', 'CODEOWNERS'),
+  'CODEOWNERS',
+  path.join('docs', 'CODEOWNERS'),
+];
+
+/**
+ * Parses a CODEOWNERS file.
+ *
+ * @param text CODEOWNERS file contents
+ * @returns rules, in the same order as the file
+ */
+export function parseCodeowners(text: string): CodeownersRule[] {
+  const rules: CodeownersRule[] = [];
+  text.split('\n').forEach((rawLine, i) => {
+    const line = rawLine.replace(/(^|\s)#.*$/, '').trim();
+    if (line === '') {
+      return;
+    }
+    const [pattern, ...owners] = line.split(/\s+/);
+    rules.push({pattern, owners, line: i + 1});
+  });
+  return rules;
+}
+
+/**
+ * Loads the CODEOWNERS file of a repository.
+ *
+ * Like GitHub, it looks in `.github/`, the root, and `docs/`, and uses the
+ * first one it finds.
+ *
+ * @param checkoutPath path to the repository checkout
+ * @returns rules, or an empty list if there is no CODEOWNERS file
+ */
+export function loadCodeowners(checkoutPath = '.'): CodeownersRule[] {
+  for (const codeownersPath of codeownersPaths) {
+    const fullPath = path.join(checkoutPath, codeownersPath);
+    if (fs.existsSync(fullPath)) {
+      return parseCodeowners(fs.readFileSync(fullPath, 'utf8'));
+    }
+  }
+  return [];
+}
+
+/**
+ * Finds the owners of a package.
+ *
+ * The package is matched as a directory, and the last matching rule wins,
+ * like on GitHub.
+ *
+ * @param rules CODEOWNERS rules
+ * @param pkg package path, relative to the checkout path
+ * @returns owners of the package, or an empty list if it has none
+ */
+export function ownersFor(rules: CodeownersRule[], pkg: string): string[] {
+  // Packages files can have backslashes, a leading `./`, or a trailing `/`.
+  const dir = pkg
+    .replaceAll('\\', '/')
+    .replace(/^(\.\/)+/, '')
+    .replace(/^\/+|\/+$/g, '');
+  for (let i = rules.length - 1; i >= 0; i--) {
+    if (patternRegExp(rules[i].pattern).test(dir)) {
+      return rules[i].owners;
+    }
+  }
+  return [];
+}
+
+/**
+ * Groups packages by their owners.
+ *
+ * @param rules CODEOWNERS rules
+ * @param packages package paths, relative to the checkout path
+ * @returns packages of each owner, and the packages without owners
+ */
+export function affectedByOwner(
+  rules: CodeownersRule[],
+  packages: string[],
+): OwnerGroups {
+  const groups: OwnerGroups = {owners: {}, unowned: []};
+  for (const pkg of packages) {
+    const owners = ownersFor(rules, pkg);
+    if (owners.length === 0) {
+      groups.unowned.push(pkg);
+    }
+    for (const owner of owners) {
+      groups.owners[owner] = [...(groups.owners[owner] || []), pkg];
+    }
+  }
+  return groups;
+}
+
+/**
+ * Creates a summary with the affected packages of each owner.
+ *
+ * @param groups packages grouped by owner
+ * @returns summary markdown
+ */
+export function ownersSummary(groups: OwnerGroups): string {
+  const lines = ['## 🍮 Affected packages by owner', ''];
+  const owners = Object.keys(groups.owners).sort();
+  if (owners.length === 0 && groups.unowned.length === 0) {
+    lines.push('No packages affected.');
+    return lines.join('\n') + '\n';
+  }
+  for (const owner of owners) {
+    lines.push(`### ${owner}`, '');
+    lines.push(...groups.owners[owner].map(pkg => `- \`${pkg}\``), '');
+  }
+  if (groups.unowned.length > 0) {
+    lines.push('### No owners', '');
+    lines.push(...groups.unowned.map(pkg => `- \`${pkg}\``), '');
+  }
+  return lines.join('\n');
+}
+
+/**
+ * Converts a CODEOWNERS pattern into a regular expression for directories.
+ *
+ * Patterns follow the gitignore rules: a pattern with a slash at the start
+ * or in the middle is relative to the root, otherwise it matches at any
+ * depth. A pattern matches a directory and everything beneath it, except
+ * patterns ending in `/*`, which only match the direct children.
+ *
+ * @param pattern CODEOWNERS pattern
+ * @returns regular expression matching directory paths
+ */
+function patternRegExp(pattern: string): RegExp {
+  // A leading `**/` matches at any depth, like no slash at all.
+  const trimmed = pattern.replace(/\/$/, '').replace(/^\*\*\//, '');
+  const anchored = trimmed.includes('/');
+  const directChildren = pattern.endsWith('/*');
+  const glob = trimmed
+    .replace(/^\//, '')
+    .split(/(\*\*|\*|\?)/)
+    .map(
+      token =>
+        ({'**': '.*', '*': '[^/]*', '?': '[^/]'})[token] ??
+        token.replace(/[.+^${}()|[\]\\]/g, '\\$&'),
+    )
+    .join('');
+  const prefix = anchored ? '^' : '^(.*/)?';
+  const suffix = directChildren ? '$' : '(/.*)?$';
+  return new RegExp(`${prefix}${glob}${suffix}`);
+}
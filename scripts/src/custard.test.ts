@@ -14,9 +14,12 @@
  limitations under the License.
  */
 
+import * as fs from 'node:fs';
 import * as path from 'node:path';
+import {Readable} from 'node:stream';
 import {expect} from 'chai';
 import * as custard from './custard.ts';
+import * as testing from './testing.ts';
 
 describe('loadJsonc', () => {
   it('file does not exist', () => {
@@ -35,14 +38,478 @@ describe('loadJsonc', () => {
   });
 });
 
+describe('parseJsonc', () => {
+  it('comments and trailing commas', () => {
+    const jsonc = [
+      '{',
+      '  // line comment',
+      '  "a": [1, 2,], /* block',
+      '  comment */ "b": "not // a comment",',
+      '  "c": {"d": null, "e": -1.5e3, "f": true},',
+      '}',
+    ].join('\n');
+    expect(custard.parseJsonc(jsonc)).to.deep.equal({
+      a: [1, 2],
+      b: 'not // a comment',
+      c: {d: null, e: -1500, f: true},
+    });
+  });
+
+  it('syntax errors with positions', () => {
+    const parse = (text: string) => () => custard.parseJsonc(text, 'x.json');
+    expect(parse('{\n  "a": 1\n  "b": 2\n}')).to.throw(
+      "x.json:3:3: expected ',' or '}', got \"\\\"\"",
+    );
+    expect(parse('{"a": {"b": [1, tru]}}')).to.throw(
+      "x.json:1:17: unexpected \"t\" in 'a.b[1]'",
+    );
+    expect(parse('{"a": "b')).to.throw('x.json:1:9: unterminated string');
+    expect(parse('{} /*')).to.throw('x.json:1:4: unterminated comment');
+    expect(parse('{"a" 1}')).to.throw(
+      'x.json:1:6: expected \':\' after key "a", got "1"',
+    );
+    expect(parse('')).to.throw('x.json:1:1: unexpected end of file');
+  });
+});
+
+// Fields that configs without a 'schema-version' get when loaded.
+const migratedV1 = {
+  'schema-version': custard.configSchemaVersion,
+  'ci-setup-defaults-filename': [],
+};
+
 describe('loadConfig', () => {
   it('default values', () => {
     const configPath = path.join('test', 'config', 'default-values.json');
     expect(custard.loadConfig(configPath)).deep.equals({
       'package-file': ['package.json'],
       match: ['*'],
+      ...migratedV1,
+    });
+  });
+
+  it('toml', () => {
+    const configPath = path.join('test', 'config', 'config.toml');
+    expect(custard.loadConfig(configPath)).deep.equals({
+      'package-file': ['package.json'],
+      ignore: ['README.md', '*.txt'],
+      'ci-setup-defaults': {'node-version': 20, env: {A: 'a'}},
+      commands: {test: {run: 'npm test'}},
+      match: ['*'],
+      ...migratedV1,
+    });
+  });
+
+  it('pyproject.toml', () => {
+    const configPath = path.join('test', 'config', 'pyproject.toml');
+    expect(custard.loadConfig(configPath)).deep.equals({
+      'package-file': 'requirements.txt',
+      match: ['*'],
+      ...migratedV1,
+    });
+  });
+
+  it('match file', () => {
+    const dir = testing.materialize({
+      'config/config.json': JSON.stringify({
+        'package-file': 'package.json',
+        ignore: 'README.md',
+        'match-file': '../.custard-patterns',
+      }),
+      '.custard-patterns': [
+        '# Source files.',
+        '*.ts',
+        '/src/',
+        '',
+        '!*.test.ts',
+        '\\#literal',
+      ].join('\n'),
+    });
+    try {
+      const configPath = path.join(dir, 'config', 'config.json');
+      expect(custard.loadConfig(configPath)).deep.equals({
+        'package-file': 'package.json',
+        'match-file': '../.custard-patterns',
+        match: ['*.ts', 'src/**', '#literal'],
+        ignore: ['README.md', '*.test.ts'],
+        ...migratedV1,
+      });
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+});
+
+describe('loadConfigs', () => {
+  const base = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {'node-version': 20, env: {A: 'a'}},
+    commands: {test: {run: 'npm test'}},
+    profiles: {
+      presubmit: {match: '*.ts'},
+      nightly: {'ci-setup-defaults': {'node-version': 22}},
+    },
+  };
+
+  it('merges files in order', () => {
+    const dir = testing.materialize({
+      'base.json': JSON.stringify(base),
+      'team.json': JSON.stringify({
+        ignore: 'README.md',
+        'ci-setup-defaults': {env: {B: 'b'}},
+        commands: {lint: {run: 'npm run lint'}},
+        profiles: {presubmit: {ignore: '*.md'}},
+      }),
+    });
+    try {
+      const paths = ['base.json', 'team.json'].map(f => path.join(dir, f));
+      expect(custard.loadConfigs(paths, '')).deep.equals({
+        'package-file': 'package.json',
+        ignore: 'README.md',
+        'ci-setup-defaults': {'node-version': 20, env: {A: 'a', B: 'b'}},
+        commands: {test: {run: 'npm test'}, lint: {run: 'npm run lint'}},
+        profiles: {
+          presubmit: {match: '*.ts', ignore: '*.md'},
+          nightly: {'ci-setup-defaults': {'node-version': 22}},
+        },
+        match: ['*'],
+        ...migratedV1,
+      });
+      expect(custard.loadConfig(paths.join(path.delimiter), '')).deep.equals(
+        custard.loadConfigs(paths, ''),
+      );
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('applies a profile', () => {
+    const dir = testing.materialize({'config.json': JSON.stringify(base)});
+    try {
+      const configPath = path.join(dir, 'config.json');
+      const presubmit = custard.loadConfigs([configPath], 'presubmit');
+      expect(presubmit.match).equals('*.ts');
+      expect(presubmit['ci-setup-defaults']).deep.equals({
+        'node-version': 20,
+        env: {A: 'a'},
+      });
+      const nightly = custard.loadConfigs([configPath], 'nightly');
+      expect(nightly.match).deep.equals(['*']);
+      expect(nightly['ci-setup-defaults']).deep.equals({
+        'node-version': 22,
+        env: {A: 'a'},
+      });
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('unknown profile', () => {
+    const dir = testing.materialize({'config.json': JSON.stringify(base)});
+    try {
+      const configPath = path.join(dir, 'config.json');
+      expect(() => custard.loadConfigs([configPath], 'weekly')).to.throw(
+        'unknown profile: "weekly", expected one of: presubmit, nightly',
+      );
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('config URLs', () => {
+    const files: {[url: string]: string} = {
+      'https://example.com/custard/base.toml': [
+        'package-file = "package.json"',
+        'match-file = "patterns.txt"',
+      ].join('\n'),
+      'https://example.com/custard/patterns.txt': '*.ts\n!*.test.ts',
+      'gs://bucket/team.jsonc': '{"ignore": ["README.md"]}',
+    };
+    const fetched: string[] = [];
+    const fetchers = {
+      'https:': (url: string) => {
+        fetched.push(url);
+        return files[url];
+      },
+      'gs:': (url: string) => {
+        fetched.push(url);
+        return files[url];
+      },
+    };
+    const urls = [
+      'https://example.com/custard/base.toml',
+      'gs://bucket/team.jsonc',
+    ].join(path.delimiter);
+    expect(custard.loadConfig(urls, '', fetchers)).deep.equals({
+      'package-file': 'package.json',
+      'match-file': 'patterns.txt',
+      match: ['*.ts'],
+      ignore: ['README.md'],
+      ...migratedV1,
+    });
+    expect(fetched).deep.equals([
+      'https://example.com/custard/base.toml',
+      'https://example.com/custard/patterns.txt',
+      'gs://bucket/team.jsonc',
+    ]);
+    expect(() =>
+      custard.loadConfigs(['s3://bucket/config.json'], '', fetchers),
+    ).to.throw(
+      'unsupported config URL: s3://bucket/config.json, expected one of: https:, gs:',
+    );
+    expect(() => custard.loadConfigs(['http://example.com/c.json'])).to.throw(
+      'unsupported config URL: http://example.com/c.json',
+    );
+  });
+
+  it('config URLs with ports', () => {
+    const files: {[url: string]: string} = {
+      'https://example.com:8443/base.jsonc': '{"package-file": "go.mod"}',
+      'https://example.com:8443': '{"ignore": ["*.md"]}',
+    };
+    const fetchers = {'https:': (url: string) => files[url]};
+    if (path.delimiter === ':') {
+      const dir = testing.materialize({'local.jsonc': '{"match": ["*.go"]}'});
+      try {
+        const urls = [...Object.keys(files), path.join(dir, 'local.jsonc')];
+        expect(custard.loadConfig(urls.join(':'), '', fetchers)).deep.equals({
+          'package-file': 'go.mod',
+          ignore: ['*.md'],
+          match: ['*.go'],
+          ...migratedV1,
+        });
+      } finally {
+        testing.cleanup(dir);
+      }
+    }
+  });
+
+  it('validation', () => {
+    const invalid = {
+      profiles: {
+        a: {symlinks: 'maybe'},
+        b: 1,
+        c: {profiles: {}},
+      },
+    };
+    expect(custard.validateConfig(invalid)).deep.equals([
+      "'profiles.a': 'symlinks' must be one of: skip, follow, error, got: \"maybe\"",
+      "'profiles.b' must be a config object, got: 1",
+      "'profiles.c': profiles cannot be nested",
+    ]);
+  });
+});
+
+describe('migrateConfig', () => {
+  it('keeps the behavior of older versions', () => {
+    const config: custard.Config = {
+      'schema-version': 1,
+      'package-file': 'package.json',
+      ignore: ['!important.md', '*.md'],
+      profiles: {docs: {ignore: '!notes.txt'}},
+    };
+    expect(custard.migrateConfig(config).length).equals(4);
+    expect(config).to.deep.equal({
+      'schema-version': custard.configSchemaVersion,
+      'package-file': 'package.json',
+      ignore: ['\\!important.md', '*.md'],
+      profiles: {docs: {ignore: ['\\!notes.txt']}},
+      'ci-setup-defaults-filename': [],
+    });
+  });
+
+  it('current version', () => {
+    const config: custard.Config = {
+      'schema-version': custard.configSchemaVersion,
+      ignore: ['!a.md'],
+    };
+    expect(custard.migrateConfig(config)).to.deep.equal([]);
+    expect(config.ignore).to.deep.equal(['!a.md']);
+  });
+
+  it('no version', () => {
+    const config: custard.Config = {ignore: ['!a.md']};
+    expect(custard.migrateConfig(config)).to.deep.equal([
+      "escaped the 'ignore' patterns starting with '!', they re-include files since version 2",
+      "set 'ci-setup-defaults-filename' to [], ci-setup defaults files are loaded since version 2",
+      `set 'schema-version' to ${custard.configSchemaVersion}`,
+    ]);
+    expect(config.ignore).to.deep.equal(['\\!a.md']);
+  });
+
+  it('unsupported version', () => {
+    const config = {'schema-version': custard.configSchemaVersion + 1};
+    expect(() => custard.migrateConfig(config)).to.throw(
+      'upgrade Custard to use this config',
+    );
+    expect(custard.validateConfig(config)).to.deep.equal([
+      `'schema-version' must be at most ${custard.configSchemaVersion}, got: ${config['schema-version']}, upgrade Custard to use this config`,
+    ]);
+  });
+
+  it('migrated on load', () => {
+    const dir = testing.materialize({
+      'config.json': JSON.stringify({
+        'schema-version': 1,
+        'package-file': 'package.json',
+      }),
+    });
+    try {
+      const config = custard.loadConfig(path.join(dir, 'config.json'));
+      expect(config['schema-version']).equals(custard.configSchemaVersion);
+      expect(config['ci-setup-defaults-filename']).to.deep.equal([]);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+});
+
+describe('marshalConfig', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    match: ['*.ts'],
+    'ci-setup-defaults': {env: {A: 'a'}},
+  };
+
+  it('keeps the field order, with the defaults as comments', () => {
+    expect(custard.marshalConfig(config)).to.equal(
+      [
+        '{',
+        '  "package-file": "package.json",',
+        '  "match": [',
+        '    "*.ts"',
+        '  ],',
+        '  "ci-setup-defaults": {',
+        '    "env": {',
+        '      "A": "a"',
+        '    }',
+        '  }',
+        '  // Defaults:',
+        '  // "ci-setup-filename": ["ci-setup.jsonc","ci-setup.json"]',
+        '  // "ci-setup-defaults-filename": ["ci-setup-defaults.jsonc","ci-setup-defaults.json"]',
+        '  // "ci-setup-inherit": false',
+        '  // "match-engine": "simple"',
+        '  // "case-insensitive": false',
+        '  // "normalize-unicode": false',
+        '  // "roots": ["."]',
+        '  // "exclude-subpackages": false',
+        '  // "nested-packages": "separate"',
+        '  // "prune-ignored": false',
+        '  // "respect-gitignore": false',
+        '  // "max-affected-action": "fail"',
+        '  // "affected-order": "path"',
+        '  // "symlinks": "skip"',
+        '}',
+        '',
+      ].join('\n'),
+    );
+  });
+
+  it('round trip', () => {
+    const jsonc = custard.marshalConfig(config);
+    expect(custard.parseJsonc(jsonc)).to.deep.equal(config);
+    expect(custard.parseJsonc(custard.marshalConfig({}))).to.deep.equal({});
+  });
+
+  it('save to a writer', () => {
+    const chunks: string[] = [];
+    custard.saveConfig(config, {write: chunk => chunks.push(chunk)});
+    expect(chunks.join('')).to.equal(custard.marshalConfig(config));
+  });
+});
+
+describe('loadPatternsFile', () => {
+  it('match and ignore patterns', () => {
+    const dir = testing.materialize({
+      'patterns.txt': ['# comment', '', 'src/', '/*.ts', '!*.test.ts'].join(
+        '\n',
+      ),
+    });
+    try {
+      const filePath = path.join(dir, 'patterns.txt');
+      expect(custard.loadPatternsFile(filePath)).to.deep.equal({
+        match: ['src/**', '*.ts'],
+        ignore: ['*.test.ts'],
+      });
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+});
+
+describe('parseToml', () => {
+  it('values', () => {
+    const toml = [
+      'str = "a\\tb \\u00e9"',
+      "literal = 'C:\\path'",
+      'int = 1_000',
+      'float = -1.5e3',
+      'bool = true',
+      'array = [1, [2, 3], ]',
+      'inline = {a = 1, b.c = 2}',
+      '"quoted key" = 1',
+      'multi = """',
+      'line 1',
+      'line 2"""',
+    ].join('\n');
+    expect(custard.parseToml(toml)).deep.equals({
+      str: 'a\tb é',
+      literal: 'C:\\path',
+      int: 1000,
+      float: -1500,
+      bool: true,
+      array: [1, [2, 3]],
+      inline: {a: 1, b: {c: 2}},
+      'quoted key': 1,
+      multi: 'line 1\nline 2',
+    });
+  });
+
+  it('tables', () => {
+    const toml = [
+      'a.b = 1',
+      '[x.y]',
+      'z = 2',
+      '[[items]]',
+      'name = "one"',
+      '[[items]]',
+      'name = "two"',
+    ].join('\n');
+    expect(custard.parseToml(toml)).deep.equals({
+      a: {b: 1},
+      x: {y: {z: 2}},
+      items: [{name: 'one'}, {name: 'two'}],
     });
   });
+
+  it('dates', () => {
+    const toml = [
+      'offset = 1979-05-27T07:32:00-08:00',
+      'local = 1979-05-27 07:32:00.5',
+      'date = 1979-05-27',
+      'time = 07:32:00',
+      'dates = [2025-01-01, 2025-12-31]',
+    ].join('\n');
+    expect(custard.parseToml(toml)).deep.equals({
+      offset: '1979-05-27T07:32:00-08:00',
+      local: '1979-05-27 07:32:00.5',
+      date: '1979-05-27',
+      time: '07:32:00',
+      dates: ['2025-01-01', '2025-12-31'],
+    });
+  });
+
+  it('errors', () => {
+    expect(() => custard.parseToml('a = 1\na = 2')).to.throw(
+      'TOML line 2: duplicate key: a',
+    );
+    expect(() => custard.parseToml('a = "x')).to.throw(
+      'TOML line 1: unterminated string',
+    );
+    expect(() => custard.parseToml('a = 1 b = 2')).to.throw(
+      'TOML line 1: expected a new line',
+    );
+  });
 });
 
 describe('validateConfig', () => {
@@ -74,7 +541,7 @@ describe('validateConfig', () => {
       'exclude-packages': 1,
     };
     expect(custard.validateConfig(config)).to.deep.equal([
-      "'package-file' must be string or string[], got: 1",
+      "'package-file' must be string, string[], or {any: [...]} and {all: [...]} groups, got: 1",
       "'ci-setup-filename' must be string or string[], got: 1",
       '\'ci-setup-defaults.env\' must be {string: string} mappings, got: {"A":1}',
       '\'ci-setup-defaults.secrets\' must be {string: string} mappings, got: {"B":1}',
@@ -87,6 +554,13 @@ describe('validateConfig', () => {
       "'commands.test.post' must be string or string[], got: 1",
     ]);
   });
+
+  it('site generators', () => {
+    const config = {'site-generators': ['mdbook', 'jekyll']};
+    expect(custard.validateConfig(config)).to.deep.equal([
+      '\'site-generators\' must be one of: mdbook, hugo, docusaurus, got: "jekyll"',
+    ]);
+  });
 });
 
 describe('validateCISetup', () => {
@@ -129,9 +603,520 @@ describe('validateCISetup', () => {
       "'var1' must be string, got: 1",
     ]);
   });
+
+  it('secret paths', () => {
+    const config: custard.Config = {'package-file': 'pkg.txt'};
+    const ciSetup = {
+      secrets: {
+        A: 'my-project/my-secret',
+        B: 'projects/my-project/secrets/my-secret',
+        C: 'projects/my-project/secrets/my-secret/versions/2',
+        D: 'my-secret',
+        E: 'my-project/my-secret/latest',
+      },
+    };
+    expect(custard.validateCISetup(config, ciSetup)).to.deep.equal([
+      "'secrets.E' must be 'secret-id', 'project-id/secret-id', or " +
+        '\'projects/project-id/secrets/secret-id\', got: "my-project/my-secret/latest"',
+    ]);
+  });
+
+  it('archived', () => {
+    const config: custard.Config = {'package-file': 'pkg.txt'};
+    const valid = {archived: true, 'eol-date': '2030-12-31'};
+    expect(custard.validateCISetup(config, valid)).to.deep.equal([]);
+    const invalid = {archived: 'yes', 'eol-date': '12/2030'};
+    expect(custard.validateCISetup(config, invalid)).to.deep.equal([
+      '\'archived\' must be boolean, got: "yes"',
+      '\'eol-date\' must be a YYYY-MM-DD date, got: "12/2030"',
+    ]);
+  });
+
+  it('nested type checking', () => {
+    const config: custard.Config = {
+      'package-file': 'pkg.txt',
+      'ci-setup-defaults': {
+        labels: ['a'],
+        deploy: {region: 'us-central1', replicas: 1},
+        jobs: [{name: 'test', args: ['x']}],
+        anything: null,
+      },
+    };
+    const valid = {
+      labels: [],
+      deploy: {region: 'europe-west1', extra: true},
+      jobs: [{name: 'lint'}, {name: 'build', args: ['y', 'z']}],
+      anything: [1, 'a'],
+    };
+    expect(custard.validateCISetup(config, valid)).to.deep.equal([]);
+    const invalid = {
+      labels: ['a', 1],
+      deploy: {replicas: '2'},
+      jobs: [{name: 1}, {args: 'y'}, 'z'],
+    };
+    expect(custard.validateCISetup(config, invalid)).to.deep.equal([
+      "'labels[1]' must be string, got: 1",
+      '\'deploy.replicas\' must be number, got: "2"',
+      "'jobs[0].name' must be string, got: 1",
+      '\'jobs[1].args\' must be array, got: "y"',
+      '\'jobs[2]\' must be object, got: "z"',
+    ]);
+  });
+
+  it('required fields', () => {
+    const config: custard.Config = {
+      'package-file': 'pkg.txt',
+      'ci-setup-defaults': {
+        owner: '',
+        deploy: {region: ''},
+        jobs: [{name: ''}],
+      },
+      'ci-setup-required': ['owner', 'deploy.region', 'jobs.name'],
+    };
+    const valid = {owner: 'me', jobs: [{name: 'test'}]};
+    expect(custard.validateCISetup(config, valid)).to.deep.equal([]);
+    const invalid = {deploy: {}, jobs: [{name: 'test'}, {}]};
+    expect(custard.validateCISetup(config, invalid)).to.deep.equal([
+      "'owner' is required",
+      "'deploy.region' is required",
+      "'jobs[1].name' is required",
+    ]);
+  });
+
+  it('required fields in defaults', () => {
+    const config: custard.Config = {
+      'package-file': 'pkg.txt',
+      'ci-setup-defaults': {owner: '', deploy: {region: '', replicas: 0}},
+      'ci-setup-required': ['owner', 'deploy.region'],
+      'ci-setup-scoped-defaults': {'web/**': {deploy: {}}},
+    };
+    expect(custard.validateConfig(config)).to.deep.equal([]);
+    const checkoutPath = testing.materialize({
+      'ci-setup-defaults.json': '{"deploy": {"replicas": 1}}',
+      'web/pkg.txt': '',
+      'web/ci-setup.json': '{"owner": "me", "deploy": {"region": "eu"}}',
+      'api/pkg.txt': '',
+      'api/ci-setup.json': '{}',
+    });
+    try {
+      const pkg = custard.loadPackage(config, 'web', checkoutPath);
+      expect(pkg.ciSetup.owner).to.equal('me');
+      expect(() => custard.loadPackage(config, 'api', checkoutPath)).to.throw(
+        "'owner' is required",
+      );
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+  });
+
+  it('timeout', () => {
+    const config: custard.Config = {'package-file': 'pkg.txt'};
+    expect(custard.validateCISetup(config, {timeout: '1h30m'})).to.deep.equal(
+      [],
+    );
+    expect(custard.validateCISetup(config, {timeout: 'soon'})).to.deep.equal([
+      "'timeout' must be a duration like 90s or 1h30m, got: \"soon\"",
+    ]);
+  });
+});
+
+describe('parseDuration', () => {
+  it('units', () => {
+    expect(custard.parseDuration('250ms')).to.equal(250);
+    expect(custard.parseDuration('90s')).to.equal(90_000);
+    expect(custard.parseDuration('1h30m')).to.equal(5_400_000);
+  });
+
+  it('invalid', () => {
+    expect(custard.parseDuration('')).to.equal(null);
+    expect(custard.parseDuration('15')).to.equal(null);
+    expect(custard.parseDuration('1d')).to.equal(null);
+  });
+});
+
+describe('parseSecretPath', () => {
+  it('short format', () => {
+    expect(custard.parseSecretPath('my-project/my-secret')).to.deep.equal({
+      project: 'my-project',
+      secret: 'my-secret',
+      version: 'latest',
+    });
+  });
+  it('full format', () => {
+    const secretPath = 'projects/my-project/secrets/my-secret';
+    expect(custard.parseSecretPath(secretPath)).to.deep.equal({
+      project: 'my-project',
+      secret: 'my-secret',
+      version: 'latest',
+    });
+  });
+  it('full format with version', () => {
+    const secretPath = 'projects/my-project/secrets/my-secret/versions/2';
+    expect(custard.parseSecretPath(secretPath)).to.deep.equal({
+      project: 'my-project',
+      secret: 'my-secret',
+      version: '2',
+    });
+  });
+  it('secret id only', () => {
+    expect(custard.parseSecretPath('my-secret')).to.deep.equal({
+      project: null,
+      secret: 'my-secret',
+      version: 'latest',
+    });
+  });
+  it('invalid format', () => {
+    expect(custard.parseSecretPath('a/b/c')).to.be.null;
+    expect(custard.parseSecretPath('my secret')).to.be.null;
+  });
+});
+
+describe('validateSetupFiles', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {'allow-failure': false},
+  };
+  const checkoutPath = testing.materialize({
+    'valid/package.json': '{}',
+    'valid/ci-setup.json': '{"env": {"A": "a"}}',
+    'invalid/package.json': '{}',
+    'invalid/ci-setup.json': JSON.stringify(
+      {
+        'undefined-field': 1,
+        'allow-failure': 'no',
+        secrets: {B: 'not/a/secret-path'},
+      },
+      null,
+      2,
+    ),
+    'archived/package.json': '{}',
+    'archived/ci-setup.jsonc': '{"archived": "yes"}',
+    'broken/package.json': '{}',
+    'broken/ci-setup.json': '{',
+    'no-setup/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('typed errors', async () => {
+    const errors = await custard.validateSetupFiles(config, checkoutPath, 2);
+    const relative = errors.map(error => ({
+      ...error,
+      path: path.relative(checkoutPath, error.path),
+      message: error.message.split(':')[0],
+    }));
+    relative.sort((a, b) => a.path.localeCompare(b.path));
+    expect(relative).to.deep.equal([
+      {
+        path: path.join('archived', 'ci-setup.jsonc'),
+        field: 'archived',
+        kind: 'invalid-type',
+        message: "'archived' must be boolean, got",
+        line: 1,
+        column: 2,
+      },
+      {
+        path: path.join('broken', 'ci-setup.json'),
+        field: null,
+        kind: 'parse-error',
+        message: 'invalid JSON',
+        line: 1,
+        column: 2,
+      },
+      {
+        path: path.join('invalid', 'ci-setup.json'),
+        field: 'undefined-field',
+        kind: 'unknown-field',
+        message: "'undefined-field' is not a valid field",
+        line: 2,
+        column: 3,
+      },
+      {
+        path: path.join('invalid', 'ci-setup.json'),
+        field: 'secrets',
+        kind: 'invalid-value',
+        message: "'secrets.B' must be 'secret-id', 'project-id/secret-id', or 'projects/project-id/secrets/secret-id', got",
+        line: 4,
+        column: 3,
+      },
+      {
+        path: path.join('invalid', 'ci-setup.json'),
+        field: 'allow-failure',
+        kind: 'invalid-type',
+        message: "'allow-failure' must be boolean, got",
+        line: 3,
+        column: 3,
+      },
+    ]);
+  });
+
+  it('deprecated fields', async () => {
+    const deprecated: custard.Config = {
+      'package-file': 'package.json',
+      'ci-setup-defaults': {'node-version': 22},
+      'ci-setup-deprecated': {'node-image': "use 'node-version' instead"},
+    };
+    const dir = testing.materialize({
+      'old/package.json': '{}',
+      'old/ci-setup.json': '{\n  "node-image": "node:18"\n}',
+      'new/package.json': '{}',
+      'new/ci-setup.json': '{"node-version": 20}',
+    });
+    const error = console.error;
+    const warnings: string[] = [];
+    try {
+      expect(await custard.validateSetupFiles(deprecated, dir)).to.deep.equal([
+        {
+          path: path.join(dir, 'old', 'ci-setup.json'),
+          field: 'node-image',
+          kind: 'deprecated-field',
+          message: "'node-image' is deprecated, use 'node-version' instead",
+          line: 2,
+          column: 3,
+        },
+      ]);
+      // Still valid, packages using them keep working, without printing
+      // from library calls.
+      console.error = (text: string) => warnings.push(text);
+      const ciSetup = custard.loadCISetup(deprecated, path.join(dir, 'old'));
+      expect(ciSetup).to.deep.equal({'node-image': 'node:18'});
+      expect(warnings).to.deep.equal([]);
+    } finally {
+      console.error = error;
+      testing.cleanup(dir);
+    }
+  });
+
+  it('no setup files', async () => {
+    const dir = testing.materialize({'a/package.json': '{}'});
+    try {
+      expect(await custard.validateSetupFiles(config, dir)).to.deep.equal([]);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('cancelled', async () => {
+    const signal = AbortSignal.abort();
+    let error = '';
+    try {
+      await custard.validateSetupFiles(config, checkoutPath, 2, signal);
+    } catch (e) {
+      error = `${e}`;
+    }
+    expect(error).to.contain('AbortError');
+  });
+});
+
+describe('rewriteSetupText', () => {
+  const text = [
+    '{',
+    '  // Node.js version.',
+    '  "node-image": "node:18", // Old name.',
+    '  "env": {"A": "a"},',
+    '  /* Last field. */',
+    '  "tags": ["web"]',
+    '}',
+    '',
+  ].join('\n');
+
+  it('rename', () => {
+    const rewrite = {action: 'rename', field: 'node-image', to: 'node'};
+    expect(custard.rewriteSetupText(text, rewrite)).to.equal(
+      text.replace('"node-image"', '"node"'),
+    );
+  });
+
+  it('rename to a field already set', () => {
+    const rewrite = {action: 'rename', field: 'node-image', to: 'tags'};
+    expect(() => custard.rewriteSetupText(text, rewrite, 'a.json')).to.throw(
+      "a.json: can't rename 'node-image' to 'tags', it's already set",
+    );
+  });
+
+  it('delete', () => {
+    const rewrite = {action: 'delete', field: 'node-image'};
+    expect(custard.rewriteSetupText(text, rewrite)).to.equal(
+      text.replace('  "node-image": "node:18", // Old name.\n', ''),
+    );
+  });
+
+  it('delete the last field', () => {
+    const rewrite = {action: 'delete', field: 'tags'};
+    expect(custard.rewriteSetupText(text, rewrite)).to.equal(
+      ['{', '  // Node.js version.', '  "node-image": "node:18", // Old name.']
+        .concat(['  "env": {"A": "a"}', '}', ''])
+        .join('\n'),
+    );
+  });
+
+  it('delete the last field after a comment', () => {
+    const rewrite = {action: 'delete', field: 'b'};
+    const commented = '{\n  "a": 1, // Keep.\n  "b": 2 // Drop.\n}\n';
+    expect(custard.rewriteSetupText(commented, rewrite)).to.equal(
+      '{\n  "a": 1 // Keep.\n}\n',
+    );
+  });
+
+  it('delete inline', () => {
+    const rewrite = {action: 'delete', field: 'a'};
+    expect(custard.rewriteSetupText('{"a": 1, "b": 2}', rewrite)).to.equal(
+      '{"b": 2}',
+    );
+    expect(custard.rewriteSetupText('{"a": 1}', rewrite)).to.equal('{}');
+  });
+
+  it('set-default', () => {
+    const rewrite = {action: 'set-default', field: 'timeout', value: '15m'};
+    expect(custard.rewriteSetupText(text, rewrite)).to.equal(
+      text.replace('"tags": ["web"]', '"tags": ["web"],\n  "timeout": "15m"'),
+    );
+    // Files that already set it keep their value.
+    const existing = {...rewrite, field: 'tags'};
+    expect(custard.rewriteSetupText(text, existing)).to.equal(text);
+  });
+
+  it('set-default with a trailing comma', () => {
+    const rewrite = {action: 'set-default', field: 'b', value: [1]};
+    expect(custard.rewriteSetupText('{\n  "a": 1,\n}', rewrite)).to.equal(
+      '{\n  "a": 1,\n  "b": [1],\n}',
+    );
+    expect(custard.rewriteSetupText('{}', rewrite)).to.equal(
+      '{\n  "b": [1]\n}',
+    );
+  });
+
+  it('unknown action', () => {
+    const rewrite = {action: 'move', field: 'a'};
+    expect(() => custard.rewriteSetupText('{}', rewrite)).to.throw(
+      "unknown ci-setup rewrite 'move'",
+    );
+  });
+});
+
+describe('rewriteSetupFiles', () => {
+  const config: custard.Config = {'package-file': 'package.json'};
+  let checkoutPath = '';
+  beforeEach(() => {
+    checkoutPath = testing.materialize({
+      'a/package.json': '{}',
+      'a/ci-setup.json': '{"old": 1}',
+      'b/package.json': '{}',
+      'b/ci-setup.jsonc': '{\n  // Comment.\n  "old": 2,\n}',
+      'c/package.json': '{}',
+      'c/ci-setup.json': '{"new": 3}',
+    });
+  });
+  afterEach(() => testing.cleanup(checkoutPath));
+  const read = (file: string) =>
+    fs.readFileSync(path.join(checkoutPath, file), 'utf8');
+
+  it('rewrites every file', () => {
+    const rewrite = {action: 'rename', field: 'old', to: 'new'};
+    const files = custard.rewriteSetupFiles(config, rewrite, checkoutPath);
+    expect(files.map(file => path.relative(checkoutPath, file))).to.deep.equal([
+      path.join('a', 'ci-setup.json'),
+      path.join('b', 'ci-setup.jsonc'),
+    ]);
+    expect(read('a/ci-setup.json')).to.equal('{"new": 1}');
+    expect(read('b/ci-setup.jsonc')).to.equal(
+      '{\n  // Comment.\n  "new": 2,\n}',
+    );
+  });
+
+  it('dry run', () => {
+    const rewrite = {action: 'delete', field: 'old'};
+    const files = custard.rewriteSetupFiles(
+      config,
+      rewrite,
+      checkoutPath,
+      true,
+    );
+    expect(files.length).to.equal(2);
+    expect(read('a/ci-setup.json')).to.equal('{"old": 1}');
+  });
+
+  it('no file changes on errors', () => {
+    const conflict = '{"old": 3, "new": 3}';
+    fs.writeFileSync(path.join(checkoutPath, 'c/ci-setup.json'), conflict);
+    const rewrite = {action: 'rename', field: 'old', to: 'new'};
+    expect(() =>
+      custard.rewriteSetupFiles(config, rewrite, checkoutPath),
+    ).to.throw("can't rename 'old' to 'new'");
+    expect(read('a/ci-setup.json')).to.equal('{"old": 1}');
+  });
 });
 
 describe('loadCISetup', () => {
+  it('validation errors with positions', () => {
+    const config: custard.Config = {'package-file': 'package.json'};
+    const dir = testing.materialize({
+      'ci-setup.json': '{\n  "env": {},\n  "archived": "yes"\n}',
+    });
+    try {
+      const ciSetupPath = path.join(dir, 'ci-setup.json');
+      expect(() => custard.loadCISetup(config, dir)).to.throw(
+        `- ${ciSetupPath}:3:3: 'archived' must be boolean, got: "yes"`,
+      );
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('extends', () => {
+    const config: custard.Config = {
+      'package-file': 'package.json',
+      'ci-setup-defaults': {region: 'us-central1'},
+    };
+    const dir = testing.materialize({
+      'base-setup.json': '{"region": "us-east1", "env": {"A": "a"}}',
+      'python/shared-setup.json': JSON.stringify({
+        _extends: '../base-setup.json',
+        env: {B: 'b'},
+      }),
+      'python/app/ci-setup.json': JSON.stringify({
+        _extends: '../shared-setup.json',
+        env: {B: 'app', C: 'c'},
+      }),
+    });
+    try {
+      const packagePath = path.join(dir, 'python', 'app');
+      expect(custard.loadCISetup(config, packagePath)).deep.equals({
+        region: 'us-east1',
+        env: {A: 'a', B: 'app', C: 'c'},
+      });
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('invalid extends', () => {
+    const config: custard.Config = {'package-file': 'package.json'};
+    const dir = testing.materialize({
+      'outside/ci-setup.json': '{"_extends": "../other/base.json"}',
+      'cycle/ci-setup.json': '{"_extends": "shared.json"}',
+      'cycle/shared.json': '{"_extends": "ci-setup.json"}',
+      'missing/ci-setup.json': '{"_extends": "../missing.json"}',
+      'undefined-field/ci-setup.json': '{"_extends": "../base.json"}',
+      'base.json': '{"undefined-field": 1}',
+    });
+    try {
+      expect(() =>
+        custard.loadCISetup(config, path.join(dir, 'outside')),
+      ).to.throw('must be a file in the same directory or a directory above');
+      expect(() =>
+        custard.loadCISetup(config, path.join(dir, 'cycle')),
+      ).to.throw("ci-setup '_extends' cycle");
+      expect(() =>
+        custard.loadCISetup(config, path.join(dir, 'missing')),
+      ).to.throw('not found');
+      expect(() =>
+        custard.loadCISetup(config, path.join(dir, 'undefined-field')),
+      ).to.throw("'undefined-field' is not a valid field");
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
   it('no ci-setup file', () => {
     const config: custard.Config = {'package-file': 'package.json'};
     const packagePath = path.join('test', 'ci-setup', 'without-setup');
@@ -181,27 +1166,376 @@ describe('loadCISetup', () => {
   });
 });
 
-describe('listVars', () => {
-  it('empty', () => {
-    const env = {};
-    const ciSetup = {};
-    const defaults = {};
-    const automatic = {};
-    const vars = [...custard.listVars(env, ciSetup, defaults, automatic)];
-    expect(vars).to.deep.equal([]);
+describe('ciSetupDefaults', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {'allow-failure': false, env: {X: 'x'}},
+    'ci-setup-scoped-defaults': {
+      'test/ci-setup/**': {'allow-failure': true, env: {Y: 'y'}},
+      'does-not-match/**': {env: {Z: 'z'}},
+    },
+  };
+  it('no scoped defaults match', () => {
+    expect(custard.ciSetupDefaults(config, 'other/package')).deep.equals({
+      'allow-failure': false,
+      env: {X: 'x'},
+    });
+  });
+  it('scoped defaults match', () => {
+    const packagePath = path.join('test', 'ci-setup', 'with-setup-json');
+    expect(custard.ciSetupDefaults(config, packagePath)).deep.equals({
+      'allow-failure': true,
+      env: {X: 'x', Y: 'y'},
+    });
+  });
+  it('resolve with ci-setup file', () => {
+    const packagePath = path.join('test', 'ci-setup', 'with-setup-json');
+    expect(custard.resolveCISetup(config, packagePath)).deep.equals({
+      'allow-failure': true,
+      env: {X: 'x', Y: 'y', A: 'a', B: 'b'},
+      secrets: {C: 'c'},
+    });
   });
+  it('validation', () => {
+    const invalid = {
+      ...config,
+      'ci-setup-scoped-defaults': {
+        'a/**': {'undefined-field': 1},
+        'b/**': 1,
+      },
+    };
+    expect(custard.validateConfig(invalid)).deep.equals([
+      "'ci-setup-scoped-defaults.a/**': 'undefined-field' is not a valid field",
+      "'ci-setup-scoped-defaults.b/**' must be a ci-setup object, got: 1",
+    ]);
+  });
+});
 
-  it('4) automatic var', () => {
-    const env = {};
-    const ciSetup = {};
-    const defaults = {};
-    const automatic = {VAR: () => 'auto'};
-    const vars = [...custard.listVars(env, ciSetup, defaults, automatic)];
-    const expected = [['VAR', {value: 'auto', source: 'automatic var'}]];
-    expect(vars).to.deep.equal(expected);
+describe('ci-setup interpolation', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {
+      region: 'us-central1',
+      replicas: 1,
+      'service-name': 'sample-${package-name}',
+      url: 'https://${service-name}.${region}.example.com',
+      deploy: {args: ['--replicas=${replicas}', '${unknown}']},
+      env: {SERVICE: '${service-name}'},
+    },
+  };
+  const checkoutPath = testing.materialize({
+    'apps/web/package.json': '{}',
+    'apps/web/ci-setup.json': '{"region": "europe-west1"}',
+    'apps/cycle/package.json': '{}',
+    'apps/cycle/ci-setup.json': '{"region": "${url}"}',
   });
+  after(() => testing.cleanup(checkoutPath));
 
-  it('3) default value', () => {
+  it('resolves references', () => {
+    const pkg = custard.loadPackage(config, 'apps/web', checkoutPath);
+    expect(pkg.ciSetup).to.deep.equal({
+      region: 'europe-west1',
+      replicas: 1,
+      'service-name': 'sample-web',
+      url: 'https://sample-web.europe-west1.example.com',
+      deploy: {args: ['--replicas=1', '${unknown}']},
+      env: {SERVICE: '${service-name}'},
+    });
+  });
+
+  it('cycles', () => {
+    expect(() =>
+      custard.loadPackage(config, 'apps/cycle', checkoutPath),
+    ).to.throw(
+      'ci-setup field reference cycle in apps/cycle: region -> url -> region',
+    );
+  });
+});
+
+describe('value providers', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {
+      region: {$provider: 'round-robin', values: ['us-east1', 'us-west1']},
+      zone: {$provider: 'random', values: ['a', 'b', 'c'], seed: 'zones'},
+      project: {$provider: 'env', name: 'TEST_PROJECT', default: 'dev'},
+      url: 'https://${region}.example.com',
+    },
+  };
+  const checkoutPath = testing.materialize({
+    'a/package.json': '{}',
+    'b/package.json': '{}',
+    'c/package.json': '{}',
+    'c/ci-setup.json': '{"region": "europe-west1"}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  const load = (pkg: string) =>
+    custard.loadPackage(config, pkg, checkoutPath).ciSetup;
+
+  it('round-robin', () => {
+    expect(load('b').region).to.equal('us-west1');
+    expect(load('a').region).to.equal('us-east1');
+    expect(load('b').region).to.equal('us-west1');
+    expect(load('a').region).to.equal('us-east1');
+    expect(load('a').url).to.equal('https://us-east1.example.com');
+    expect(load('c').region).to.equal('europe-west1');
+  });
+
+  it('random', () => {
+    const zone = load('a').zone;
+    expect(['a', 'b', 'c']).to.include(zone);
+    expect(load('a').zone).to.equal(zone);
+  });
+
+  it('env', () => {
+    expect(load('a').project).to.equal('dev');
+    process.env.TEST_PROJECT = 'prod';
+    try {
+      expect(load('a').project).to.equal('prod');
+    } finally {
+      delete process.env.TEST_PROJECT;
+    }
+  });
+
+  it('custom provider', () => {
+    custard.valueProviders.upper = (args, {package: pkg}) =>
+      `${args.prefix}-${pkg.toUpperCase()}`;
+    try {
+      const custom = {
+        ...config,
+        'ci-setup-defaults': {name: {$provider: 'upper', prefix: 'svc'}},
+      };
+      const pkg = custard.loadPackage(custom, 'b', checkoutPath);
+      expect(pkg.ciSetup.name).to.equal('svc-B');
+    } finally {
+      delete custard.valueProviders.upper;
+    }
+  });
+
+  it('invalid', () => {
+    const invalid = {
+      ...config,
+      'ci-setup-defaults': {region: {$provider: 'round-robin', values: []}},
+    };
+    expect(() => custard.loadPackage(invalid, 'a', checkoutPath)).to.throw(
+      "value provider 'round-robin' failed for 'region' in a: 'values' must be a non-empty array, got: []",
+    );
+    const unknown = {
+      ...config,
+      'ci-setup-defaults': {region: {$provider: 'nearest'}},
+    };
+    expect(custard.validateConfig(unknown)).to.deep.equal([
+      `'ci-setup-defaults.region.$provider' must be one of: round-robin, random, env, got: "nearest"`,
+    ]);
+  });
+});
+
+describe('ci-setup defaults files', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {'allow-failure': false, env: {X: 'x'}},
+  };
+  const checkoutPath = testing.materialize({
+    'ci-setup-defaults.json': '{"env": {"ROOT": "root"}}',
+    'python/ci-setup-defaults.json': '{"env": {"LANG": "python"}}',
+    'python/web/ci-setup-defaults.jsonc': '{"allow-failure": true}',
+    'python/web/app/package.json': '{}',
+    'python/web/app/ci-setup.json': '{"env": {"LANG": "python3"}}',
+    'python/lib/package.json': '{}',
+    'python/lib/ci-setup-defaults.json': '{"env": {"IGNORED": "own dir"}}',
+    'invalid/ci-setup-defaults.json': '{"undefined-field": 1}',
+    'invalid/pkg/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('layered by directory', () => {
+    const pkg = custard.loadPackage(config, 'python/web/app', checkoutPath);
+    expect(pkg.ciSetup).to.deep.equal({
+      'allow-failure': true,
+      env: {X: 'x', ROOT: 'root', LANG: 'python3'},
+    });
+  });
+
+  it('package directory is not a defaults directory', () => {
+    const defaults = custard.ciSetupDefaults(
+      config,
+      'python/lib',
+      checkoutPath,
+    );
+    expect(defaults).to.deep.equal({
+      'allow-failure': false,
+      env: {X: 'x', ROOT: 'root', LANG: 'python'},
+    });
+  });
+
+  it('validation', () => {
+    expect(() =>
+      custard.ciSetupDefaults(config, 'invalid/pkg', checkoutPath),
+    ).to.throw("'undefined-field' is not a valid field");
+  });
+});
+
+describe('withCISetupValidators', () => {
+  const config = custard.withCISetupValidators(
+    {'package-file': 'package.json'},
+    {
+      'service-account': (_setupPath, ciSetup) => {
+        const account = ciSetup.env?.SERVICE_ACCOUNT;
+        const message = 'the service account must be in my-project';
+        return account?.endsWith('@my-project.iam.gserviceaccount.com')
+          ? []
+          : [{field: 'env', message}];
+      },
+    },
+  );
+  const checkoutPath = testing.materialize({
+    'web/package.json': '{}',
+    'web/ci-setup.json': JSON.stringify(
+      {env: {SERVICE_ACCOUNT: 'ci@other.iam.gserviceaccount.com'}},
+      null,
+      2,
+    ),
+    'api/package.json': '{}',
+    'api/ci-setup.json': '{"env": {"SERVICE_ACCOUNT": "ci@my-project.iam.gserviceaccount.com"}}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('loading a package', () => {
+    expect(custard.loadPackage(config, 'api', checkoutPath).path).to.equal(
+      'api',
+    );
+    expect(() => custard.loadPackage(config, 'web', checkoutPath)).to.throw(
+      ':2:3: the service account must be in my-project (policy: service-account)',
+    );
+    // Other configs don't check the policy.
+    const other: custard.Config = {'package-file': 'package.json'};
+    expect(custard.loadPackage(other, 'web', checkoutPath).path).to.equal(
+      'web',
+    );
+  });
+
+  it('validateSetupFiles', async () => {
+    const errors = await custard.validateSetupFiles(config, checkoutPath);
+    expect(errors).to.deep.equal([
+      {
+        path: path.join(checkoutPath, 'web', 'ci-setup.json'),
+        field: 'env',
+        kind: 'policy',
+        message:
+          'the service account must be in my-project (policy: service-account)',
+        line: 2,
+        column: 3,
+      },
+    ]);
+  });
+});
+
+describe('ci-setup-inherit', () => {
+  const config: custard.Config = {
+    'package-file': 'pom.xml',
+    'ci-setup-defaults': {'java-version': 17, region: 'us', env: {}},
+  };
+  const checkoutPath = testing.materialize({
+    'java/ci-setup-defaults.json': '{"java-version": 21}',
+    'java/ci-setup.json': '{"region": "eu", "env": {"REGION": "eu"}}',
+    'java/billing/ci-setup.json': '{"java-version": 25}',
+    'java/billing/api/pom.xml': '',
+    'java/billing/api/ci-setup.json': '{"env": {"APP": "api"}}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const ciSetup = (inherit?: boolean) =>
+    custard.loadPackage(
+      {...config, 'ci-setup-inherit': inherit},
+      'java/billing/api',
+      checkoutPath,
+    ).ciSetup;
+
+  it('only the package ci-setup by default', () => {
+    expect(ciSetup()).to.deep.equal({
+      'java-version': 21,
+      region: 'us',
+      env: {APP: 'api'},
+    });
+  });
+
+  it('merges the ci-setup files above, outer to inner', () => {
+    expect(ciSetup(true)).to.deep.equal({
+      'java-version': 25,
+      region: 'eu',
+      env: {REGION: 'eu', APP: 'api'},
+    });
+  });
+});
+
+describe('resolveCISetupDetailed', () => {
+  const config: custard.Config = {
+    'package-file': 'pom.xml',
+    'ci-setup-defaults': {'java-version': 17, region: 'us', env: {}},
+    'ci-setup-scoped-defaults': {'java/billing/**': {region: 'eu'}},
+    'ci-setup-inherit': true,
+  };
+  const checkoutPath = testing.materialize({
+    'java/ci-setup-defaults.json': '{"java-version": 21}',
+    'java/ci-setup.json': '{"env": {"REGION": "eu"}}',
+    'java/billing/api/pom.xml': '',
+    'java/billing/api/ci-setup.json': '{"env": {"APP": "api"}}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const resolved = () =>
+    custard.resolveCISetupDetailed(config, 'java/billing/api', checkoutPath);
+
+  it('records the source of each field', () => {
+    const {ciSetup, sources} = resolved();
+    expect(ciSetup).to.deep.equal(
+      custard.loadPackage(config, 'java/billing/api', checkoutPath).ciSetup,
+    );
+    expect(sources).to.deep.equal({
+      'java-version': {
+        layer: 'defaults-file',
+        file: 'java/ci-setup-defaults.json',
+      },
+      region: {
+        layer: 'scoped-defaults',
+        file: null,
+        pattern: 'java/billing/**',
+      },
+      'env.REGION': {layer: 'inherited', file: 'java/ci-setup.json'},
+      'env.APP': {layer: 'package', file: 'java/billing/api/ci-setup.json'},
+    });
+  });
+
+  it('formatSetupSources', () => {
+    expect(custard.formatSetupSources(resolved()).split('\n')).to.deep.equal([
+      'java-version: 21  # java/ci-setup-defaults.json (defaults-file)',
+      'region: "eu"  # java/billing/** (scoped-defaults)',
+      'env.REGION: "eu"  # java/ci-setup.json (inherited)',
+      'env.APP: "api"  # java/billing/api/ci-setup.json (package)',
+    ]);
+  });
+});
+
+describe('listVars', () => {
+  it('empty', () => {
+    const env = {};
+    const ciSetup = {};
+    const defaults = {};
+    const automatic = {};
+    const vars = [...custard.listVars(env, ciSetup, defaults, automatic)];
+    expect(vars).to.deep.equal([]);
+  });
+
+  it('4) automatic var', () => {
+    const env = {};
+    const ciSetup = {};
+    const defaults = {};
+    const automatic = {VAR: () => 'auto'};
+    const vars = [...custard.listVars(env, ciSetup, defaults, automatic)];
+    const expected = [['VAR', {value: 'auto', source: 'automatic var'}]];
+    expect(vars).to.deep.equal(expected);
+  });
+
+  it('3) default value', () => {
     const env = {};
     const ciSetup = {};
     const defaults = {VAR: 'default'};
@@ -365,6 +1699,31 @@ describe('listSecrets', () => {
     const vars = Object.fromEntries(custard.listSecrets(env));
     expect(vars).deep.equals({ID_TOKEN: '$PROJECT_ID'});
   });
+
+  it('custom resolver', () => {
+    const env = {ID_TOKEN: 'id-token'};
+    const ciSetup = {A: 'my-project/a'};
+    const resolve = (secretPath: string, name: string) =>
+      `${name}=${secretPath}`;
+    const vars = Object.fromEntries(
+      custard.listSecrets(env, ciSetup, {}, resolve),
+    );
+    expect(vars).deep.equals({ID_TOKEN: 'id-token', A: 'A=my-project/a'});
+  });
+
+  it('env resolver', () => {
+    const env = {ID_TOKEN: 'id-token', API_KEY: 'key', DB: 'db'};
+    const ciSetup = {A: 'my-project/api-key', DB: 'my-project/db'};
+    const resolve = custard.envSecret(env);
+    const vars = Object.fromEntries(
+      custard.listSecrets(env, ciSetup, {}, resolve),
+    );
+    expect(vars).deep.equals({ID_TOKEN: 'id-token', A: 'key', DB: 'db'});
+    const missing = {B: 'projects/p/secrets/token'};
+    expect(() => [...custard.listSecrets(env, missing, {}, resolve)]).to.throw(
+      "Secret 'B' (projects/p/secrets/token) is not defined in the environment as TOKEN.",
+    );
+  });
 });
 
 describe('isPackageDir', () => {
@@ -380,6 +1739,258 @@ describe('isPackageDir', () => {
   });
 });
 
+describe('glob package files', () => {
+  const config: custard.Config = {'package-file': ['*.gemspec', 'Gemfile']};
+  let checkoutPath = '';
+  beforeEach(() => {
+    checkoutPath = testing.materialize({
+      'gems/parser/parser.gemspec': '',
+      'gems/parser/lib/parser.rb': '',
+      'gems/broken/broken.gemspec/README.md': '',
+      'app/Gemfile': '',
+    });
+  });
+  afterEach(() => testing.cleanup(checkoutPath));
+  const isPackage = (dir: string) =>
+    custard.isPackageDir(config, path.join(checkoutPath, dir));
+
+  it('matches file names', () => {
+    expect(isPackage('gems/parser')).to.equal(true);
+    expect(isPackage('gems/parser/lib')).to.equal(false);
+    expect(isPackage('app')).to.equal(true);
+    const pkg = custard.loadPackage(config, 'gems/parser', checkoutPath);
+    expect(pkg.packageFile).to.equal('parser.gemspec');
+  });
+
+  it('skips directories', () => {
+    expect(isPackage('gems/broken')).to.equal(false);
+  });
+
+  it('lists each directory once per run', async () => {
+    const listed: string[] = [];
+    const files: custard.FileSystem = {
+      ...fs,
+      readdirSync: (dir, options) => {
+        listed.push(path.relative(checkoutPath, dir));
+        return fs.readdirSync(dir, options);
+      },
+    };
+    const filesConfig = custard.withFileSystem(config, files);
+    const gemsParser = path.join(checkoutPath, 'gems/parser');
+    custard.isPackageDir(filesConfig, gemsParser);
+    custard.isPackageDir(filesConfig, gemsParser);
+    expect(listed).to.deep.equal(['gems/parser']);
+    await new Promise(resolve => setImmediate(resolve));
+    custard.isPackageDir(filesConfig, gemsParser);
+    expect(listed).to.deep.equal(['gems/parser', 'gems/parser']);
+  });
+
+  it('sees new files', () => {
+    expect(isPackage('gems/parser/lib')).to.equal(false);
+    const gemspec = path.join(checkoutPath, 'gems/parser/lib/lib.gemspec');
+    fs.writeFileSync(gemspec, '');
+    expect(isPackage('gems/parser/lib')).to.equal(true);
+  });
+
+  it('validation', () => {
+    const invalid = {'package-file': ['src/*.csproj', '*.fsproj']};
+    expect(custard.validateConfig(invalid)).to.deep.equal([
+      '\'package-file\' globs only match file names, got: "src/*.csproj"',
+    ]);
+  });
+});
+
+describe('package file groups', () => {
+  const checkoutPath = testing.materialize({
+    'web/package.json': '{}',
+    'web/Dockerfile': '',
+    'lib/package.json': '{}',
+    'api/go.mod': 'module example.com/api\n',
+    'api/Dockerfile': '',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const isPackage = (config: custard.Config, dir: string) =>
+    custard.isPackageDir(config, path.join(checkoutPath, dir));
+
+  it('all files', () => {
+    const config = {'package-file': {all: ['package.json', 'Dockerfile']}};
+    expect(isPackage(config, 'web')).to.equal(true);
+    expect(isPackage(config, 'lib')).to.equal(false);
+    expect(isPackage(config, 'api')).to.equal(false);
+  });
+
+  it('any files', () => {
+    const config = {'package-file': {any: ['package.json', 'go.mod']}};
+    expect(isPackage(config, 'web')).to.equal(true);
+    expect(isPackage(config, 'lib')).to.equal(true);
+    expect(isPackage(config, 'api')).to.equal(true);
+  });
+
+  it('nested groups', () => {
+    const config = {
+      'package-file': [
+        {all: ['package.json', 'Dockerfile']},
+        {all: [{any: ['go.mod', 'requirements.txt']}, 'Dockerfile']},
+      ],
+    };
+    expect(isPackage(config, 'web')).to.equal(true);
+    expect(isPackage(config, 'lib')).to.equal(false);
+    expect(isPackage(config, 'api')).to.equal(true);
+  });
+
+  it('package file of a group', () => {
+    const config = {
+      'package-file': {all: [{any: ['go.mod', 'package.json']}, 'Dockerfile']},
+    };
+    const pkg = custard.loadPackage(config, 'api', checkoutPath);
+    expect(pkg.packageFile).to.equal('go.mod');
+  });
+
+  it('validation', () => {
+    const valid = {'package-file': [{all: ['a', {any: ['b', 'c']}]}, 'd']};
+    expect(custard.validateConfig(valid)).to.deep.equal([]);
+    const invalid = {'package-file': [{all: ['a'], any: ['b']}]};
+    expect(custard.validateConfig(invalid)).to.deep.equal([
+      '\'package-file\' must be string, string[], or {any: [...]} and {all: [...]} groups, got: [{"all":["a"],"any":["b"]}]',
+    ]);
+  });
+});
+
+describe('presets', () => {
+  it('adds the preset patterns first', () => {
+    const config = custard.applyPresets({
+      presets: ['go'],
+      'package-file': 'package.json',
+      match: ['*.proto'],
+      ignore: '!testdata/keep/**',
+    });
+    expect(config['package-file']).to.deep.equal(['go.mod', 'package.json']);
+    expect(config.match).to.include.members(['*.go', 'go.sum', '*.proto']);
+    expect((config.match as string[]).at(-1)).to.equal('*.proto');
+    expect(config.ignore).to.deep.equal(['!testdata/keep/**']);
+    expect(custard.applyPresets(config)).to.deep.equal(config);
+  });
+
+  it('load config', () => {
+    const dir = testing.materialize({
+      'config.json': JSON.stringify({presets: ['node', 'python']}),
+    });
+    try {
+      const config = custard.loadConfig(path.join(dir, 'config.json'));
+      expect(config['package-file']).to.deep.equal([
+        'package.json',
+        'requirements.txt',
+        'pyproject.toml',
+        'setup.py',
+      ]);
+      expect(config.ignore).to.include.members(['node_modules/**', '*.pyc']);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('glob package files', () => {
+    const checkoutPath = testing.materialize({
+      'api/Api.csproj': '<Project />',
+      'api/Program.cs': '',
+      'docs/index.md': '',
+    });
+    try {
+      const config = custard.applyPresets({presets: 'dotnet'});
+      const packages = custard.findPackages(config, '.', checkoutPath);
+      expect([...packages]).to.deep.equal(['api']);
+      const diffs = ['api/Program.cs', 'docs/index.md'];
+      expect(custard.affected(config, diffs, checkoutPath)).to.deep.equal([
+        'api',
+      ]);
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+  });
+
+  it('config objects', () => {
+    const checkoutPath = testing.materialize({
+      'api/go.mod': 'module api',
+      'api/main.go': '',
+      'api/README.md': '',
+    });
+    try {
+      const config: custard.Config = {presets: 'go'};
+      const diffs = ['api/main.go', 'api/README.md'];
+      expect(custard.affected(config, diffs, checkoutPath)).to.deep.equal([
+        'api',
+      ]);
+      expect(custard.affected(config, ['api/README.md'], checkoutPath)).to.be
+        .empty;
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+  });
+
+  it('match categories', () => {
+    const config = custard.applyPresets({
+      presets: 'go',
+      'match-categories': ['source', 'build'],
+      match: '*.proto',
+    });
+    expect(config['package-file']).to.deep.equal(['go.mod']);
+    expect(config.match).to.deep.equal([
+      '*.go',
+      'Dockerfile',
+      '.dockerignore',
+      'go.mod',
+      'go.sum',
+      'ci-setup.jsonc',
+      'ci-setup.json',
+      '*.proto',
+    ]);
+    expect(custard.applyPresets(config)).to.deep.equal(config);
+  });
+
+  it('match categories without presets', () => {
+    const config = custard.applyPresets({
+      'package-file': 'pkg.txt',
+      'match-categories': 'docs',
+    });
+    expect(config['package-file']).to.equal('pkg.txt');
+    expect(config.match).to.deep.equal([
+      '*.md',
+      '*.rst',
+      'docs/**',
+      'ci-setup.jsonc',
+      'ci-setup.json',
+    ]);
+  });
+
+  it('match categories with ci-setup files', () => {
+    const config = custard.applyPresets({
+      'package-file': 'pkg.txt',
+      'match-categories': 'source',
+      'ci-setup-filename': 'build.json',
+    });
+    expect(config.match).to.include('build.json');
+  });
+
+  it('validation', () => {
+    const config = {presets: ['go', 'rust'], 'match-engine': 'regexp'};
+    expect(custard.validateConfig(config)).to.deep.equal([
+      '\'presets\' must be one of: node, go, python, java, dotnet, terraform, got: "rust"',
+      "'presets' use glob patterns, they can't be used with the regexp 'match-engine'",
+    ]);
+  });
+
+  it('match categories validation', () => {
+    const config = {
+      'match-categories': ['source', 'tests'],
+      'match-engine': 'regexp',
+    };
+    expect(custard.validateConfig(config)).to.deep.equal([
+      '\'match-categories\' must be one of: assets, build, config, docs, source, got: "tests"',
+      "'match-categories' use glob patterns, they can't be used with the regexp 'match-engine'",
+    ]);
+  });
+});
+
 describe('getPackageDir', () => {
   const config: custard.Config = {'package-file': 'package-file.txt'};
   it('path does not exist', () => {
@@ -424,6 +2035,44 @@ describe('getPackageDir', () => {
       ),
     ).equals('test/affected/valid-package/subdir/subpackage');
   });
+  it('relative to checkout path', () => {
+    expect(
+      custard.getPackageDir(
+        config,
+        'valid-package/path/to/file.txt',
+        'test/affected',
+      ),
+    ).equals('valid-package');
+  });
+  it('traces each directory', () => {
+    const trace = console.trace;
+    const style = process.env.CUSTARD_LOG_STYLE;
+    const traces: string[] = [];
+    console.trace = (text: string) => traces.push(text);
+    process.env.CUSTARD_LOG_STYLE = 'plain';
+    try {
+      custard.getPackageDir(
+        config,
+        'test/affected/valid-package/path/to/file.txt',
+        '.',
+      );
+    } finally {
+      console.trace = trace;
+      if (style === undefined) {
+        delete process.env.CUSTARD_LOG_STYLE;
+      } else {
+        process.env.CUSTARD_LOG_STYLE = style;
+      }
+    }
+    expect(traces).to.deep.equal([
+      'TRACE CUSTARD-T002: test/affected/valid-package/path/to: ' +
+        'no package file, checking parent',
+      'TRACE CUSTARD-T002: test/affected/valid-package/path: ' +
+        'no package file, checking parent',
+      'TRACE CUSTARD-T002: test/affected/valid-package: ' +
+        'package file found, stop',
+    ]);
+  });
 });
 
 describe('matches', () => {
@@ -440,6 +2089,210 @@ describe('matches', () => {
   it('regex match', () =>
     expect(custard.matches('path/to/match-wildcard.txt', ['match-[^.]*\\.txt']))
       .to.be.true);
+  it('backslash full match', () =>
+    expect(custard.matches('path\\to\\match', ['path/to/match'])).to.be.true);
+  it('backslash filename match', () =>
+    expect(custard.matches('path\\to\\match', ['match'])).to.be.true);
+  it('backslash glob match', () =>
+    expect(custard.matches('path\\to\\a.txt', ['path/*/*.txt'])).to.be.true);
+});
+
+describe('ignoringPattern', () => {
+  const ignore = ['**/*.md', '!docs/required.md'];
+  it('not ignored', () =>
+    expect(custard.ignoringPattern('src/index.js', ignore)).to.equal(null));
+  it('ignored', () =>
+    expect(custard.ignoringPattern('docs/other.md', ignore)).to.equal(
+      '**/*.md',
+    ));
+  it('re-included', () =>
+    expect(custard.ignoringPattern('docs/required.md', ignore)).to.equal(null));
+  it('last match wins', () =>
+    expect(
+      custard.ignoringPattern('docs/required.md', [...ignore, 'docs/**']),
+    ).to.equal('docs/**'));
+  it('escaped exclamation mark', () =>
+    expect(custard.ignoringPattern('a/!important', ['\\!important'])).to.equal(
+      '\\!important',
+    ));
+  it('explain re-included file', () => {
+    const config = {'package-file': 'package.json', ignore};
+    const checkoutPath = testing.materialize({
+      'docs/package.json': '{}',
+      'docs/required.md': '',
+      'docs/other.md': '',
+    });
+    try {
+      const explain = (diff: string) =>
+        custard.explainDiff(config, diff, checkoutPath).reason;
+      expect(explain('docs/required.md')).to.equal('package file found');
+      expect(explain('docs/other.md')).to.equal('ignored');
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+  });
+});
+
+describe('match engines', () => {
+  const {gitignore, regexp} = custard.matchEngines;
+  const matches = (engine: custard.MatchEngine, p: string, f: string) =>
+    custard.matches(f, [p], engine);
+
+  it('gitignore', () => {
+    expect(matches(gitignore, '*.md', 'docs/guide/intro.md')).to.be.true;
+    expect(matches(gitignore, '/build', 'build/out.js')).to.be.true;
+    expect(matches(gitignore, '/build', 'src/build/out.js')).to.be.false;
+    expect(matches(gitignore, 'build/', 'src/build/out.js')).to.be.true;
+    expect(matches(gitignore, 'build/', 'src/build')).to.be.false;
+    expect(matches(gitignore, 'src/*.js', 'src/index.js')).to.be.true;
+    expect(matches(gitignore, 'src/*.js', 'lib/src/index.js')).to.be.false;
+    expect(matches(gitignore, '**/test/**', 'a/test/b.go')).to.be.true;
+    expect(matches(gitignore, 'a/**/b.go', 'a/b.go')).to.be.true;
+    expect(matches(gitignore, 'file[0-9].txt', 'x/file1.txt')).to.be.true;
+    expect(matches(gitignore, 'file?.txt', 'x/file10.txt')).to.be.false;
+    // No regular expression fallback, unlike the simple engine.
+    expect(matches(gitignore, 'a|b', 'a')).to.be.false;
+  });
+
+  it('regexp', () => {
+    const pattern = '^(src|lib)/.*_test\\.go$';
+    expect(matches(regexp, pattern, 'src/a/b_test.go')).to.be.true;
+    expect(matches(regexp, pattern, 'lib/b_test.go')).to.be.true;
+    expect(matches(regexp, pattern, 'cmd/src/b_test.go')).to.be.false;
+    expect(matches(regexp, pattern, 'src/b.go')).to.be.false;
+    expect(matches(regexp, '*', 'anything')).to.be.true;
+  });
+
+  it('config', () => {
+    const config: custard.Config = {
+      'package-file': 'package.json',
+      'match-engine': 'regexp',
+      match: '\\.go$',
+      ignore: ['_test\\.go$', '!^lib/'],
+    };
+    const checkoutPath = testing.materialize({
+      'src/package.json': '{}',
+      'lib/package.json': '{}',
+    });
+    try {
+      const reason = (diff: string) =>
+        custard.explainDiff(config, diff, checkoutPath).reason;
+      expect(reason('src/main.go')).to.equal('package file found');
+      expect(reason('src/README.md')).to.equal('no match pattern');
+      expect(reason('src/main_test.go')).to.equal('ignored');
+      expect(reason('lib/lib_test.go')).to.equal('package file found');
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+  });
+
+  it('validation', () => {
+    expect(
+      custard.validateConfig({'match-engine': 'regexp', match: ['(', 'a']}),
+    ).to.deep.equal([
+      "'match' has an invalid pattern: SyntaxError: Invalid regular expression: /(/: Unterminated group",
+    ]);
+    expect(custard.validateConfig({'match-engine': 'fnmatch'})).to.deep.equal([
+      '\'match-engine\' must be one of: simple, gitignore, regexp, got: "fnmatch"',
+    ]);
+  });
+
+  it('custom engine', () => {
+    // Matches file names with a prefix.
+    const prefix: custard.MatchEngine = pattern => {
+      if (!pattern.endsWith('-')) {
+        throw new Error(`not a prefix: ${pattern}`);
+      }
+      return {matches: fullPath => fullPath.includes(`/${pattern}`)};
+    };
+    const config = custard.withMatchEngine(
+      {'package-file': 'package.json', match: 'gen-'},
+      prefix,
+    );
+    const checkoutPath = testing.materialize({'a/package.json': '{}'});
+    try {
+      expect(
+        custard.affected(config, ['a/gen-api.ts', 'a/api.ts'], checkoutPath),
+      ).to.deep.equal(['a']);
+      expect(custard.affected(config, ['a/api.ts'], checkoutPath)).to.be.empty;
+      const errors = custard.validateConfig({...config, ignore: 'tmp'});
+      expect(errors).to.deep.equal([
+        "'ignore' has an invalid pattern: Error: not a prefix: tmp",
+      ]);
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+  });
+});
+
+describe('.custardignore', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    ignore: ['*.txt'],
+  };
+  const checkoutPath = testing.materialize({
+    '.custardignore': '# Docs never affect packages.\n*.md\ngenerated/\n',
+    'a/package.json': '{}',
+    'b/package.json': '{}',
+    'b/.custardignore': '!README.md\n/fixtures/\n!keep.txt\n',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('merges the files hierarchically', () => {
+    const diffs = [
+      'a/README.md',
+      'a/generated/x.js',
+      'b/README.md',
+      'b/fixtures/x.js',
+      'b/src/fixtures/x.js',
+      'b/keep.txt',
+      'a/notes.txt',
+    ];
+    const explain = (diff: string) =>
+      custard.explainDiff(config, diff, checkoutPath).ignore;
+    expect(diffs.map(explain)).to.deep.equal([
+      '.custardignore: *.md',
+      '.custardignore: generated/',
+      null,
+      'b/.custardignore: /fixtures/',
+      null,
+      null,
+      '*.txt',
+    ]);
+    expect(custard.affected(config, diffs, checkoutPath)).to.deep.equal(['b']);
+  });
+
+  it('reads each file once per run', () => {
+    const reads: string[] = [];
+    const files: custard.FileSystem = {
+      ...fs,
+      readFileSync: (filePath, encoding) => {
+        reads.push(path.relative(checkoutPath, filePath));
+        return fs.readFileSync(filePath, encoding);
+      },
+    };
+    const diffs = ['b/README.md', 'b/src/index.js', 'b/src/lib/x.js'];
+    custard.affected(
+      custard.withFileSystem(config, files),
+      diffs,
+      checkoutPath,
+    );
+    const ignoreReads = reads.filter(read => read.endsWith('.custardignore'));
+    expect(ignoreReads.sort()).to.deep.equal([
+      '.custardignore',
+      'b/.custardignore',
+    ]);
+  });
+});
+
+describe('toSlash', () => {
+  it('forward slashes', () => {
+    expect(custard.toSlash('path/to/file.txt')).to.equal('path/to/file.txt');
+  });
+  it('backslashes', () => {
+    const filepath = 'path\\to\\file.txt';
+    expect(custard.toSlash(filepath)).to.equal('path/to/file.txt');
+  });
 });
 
 describe('fileMatchesConfig', () => {
@@ -496,38 +2349,2009 @@ describe('matchPackages', () => {
     const diffs = ['test/affected/excluded/file.txt'];
     expect(custard.matchPackages(config, diffs, '.')).to.deep.equals([]);
   });
+  it('matches but outside roots', () => {
+    const diffs = ['test/affected/valid-package/file.txt'];
+    const withRoots = {...config, roots: ['test/affected/excluded']};
+    expect(custard.matchPackages(withRoots, diffs, '.')).to.deep.equals([]);
+  });
 });
 
-describe('findPackages', () => {
+describe('explain', () => {
   const config: custard.Config = {
     'package-file': 'package-file.txt',
+    match: ['*.txt'],
+    ignore: ['ignored.txt'],
     'exclude-packages': ['test/affected/excluded'],
   };
-  it('finds recursively', () => {
-    expect([...custard.findPackages(config, 'test/affected')]).to.deep.equals([
-      'test/affected/valid-package',
-      'test/affected/valid-package/subdir/subpackage',
+  it('explains each diff', () => {
+    const diffs = [
+      'test/affected/valid-package/file.md',
+      'test/affected/valid-package/ignored.txt',
+      'test/affected/excluded/file.txt',
+      'test/affected/valid-package/path/to/file.txt',
+    ];
+    expect(custard.explain(config, diffs, '.')).to.deep.equal({
+      diffs: [
+        {
+          diff: 'test/affected/valid-package/file.md',
+          match: null,
+          ignore: null,
+          package: null,
+          reason: 'no match pattern',
+        },
+        {
+          diff: 'test/affected/valid-package/ignored.txt',
+          match: '*.txt',
+          ignore: 'ignored.txt',
+          package: null,
+          reason: 'ignored',
+        },
+        {
+          diff: 'test/affected/excluded/file.txt',
+          match: '*.txt',
+          ignore: null,
+          package: 'test/affected/excluded',
+          reason: 'excluded package',
+        },
+        {
+          diff: 'test/affected/valid-package/path/to/file.txt',
+          match: '*.txt',
+          ignore: null,
+          package: 'test/affected/valid-package',
+          reason: 'package file found',
+        },
+      ],
+      excluded: ['test/affected/excluded'],
+      archived: [],
+      affected: ['test/affected/valid-package'],
+    });
+  });
+  it('global file', () => {
+    const diff = 'test/affected/no-package-file/file.txt';
+    const explanation = custard.explainDiff(config, diff, '.');
+    expect(explanation.package).to.equal('.');
+    expect(explanation.reason).to.equal('global file');
+  });
+  it('backslash separators', () => {
+    const withBackslashes = {
+      ...config,
+      'exclude-packages': ['test\\affected\\excluded'],
+    };
+    const diffs = [
+      'test\\affected\\valid-package\\path\\to\\file.txt',
+      'test\\affected\\excluded\\file.txt',
+    ];
+    const explanation = custard.explain(withBackslashes, diffs, '.');
+    expect(explanation.diffs.map(d => [d.diff, d.package])).to.deep.equal([
+      [
+        'test/affected/valid-package/path/to/file.txt',
+        'test/affected/valid-package',
+      ],
+      ['test/affected/excluded/file.txt', 'test/affected/excluded'],
     ]);
+    expect(explanation.excluded).to.deep.equal(['test/affected/excluded']);
+    expect(explanation.affected).to.deep.equal(['test/affected/valid-package']);
   });
 });
 
-describe('affected', () => {
+describe('whyNot', () => {
   const config: custard.Config = {
     'package-file': 'package-file.txt',
+    match: ['*.txt'],
+    ignore: ['ignored.txt'],
     'exclude-packages': ['test/affected/excluded'],
   };
-  it('affected one', () => {
+  const whyNot = (pkg: string, diffs: string[]) =>
+    custard.whyNot(config, pkg, diffs, '.').reason;
+
+  it('affected', () => {
     const diffs = ['test/affected/valid-package/file.txt'];
-    expect(custard.affected(config, diffs, '.')).to.deep.equals([
+    const report = custard.whyNot(
+      config,
       'test/affected/valid-package',
-    ]);
+      diffs,
+      '.',
+    );
+    expect(report.selected).to.equal(true);
+    expect(report.reason).to.equal('affected');
   });
-  it('affected all', () => {
-    const diffs = ['test/affected/no-package-file/file.txt'];
-    expect(custard.affected(config, diffs, '.')).to.deep.equals([
-      'test/affected/valid-package',
-      'test/affected/valid-package/subdir/subpackage',
-    ]);
+  it('not selected', () => {
+    const pkg = 'test/affected/valid-package';
+    expect(whyNot('does/not/exist', [])).to.equal('path does not exist');
+    expect(whyNot('test/affected', [])).to.equal('not a package');
+    expect(whyNot('test/affected/excluded', [])).to.equal('excluded package');
+    expect(whyNot(pkg, [])).to.equal('no changes in package');
+    expect(whyNot(pkg, [`${pkg}/file.md`])).to.equal('no match pattern');
+    expect(whyNot(pkg, [`${pkg}/ignored.txt`])).to.equal('ignored');
+    expect(whyNot(pkg, [`${pkg}/subdir/subpackage/file.txt`])).to.equal(
+      'changes in a nested package',
+    );
+  });
+  it('outside roots', () => {
+    const withRoots = {...config, roots: 'test/affected/valid-package/subdir'};
+    const pkg = 'test/affected/valid-package';
+    const diffs = [`${pkg}/file.txt`];
+    const report = custard.whyNot(withRoots, pkg, diffs, '.');
+    expect(report.reason).to.equal('outside roots');
+    expect(report.diffs.map(d => d.reason)).to.deep.equal(['outside roots']);
+  });
+});
+
+describe('manifest', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {env: {A: 'default'}},
+  };
+  const checkoutPath = testing.materialize({
+    'a/package.json': '{}',
+    'a/ci-setup.json': '{"env": {"B": "b"}}',
+    'b/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('create', () => {
+    const manifest = custard.createManifest(config, ['a/x.js'], checkoutPath);
+    expect(manifest).to.deep.equal({
+      'manifest-version': custard.manifestVersion,
+      'custard-version': custard.version,
+      'config-hash': custard.configHash(config),
+      diffs: ['a/x.js'],
+      changed: ['a'],
+      affected: [{path: 'a', reasons: ['a/x.js changed']}],
+      removed: [],
+      archived: [],
+      'ci-setup': {a: {env: {A: 'default', B: 'b'}}},
+    });
+  });
+
+  it('load', () => {
+    const manifest = custard.createManifest(config, ['b/x.js'], checkoutPath);
+    const filePath = path.join(checkoutPath, 'manifest.json');
+    fs.writeFileSync(filePath, JSON.stringify(manifest));
+    expect(custard.loadManifest(filePath, config)).to.deep.equal(manifest);
+  });
+
+  it('load with a different config', () => {
+    const manifest = custard.createManifest(config, ['b/x.js'], checkoutPath);
+    const filePath = path.join(checkoutPath, 'manifest.json');
+    fs.writeFileSync(filePath, JSON.stringify(manifest));
+    const other = {...config, ignore: ['*.md']};
+    expect(() => custard.loadManifest(filePath, other)).to.throw(
+      'was created with a different config',
+    );
+  });
+
+  it('load unsupported version', () => {
+    const filePath = path.join(checkoutPath, 'manifest.json');
+    fs.writeFileSync(filePath, JSON.stringify({'manifest-version': 999}));
+    expect(() => custard.loadManifest(filePath)).to.throw(
+      'unsupported manifest version 999',
+    );
+  });
+
+  it('config hash ignores field order', () => {
+    const reordered = {
+      'ci-setup-defaults': {env: {A: 'default'}},
+      'package-file': 'package.json',
+    };
+    expect(custard.configHash(reordered)).to.equal(custard.configHash(config));
+  });
+});
+
+describe('hashPackage', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    ignore: ['*.md'],
+  };
+  let checkoutPath = '';
+  beforeEach(() => {
+    checkoutPath = testing.materialize({
+      'a/package.json': '{}',
+      'a/index.js': 'console.log("a")',
+      'a/README.md': '# a',
+      'a/.custardignore': 'fixtures/',
+      'a/fixtures/data.json': '{}',
+      'a/nested/package.json': '{}',
+      'a/nested/index.js': 'console.log("nested")',
+    });
+  });
+  afterEach(() => testing.cleanup(checkoutPath));
+  const write = (file: string, contents: string) =>
+    fs.writeFileSync(path.join(checkoutPath, file), contents);
+
+  it('changes with the package files', () => {
+    const before = custard.hashPackage(config, 'a', checkoutPath);
+    expect(before).to.match(/^[0-9a-f]{64}$/);
+    expect(custard.hashPackage(config, 'a', checkoutPath)).to.equal(before);
+    write('a/index.js', 'console.log("changed")');
+    expect(custard.hashPackage(config, 'a', checkoutPath)).to.not.equal(before);
+  });
+
+  it('skips ignored files', () => {
+    const before = custard.hashPackage(config, 'a', checkoutPath);
+    write('a/README.md', '# changed');
+    write('a/fixtures/data.json', '[]');
+    expect(custard.hashPackage(config, 'a', checkoutPath)).to.equal(before);
+  });
+
+  it('skips nested packages', () => {
+    const before = custard.hashPackage(config, 'a', checkoutPath);
+    write('a/nested/index.js', 'console.log("changed")');
+    expect(custard.hashPackage(config, 'a', checkoutPath)).to.equal(before);
+    const parent = {...config, 'nested-packages': 'parent'};
+    const parentBefore = custard.hashPackage(parent, 'a', checkoutPath);
+    write('a/nested/index.js', 'console.log("changed again")');
+    expect(custard.hashPackage(parent, 'a', checkoutPath)).to.not.equal(
+      parentBefore,
+    );
+  });
+
+  it('file system', () => {
+    const read: string[] = [];
+    const files: custard.FileSystem = {
+      ...fs,
+      readFileSync: (filePath, encoding) => {
+        read.push(path.relative(checkoutPath, filePath));
+        return fs.readFileSync(filePath, encoding);
+      },
+    };
+    const filesConfig = custard.withFileSystem(config, files);
+    expect(custard.hashPackage(filesConfig, 'a', checkoutPath)).to.equal(
+      custard.hashPackage(config, 'a', checkoutPath),
+    );
+    expect(read).to.include.members(['a/index.js', 'a/package.json']);
+  });
+
+  it('independent of the package path', () => {
+    const other = testing.materialize({
+      'x/y/package.json': '{}',
+      'x/y/index.js': 'console.log("a")',
+    });
+    try {
+      const onlyJs = {...config, match: ['*.js', 'package.json']};
+      expect(custard.hashPackage(onlyJs, 'x/y', other)).to.equal(
+        custard.hashPackage(onlyJs, 'a', checkoutPath),
+      );
+    } finally {
+      testing.cleanup(other);
+    }
+  });
+});
+
+describe('stackedAffected', () => {
+  const config: custard.Config = {'package-file': 'package.json'};
+  let repo = '';
+  beforeEach(() => {
+    repo = testing.gitInit({
+      'a/package.json': '{}',
+      'b/package.json': '{}',
+      'c/package.json': '{}',
+    });
+  });
+  afterEach(() => testing.cleanup(repo));
+
+  it('only the packages added by the top changes', () => {
+    const base = testing.gitCommit(repo, {write: {'c/x.js': 'base'}});
+    const parent = testing.gitCommit(repo, {write: {'a/x.js': 'below'}});
+    testing.gitCommit(repo, {write: {'a/x.js': 'top', 'b/x.js': 'top'}});
+    expect(
+      custard.stackedAffected(config, base, parent, 'HEAD', repo),
+    ).to.deep.equal({all: ['a', 'b'], below: ['a'], added: ['a', 'b']});
+  });
+
+  it('not changed again by the top changes', () => {
+    const base = testing.gitCommit(repo, {write: {'c/x.js': 'base'}});
+    const parent = testing.gitCommit(repo, {write: {'a/x.js': 'below'}});
+    testing.gitCommit(repo, {write: {'b/x.js': 'top'}});
+    expect(
+      custard.stackedAffected(config, base, parent, 'HEAD', repo),
+    ).to.deep.equal({all: ['a', 'b'], below: ['a'], added: ['b']});
+  });
+
+  it('with another VCS', () => {
+    const diffs: {[range: string]: string[]} = {
+      'b..head': ['a/x.js', 'c/x.js'],
+      'b..p': ['a/x.js'],
+      'p..head': ['c/x.js'],
+    };
+    const vcs = {
+      diff: (base: string, head: string) => diffs[`${base}..${head}`],
+    };
+    const stack = custard.stackedAffected(config, 'b', 'p', 'head', repo, vcs);
+    expect(stack.added).to.deep.equal(['c']);
+  });
+});
+
+describe('simulate', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    ignore: ['*.md'],
+  };
+  const checkoutPath = testing.materialize({
+    'a/package.json': '{}',
+    'b/package.json': '{}',
+    'c/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('aggregate impact', () => {
+    const history = [
+      ['a/index.js'],
+      ['a/index.js', 'b/index.js'],
+      ['README.md'],
+      ['global.txt'],
+    ];
+    expect(custard.simulate(config, history, checkoutPath)).to.deep.equal({
+      commits: 4,
+      averageAffected: 1.5,
+      blastRadius: 0.5,
+      maxAffected: 3,
+      allAffected: 1,
+      selections: {a: 3, b: 2, c: 1},
+      mostAffected: ['a', 'b', 'c'],
+      neverSelected: [],
+    });
+  });
+
+  it('packages never selected', () => {
+    const history = [['a/index.js']];
+    const report = custard.simulate(config, history, checkoutPath);
+    expect(report.neverSelected).to.deep.equal(['b', 'c']);
+    expect(report.mostAffected).to.deep.equal(['a']);
+  });
+
+  it('no history', () => {
+    const report = custard.simulate(config, [], checkoutPath);
+    expect(report.averageAffected).to.equal(0);
+    expect(report.blastRadius).to.equal(0);
+  });
+});
+
+describe('configDiff', () => {
+  const checkoutPath = testing.materialize({
+    'apps/a/package.json': '{}',
+    'apps/b/package.json': '{}',
+    'apps/b/ci-setup.json': JSON.stringify({deploy: {region: 'eu'}}),
+    'tools/c/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  const oldConfig: custard.Config = {
+    'package-file': 'package.json',
+    'exclude-packages': ['apps/a'],
+    'ci-setup-defaults': {
+      deploy: {region: 'us', replicas: 1},
+      tags: ['web'],
+    },
+  };
+
+  it('same config', () => {
+    const report = custard.configDiff(oldConfig, oldConfig, checkoutPath);
+    expect(report).to.deep.equal({
+      included: [],
+      excluded: [],
+      changed: [],
+      defaults: [],
+    });
+  });
+
+  it('packages and defaults', () => {
+    const newConfig: custard.Config = {
+      'package-file': 'package.json',
+      roots: ['apps'],
+      'ci-setup-defaults': {
+        deploy: {region: 'us', replicas: 2},
+        timeout: '1h',
+      },
+    };
+    const report = custard.configDiff(oldConfig, newConfig, checkoutPath);
+    expect(report).to.deep.equal({
+      included: ['apps/a'],
+      excluded: ['tools/c'],
+      changed: ['apps/b'],
+      defaults: [
+        {field: 'deploy.replicas', before: 1, after: 2},
+        {field: 'tags', before: ['web'], after: undefined},
+        {field: 'timeout', before: undefined, after: '1h'},
+      ],
+    });
+  });
+});
+
+describe('findPackages', () => {
+  const config: custard.Config = {
+    'package-file': 'package-file.txt',
+    'exclude-packages': ['test/affected/excluded'],
+  };
+  it('finds recursively', () => {
+    expect([...custard.findPackages(config, 'test/affected')]).to.deep.equals([
+      'test/affected/valid-package',
+      'test/affected/valid-package/subdir/subpackage',
+    ]);
+  });
+  it('relative to checkout path', () => {
+    const root = 'valid-package';
+    const packages = custard.findPackages(config, root, 'test/affected');
+    expect([...packages]).to.deep.equals(['valid-package/subdir/subpackage']);
+  });
+  it('streams packages as they are found', () => {
+    const checkoutPath = testing.materialize({
+      'a/package.json': '{}',
+      'b/package.json': '{}',
+    });
+    try {
+      const streamConfig = {'package-file': 'package.json'};
+      const packages = custard.findPackages(streamConfig, '.', checkoutPath);
+      const first = packages.next().value;
+      // The other directory hasn't been walked yet, so it finds new packages.
+      const other = first === 'a' ? 'b' : 'a';
+      const newPackage = path.join(checkoutPath, other, 'new');
+      fs.mkdirSync(newPackage);
+      fs.writeFileSync(path.join(newPackage, 'package.json'), '{}');
+      expect([...packages].sort()).to.deep.equal([other, `${other}/new`]);
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+  });
+});
+
+describe('cancellation', () => {
+  const config: custard.Config = {'package-file': 'package.json'};
+  const checkoutPath = testing.materialize({
+    'a/package.json': '{}',
+    'b/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('stops the walk', () => {
+    const controller = new AbortController();
+    const packages = custard.findPackages(
+      config,
+      '.',
+      checkoutPath,
+      controller.signal,
+    );
+    packages.next();
+    controller.abort();
+    expect(() => packages.next()).to.throw('aborted');
+  });
+
+  it('times out between packages', async () => {
+    const packages = custard.findPackages(
+      config,
+      '.',
+      checkoutPath,
+      AbortSignal.timeout(1),
+    );
+    packages.next();
+    await new Promise(resolve => setTimeout(resolve, 10));
+    expect(() => packages.next()).to.throw('timeout');
+  });
+
+  it('affected packages', () => {
+    const signal = AbortSignal.abort();
+    const diffs = ['a/index.js'];
+    expect(() =>
+      custard.affected(config, diffs, checkoutPath, signal),
+    ).to.throw('aborted');
+    expect(custard.affected(config, diffs, checkoutPath)).to.deep.equal(['a']);
+  });
+});
+
+describe('exclude-subpackages', () => {
+  const checkoutPath = testing.materialize({
+    'excluded/package.json': '{}',
+    'excluded/nested/pkg/package.json': '{}',
+    'excluded-not/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const config = (subpackages?: boolean): custard.Config => ({
+    'package-file': 'package.json',
+    'exclude-packages': 'excluded',
+    'exclude-subpackages': subpackages,
+  });
+  const diffs = ['excluded/nested/pkg/x.js', 'excluded-not/x.js'];
+
+  it('exact matches by default', () => {
+    const packages = [...custard.findPackages(config(), '.', checkoutPath)];
+    expect(packages.sort()).to.deep.equal([
+      'excluded-not',
+      'excluded/nested/pkg',
+    ]);
+    expect(custard.affected(config(), diffs, checkoutPath)).to.deep.equal([
+      'excluded-not',
+      'excluded/nested/pkg',
+    ]);
+  });
+
+  it('excludes everything beneath', () => {
+    const packages = [...custard.findPackages(config(true), '.', checkoutPath)];
+    expect(packages).to.deep.equal(['excluded-not']);
+    expect(custard.affected(config(true), diffs, checkoutPath)).to.deep.equal([
+      'excluded-not',
+    ]);
+    const pkg = 'excluded/nested/pkg';
+    const why = custard.whyNot(config(true), pkg, diffs, checkoutPath);
+    expect(why.reason).to.equal('excluded package');
+  });
+});
+
+describe('case-insensitive', () => {
+  const checkoutPath = testing.materialize({
+    'web/package.json': '{}',
+    'web/.custardignore': 'fixtures/',
+    'api/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const config = (ignoreCase?: boolean): custard.Config => ({
+    'package-file': 'package.json',
+    ignore: ['*.md', 'docs/**'],
+    'exclude-packages': ['API'],
+    'case-insensitive': ignoreCase,
+  });
+  const ignoredBy = (cfg: custard.Config, diff: string) =>
+    custard.explainDiff(cfg, diff, checkoutPath).ignore;
+
+  it('case-sensitive by default', () => {
+    expect(ignoredBy(config(), 'web/README.MD')).to.be.null;
+    expect(ignoredBy(config(), 'Docs/index.html')).to.be.null;
+    expect(ignoredBy(config(), 'web/Fixtures/data.json')).to.be.null;
+    const packages = [...custard.findPackages(config(), '.', checkoutPath)];
+    expect(packages.sort()).to.deep.equal(['api', 'web']);
+  });
+
+  it('ignores case', () => {
+    expect(ignoredBy(config(true), 'web/README.MD')).to.equal('*.md');
+    expect(ignoredBy(config(true), 'Docs/index.html')).to.equal('docs/**');
+    expect(ignoredBy(config(true), 'web/Fixtures/data.json')).to.equal(
+      'web/.custardignore: fixtures/',
+    );
+    const packages = [...custard.findPackages(config(true), '.', checkoutPath)];
+    expect(packages).to.deep.equal(['web']);
+  });
+
+  it('regexp engine', () => {
+    const regexp = {
+      ...config(true),
+      'match-engine': 'regexp',
+      ignore: '\\.md$',
+    };
+    expect(ignoredBy(regexp, 'web/README.MD')).to.equal('\\.md$');
+  });
+});
+
+describe('normalize-unicode', () => {
+  const config = (normalize?: boolean): custard.Config => ({
+    'package-file': 'package.json',
+    ignore: ['caf\u00e9.md'],
+    'normalize-unicode': normalize,
+  });
+  // The same name with a decomposed accent, like macOS file names.
+  const decomposed = 'docs/cafe\u0301.md';
+
+  it('compares the NFC form', () => {
+    expect(custard.explainDiff(config(), decomposed, '.').ignore).to.be.null;
+    expect(custard.explainDiff(config(true), decomposed, '.').ignore).to.equal(
+      'caf\u00e9.md',
+    );
+  });
+});
+
+describe('prune and max-depth', () => {
+  const checkoutPath = testing.materialize({
+    'web/package.json': '{}',
+    'web/node_modules/left-pad/package.json': '{}',
+    'web/dist/package.json': '{}',
+    'web/app/ui/package.json': '{}',
+    'api/.custardignore': 'vendor/',
+    'api/vendor/lib/package.json': '{}',
+    'api/service/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    ignore: ['web/dist/**'],
+  };
+  const packages = (cfg: custard.Config) =>
+    [...custard.findPackages(cfg, '.', checkoutPath)].sort();
+
+  it('searches everything by default', () => {
+    expect(packages(config)).to.deep.equal([
+      'api/service',
+      'api/vendor/lib',
+      'web',
+      'web/app/ui',
+      'web/dist',
+      'web/node_modules/left-pad',
+    ]);
+  });
+
+  it('prunes directories', () => {
+    expect(packages({...config, prune: ['node_modules/']})).to.deep.equal([
+      'api/service',
+      'api/vendor/lib',
+      'web',
+      'web/app/ui',
+      'web/dist',
+    ]);
+  });
+
+  it('prunes ignored directories', () => {
+    expect(packages({...config, 'prune-ignored': true})).to.deep.equal([
+      'api/service',
+      'web',
+      'web/app/ui',
+      'web/node_modules/left-pad',
+    ]);
+  });
+
+  it('stops at the max depth', () => {
+    expect(packages({...config, 'max-depth': 2})).to.deep.equal([
+      'api/service',
+      'web',
+      'web/dist',
+    ]);
+  });
+
+  it('prunes with the package index', () => {
+    const indexed = {
+      ...config,
+      prune: 'node_modules',
+      'max-depth': 2,
+      'package-index': '.custard-index.json',
+    };
+    expect(packages(indexed)).to.deep.equal(['api/service', 'web', 'web/dist']);
+  });
+});
+
+describe('respect-gitignore', () => {
+  const checkoutPath = testing.materialize({
+    '.gitignore': 'dist/\n*.log',
+    'web/package.json': '{}',
+    'web/dist/package.json': '{}',
+    'api/.gitignore': 'vendor/',
+    'api/.custardignore': '!debug.log',
+    'api/package.json': '{}',
+    'api/vendor/lib/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const config = (respect?: boolean): custard.Config => ({
+    'package-file': 'package.json',
+    'respect-gitignore': respect,
+  });
+  const packages = (cfg: custard.Config) =>
+    [...custard.findPackages(cfg, '.', checkoutPath)].sort();
+
+  it('ignores nothing by default', () => {
+    expect(
+      custard.affected(config(), ['web/dist/a.js'], checkoutPath),
+    ).to.deep.equal(['web/dist']);
+    expect(packages(config())).to.deep.equal([
+      'api',
+      'api/vendor/lib',
+      'web',
+      'web/dist',
+    ]);
+  });
+
+  it('ignores the files in .gitignore', () => {
+    const diffs = ['web/dist/a.js', 'web/error.log', 'api/vendor/lib/a.js'];
+    expect(custard.affected(config(true), diffs, checkoutPath)).to.deep.equal(
+      [],
+    );
+    expect(
+      custard.explainDiff(config(true), 'web/error.log', checkoutPath).ignore,
+    ).to.equal('.gitignore: *.log');
+  });
+
+  it('applies .custardignore after .gitignore', () => {
+    expect(
+      custard.affected(config(true), ['api/debug.log'], checkoutPath),
+    ).to.deep.equal(['api']);
+  });
+
+  it('prunes the directories in .gitignore', () => {
+    expect(packages(config(true))).to.deep.equal(['api', 'web']);
+  });
+});
+
+describe('nested-packages', () => {
+  const checkoutPath = testing.materialize({
+    'app/package.json': '{}',
+    'app/src/index.js': '',
+    'app/internal/ui/package.json': '{}',
+    'app/internal/ui/button.js': '',
+    'teams/web/site/package.json': '{}',
+    'teams/web/site/blog/package.json': '{}',
+    'teams/web/site/blog/post.js': '',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const config = (nested?: string): custard.Config => ({
+    'package-file': 'package.json',
+    'nested-packages': nested,
+  });
+  const diffs = ['app/internal/ui/button.js', 'teams/web/site/blog/post.js'];
+
+  it('separate packages by default', () => {
+    const packages = [...custard.findPackages(config(), '.', checkoutPath)];
+    expect(packages.sort()).to.deep.equal([
+      'app',
+      'app/internal/ui',
+      'teams/web/site',
+      'teams/web/site/blog',
+    ]);
+    expect(custard.affected(config(), diffs, checkoutPath)).to.deep.equal([
+      'app/internal/ui',
+      'teams/web/site/blog',
+    ]);
+  });
+
+  it('part of the parent package', () => {
+    const parent = config('parent');
+    const packages = [...custard.findPackages(parent, '.', checkoutPath)];
+    expect(packages.sort()).to.deep.equal(['app', 'teams/web/site']);
+    expect(custard.affected(parent, diffs, checkoutPath)).to.deep.equal([
+      'app',
+      'teams/web/site',
+    ]);
+  });
+
+  it('stops at boundaries', () => {
+    const parent = {...config('parent'), boundaries: 'teams/*/site'};
+    expect(custard.getPackageDir(parent, diffs[1], checkoutPath)).to.equal(
+      'teams/web/site',
+    );
+    const blog = {...config('parent'), boundaries: 'teams/*/site/blog'};
+    expect(custard.getPackageDir(blog, diffs[1], checkoutPath)).to.equal(
+      'teams/web/site/blog',
+    );
+  });
+
+  it('package index', () => {
+    const indexed = {...config('parent'), 'package-index': '.index.json'};
+    try {
+      for (let i = 0; i < 2; i++) {
+        const packages = custard.findPackages(indexed, '.', checkoutPath);
+        expect([...packages].sort()).to.deep.equal(['app', 'teams/web/site']);
+      }
+    } finally {
+      fs.rmSync(path.join(checkoutPath, '.index.json'));
+    }
+  });
+
+  it('validation', () => {
+    expect(custard.validateConfig(config('merge'))).to.deep.equal([
+      '\'nested-packages\' must be one of: separate, parent, got: "merge"',
+    ]);
+  });
+});
+
+describe('symlinks', () => {
+  let checkoutPath = '';
+  beforeEach(() => {
+    checkoutPath = testing.materialize({
+      'a/package.json': '{}',
+      'vendor/lib/package.json': '{}',
+    });
+    // A link to another package, and a cycle back to the checkout root.
+    const vendor = path.join('..', 'vendor');
+    fs.symlinkSync(vendor, path.join(checkoutPath, 'a', 'v'));
+    fs.symlinkSync('..', path.join(checkoutPath, 'vendor', 'loop'));
+  });
+  afterEach(() => testing.cleanup(checkoutPath));
+  const find = (symlinks?: string) => {
+    const config = {'package-file': 'package.json', symlinks};
+    return [...custard.findPackages(config, '.', checkoutPath)].sort();
+  };
+
+  it('skip by default', () => {
+    expect(find()).to.deep.equal(['a', 'vendor/lib']);
+  });
+
+  it('follow with cycle detection', () => {
+    expect(find('follow')).to.deep.equal(['a', 'a/v/lib', 'vendor/lib']);
+  });
+
+  it('follow links outside the walked tree', () => {
+    const config = {'package-file': 'package.json', symlinks: 'follow'};
+    const packages = [...custard.findPackages(config, 'a', checkoutPath)];
+    expect(packages).to.deep.equal(['a/v/lib']);
+  });
+
+  it('error', () => {
+    expect(() => find('error')).to.throw('symlinked directory found');
+  });
+
+  it('validation', () => {
+    expect(custard.validateConfig({symlinks: 'ignore'})).to.deep.equal([
+      '\'symlinks\' must be one of: skip, follow, error, got: "ignore"',
+    ]);
+  });
+});
+
+describe('packageIndex', () => {
+  let checkoutPath = '';
+  beforeEach(() => {
+    checkoutPath = testing.materialize({
+      'a/package.json': '{}',
+      'b/c/package.json': '{}',
+      'b/d/README.md': '',
+    });
+  });
+  afterEach(() => testing.cleanup(checkoutPath));
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    'package-index': '.custard-index.json',
+  };
+  const indexPath = () => path.join(checkoutPath, '.custard-index.json');
+
+  it('same packages as a full walk', () => {
+    const index = custard.packageIndex(config, checkoutPath, indexPath());
+    expect(index.packageDirs('.')).to.deep.equal(['a', 'b/c']);
+    expect(index.packageDirs('b')).to.deep.equal(['b/c']);
+  });
+
+  it('reuses unchanged directories', () => {
+    const index = custard.packageIndex(config, checkoutPath, indexPath());
+    index.packageDirs('.');
+    index.save();
+    // Mark an unchanged directory as a package, to tell it was not read.
+    const data = JSON.parse(fs.readFileSync(indexPath(), 'utf8'));
+    data.dirs['b/d'].package = true;
+    fs.writeFileSync(indexPath(), JSON.stringify(data));
+    expect([...custard.findPackages(config, '.', checkoutPath)]).to.deep.equal(
+      ['a', 'b/c', 'b/d'],
+    );
+  });
+
+  it('reads changed directories', () => {
+    expect([...custard.findPackages(config, '.', checkoutPath)]).to.deep.equal(
+      ['a', 'b/c'],
+    );
+    fs.writeFileSync(path.join(checkoutPath, 'b', 'd', 'package.json'), '{}');
+    fs.rmSync(path.join(checkoutPath, 'a'), {recursive: true});
+    expect([...custard.findPackages(config, '.', checkoutPath)]).to.deep.equal(
+      ['b/c', 'b/d'],
+    );
+    const data = JSON.parse(fs.readFileSync(indexPath(), 'utf8'));
+    expect(Object.keys(data.dirs).sort()).to.deep.equal([
+      '.',
+      'b',
+      'b/c',
+      'b/d',
+    ]);
+  });
+
+  it('discarded when the config changes', () => {
+    const index = custard.packageIndex(config, checkoutPath, indexPath());
+    index.packageDirs('.');
+    index.save();
+    // Hide 'b' from the index, a rebuilt index finds it again.
+    const data = JSON.parse(fs.readFileSync(indexPath(), 'utf8'));
+    data.dirs['.'].subdirs = ['a'];
+    fs.writeFileSync(indexPath(), JSON.stringify(data));
+    const other = {...config, 'exclude-packages': 'a'};
+    const rebuilt = custard.packageIndex(other, checkoutPath, indexPath());
+    expect(rebuilt.packageDirs('.')).to.deep.equal(['b/c']);
+  });
+});
+
+describe('boundaries', () => {
+  const config: custard.Config = {
+    'package-file': 'package-file.txt',
+    boundaries: 'teams/*',
+  };
+  const checkoutPath = testing.materialize({
+    'global.txt': '',
+    'teams/a/shared/util.txt': '',
+    'teams/a/pkg/package-file.txt': '',
+    'teams/a/other/package-file.txt': '',
+    'teams/b/README.md': '',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('stops at the boundary', () => {
+    const diffs = ['teams/a/pkg/file.txt'];
+    const packages = custard.affected(config, diffs, checkoutPath);
+    expect(packages).to.deep.equals(['teams/a/pkg']);
+  });
+  it('affects the packages in the boundary', () => {
+    const diffs = ['teams/a/shared/util.txt', 'teams/b/README.md'];
+    const packages = custard.affectedDetailed(config, diffs, checkoutPath);
+    expect(packages).to.deep.equals([
+      {path: 'teams/a/other', reasons: ['teams/a/shared/util.txt changed']},
+      {path: 'teams/a/pkg', reasons: ['teams/a/shared/util.txt changed']},
+    ]);
+  });
+  it('boundaries are not packages', () => {
+    const packages = [...custard.findAllPackages(config, '.', checkoutPath)];
+    expect(packages.map(pkg => pkg.path).sort()).to.deep.equals([
+      'teams/a/other',
+      'teams/a/pkg',
+    ]);
+  });
+  it('explain', () => {
+    const diff = 'teams/a/shared/util.txt';
+    const explanation = custard.explainDiff(config, diff, checkoutPath);
+    expect(explanation.package).to.equal('teams/a');
+    expect(explanation.reason).to.equal('boundary');
+  });
+  it('outside boundaries is global', () => {
+    const diffs = ['global.txt'];
+    const packages = custard.affected(config, diffs, checkoutPath);
+    expect(packages.sort()).to.deep.equals(['teams/a/other', 'teams/a/pkg']);
+  });
+});
+
+describe('parseGoMod', () => {
+  it('directives', () => {
+    const gomod = [
+      'module example.com/app // the app',
+      '',
+      'go 1.24',
+      '',
+      'require example.com/lib v1.0.0',
+      'require (',
+      '\tgolang.org/x/text v0.3.0',
+      '\texample.com/util v0.1.0 // indirect',
+      ')',
+      '',
+      'replace example.com/lib => ../lib',
+      'replace (',
+      '\texample.com/util v0.1.0 => ../util',
+      ')',
+    ].join('\n');
+    expect(custard.parseGoMod(gomod)).to.deep.equal({
+      module: 'example.com/app',
+      requires: ['example.com/lib', 'golang.org/x/text', 'example.com/util'],
+      replaces: {
+        'example.com/lib': '../lib',
+        'example.com/util': '../util',
+      },
+    });
+  });
+});
+
+describe('parseGoWork', () => {
+  it('directives', () => {
+    const gowork = [
+      'go 1.24',
+      '',
+      'use ./api',
+      'use (',
+      '\t./worker // the worker',
+      ')',
+      '',
+      'replace example.com/shared => ./shared',
+    ].join('\n');
+    expect(custard.parseGoWork(gowork)).to.deep.equal({
+      uses: ['./api', './worker'],
+      replaces: {'example.com/shared': './shared'},
+    });
+  });
+});
+
+describe('goImports', () => {
+  it('single and grouped imports', () => {
+    const source = [
+      'package main',
+      '',
+      'import "fmt"',
+      'import (',
+      '\t"os"',
+      '\tlib "example.com/lib/greet"',
+      '\t_ "embed"',
+      ')',
+      '',
+      'func main() {}',
+    ].join('\n');
+    expect(custard.goImports(source)).to.deep.equal([
+      'fmt',
+      'os',
+      'example.com/lib/greet',
+      'embed',
+    ]);
+  });
+});
+
+describe('go dependencies', () => {
+  const config: custard.Config = {
+    'package-file': 'go.mod',
+    dependencies: 'go',
+  };
+  const checkoutPath = testing.materialize({
+    'lib/go.mod': 'module example.com/lib\n',
+    'lib/greet/greet.go':
+      'package greet\n\nimport "example.com/lib/internal/text"\n',
+    'lib/internal/text/text.go': 'package text\n',
+    'lib/other/other.go': 'package other\n',
+    'app/go.mod': [
+      'module example.com/app',
+      'require example.com/lib v0.0.0',
+      'replace example.com/lib => ../lib',
+    ].join('\n'),
+    'app/main.go': 'package main\n\nimport "example.com/lib/greet"\n',
+    'tool/go.mod': 'module example.com/tool\n',
+    'tool/main.go': 'package main\n\nimport "example.com/app/api"\n',
+    'unrelated/go.mod': 'module example.com/unrelated\n',
+    'unrelated/main.go': 'package main\n\nimport "example.com/lib/other"\n',
+    'README.md': '',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('transitive imports', () => {
+    const diffs = ['lib/internal/text/text.go'];
+    const packages = custard.affectedDetailed(config, diffs, checkoutPath);
+    expect(packages).to.deep.equal([
+      {
+        path: 'app',
+        reasons: ['example.com/app imports example.com/lib/greet'],
+      },
+      {path: 'lib', reasons: ['lib/internal/text/text.go changed']},
+    ]);
+  });
+  it('topological order', () => {
+    const topological = {...config, 'affected-order': 'topological'};
+    const diffs = ['lib/internal/text/text.go'];
+    expect(custard.affected(topological, diffs, checkoutPath)).to.deep.equal([
+      'lib',
+      'app',
+    ]);
+    const all = custard.affected(topological, ['README.md'], checkoutPath);
+    expect(all).to.deep.equal(['lib', 'app', 'tool', 'unrelated']);
+  });
+  it('go.mod changes affect all importers', () => {
+    const diffs = ['lib/go.mod'];
+    const packages = custard.affected(config, diffs, checkoutPath);
+    expect(packages.sort()).to.deep.equal(['app', 'lib', 'unrelated']);
+  });
+  it('not imported', () => {
+    const diffs = ['app/main.go'];
+    expect(custard.affected(config, diffs, checkoutPath)).to.deep.equal([
+      'app',
+    ]);
+  });
+  it('invalid dependencies', () => {
+    const invalid = {dependencies: ['go', 'ant']};
+    expect(custard.validateConfig(invalid)).to.deep.equal([
+      '\'dependencies\' must be one of: go, npm, bazel, got: "ant"',
+    ]);
+  });
+});
+
+describe('go workspaces', () => {
+  const config: custard.Config = {
+    'package-file': ['go.mod', 'go.work'],
+    dependencies: 'go',
+  };
+  const checkoutPath = testing.materialize({
+    'services/go.work': [
+      'go 1.24',
+      'use (',
+      '\t./api',
+      '\t./worker',
+      ')',
+      'replace example.com/shared => ./shared',
+    ].join('\n'),
+    'services/api/go.mod': 'module example.com/api\n',
+    'services/api/main.go': 'package main\n\nimport "example.com/shared"\n',
+    'services/worker/go.mod': 'module example.com/worker\n',
+    'services/worker/main.go': 'package main\n',
+    'services/shared/go.mod': 'module example.com/services/shared\n',
+    'services/shared/shared.go': 'package shared\n',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('workspace replacements', () => {
+    const diffs = ['services/shared/shared.go'];
+    const packages = custard.affectedDetailed(config, diffs, checkoutPath);
+    expect(packages).to.deep.equal([
+      {
+        path: 'services/api',
+        reasons: ['example.com/api imports example.com/services/shared'],
+      },
+      {path: 'services/shared', reasons: ['services/shared/shared.go changed']},
+    ]);
+  });
+  it('go.work changes affect the workspace modules', () => {
+    const diffs = ['services/go.work'];
+    const packages = custard.affectedDetailed(config, diffs, checkoutPath);
+    expect(packages).to.deep.equal([
+      {path: 'services', reasons: ['services/go.work changed']},
+      {path: 'services/api', reasons: ['services/go.work changed']},
+      {path: 'services/worker', reasons: ['services/go.work changed']},
+    ]);
+  });
+});
+
+describe('npm dependencies', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    dependencies: 'npm',
+  };
+  const manifest = (name: string, dependencies = {}, devDependencies = {}) =>
+    JSON.stringify({name, dependencies, devDependencies});
+  const checkoutPath = testing.materialize({
+    'package.json': JSON.stringify({workspaces: ['./packages/*', 'apps/*']}),
+    'packages/shared/package.json': manifest('@org/shared'),
+    'packages/ui/package.json': manifest('@org/ui', {'@org/shared': '*'}),
+    'apps/web/package.json': manifest('web', {}, {'@org/ui': '^1.0.0'}),
+    'apps/cli/package.json': manifest('cli', {chalk: '^5.0.0'}),
+    'tools/package.json': manifest('tools', {'@org/shared': '*'}),
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('transitive dependents', () => {
+    const diffs = ['packages/shared/index.js'];
+    const packages = custard.affectedDetailed(config, diffs, checkoutPath);
+    expect(packages).to.deep.equal([
+      {path: 'apps/web', reasons: ['web depends on @org/ui']},
+      {path: 'packages/shared', reasons: ['packages/shared/index.js changed']},
+      {path: 'packages/ui', reasons: ['@org/ui depends on @org/shared']},
+    ]);
+  });
+  it('topological order', () => {
+    const topological = {...config, 'affected-order': 'topological'};
+    const diffs = ['apps/web/index.js', 'packages/shared/index.js'];
+    expect(custard.affected(topological, diffs, checkoutPath)).to.deep.equal([
+      'packages/shared',
+      'packages/ui',
+      'apps/web',
+    ]);
+  });
+  it('no dependents', () => {
+    const diffs = ['apps/web/index.js'];
+    expect(custard.affected(config, diffs, checkoutPath)).to.deep.equal([
+      'apps/web',
+    ]);
+  });
+});
+
+describe('bazel dependencies', () => {
+  const config: custard.Config = {
+    'package-file': 'BUILD.bazel',
+    dependencies: 'bazel',
+  };
+  // A fake bazel binary, it logs the query and prints the targets.
+  const checkoutPath = testing.materialize({
+    'lib/BUILD.bazel': '',
+    'lib/src/lib.go': '',
+    'app/BUILD.bazel': '',
+    'app/main.go': '',
+    'tool/BUILD.bazel': '',
+    'bin/bazel': [
+      '#!/bin/sh',
+      'echo "$@" >> "$(dirname "$0")/queries.txt"',
+      'case "$*" in *--output=graph*)',
+      '  echo "digraph mygraph {"',
+      '  echo \'  "//app:server" -> "//lib:lib"\'',
+      '  echo \'  "//app/cmd:cli" -> "//app:server"\'',
+      '  echo "}"',
+      '  exit 0;;',
+      '*--output=package*)',
+      '  printf "lib\\napp\\napp/cmd\\ntool\\n"',
+      '  exit 0;;',
+      'esac',
+      'echo //lib:lib',
+      'echo //app:server',
+      'echo //app/cmd:cli',
+      'exit 3',
+    ].join('\n'),
+  });
+  const bazel = path.join(checkoutPath, 'bin', 'bazel');
+  const queries = path.join(checkoutPath, 'bin', 'queries.txt');
+  fs.chmodSync(bazel, 0o755);
+  beforeEach(() => {
+    process.env.CUSTARD_BAZEL = bazel;
+    fs.rmSync(queries, {force: true});
+  });
+  afterEach(() => delete process.env.CUSTARD_BAZEL);
+  after(() => testing.cleanup(checkoutPath));
+
+  it('dependent targets', () => {
+    const diffs = ['lib/src/lib.go', 'lib/BUILD.bazel'];
+    const packages = custard.affectedDetailed(config, diffs, checkoutPath);
+    expect(packages).to.deep.equal([
+      {
+        path: 'app',
+        reasons: [
+          '//app:server depends on //lib',
+          '//app/cmd:cli depends on //lib',
+        ],
+      },
+      {
+        path: 'lib',
+        reasons: ['lib/src/lib.go changed', 'lib/BUILD.bazel changed'],
+      },
+    ]);
+    expect(fs.readFileSync(queries, 'utf8').split('\n')).to.deep.equal([
+      'query --keep_going --output=package kind(".*", //...)',
+      'query --keep_going --output=label kind(rule, rdeps(//..., set("//lib:src/lib.go" "//lib:all")))',
+      '',
+    ]);
+  });
+
+  it('affectedTargets', () => {
+    const diffs = ['app/main.go'];
+    expect(custard.affectedTargets(config, diffs, checkoutPath)).deep.equals([
+      '//app/cmd:cli',
+      '//app:server',
+      '//lib:lib',
+    ]);
+    expect(fs.readFileSync(queries, 'utf8')).to.contain(
+      'set("//app:main.go")',
+    );
+  });
+
+  it('dependencyEdges', () => {
+    const packages = ['app', 'lib', 'tool'];
+    const edges = custard.dependencyEdges(config, packages, checkoutPath);
+    expect(edges).to.deep.equal(new Map([['app', new Set(['lib'])]]));
+    expect(fs.readFileSync(queries, 'utf8')).equals(
+      'query --keep_going --output=graph --nograph:factored //...\n',
+    );
+  });
+});
+
+describe('archived packages', () => {
+  const config: custard.Config = {'package-file': 'package-file.txt'};
+  const checkoutPath = testing.materialize({
+    'global.txt': '',
+    'active/package-file.txt': '',
+    'archived/package-file.txt': '',
+    'archived/ci-setup.json': '{"archived": true}',
+    'eol/package-file.txt': '',
+    'eol/ci-setup.json': '{"eol-date": "2000-01-01"}',
+    'not-eol/package-file.txt': '',
+    'not-eol/ci-setup.json': '{"eol-date": "2999-01-01"}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('isArchived', () => {
+    const today = new Date('2025-06-01');
+    const isArchived = (dir: string) =>
+      custard.isArchived(config, dir, checkoutPath, today);
+    expect(isArchived('active')).to.equal(false);
+    expect(isArchived('archived')).to.equal(true);
+    expect(isArchived('eol')).to.equal(true);
+    expect(isArchived('not-eol')).to.equal(false);
+  });
+  it('skipped from global changes', () => {
+    const diffs = ['global.txt'];
+    const packages = custard.affected(config, diffs, checkoutPath);
+    expect(packages.sort()).to.deep.equals(['active', 'not-eol']);
+  });
+  it('skipped from direct changes', () => {
+    const diffs = ['archived/file.txt', 'active/file.txt'];
+    const packages = custard.affected(config, diffs, checkoutPath);
+    expect(packages).to.deep.equals(['active']);
+  });
+  it('explain', () => {
+    const diffs = ['global.txt'];
+    const explanation = custard.explain(config, diffs, checkoutPath);
+    expect(explanation.archived.sort()).to.deep.equals(['archived', 'eol']);
+  });
+  it('manifest', () => {
+    const diffs = ['archived/file.txt', 'active/file.txt'];
+    const manifest = custard.createManifest(config, diffs, checkoutPath);
+    expect(manifest.affected.map(pkg => pkg.path)).to.deep.equal(['active']);
+    expect(manifest.archived).to.deep.equal(['archived']);
+  });
+  it('invalid ci-setup files', () => {
+    const dir = testing.materialize({
+      'global.txt': '',
+      'active/package-file.txt': '',
+      'invalid/package-file.txt': '',
+      'invalid/ci-setup.json': '{"archived": "yes"}',
+    });
+    try {
+      const packages = custard.affected(config, ['global.txt'], dir);
+      expect(packages.sort()).to.deep.equals(['active', 'invalid']);
+      expect(() => custard.loadPackage(config, 'invalid', dir)).to.throw(
+        "'archived' must be boolean",
+      );
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+});
+
+describe('findAllPackages', () => {
+  const config: custard.Config = {
+    'package-file': ['package.json', 'go.mod', 'requirements.txt'],
+    'ci-setup-defaults': {env: {A: 'default'}},
+  };
+  const checkoutPath = testing.materialize({
+    'js/package.json': '{"name": "my-js", "version": "1.2.3"}',
+    'js/ci-setup.json': '{"env": {"B": "js"}}',
+    'go/go.mod': 'module example.com/my-go\n\ngo 1.24\n',
+    'py/requirements.txt': '',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('packages with metadata', () => {
+    const packages = [...custard.findAllPackages(config, '.', checkoutPath)];
+    packages.sort((a, b) => a.path.localeCompare(b.path));
+    expect(packages).to.deep.equals([
+      {
+        path: 'go',
+        packageFile: 'go.mod',
+        name: 'example.com/my-go',
+        ciSetup: {env: {A: 'default'}},
+      },
+      {
+        path: 'js',
+        packageFile: 'package.json',
+        name: 'my-js',
+        version: '1.2.3',
+        ciSetup: {env: {A: 'default', B: 'js'}},
+      },
+      {
+        path: 'py',
+        packageFile: 'requirements.txt',
+        ciSetup: {env: {A: 'default'}},
+      },
+    ]);
+  });
+  it('not a package', () => {
+    expect(() => custard.loadPackage(config, '.', checkoutPath)).to.throw(
+      'no package file found',
+    );
+  });
+});
+
+describe('affected', () => {
+  const config: custard.Config = {
+    'package-file': 'package-file.txt',
+    'exclude-packages': ['test/affected/excluded'],
+  };
+  it('affected one', () => {
+    const diffs = ['test/affected/valid-package/file.txt'];
+    expect(custard.affected(config, diffs, '.')).to.deep.equals([
+      'test/affected/valid-package',
+    ]);
+  });
+  it('affected all', () => {
+    const diffs = ['test/affected/no-package-file/file.txt'];
+    expect(custard.affected(config, diffs, '.')).to.deep.equals([
+      'test/affected/valid-package',
+      'test/affected/valid-package/subdir/subpackage',
+    ]);
+  });
+  it('affected all in a materialized checkout', () => {
+    const checkoutPath = testing.materialize({
+      'global.txt': '',
+      'a/package-file.txt': '',
+      'a/b/package-file.txt': '',
+      'test/affected/excluded/package-file.txt': '',
+    });
+    try {
+      const diffs = ['global.txt'];
+      expect(custard.affected(config, diffs, checkoutPath)).to.deep.equals([
+        'a',
+        'a/b',
+      ]);
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+  });
+  it('affected all within roots', () => {
+    const withRoots = {
+      ...config,
+      roots: [
+        'test/affected/no-package-file',
+        'test/affected/valid-package/subdir',
+      ],
+    };
+    const diffs = ['test/affected/no-package-file/file.txt'];
+    expect(custard.affected(withRoots, diffs, '.')).to.deep.equals([
+      'test/affected/valid-package/subdir/subpackage',
+    ]);
+  });
+});
+
+describe('max-affected', () => {
+  const checkoutPath = testing.materialize({
+    'a/package.json': '{}',
+    'b/package.json': '{}',
+    'c/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const diffs = ['a/x.js', 'b/x.js', 'c/x.js'];
+  const config = (action?: string): custard.Config => ({
+    'package-file': 'package.json',
+    'max-affected': 2,
+    'max-affected-action': action,
+  });
+
+  it('within the limit', () => {
+    const packages = custard.affected(config(), ['a/x.js'], checkoutPath);
+    expect(packages).to.deep.equal(['a']);
+  });
+
+  it('fail', () => {
+    const affected = () => custard.affected(config('fail'), diffs, checkoutPath);
+    expect(affected).to.throw(
+      "3 packages affected, more than the 'max-affected' limit of 2",
+    );
+  });
+
+  it('fail by default', () => {
+    expect(() => custard.affected(config(), diffs, checkoutPath)).to.throw(
+      "more than the 'max-affected' limit",
+    );
+  });
+
+  it('cap', () => {
+    const packages = custard.affected(config('cap'), diffs, checkoutPath);
+    expect(packages).to.deep.equal(['a', 'b']);
+  });
+
+  it('all packages marker', () => {
+    const packages = custard.affected(config('all'), diffs, checkoutPath);
+    expect(packages).to.deep.equal([custard.allPackages]);
+  });
+
+  it('expands the all packages marker', () => {
+    const packages = custard.affected(config('all'), diffs, checkoutPath);
+    expect(
+      custard.expandAllPackages(config('all'), packages, checkoutPath),
+    ).to.deep.equal(['a', 'b', 'c']);
+    expect(custard.expandAllPackages(config(), ['a'])).to.deep.equal(['a']);
+    expect(() =>
+      custard.loadPackage(config(), custard.allPackages, checkoutPath),
+    ).to.throw("'*' stands for all packages");
+  });
+
+  it('global changes', () => {
+    expect(() =>
+      custard.affected(config('fail'), ['global.txt'], checkoutPath),
+    ).to.throw("3 packages affected, more than the 'max-affected' limit");
+  });
+
+  it('validation', () => {
+    const invalid = {'max-affected': 1.5, 'max-affected-action': 'skip'};
+    expect(custard.validateConfig(invalid)).to.deep.equal([
+      "'max-affected-action' must be one of: fail, cap, all, got: \"skip\"",
+      "'max-affected' must be a positive integer, got: 1.5",
+    ]);
+  });
+});
+
+describe('removedPackages', () => {
+  const config: custard.Config = {
+    'package-file': [{all: ['package.json', 'Dockerfile']}],
+    roots: ['apps', 'libs'],
+    'exclude-packages': 'apps/excluded',
+  };
+  const checkoutPath = testing.materialize({
+    'apps/kept/package.json': '{}',
+    'apps/kept/Dockerfile': '',
+    'apps/partial/package.json': '{}',
+    'libs/x.txt': '',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('removed packages', () => {
+    const diffs = [
+      'apps/gone/package.json',
+      'apps/gone/Dockerfile',
+      'apps/gone/index.js',
+      'apps/partial/Dockerfile',
+      'apps/kept/package.json',
+      'apps/kept/index.js',
+      'apps/excluded/package.json',
+      'other/package.json',
+      'package.json',
+    ];
+    expect(custard.removedPackages(config, diffs, checkoutPath)).deep.equals([
+      'apps/gone',
+      'apps/partial',
+    ]);
+  });
+
+  it('not affected', () => {
+    const diffs = ['apps/gone/package.json', 'apps/kept/index.js'];
+    expect(custard.affected(config, diffs, checkoutPath)).deep.equals([
+      'apps/kept',
+    ]);
+  });
+});
+
+describe('readDiffs', () => {
+  const read = async (chunks: Array<string | Buffer>) => {
+    const diffs = [];
+    for await (const diff of custard.readDiffs(Readable.from(chunks))) {
+      diffs.push(diff);
+    }
+    return diffs;
+  };
+
+  it('newline separated', async () => {
+    const diffs = await read(['a/index.js\r\nb/in', 'dex.js\n\n', 'c.js']);
+    expect(diffs).to.deep.equal(['a/index.js', 'b/index.js', 'c.js']);
+  });
+
+  it('NUL separated', async () => {
+    const diffs = await read(['a/new\nline.js\0', 'b.js', '\0']);
+    expect(diffs).to.deep.equal(['a/new\nline.js', 'b.js']);
+  });
+
+  it('multibyte characters across chunks', async () => {
+    const bytes = Buffer.from('café/a.js\0b.js');
+    const chunks = [bytes.subarray(0, 4), bytes.subarray(4)];
+    expect(await read(chunks)).to.deep.equal(['café/a.js', 'b.js']);
+  });
+
+  it('splitDiffs', () => {
+    expect(custard.splitDiffs('a.js\nb.js\n')).to.deep.equal(['a.js', 'b.js']);
+    expect(custard.splitDiffs('a\nb.js\0c.js\0')).to.deep.equal([
+      'a\nb.js',
+      'c.js',
+    ]);
+    expect(custard.splitDiffs('')).to.deep.equal([]);
+  });
+
+  it('affectedFromReader', async () => {
+    const config = {'package-file': 'package-file.txt'};
+    const diffs = Readable.from([
+      'valid-package/file.txt\0',
+      'valid-package/subdir/subpackage/file.txt\0',
+    ]);
+    const packages = await custard.affectedFromReader(
+      config,
+      diffs,
+      'test/affected',
+    );
+    expect(packages).to.deep.equal([
+      'valid-package',
+      'valid-package/subdir/subpackage',
+    ]);
+  });
+});
+
+describe('affectedDetailed', () => {
+  const config: custard.Config = {
+    'package-file': 'package-file.txt',
+    'exclude-packages': ['test/affected/excluded'],
+  };
+  it('changed files', () => {
+    const diffs = [
+      'test/affected/valid-package/file.txt',
+      'test/affected/valid-package/path/to/file.txt',
+    ];
+    expect(custard.affectedDetailed(config, diffs, '.')).to.deep.equals([
+      {
+        path: 'test/affected/valid-package',
+        reasons: [
+          'test/affected/valid-package/file.txt changed',
+          'test/affected/valid-package/path/to/file.txt changed',
+        ],
+      },
+    ]);
+  });
+  it('global file changed', () => {
+    const diffs = [
+      'test/affected/no-package-file/file.txt',
+      'test/affected/valid-package/file.txt',
+    ];
+    expect(custard.affectedDetailed(config, diffs, '.')).to.deep.equals([
+      {
+        path: 'test/affected/valid-package',
+        reasons: [
+          'test/affected/valid-package/file.txt changed',
+          'global file test/affected/no-package-file/file.txt changed',
+        ],
+      },
+      {
+        path: 'test/affected/valid-package/subdir/subpackage',
+        reasons: ['global file test/affected/no-package-file/file.txt changed'],
+      },
+    ]);
+  });
+});
+
+describe('tags', () => {
+  const config: custard.Config = {
+    'package-file': 'package.json',
+    'ci-setup-scoped-defaults': {'gpu/*': {tags: ['gpu']}},
+  };
+  const checkoutPath = testing.materialize({
+    'gpu/train/package.json': '{}',
+    'gpu/slow/package.json': '{}',
+    'gpu/slow/ci-setup.json': '{"tags": ["gpu", "long-running"]}',
+    'web/package.json': '{}',
+    'web/ci-setup.json': '{"tags": "long-running"}',
+    'api/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  const diffs = [
+    'gpu/train/main.py',
+    'gpu/slow/main.py',
+    'web/index.html',
+    'api/main.go',
+  ];
+
+  it('packageTags', () => {
+    expect(custard.packageTags(config, 'gpu/slow', checkoutPath)).deep.equals(
+      ['gpu', 'long-running'],
+    );
+    expect(custard.packageTags(config, 'web', checkoutPath)).deep.equals([
+      'long-running',
+    ]);
+    expect(custard.packageTags(config, 'api', checkoutPath)).deep.equals([]);
+  });
+
+  it('affectedWithTag', () => {
+    expect(
+      custard.affectedWithTag(config, diffs, 'gpu', checkoutPath),
+    ).deep.equals(['gpu/slow', 'gpu/train']);
+  });
+
+  it('excludeTag', () => {
+    const packages = custard.affected(config, diffs, checkoutPath);
+    expect(
+      custard.excludeTag(config, packages, 'long-running', checkoutPath),
+    ).deep.equals(['api', 'gpu/train']);
+    expect(
+      custard.excludeTag(config, ['*'], 'long-running', checkoutPath),
+    ).deep.equals(['*']);
+  });
+
+  it('validation', () => {
+    expect(custard.validateCISetup(config, {tags: ['gpu', 1]})).deep.equals([
+      "'tags' must be string or string[], got: [\"gpu\",1]",
+    ]);
+  });
+});
+
+describe('groupPackages', () => {
+  const config: custard.Config = {
+    'package-file': ['package.json', 'go.mod'],
+    'ci-setup-scoped-defaults': {'apps/*': {tags: ['app']}},
+  };
+  const checkoutPath = testing.materialize({
+    'apps/web/package.json': '{}',
+    'apps/api/go.mod': 'module example.com/api',
+    'libs/ui/package.json': '{}',
+    'libs/ui/ci-setup.json': '{"tags": ["app", "shared"]}',
+    'tools/package.json': '{}',
+    CODEOWNERS: '/apps/ @org/apps\n/libs/ @org/libs @org/design\n',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const packages = ['apps/api', 'apps/web', 'libs/ui', 'tools'];
+  const group = (groupBy: string | custard.PackageGrouper, pkgs = packages) =>
+    custard.groupPackages(config, pkgs, groupBy, checkoutPath);
+
+  it('by directory', () => {
+    expect(group('directory')).to.deep.equal({
+      apps: ['apps/api', 'apps/web'],
+      libs: ['libs/ui'],
+      tools: ['tools'],
+    });
+  });
+
+  it('by preset', () => {
+    expect(group('preset')).to.deep.equal({
+      go: ['apps/api'],
+      node: ['apps/web', 'libs/ui', 'tools'],
+    });
+  });
+
+  it('by owner', () => {
+    expect(group('owner')).to.deep.equal({
+      '@org/apps': ['apps/api', 'apps/web'],
+      '@org/libs': ['libs/ui'],
+      '@org/design': ['libs/ui'],
+      '': ['tools'],
+    });
+  });
+
+  it('by tag', () => {
+    expect(group('tag')).to.deep.equal({
+      app: ['apps/api', 'apps/web', 'libs/ui'],
+      shared: ['libs/ui'],
+      '': ['tools'],
+    });
+  });
+
+  it('keeps the all packages marker', () => {
+    expect(group('tag', ['*'])).to.deep.equal({'*': ['*']});
+  });
+
+  it('by a custom grouper', () => {
+    const depth: custard.PackageGrouper = (_config, pkg) => [
+      `${pkg.split('/').length}`,
+    ];
+    expect(group(depth)).to.deep.equal({
+      '2': ['apps/api', 'apps/web', 'libs/ui'],
+      '1': ['tools'],
+    });
+  });
+
+  it('unknown group', () => {
+    expect(() => group('team')).to.throw(
+      "unknown group 'team', must be one of: directory, preset, owner, tag",
+    );
+  });
+});
+
+describe('findSites', () => {
+  const config: custard.Config = {
+    'package-file': 'package-file.txt',
+    'site-generators': ['mdbook', 'hugo', 'docusaurus'],
+  };
+  const checkoutPath = testing.materialize({
+    'book/book.toml': '[book]\nsrc = "../docs"\n',
+    'docs/intro.md': '',
+    'hugo-site/hugo.toml': 'contentDir = "pages"\n',
+    'hugo-site/pages/page.md': '',
+    'hugo-yaml/hugo.yaml': 'title: Site\ncontentDir: "articles" # posts\n',
+    'website/docusaurus.config.js': '',
+    'website/docs/intro.md': '',
+    'pkg/package-file.txt': '',
+    'global.txt': '',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('finds sites', () => {
+    const sites = custard.findSites(config, checkoutPath);
+    sites.sort((a, b) => a.path.localeCompare(b.path));
+    expect(sites).to.deep.equals([
+      {path: 'book', generator: 'mdbook', content: ['docs']},
+      {path: 'hugo-site', generator: 'hugo', content: ['hugo-site/pages']},
+      {path: 'hugo-yaml', generator: 'hugo', content: ['hugo-yaml/articles']},
+      {
+        path: 'website',
+        generator: 'docusaurus',
+        content: ['website/docs', 'website/blog'],
+      },
+    ]);
+  });
+  it('no site generators', () => {
+    const noSites = {'package-file': 'package-file.txt'};
+    expect(custard.findSites(noSites, checkoutPath)).to.deep.equals([]);
+  });
+  it('affected site content', () => {
+    const diffs = ['docs/intro.md', 'hugo-site/pages/page.md'];
+    const affected = custard.affected(config, diffs, checkoutPath);
+    expect(affected.sort()).to.deep.equals(['book', 'hugo-site']);
+  });
+  it('explain site content', () => {
+    const explanation = custard.explainDiff(
+      config,
+      'docs/intro.md',
+      checkoutPath,
+    );
+    expect(explanation.package).to.equal('book');
+    expect(explanation.reason).to.equal('site content');
+  });
+});
+
+describe('watch', () => {
+  const config: custard.Config = {'package-file': 'package-file.txt'};
+
+  it('reports affected packages on changes', async () => {
+    const checkoutPath = testing.materialize({
+      'a/package-file.txt': '',
+      'b/package-file.txt': '',
+    });
+    let stop = () => {};
+    try {
+      const reported = new Promise<string[][]>(resolve => {
+        stop = custard.watch(
+          config,
+          checkoutPath,
+          (packages, diffs) => resolve([packages, diffs]),
+          10,
+        );
+      });
+      // Give the watcher time to start before changing files.
+      await new Promise(resolve => setTimeout(resolve, 50));
+      fs.writeFileSync(path.join(checkoutPath, 'a', 'file.txt'), 'x');
+      fs.mkdirSync(path.join(checkoutPath, '.git'));
+      const [packages, diffs] = await reported;
+      expect(packages).to.deep.equals(['a']);
+      expect(diffs).to.deep.equals(['a/file.txt']);
+    } finally {
+      stop();
+      testing.cleanup(checkoutPath);
+    }
+  });
+});
+
+describe('watchConfig', () => {
+  it('reloads the config on changes', async () => {
+    const dir = testing.materialize({
+      'config.json': JSON.stringify({'package-file': 'package.json'}),
+    });
+    const configPath = path.join(dir, 'config.json');
+    const watcher = custard.watchConfig(configPath, '', 10);
+    try {
+      expect(watcher.config().ignore).equals(undefined);
+      const reloaded = new Promise<custard.Config>(resolve =>
+        watcher.subscribe(resolve),
+      );
+      // Give the watcher time to start before changing files.
+      await new Promise(resolve => setTimeout(resolve, 50));
+      fs.writeFileSync(
+        configPath,
+        JSON.stringify({'package-file': 'package.json', ignore: '*.md'}),
+      );
+      expect((await reloaded).ignore).equals('*.md');
+      expect(watcher.config().ignore).equals('*.md');
+    } finally {
+      watcher.close();
+      testing.cleanup(dir);
+    }
+  });
+
+  it('keeps the previous config if the new one is invalid', async () => {
+    const dir = testing.materialize({
+      'config.json': JSON.stringify({'package-file': 'package.json'}),
+    });
+    const configPath = path.join(dir, 'config.json');
+    const watcher = custard.watchConfig(configPath, '', 10);
+    try {
+      let notified = false;
+      watcher.subscribe(() => {
+        notified = true;
+      });
+      await new Promise(resolve => setTimeout(resolve, 50));
+      fs.writeFileSync(configPath, '{"package-file": 1}');
+      await new Promise(resolve => setTimeout(resolve, 100));
+      expect(notified).equals(false);
+      expect(watcher.config()['package-file']).equals('package.json');
+    } finally {
+      watcher.close();
+      testing.cleanup(dir);
+    }
+  });
+});
+
+describe('shard', () => {
+  const packages = ['a', 'b', 'c', 'd', 'e'];
+  it('round-robin', () => {
+    expect(custard.shard(packages, 2, 0)).to.deep.equals(['a', 'c', 'e']);
+    expect(custard.shard(packages, 2, 1)).to.deep.equals(['b', 'd']);
+  });
+  it('more shards than packages', () => {
+    expect(custard.shard(['a'], 3, 2)).to.deep.equals([]);
+  });
+  it('invalid shard', () => {
+    expect(() => custard.shard(packages, 0, 0)).to.throw(
+      'shard count must be at least 1',
+    );
+    expect(() => custard.shard(packages, 2, 2)).to.throw(
+      'shard index must be between 0 and 1',
+    );
+  });
+});
+
+describe('shardByTimings', () => {
+  const packages = ['a', 'b', 'c', 'd', 'e'];
+  it('balanced by timings', () => {
+    const timings = {a: 10, b: 1, c: 4, d: 5, e: 2};
+    expect(custard.shardByTimings(packages, 2, 0, timings)).to.deep.equals([
+      'a',
+      'b',
+    ]);
+    expect(custard.shardByTimings(packages, 2, 1, timings)).to.deep.equals([
+      'c',
+      'd',
+      'e',
+    ]);
+  });
+  it('missing timings use the average', () => {
+    const timings = {a: 6, b: 2};
+    expect(custard.shardByTimings(packages, 2, 0, timings)).to.deep.equals([
+      'a',
+      'e',
+    ]);
+    expect(custard.shardByTimings(packages, 2, 1, timings)).to.deep.equals([
+      'b',
+      'c',
+      'd',
+    ]);
+  });
+  it('package paths', () => {
+    const timings = {'./a/': 10, 'b\\c': 1, c: 4};
+    const paths = ['a', 'b/c/', './c'];
+    expect(custard.shardByTimings(paths, 2, 0, timings)).to.deep.equals([
+      'a',
+    ]);
+    expect(
+      custard.planBuilds(paths, 1, timings).map(wave => wave.packages),
+    ).to.deep.equal([['a'], ['./c'], ['b/c/']]);
+  });
+  it('load timings', () => {
+    const dir = testing.materialize({
+      'timings.json': '{"a": 1.5, "b": 2}',
+      'invalid.json': '{"a": "slow"}',
+    });
+    try {
+      const timingsFile = path.join(dir, 'timings.json');
+      expect(custard.loadTimings(timingsFile)).to.deep.equals({a: 1.5, b: 2});
+      expect(() =>
+        custard.loadTimings(path.join(dir, 'invalid.json')),
+      ).to.throw("timing for 'a' must be a non-negative number");
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+});
+
+describe('schedulingOrder', () => {
+  const checkoutPath = testing.materialize({
+    'docs/package.json': '{}',
+    'api/package.json': '{}',
+    'api/ci-setup.json': '{"estimated-duration": "5m"}',
+    'web/package.json': '{}',
+    'web/ci-setup.json': '{"estimated-duration": "1h"}',
+    'e2e/package.json': '{}',
+    'e2e/ci-setup.json': '{"priority": 10, "estimated-duration": "1m"}',
+    'lint/package.json': '{}',
+    'lint/ci-setup.json': '{"priority": -1}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const config: custard.Config = {'package-file': 'package.json'};
+
+  it('sorts by priority, then duration, then path', () => {
+    const packages = ['api', 'docs', 'e2e', 'lint', 'web'];
+    expect(
+      custard.schedulingOrder(config, packages, checkoutPath),
+    ).to.deep.equal(['e2e', 'web', 'api', 'docs', 'lint']);
+  });
+
+  it('keeps the all packages marker', () => {
+    expect(custard.schedulingOrder(config, ['*'], checkoutPath)).to.deep.equal(
+      ['*'],
+    );
+  });
+
+  it('priority affected order', () => {
+    const priority = {...config, 'affected-order': 'priority'};
+    const diffs = ['api/a.js', 'e2e/a.js', 'lint/a.js', 'web/a.js'];
+    expect(custard.affected(priority, diffs, checkoutPath)).to.deep.equal([
+      'e2e',
+      'web',
+      'api',
+      'lint',
+    ]);
+  });
+
+  it('validation', () => {
+    const ciSetup = {priority: 1.5, 'estimated-duration': 'soon'};
+    expect(custard.validateCISetup(config, ciSetup)).to.deep.equal([
+      "'priority' must be an integer, got: 1.5",
+      "'estimated-duration' must be a duration like 90s or 1h30m, got: \"soon\"",
+    ]);
+  });
+});
+
+describe('planBuilds', () => {
+  it('waves within the quota', () => {
+    expect(custard.planBuilds(['a', 'b', 'c', 'd', 'e'], 2)).to.deep.equal([
+      {id: 'wave-0', waitFor: [], packages: ['a', 'b']},
+      {id: 'wave-1', waitFor: ['wave-0'], packages: ['c', 'd']},
+      {id: 'wave-2', waitFor: ['wave-1'], packages: ['e']},
+    ]);
+  });
+  it('slowest packages first', () => {
+    const timings = {a: 1, b: 5, c: 3};
+    expect(custard.planBuilds(['a', 'b', 'c'], 2, timings)).to.deep.equal([
+      {id: 'wave-0', waitFor: [], packages: ['b', 'c']},
+      {id: 'wave-1', waitFor: ['wave-0'], packages: ['a']},
+    ]);
+  });
+  it('no packages', () => {
+    expect(custard.planBuilds([], 2)).to.deep.equal([]);
+  });
+  it('invalid quota', () => {
+    expect(() => custard.planBuilds(['a'], 0)).to.throw(
+      'max concurrent builds must be at least 1',
+    );
   });
 });
 
@@ -14,11 +14,67 @@
  limitations under the License.
  */
 
+import * as crypto from 'node:crypto';
 import * as fs from 'node:fs';
 import * as path from 'node:path';
-import {execSync} from 'node:child_process';
+import {execFileSync, execSync} from 'node:child_process';
+import {StringDecoder} from 'node:string_decoder';
+import {cloudBuildConfig} from './cloudbuild.ts';
+import {
+  affectedByOwner,
+  loadCodeowners,
+  ownersFor,
+  ownersSummary,
+} from './codeowners.ts';
+import type {CodeownersRule} from './codeowners.ts';
+import {envFormats, envMap, writeEnvFiles} from './envfiles.ts';
+import {execPackages, formatReport} from './exec.ts';
+import {
+  addExclusion,
+  exclusionsPath,
+  expiredExclusions,
+  parseExclusions,
+  removeExclusion,
+} from './exclusions.ts';
+import {federatedAffected, findConfigs} from './federation.ts';
+import {githubActions} from './github-actions.ts';
+import {githubClient} from './github.ts';
+import {affectedFromPatch, parseUnifiedDiff} from './hunks.ts';
+import {
+  affectedSubgraph,
+  formatGraph,
+  graphFormats,
+  packageGraph,
+} from './graph.ts';
+import {addStaleImages, imageInspectors, sourceDigest} from './images.ts';
+import {initWizard, proposeConfig, writeInitConfig} from './init.ts';
+import {affectedLockfiles} from './lockfiles.ts';
+import {
+  metricLabels,
+  openMetricsSink,
+  pushMetrics,
+  recordMetric,
+  recordStats,
+} from './metrics.ts';
+import {generatePipeline, pipelineGenerators} from './pipelines.ts';
+import {pullRequestFiles} from './pr-files.ts';
+import {reportFormats, setupErrorsReport} from './reports.ts';
+import {
+  fileConcurrency,
+  resilientFileSystem,
+  resilientOptions,
+} from './resilient-fs.ts';
+import {openResultsCache} from './results-cache.ts';
+import {loadQuotas, scheduleResources} from './scheduler.ts';
+import {webhookServer} from './server.ts';
+import {affectedSummary, summaryLinkBase} from './summary.ts';
+import {logStyles, message} from './log.ts';
+import {formatStats, timed, timedIter, withStatsAsync} from './stats.ts';
+import {gitCli, gitHistory, gitShow, vcsProvider} from './vcs.ts';
+import type {VCS} from './vcs.ts';
+import type {Exclusion} from './exclusions.ts';
 
-const version = 'v0.0.10'; // x-release-please-version
+export const version = 'v0.0.10'; // x-release-please-version
 
 export type CISetup = {
   // Environment variables to export.
@@ -27,6 +83,45 @@ export type CISetup = {
   // Secret Manager secrets to export.
   secrets?: {[k: string]: string};
 
+  // Archived packages are skipped, they are not affected by any changes.
+  archived?: boolean;
+
+  // End of life date (YYYY-MM-DD), the package is archived from this date.
+  'eol-date'?: string;
+
+  // Cloud Build config file for the package, relative to the package.
+  'cloud-build'?: string;
+
+  // Labels to route or skip packages in CI, like 'gpu' or 'long-running'.
+  tags?: string | string[];
+
+  // Maximum time the package's command can run, like '90s', '15m', or
+  // '1h30m'. The `exec` command stops it after that, see `parseDuration`.
+  timeout?: string;
+
+  // Container image the package publishes, labeled with its source digest
+  // to find stale images, see `addStaleImages`.
+  'published-image'?: string;
+
+  // Base image the published image is built from, like 'node:22-slim'.
+  // The published image is stale when the base image changes.
+  'base-image'?: string;
+
+  // Packages with a higher priority are scheduled first, defaults to 0.
+  priority?: number;
+
+  // How long the package usually takes, like '20m', so long-running
+  // packages are scheduled first, see `schedulingOrder`.
+  'estimated-duration'?: string;
+
+  // Changed lines that don't affect the package, like comments, when the
+  // diffs have line information, see `affectedFromPatch`.
+  'ignore-changes'?: LineRule[];
+
+  // Resources the package needs while it runs, to schedule the packages
+  // within the quotas of each region, see `scheduleResources`.
+  resources?: Resources;
+
   /* eslint-disable  @typescript-eslint/no-explicit-any */
   // Other fields can be here, but are not required.
   // They can be any type, the ci-setup files are validated
@@ -35,6 +130,350 @@ export type CISetup = {
   /* eslint-enable @typescript-eslint/no-explicit-any */
 };
 
+// Resources a package needs while it runs, see `scheduleResources`.
+export type Resources = {
+  // CPUs, like 2 or 0.5.
+  cpu?: number;
+
+  // Memory, like '512Mi' or '4Gi', see `parseMemory`.
+  memory?: string;
+
+  // GPUs.
+  gpu?: number;
+
+  // Regions the package can run in, like ['us-central1'], any by default.
+  regions?: string[];
+};
+
+// Changed lines that don't affect a package, see `affectedFromPatch`.
+export type LineRule = {
+  // Files the rule applies to, relative to the package, all by default.
+  files?: string | string[];
+
+  // Regular expression matching the lines that don't matter, like
+  // `^\\s*#` for comments.
+  lines?: string;
+
+  // Regular expressions matching the first line of a block that doesn't
+  // matter and the first line after it, like a `docs:` block in YAML.
+  between?: [string, string];
+};
+
+export type DiffExplanation = {
+  // The file that changed.
+  diff: string;
+
+  // The first 'match' pattern that matched the file, if any.
+  match: string | null;
+
+  // The 'ignore' pattern that ignored the file, if any.
+  // The last matching pattern wins, `!pattern` re-includes the file.
+  ignore: string | null;
+
+  // The package the file resolved to, '.' for global files.
+  package: string | null;
+
+  // Why the file resolved to the package, or why it was skipped.
+  // One of: no match pattern, ignored, outside roots, path does not exist,
+  // global file, site content, boundary, excluded package, archived package,
+  // package file found.
+  reason: string;
+};
+
+export type AffectedPackage = {
+  // Path to the package, relative to the checkout path.
+  path: string;
+
+  // Why the package is affected, like "path/to/file.txt changed".
+  reasons: string[];
+};
+
+export type WhyNot = {
+  // The package asked about.
+  package: string;
+
+  // Whether the package was affected.
+  selected: boolean;
+
+  // Why the package was or was not affected.
+  // One of: affected, path does not exist, not a package, excluded package,
+  // quarantined, outside roots, archived package, no changes in package,
+  // changes in a nested package, ignored, no match pattern.
+  reason: string;
+
+  // Exclusion from the 'exclusions-file' for quarantined packages, with
+  // why and until when.
+  exclusion?: Exclusion;
+
+  // How each diff inside the package directory resolved.
+  diffs: DiffExplanation[];
+};
+
+export type SetupSource = {
+  // Layer the value comes from.
+  // One of: defaults, scoped-defaults, defaults-file, inherited, package.
+  layer: string;
+
+  // File the value comes from, relative to the checkout path, or null for
+  // the config's 'ci-setup-defaults' and 'ci-setup-scoped-defaults'.
+  file: string | null;
+
+  // Pattern of the scoped defaults, if the value comes from them.
+  pattern?: string;
+};
+
+export type ResolvedCISetup = {
+  // The CI setup, like from `resolveCISetup`.
+  ciSetup: CISetup;
+
+  // Where each field comes from, by field, with an entry for each variable
+  // of `env` and `secrets`, like `env.NODE_ENV`.
+  sources: {[field: string]: SetupSource};
+};
+
+export type SetupError = {
+  // Path to the CI setup file.
+  path: string;
+
+  // Field with the error, or null if the whole file is invalid.
+  field: string | null;
+
+  // One of: parse-error, unknown-field, invalid-type, invalid-value,
+  // missing-field, policy from `withCISetupValidators`, or deprecated-field,
+  // which is only a warning.
+  kind: string;
+
+  // Human readable error message.
+  message: string;
+
+  // Line of the field in the file, starting at 1, or null if unknown.
+  line: number | null;
+
+  // Column of the field in the line, starting at 1, or null if unknown.
+  column: number | null;
+};
+
+// Checks a CI setup file, as written in the file, against an organization
+// policy, like requiring service accounts from the project. Returns the
+// violations, with the field they are about if any.
+export type CISetupValidator = (
+  setupPath: string,
+  ciSetup: CISetup,
+) => {field: string | null; message: string}[];
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+export type SetupRewrite = {
+  // One of: rename, set-default, delete.
+  action: string;
+
+  // Top-level ci-setup field to change.
+  field: string;
+
+  // New name of the field, for rename.
+  to?: string;
+
+  // Value for the files that don't set the field, for set-default.
+  value?: any;
+};
+/* eslint-enable @typescript-eslint/no-explicit-any */
+
+export const setupRewriteActions = ['rename', 'set-default', 'delete'];
+
+export type Manifest = {
+  // Manifest format version, incremented on incompatible changes.
+  'manifest-version': number;
+
+  // Custard version that created the manifest.
+  'custard-version': string;
+
+  // SHA-256 of the config, to detect a different config in later stages.
+  'config-hash': string;
+
+  // Files changed.
+  diffs: string[];
+
+  // Packages with changes in their own files, '.' for global files.
+  changed: string[];
+
+  // Affected packages with their reasons.
+  affected: AffectedPackage[];
+
+  // Packages removed by the diffs, to tear down what was deployed for them.
+  removed: string[];
+
+  // Archived packages the diffs would have affected otherwise, see
+  // `isArchived`. Manifests created before it was added have none.
+  archived: string[];
+
+  // Resolved CI setup of each affected package, including its defaults.
+  'ci-setup': {[pkg: string]: CISetup};
+};
+
+// Bump on incompatible changes to the manifest format.
+export const manifestVersion = 1;
+
+export type PackageIndex = {
+  // Package directories under a root, including archived ones.
+  packageDirs: (root: string) => string[];
+
+  // Writes the directories walked so far to the index file.
+  save: () => void;
+};
+
+// The entries of a package index file, by directory.
+type PackageIndexEntry = {
+  // Modification time, it changes when entries are added or removed.
+  mtime: number;
+
+  // Names of the subdirectories.
+  subdirs: string[];
+
+  // Whether the directory is a package.
+  package: boolean;
+};
+
+// Bump on incompatible changes to the package index format.
+const packageIndexVersion = 2;
+
+// The part of the file system used to find the packages and their ci-setup
+// files, so they can also be found in an in-memory file system or in an
+// archive, see `withFileSystem`. Node's `fs` module is one.
+export type FileSystem = {
+  existsSync: (filePath: string) => boolean;
+  readFileSync: (filePath: string, encoding: 'utf8') => string;
+  readdirSync: (dir: string, options: {withFileTypes: true}) => DirEntry[];
+  statSync: (
+    filePath: string,
+    options: {throwIfNoEntry: false},
+  ) => FileStat | undefined;
+  realpathSync: (filePath: string) => string;
+
+  // Reads a file without blocking, so files can be read concurrently.
+  // Without it, files are read with `readFileSync`, one at a time.
+  readFileAsync?: (filePath: string, signal?: AbortSignal) => Promise<string>;
+};
+
+// A directory entry, like `fs.Dirent`.
+export type DirEntry = {
+  name: string;
+  isFile: () => boolean;
+  isDirectory: () => boolean;
+  isSymbolicLink: () => boolean;
+};
+
+// File information, following symlinks, like `fs.Stats`.
+export type FileStat = {
+  isFile: () => boolean;
+  isDirectory: () => boolean;
+
+  // Modification time, to reuse directory listings until it changes.
+  mtimeMs?: number;
+};
+
+// Key of the file system to find the packages in, in a config object.
+// It's a symbol, so it's never part of the config files or their hash.
+const fileSystemKey = Symbol('file-system');
+
+// Key of the custom match engine, in a config object, see `withMatchEngine`.
+const matchEngineKey = Symbol('match-engine');
+
+// Key of the CI setup policies, in a config object, see
+// `withCISetupValidators`.
+const setupValidatorsKey = Symbol('ci-setup-validators');
+
+// Key of the exclusions from the 'exclusions-file', in a config object,
+// to tell quarantined packages apart from the ones in 'exclude-packages'.
+const exclusionsKey = Symbol('exclusions');
+
+// Key of the CI setup files already warned about their deprecated fields,
+// in a config object, see `withDeprecationWarnings`.
+const deprecationsWarnedKey = Symbol('deprecations-warned');
+
+export type Simulation = {
+  // Number of commits replayed.
+  commits: number;
+
+  // Average number of affected packages per commit.
+  averageAffected: number;
+
+  // Average fraction of all the packages affected per commit, from 0 to 1.
+  blastRadius: number;
+
+  // Largest number of affected packages in a single commit.
+  maxAffected: number;
+
+  // Number of commits that affected all packages.
+  allAffected: number;
+
+  // Number of commits that affected each package.
+  selections: {[pkg: string]: number};
+
+  // Packages affected by the most commits, most affected first.
+  mostAffected: string[];
+
+  // Packages that no commit affected.
+  neverSelected: string[];
+};
+
+export type StackedAffected = {
+  // Packages affected by all the changes, from the base to the head.
+  all: string[];
+
+  // Packages already affected by the changes below, from the base to the
+  // parent, like the pull requests lower in the stack.
+  below: string[];
+
+  // Packages affected by the changes from the parent to the head, even if
+  // they were affected below too, since the top changes modified them again.
+  added: string[];
+};
+
+export type ConfigDiff = {
+  // Packages found with the new config, but not with the old one.
+  included: string[];
+
+  // Packages found with the old config, but not with the new one.
+  excluded: string[];
+
+  // Packages found with both configs whose resolved CI setup changed.
+  changed: string[];
+
+  // Fields of 'ci-setup-defaults' that changed, by their dotted path.
+  defaults: DefaultsChange[];
+};
+
+export type DefaultsChange = {
+  // Dotted path of the field, like 'deploy.region'.
+  field: string;
+
+  /* eslint-disable @typescript-eslint/no-explicit-any */
+  // Value with the old config, undefined if the field was added.
+  before: any;
+
+  // Value with the new config, undefined if the field was removed.
+  after: any;
+  /* eslint-enable @typescript-eslint/no-explicit-any */
+};
+
+export type Explanation = {
+  // How each diff resolved to a package.
+  diffs: DiffExplanation[];
+
+  // Packages skipped because of 'exclude-packages'.
+  excluded: string[];
+
+  // Packages skipped because they are archived.
+  archived: string[];
+
+  // The resulting affected packages.
+  affected: string[];
+};
+
+// Resolves the value of a secret. The secret path is the value defined in
+// the ci-setup file or defaults, and the name is the variable the secret is
+// exported as.
+export type SecretResolver = (secretPath: string, name: string) => string;
+
 export type Command = {
   // Run before the main command, at the repo root.
   pre?: string | string[];
@@ -46,9 +485,51 @@ export type Command = {
   post?: string | string[];
 };
 
+// Files that define a package: a single file, or a group of files.
+// A list or an `any` group matches if any of its files exist,
+// an `all` group matches only if all of its files exist.
+// Groups can be nested, like [{all: ['package.json', 'Dockerfile']}, 'go.mod'].
+export type PackageFile =
+  | string
+  | PackageFile[]
+  | {any: PackageFile[]}
+  | {all: PackageFile[]};
+
 export type Config = {
+  // File system to find the packages in, the OS file system by default,
+  // see `withFileSystem`.
+  [fileSystemKey]?: FileSystem;
+
+  // Match engine to use instead of the 'match-engine', see `withMatchEngine`.
+  [matchEngineKey]?: MatchEngine;
+
+  // CI setup policies by name, see `withCISetupValidators`.
+  [setupValidatorsKey]?: {[name: string]: CISetupValidator};
+
+  // Exclusions merged from the 'exclusions-file', see `withExclusionsFile`.
+  [exclusionsKey]?: Exclusion[];
+
+  // CI setup files already warned about their deprecated fields, only set
+  // by the command line, see `withDeprecationWarnings`.
+  [deprecationsWarnedKey]?: Set<string>;
+
+  // Version of the config schema the config was written for, to keep
+  // its behavior when defaults change, see `migrateConfig`.
+  // Configs without a version were written for version 1.
+  'schema-version'?: number;
+
   // Filename to look for the root of a package.
-  'package-file'?: string | string[];
+  'package-file'?: PackageFile;
+
+  // Discovery presets for common languages, like ["go", "python"].
+  // Each one adds its package files, match, and ignore patterns before the
+  // config's own, see `configPresets`.
+  presets?: string | string[];
+
+  // File categories that affect packages, like ["source", "build"],
+  // instead of every file the presets match, see `matchCategories`.
+  // Without presets, the categories of every preset are used.
+  'match-categories'?: string | string[];
 
   // CI setup file, must be located in the same directory as the package file.
   'ci-setup-filename'?: string | string[];
@@ -56,20 +537,430 @@ export type Config = {
   // CI setup defaults, used when no setup file or field is not sepcified in file.
   'ci-setup-defaults'?: CISetup;
 
+  // CI setup defaults for packages matching a path pattern.
+  // They override the global defaults, and the ci-setup file overrides them.
+  'ci-setup-scoped-defaults'?: {[pattern: string]: CISetup};
+
+  // CI setup defaults files, for all packages under their directory.
+  // They override the scoped defaults, from the outermost directory to the
+  // innermost one, and the ci-setup file overrides them.
+  'ci-setup-defaults-filename'?: string | string[];
+
+  // Also apply the ci-setup files of the directories above a package, from
+  // the outermost directory to the innermost one, defaults to false.
+  'ci-setup-inherit'?: boolean;
+
   // CI setup help URL, shown when a setup file validation fails.
   'ci-setup-help-url'?: string;
 
+  // Fields that every ci-setup file must set, like 'deploy.region'.
+  // Nested fields are only required if their parent is set, and fields
+  // in arrays of objects are required in every element.
+  'ci-setup-required'?: string | string[];
+
+  // Deprecated ci-setup fields, with what to use instead, like
+  // {"old-field": "use new-field instead"}.
+  // They are still valid, but packages using them get a warning.
+  'ci-setup-deprecated'?: {[field: string]: string};
+
   // Pattern to match filenames or directories.
   match?: string | string[];
 
   // Pattern to ignore filenames or directories.
+  // Patterns starting with `!` re-include previously ignored files.
   ignore?: string | string[];
 
+  // How 'match' and 'ignore' patterns are matched against paths.
+  // One of: simple (default), gitignore, or regexp, see `matchEngines`.
+  'match-engine'?: string;
+
+  // Whether paths match patterns regardless of their case, for diffs from
+  // case-insensitive file systems like macOS.
+  'case-insensitive'?: boolean;
+
+  // Whether paths and patterns are compared in Unicode NFC form, so
+  // decomposed accents like the ones macOS uses still match.
+  'normalize-unicode'?: boolean;
+
+  // File with match and ignore patterns in gitignore syntax,
+  // relative to the config file, merged into 'match' and 'ignore'.
+  'match-file'?: string;
+
   // Commands like `custard run <config-file> <command> [args]...`
   commands?: {[k: string]: Command};
 
   // Packages to always exclude.
   'exclude-packages'?: string | string[];
+
+  // File with excluded packages, with the reason and expiry date of each
+  // one, relative to the config file, merged into 'exclude-packages'.
+  // See `addExclusion`.
+  'exclusions-file'?: string;
+
+  // Also exclude everything beneath the excluded packages, defaults to false.
+  'exclude-subpackages'?: boolean;
+
+  // What nested package directories are, like a package.json inside a
+  // package. One of: separate (default) packages, or part of their
+  // outermost parent package, so the search stops at the first package.
+  'nested-packages'?: string;
+
+  // Directories to look for packages, relative to the checkout path.
+  roots?: string | string[];
+
+  // Directories where the search for a package stops, like team folders.
+  // Files inside a boundary but outside any package affect all the
+  // packages in the boundary instead of being global changes.
+  boundaries?: string | string[];
+
+  // Directories where the search for packages doesn't descend, in gitignore
+  // syntax, like `node_modules` for all the node_modules directories.
+  prune?: string | string[];
+
+  // Also prune the directories ignored by 'ignore' and the `.custardignore`
+  // files, defaults to false.
+  'prune-ignored'?: boolean;
+
+  // Also honor the repository's `.gitignore` files, so ignored files are
+  // never changes and ignored directories are never searched for packages,
+  // defaults to false.
+  'respect-gitignore'?: boolean;
+
+  // Maximum directory depth to look for packages, relative to the checkout
+  // path, so 2 finds `a/b` but not `a/b/c`.
+  'max-depth'?: number;
+
+  // Package managers to find the packages that depend on changed packages.
+  // One or more of: go, npm.
+  dependencies?: string | string[];
+
+  // Static site generators to detect documentation sites as packages.
+  // One or more of: mdbook, hugo, docusaurus.
+  'site-generators'?: string | string[];
+
+  // Maximum number of affected packages, to protect CI from accidentally
+  // rebuilding everything.
+  'max-affected'?: number;
+
+  // What to do when more than 'max-affected' packages are affected.
+  // One of: fail (default), cap to the first packages, or all to return
+  // the all packages marker instead.
+  'max-affected-action'?: string;
+
+  // Order of the affected packages.
+  // One of: path (default), topological so each package comes after the
+  // packages it depends on, found with 'dependencies', or priority so the
+  // packages to start first come first, see `schedulingOrder`.
+  'affected-order'?: string;
+
+  // What to do with symlinked directories when looking for packages.
+  // One of: skip (default), follow them with cycle detection, or error.
+  symlinks?: string;
+
+  // File to persist the package directories, relative to the checkout path.
+  // Later runs only re-read the directories that changed since then.
+  'package-index'?: string;
+
+  // Named overrides, like 'presubmit' or 'nightly', selected with the
+  // CUSTARD_PROFILE environment variable. A profile replaces the fields it
+  // defines, mappings like 'ci-setup-defaults' are merged by key.
+  profiles?: {[name: string]: Config};
+};
+
+// Marker returned instead of the affected packages when there are more than
+// 'max-affected' and the 'max-affected-action' is 'all'.
+export const allPackages = '*';
+
+const maxAffectedActions = ['fail', 'cap', 'all'];
+
+const affectedOrders = ['path', 'topological', 'priority'];
+
+// Files with ignore patterns for their directory, in gitignore syntax.
+const ignoreFilename = '.custardignore';
+
+// Git's ignore files, honored with the config 'respect-gitignore'.
+const gitignoreFilename = '.gitignore';
+
+// Fetches the contents of a config URL. Configs are loaded synchronously,
+// so fetchers must be synchronous too.
+export type ConfigFetcher = (url: string) => string;
+
+// Fetchers for config URLs, by protocol. To support other protocols, or to
+// authenticate, pass a copy with more fetchers to `loadConfig`.
+export const configFetchers: {[protocol: string]: ConfigFetcher} = {
+  // Plain HTTP, and redirects to it, would let anyone on the network
+  // rewrite the config.
+  'https:': url =>
+    execFileSync(
+      'curl',
+      [
+        ...['--fail', '--silent', '--show-error', '-L'],
+        ...['--proto', '=https', '--proto-redir', '=https'],
+        url,
+      ],
+      {encoding: 'utf8'},
+    ),
+  'gs:': url =>
+    execFileSync('gcloud', ['storage', 'cat', url], {encoding: 'utf8'}),
+};
+
+// Current config schema version, incremented when a field is renamed or
+// its default behavior changes, with a migration in `configMigrations`.
+export const configSchemaVersion = 2;
+
+// Upgrades a config to the next schema version, by the version it
+// upgrades from. It returns a description of each change.
+const configMigrations: {[version: number]: (config: Config) => string[]} = {
+  1: migrateConfigV1,
+};
+
+// Values used for the config fields that are not set.
+const configDefaults: Config = {
+  'ci-setup-filename': ['ci-setup.jsonc', 'ci-setup.json'],
+  'ci-setup-defaults-filename': [
+    'ci-setup-defaults.jsonc',
+    'ci-setup-defaults.json',
+  ],
+  'ci-setup-inherit': false,
+  match: ['*'],
+  'match-engine': 'simple',
+  'case-insensitive': false,
+  'normalize-unicode': false,
+  roots: ['.'],
+  'exclude-subpackages': false,
+  'nested-packages': 'separate',
+  'prune-ignored': false,
+  'respect-gitignore': false,
+  'max-affected-action': 'fail',
+  'affected-order': 'path',
+  symlinks: 'skip',
+};
+
+const symlinkPolicies = ['skip', 'follow', 'error'];
+
+const nestedPackagesModes = ['separate', 'parent'];
+
+export type Package = {
+  // Path to the package, relative to the checkout path.
+  path: string;
+
+  // The package file found in the package directory.
+  packageFile: string;
+
+  // Package name, if it can be read from the package file.
+  name?: string;
+
+  // Package version, if it can be read from the package file.
+  version?: string;
+
+  // CI setup with all the defaults applied.
+  ciSetup: CISetup;
+};
+
+export type Site = {
+  // Path to the site directory, relative to the checkout path.
+  path: string;
+
+  // Static site generator that builds the site.
+  generator: string;
+
+  // Content directories, relative to the checkout path.
+  content: string[];
+};
+
+// Files that every preset matches, since they change how packages build.
+const presetCommonMatch = [
+  'Dockerfile',
+  '.dockerignore',
+  '*.yaml',
+  '*.yml',
+  'ci-setup.jsonc',
+  'ci-setup.json',
+];
+
+// Discovery presets for the 'presets' config field, by name.
+// To add a preset, add it here before loading the config.
+export const configPresets: {[name: string]: Config} = {
+  node: {
+    'package-file': ['package.json'],
+    match: [
+      ...presetCommonMatch,
+      '*.js',
+      '*.mjs',
+      '*.cjs',
+      '*.jsx',
+      '*.ts',
+      '*.mts',
+      '*.cts',
+      '*.tsx',
+      '*.json',
+      '*.css',
+      '*.html',
+      '.npmrc',
+      '.nvmrc',
+    ],
+    ignore: ['node_modules/**', 'dist/**', 'coverage/**'],
+  },
+  go: {
+    'package-file': ['go.mod'],
+    match: [...presetCommonMatch, '*.go', 'go.mod', 'go.sum', 'testdata/**'],
+  },
+  python: {
+    'package-file': ['requirements.txt', 'pyproject.toml', 'setup.py'],
+    match: [
+      ...presetCommonMatch,
+      '*.py',
+      '*.pyi',
+      'requirements*.txt',
+      'constraints*.txt',
+      'pyproject.toml',
+      'setup.py',
+      'setup.cfg',
+      '*.ini',
+      'Pipfile',
+      'Pipfile.lock',
+      'poetry.lock',
+      'uv.lock',
+    ],
+    ignore: ['__pycache__/**', '.venv/**', '*.pyc'],
+  },
+  java: {
+    'package-file': ['pom.xml', 'build.gradle', 'build.gradle.kts'],
+    match: [
+      ...presetCommonMatch,
+      '*.java',
+      '*.kt',
+      '*.kts',
+      '*.gradle',
+      '*.xml',
+      '*.properties',
+      'resources/**',
+      'gradle/**',
+      'gradlew',
+      'mvnw',
+    ],
+    ignore: ['target/**', 'build/**', '.gradle/**'],
+  },
+  dotnet: {
+    'package-file': ['*.csproj', '*.fsproj', '*.vbproj'],
+    match: [
+      ...presetCommonMatch,
+      '*.cs',
+      '*.fs',
+      '*.vb',
+      '*.csproj',
+      '*.fsproj',
+      '*.vbproj',
+      '*.props',
+      '*.targets',
+      '*.sln',
+      'appsettings*.json',
+      'global.json',
+      'packages.lock.json',
+      'nuget.config',
+    ],
+    ignore: ['bin/**', 'obj/**'],
+  },
+  terraform: {
+    'package-file': ['*.tf'],
+    match: [...presetCommonMatch, '*.tf', '*.tfvars', '*.tftpl', '*.hcl'],
+    ignore: ['.terraform/**'],
+  },
+};
+
+// Files of each category that every preset has.
+const commonCategories: {[category: string]: string[]} = {
+  build: ['Dockerfile', '.dockerignore'],
+  config: ['*.yaml', '*.yml', 'ci-setup.jsonc', 'ci-setup.json'],
+  docs: ['*.md', '*.rst', 'docs/**'],
+};
+
+// Match patterns of each file category for the 'match-categories' config
+// field, by preset name, so configs can match kinds of files instead of
+// listing their extensions.
+export const matchCategories: Readonly<{
+  [preset: string]: {[category: string]: string[]};
+}> = {
+  node: {
+    ...commonCategories,
+    source: ['*.js', '*.mjs', '*.cjs', '*.jsx', '*.ts', '*.mts', '*.cts'],
+    build: [
+      ...commonCategories.build,
+      'package.json',
+      'package-lock.json',
+      '.npmrc',
+      '.nvmrc',
+    ],
+    config: [...commonCategories.config, 'tsconfig*.json', '.eslintrc*'],
+    assets: ['*.css', '*.html', '*.svg', 'public/**'],
+  },
+  go: {
+    ...commonCategories,
+    source: ['*.go'],
+    build: [...commonCategories.build, 'go.mod', 'go.sum'],
+    assets: ['testdata/**'],
+  },
+  python: {
+    ...commonCategories,
+    source: ['*.py', '*.pyi'],
+    build: [
+      ...commonCategories.build,
+      'requirements*.txt',
+      'constraints*.txt',
+      'pyproject.toml',
+      'setup.py',
+      'Pipfile',
+      'Pipfile.lock',
+      'poetry.lock',
+      'uv.lock',
+    ],
+    config: [...commonCategories.config, 'setup.cfg', '*.ini'],
+  },
+  java: {
+    ...commonCategories,
+    source: ['*.java', '*.kt'],
+    build: [
+      ...commonCategories.build,
+      'pom.xml',
+      '*.gradle',
+      '*.kts',
+      'gradle/**',
+      'gradlew',
+      'mvnw',
+    ],
+    config: [...commonCategories.config, '*.properties', '*.xml'],
+    assets: ['resources/**'],
+  },
+  dotnet: {
+    ...commonCategories,
+    source: ['*.cs', '*.fs', '*.vb'],
+    build: [
+      ...commonCategories.build,
+      '*.csproj',
+      '*.fsproj',
+      '*.vbproj',
+      '*.props',
+      '*.targets',
+      '*.sln',
+      'global.json',
+      'packages.lock.json',
+      'nuget.config',
+    ],
+    config: [...commonCategories.config, 'appsettings*.json'],
+  },
+  terraform: {
+    ...commonCategories,
+    source: ['*.tf', '*.tftpl'],
+    build: [...commonCategories.build, '.terraform.lock.hcl'],
+    config: [...commonCategories.config, '*.tfvars', '*.hcl'],
+  },
+};
+
+// Files that define a documentation site for each static site generator.
+const siteGeneratorFiles: {[generator: string]: string[]} = {
+  mdbook: ['book.toml'],
+  hugo: ['hugo.toml', 'hugo.json', 'hugo.yaml'],
+  docusaurus: ['docusaurus.config.js', 'docusaurus.config.ts'],
 };
 
 /**
@@ -81,17 +972,25 @@ function usage(flags: string): string {
 }
 
 switch (process.env.CUSTARD_VERBOSE || 'info') {
+  case 'trace':
+    // Traces go to stderr without a stack trace, stdout is for results.
+    console.trace = console.error;
+    break;
   case 'debug':
+    console.trace = () => {};
     break;
   case 'info':
+    console.trace = () => {};
     console.debug = () => {};
     break;
   case 'warn':
+    console.trace = () => {};
     console.debug = () => {};
     console.info = () => {};
     console.log = () => {};
     break;
   case 'error':
+    console.trace = () => {};
     console.debug = () => {};
     console.info = () => {};
     console.log = () => {};
@@ -102,12 +1001,25 @@ switch (process.env.CUSTARD_VERBOSE || 'info') {
       'Unknown CUSTARD_VERBOSE value:',
       process.env.CUSTARD_VERBOSE,
     );
-    console.error('If set, it must be one of: debug, info, warn, error');
+    console.error(
+      'If set, it must be one of: trace, debug, info, warn, error',
+    );
     /* eslint-disable n/no-process-exit */
     process.exit(1);
   /* eslint-enable n/no-process-exit */
 }
 
+if (!logStyles.includes(process.env.CUSTARD_LOG_STYLE || 'emoji')) {
+  console.error(
+    'Unknown CUSTARD_LOG_STYLE value:',
+    process.env.CUSTARD_LOG_STYLE,
+  );
+  console.error(`If set, it must be one of: ${logStyles.join(', ')}`);
+  /* eslint-disable n/no-process-exit */
+  process.exit(1);
+  /* eslint-enable n/no-process-exit */
+}
+
 /**
  * Finds the packages that have been affected from diffs.
  *
@@ -121,767 +1033,8102 @@ switch (process.env.CUSTARD_VERBOSE || 'info') {
  *
  * @param config config object
  * @param diffs list of files changed
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the search, checked on every diff and
+ *   directory; the search is synchronous, so it must be aborted before the
+ *   call or from a callback, like a custom file system
  * @returns list of affected packages
  */
 export function affected(
   config: Config,
   diffs: string[],
   checkoutPath: string,
+  signal?: AbortSignal,
 ): string[] {
-  const packages = matchPackages(config, diffs, checkoutPath);
-  if (packages.includes('.')) {
-    console.error(
-      '⚠️ One or more global files changed, all packages affected.',
-    );
-    return [...findPackages(config, checkoutPath)];
-  }
-  return packages;
-}
-
-export function matches(fullPath: string, patterns: string[]): boolean {
-  const filename = path.basename(fullPath);
-  for (const pattern of patterns) {
-    // 1) Exact full match
-    if (pattern === fullPath) {
-      return true;
-    }
-    // 2) Exact filename match
-    if (pattern === filename) {
-      return true;
-    }
-    // 3) Glob pattern match
-    //    Node does not support glob patterns as part of the standard library,
-    //    so to avoid third-party dependencies we convert them to a regex.
-    const glob = pattern
-      .split(/(\*\*|\*|\.)/)
-      .map(token => ({'**': '.*', '*': '[^/]*', '.': '\\.'})[token] ?? token)
-      .join('');
-    if (new RegExp(`(^|/)${glob}$`).test(fullPath)) {
-      return true;
-    }
-
-    // 4) Regular expression match
-    if (new RegExp(`(^|/)${pattern}$`).test(fullPath)) {
-      return true;
-    }
-  }
-  return false;
+  return affectedDetailed(config, diffs, checkoutPath, signal).map(
+    pkg => pkg.path,
+  );
 }
 
-export function fileMatchesConfig(config: Config, filepath: string): boolean {
-  const match = asArray(config.match) || ['*'];
-  const ignore = asArray(config.ignore) || [];
-  return matches(filepath, match) && !matches(filepath, ignore);
+/**
+ * Finds the packages that have been affected from diffs, and why.
+ *
+ * Same as `affected`, but each package includes the reasons it's affected.
+ *
+ * @param config config object
+ * @param diffs list of files changed
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the search, checked on every diff and
+ *   directory; the search is synchronous, so it must be aborted before the
+ *   call or from a callback, like a custom file system
+ * @returns list of affected packages with their reasons
+ */
+export function affectedDetailed(
+  config: Config,
+  diffs: string[],
+  checkoutPath: string,
+  signal?: AbortSignal,
+): AffectedPackage[] {
+  const packageDiffs = timed('match', () =>
+    matchPackageDiffs(config, diffs, checkoutPath, signal),
+  );
+  return affectedFromPackageDiffs(config, packageDiffs, checkoutPath, signal);
 }
 
-export function matchPackages(
+/**
+ * Finds the packages that have been affected from diffs read from a stream,
+ * like stdin.
+ *
+ * Same as `affected`, but each diff is matched as it arrives, so a huge
+ * list of diffs is never loaded in memory at once.
+ * See `readDiffs` for the diff list format.
+ *
+ * @param config config object
+ * @param input stream of diffs, like `process.stdin`
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the search, like `AbortSignal.timeout(ms)`
+ * @returns list of affected packages
+ */
+export async function affectedFromReader(
   config: Config,
-  paths: string[],
+  input: AsyncIterable<string | Buffer>,
   checkoutPath: string,
-): string[] {
-  const packages = new Set<string>();
-  for (const filepath of paths) {
-    if (!fileMatchesConfig(config, filepath)) {
-      // The file doesn't match the config file, so skip it.
-      continue;
-    }
-    const pkg = getPackageDir(config, filepath, checkoutPath);
-    if (pkg === null) {
-      // The package directory does not exist, it might have been removed.
-      // We can't run anything on it, so skip it.
-      console.error(
-        `⚠️ path '${pkg}' does not exist, it might have been removed.`,
-      );
-      continue;
-    }
-    if (pkg === '.') {
-      // Warn which file was considered a global change for debugging.
-      console.error(`⚠️ Global file changed: ${pkg}`);
-    }
-    packages.add(pkg);
+  signal?: AbortSignal,
+): Promise<string[]> {
+  const packageDiffs = new Map<string, string[]>();
+  const sites = findSites(config, checkoutPath);
+  for await (const filepath of readDiffs(input)) {
+    signal?.throwIfAborted();
+    addPackageDiff(config, filepath, checkoutPath, sites, packageDiffs);
   }
-
-  // Return all the affected packages, removing any excluded ones.
-  // Excluded packages must be exact full matches.
-  const excluded = asArray(config['exclude-packages']) || [];
-  return [...packages].filter(pkg => !excluded.includes(pkg));
+  withoutExcluded(config, packageDiffs);
+  return affectedFromPackageDiffs(
+    config,
+    packageDiffs,
+    checkoutPath,
+    signal,
+  ).map(pkg => pkg.path);
 }
 
-export function* findPackages(config: Config, root: string): Generator<string> {
-  const excluded = asArray(config['exclude-packages']) || [];
-  const files = fs.readdirSync(root, {withFileTypes: true});
-  for (const file of files) {
-    const fullPath = path.join(root, file.name);
-    if (file.isDirectory()) {
-      if (isPackageDir(config, fullPath) && !excluded.includes(fullPath)) {
-        yield path.relative(root, fullPath);
-      }
-      yield* findPackages(config, fullPath);
+/**
+ * Reads the diffs from a stream, one at a time.
+ *
+ * Diffs are separated by newlines, like `git diff --name-only`,
+ * or by NUL characters, like `git diff --name-only -z`, if the input
+ * has any. NUL separated paths can contain newlines.
+ * Empty entries are skipped.
+ *
+ * @param input stream of diffs, like `process.stdin`
+ * @returns generator of diff paths
+ */
+export async function* readDiffs(
+  input: AsyncIterable<string | Buffer>,
+): AsyncGenerator<string> {
+  const decoder = new StringDecoder('utf8');
+  let separator: string | undefined;
+  let pending = '';
+  for await (const chunk of input) {
+    pending += typeof chunk === 'string' ? chunk : decoder.write(chunk);
+    separator ??= diffsSeparator(pending, false);
+    if (separator === undefined) {
+      continue;
     }
+    const diffs = pending.split(separator);
+    pending = diffs.pop() || '';
+    yield* cleanDiffs(diffs, separator);
   }
+  pending += decoder.end();
+  separator ??= diffsSeparator(pending, true);
+  yield* cleanDiffs(pending.split(separator), separator);
 }
 
-export function getPackageDir(
-  config: Config,
-  filepath: string,
-  checkoutPath: string,
-): string | null {
-  const dir = path.dirname(filepath);
-  if (!fs.existsSync(path.join(checkoutPath, dir))) {
-    return null;
-  }
-  if (dir === '.' || isPackageDir(config, dir)) {
-    return dir;
-  }
-  return getPackageDir(config, dir, checkoutPath);
+// Maximum length of a path on Linux, PATH_MAX.
+const maxPathLength = 4096;
+
+/**
+ * Splits a list of diffs, separated by newlines or NUL characters.
+ *
+ * Same as `readDiffs`, for diffs already in memory, like a file.
+ *
+ * @param text list of diffs
+ * @returns diff paths
+ */
+export function splitDiffs(text: string): string[] {
+  const separator = diffsSeparator(text, true);
+  return cleanDiffs(text.split(separator), separator);
 }
 
-export function isPackageDir(config: Config, dir: string): boolean {
-  for (const pkgFile of asArray(config['package-file']) ?? []) {
-    if (fs.existsSync(path.join(dir, pkgFile))) {
-      return true;
-    }
+/**
+ * Finds the separator of a list of diffs.
+ *
+ * Paths are at most 4096 bytes, so a NUL separated list has a NUL
+ * within its first 4096 characters, even if the first path has newlines.
+ *
+ * @param text start of the list of diffs
+ * @param complete whether the text is the whole list
+ * @returns separator, or undefined if it can't be known yet
+ */
+function diffsSeparator(text: string, complete: boolean): string | undefined {
+  if (text.includes('\0')) {
+    return '\0';
   }
-  return false;
+  return complete || text.length > maxPathLength ? '\n' : undefined;
 }
 
 /**
- * Run a command defined in the config file.
+ * Removes the empty diffs, and the carriage returns of newline separated
+ * diffs, which come from files written on Windows.
  *
- * Defines the environment variables and secrets, runs the command,
- * and then cleans up the environment to its previous state.
+ * @param diffs diff paths
+ * @param separator separator of the diffs
+ * @returns diff paths
+ */
+function cleanDiffs(diffs: string[], separator: string): string[] {
+  return diffs
+    .map(diff => (separator === '\n' ? diff.replace(/\r$/, '') : diff))
+    .filter(diff => diff !== '');
+}
+
+/**
+ * Finds the affected packages from the diffs already matched to their
+ * packages, and why.
  *
  * @param config config object
- * @param cmd command to run
- * @param paths paths to the packages
- * @param env environment variables
+ * @param packageDiffs mapping of each package to its diffs, '.' for global
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the search, checked on every diff and
+ *   directory; the search is synchronous, so it must be aborted before the
+ *   call or from a callback, like a custom file system
+ * @returns list of affected packages with their reasons
  */
-export function run(
+export function affectedFromPackageDiffs(
   config: Config,
-  cmd: Command,
-  paths: string[],
-  env = process.env,
-) {
-  if (cmd.pre) {
-    const steps = asArray(cmd.pre) || [];
-    for (const step of steps) {
-      console.warn(`\n➜ [root]$ ${step}`);
-      const start = Date.now();
-      execSync(step, {stdio: 'inherit'});
-      const end = Date.now();
-      console.info(`Done in ${Math.round((end - start) / 1000)}s`);
-    }
-  }
-  const failures = [];
-  if (cmd.run) {
-    for (const path of paths) {
-      console.warn('\n➜ Configuring ci-setup');
-      const start = Date.now();
-      const defined = setup(config, path, env);
-      const end = Date.now();
-      console.info(`Done in ${Math.round((end - start) / 1000)}s`);
-      try {
-        // For each path, stop on the first command failure.
-        const steps = asArray(cmd.run) || [];
-        for (const step of steps) {
-          console.warn(`\n➜ ${path}$ ${step}`);
-          const start = Date.now();
-          execSync(step, {stdio: 'inherit', cwd: path});
-          const end = Date.now();
-          console.info(`Done in ${Math.round((end - start) / 1000)}s`);
-        }
-      } catch (e) {
-        // Run all paths always, catch the exception and report errors.
-        console.error(`${e}`);
-        failures.push(path);
-      } finally {
-        // Clean up the environment variables that were defined.
-        // This keeps the environment clean for subsequent runs.
-        for (const envVar of defined) {
-          delete env[envVar];
-        }
-      }
-    }
+  packageDiffs: Map<string, string[]>,
+  checkoutPath: string,
+  signal?: AbortSignal,
+): AffectedPackage[] {
+  const reasons = (pkg: string) =>
+    (packageDiffs.get(pkg) || []).map(diff => `${diff} changed`);
+  const globalDiffs = packageDiffs.get('.');
+  if (globalDiffs) {
+    console.error(
+      message(
+        'W001',
+        'One or more global files changed, all packages affected.',
+      ),
+    );
+    const roots = configRoots(config);
+    const packages = roots.flatMap(root => [
+      ...findPackages(config, root, checkoutPath, signal),
+    ]);
+    const edges =
+      config['affected-order'] === 'topological'
+        ? dependencyEdges(config, packages, checkoutPath)
+        : new Map<string, Set<string>>();
+    return limitAffected(
+      config,
+      orderAffected(
+        config,
+        packages.map(pkg => ({
+          path: pkg,
+          reasons: [
+            ...reasons(pkg),
+            ...globalDiffs.map(diff => `global file ${diff} changed`),
+          ],
+        })),
+        edges,
+        checkoutPath,
+      ),
+    );
   }
-  if (cmd.post) {
-    const steps = asArray(cmd.post) || [];
-    for (const step of steps) {
-      console.warn(`\n➜ [root]$ ${step}`);
-      const start = Date.now();
-      execSync(step, {stdio: 'inherit'});
-      const end = Date.now();
-      console.info(`Done in ${Math.round((end - start) / 1000)}s`);
+  const affectedPackages = [...packageDiffs.keys()].map(pkg => ({
+    path: pkg,
+    reasons: reasons(pkg),
+  }));
+  const edges = new Map<string, Set<string>>();
+  const dependentPackages = dependents(
+    config,
+    packageDiffs,
+    checkoutPath,
+    edges,
+  );
+  for (const [pkg, dependsOn] of dependentPackages) {
+    const affectedPackage = affectedPackages.find(p => p.path === pkg);
+    if (affectedPackage) {
+      affectedPackage.reasons.push(...dependsOn);
+    } else {
+      affectedPackages.push({path: pkg, reasons: dependsOn});
     }
   }
+  return limitAffected(
+    config,
+    orderAffected(config, affectedPackages, edges, checkoutPath),
+  );
+}
 
-  if (paths.length > 1) {
-    console.info(`\n=== Summary (${paths.length} packages) ===`);
-    console.info(`  Passed: ${paths.length - failures.length}`);
-    console.info(`  Failed: ${failures.length}`);
+/**
+ * Sorts the affected packages in the 'affected-order' of the config.
+ *
+ * Packages are sorted by path, so the output is the same on every run.
+ * In topological order, each package also comes after the packages it
+ * depends on. Packages in a dependency cycle keep their path order.
+ * In priority order, they are sorted by `schedulingOrder`.
+ *
+ * @param config config object
+ * @param packages affected packages
+ * @param edges packages each package depends on
+ * @param checkoutPath path to the repository checkout
+ * @returns sorted affected packages
+ */
+function orderAffected(
+  config: Config,
+  packages: AffectedPackage[],
+  edges: Map<string, Set<string>>,
+  checkoutPath: string,
+): AffectedPackage[] {
+  const sorted = [...packages].sort((a, b) =>
+    a.path < b.path ? -1 : a.path > b.path ? 1 : 0,
+  );
+  if (config['affected-order'] === 'priority') {
+    const order = schedulingOrder(
+      config,
+      sorted.map(pkg => pkg.path),
+      checkoutPath,
+    );
+    return order.map(dir => sorted.find(pkg => pkg.path === dir)!);
   }
-  if (failures.length > 0) {
-    throw new Error(`Failed:\n${failures.map(path => `- ${path}`).join('\n')}`);
+  if (config['affected-order'] !== 'topological') {
+    return sorted;
+  }
+  const result: AffectedPackage[] = [];
+  const pending = new Set(sorted.map(pkg => pkg.path));
+  const isReady = (pkg: AffectedPackage) =>
+    [...(edges.get(pkg.path) || [])].every(
+      dependency => dependency === pkg.path || !pending.has(dependency),
+    );
+  while (pending.size > 0) {
+    const remaining = sorted.filter(pkg => pending.has(pkg.path));
+    const next = remaining.find(isReady) || remaining[0];
+    result.push(next);
+    pending.delete(next.path);
   }
+  return result;
 }
 
 /**
- * Defines the environment variables and secrets.
+ * Sorts packages in the order to schedule them, so a runner or sharder
+ * starts the important and long-running ones first and the whole run ends
+ * sooner.
+ *
+ * Packages with a higher ci-setup `priority` come first, then the ones
+ * with a longer `estimated-duration`, then they are sorted by path.
+ * Packages without them have priority 0 and no duration.
  *
  * @param config config object
- * @param packagetPath path to the package
- * @param env environment variables
- * @returns environment variables that were defined
+ * @param packages package paths, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns sorted packages, or the all packages marker as is
  */
-export function setup(
+export function schedulingOrder(
   config: Config,
-  packagetPath: string,
-  env = process.env,
+  packages: string[],
+  checkoutPath = '.',
 ): string[] {
-  const defaults = config['ci-setup-defaults'] || {};
-  const ciSetup = loadCISetup(config, packagetPath);
-  console.debug(`ci-setup defaults: ${JSON.stringify(defaults, null, 2)}`);
-  console.debug(`ci-setup.json: ${JSON.stringify(ciSetup, null, 2)}`);
-
-  const definedBefore = new Set(Object.keys(env));
-  const vars = listEnv(env, ciSetup.env || {}, defaults.env || {});
-  for (const [key, value] of vars) {
-    env[key] = value;
+  if (packages.includes(allPackages)) {
+    return packages;
   }
-
-  // Export aliases required by tests.
-  env.GOOGLE_SAMPLES_PROJECT = env.PROJECT_ID;
-
-  const secrets = listSecrets(
-    env,
-    ciSetup.secrets || {},
-    defaults.secrets || {},
+  const keys = new Map(
+    packages.map(pkg => {
+      const ciSetup = loadPackage(config, pkg, checkoutPath).ciSetup;
+      const duration = ciSetup['estimated-duration'];
+      return [
+        pkg,
+        {
+          priority: ciSetup.priority ?? 0,
+          duration: duration ? (parseDuration(duration) ?? 0) : 0,
+        },
+      ];
+    }),
   );
-  for (const [key, value] of secrets) {
-    env[key] = value;
-  }
-  return [...Object.keys(env)].filter(x => !definedBefore.has(x));
+  return [...packages].sort((a, b) => {
+    const x = keys.get(a)!;
+    const y = keys.get(b)!;
+    return (
+      y.priority - x.priority ||
+      y.duration - x.duration ||
+      (a < b ? -1 : a > b ? 1 : 0)
+    );
+  });
 }
 
 /**
- * List environment variables based on the config file and ci-setup file.
+ * Finds the affected packages that have a tag in their ci-setup.
  *
- * @param env environment variables
- * @param ciSetup ci-setup variables
- * @param defaults variables default values from the config file
- * @returns generator of the environment variables
+ * If all packages are affected because of the 'max-affected' limit,
+ * the all packages marker is returned as is.
+ *
+ * @param config config object
+ * @param diffs list of files changed
+ * @param tag tag the packages must have, like 'gpu'
+ * @param checkoutPath path to the repository checkout
+ * @returns list of affected packages with the tag
  */
-export function* listEnv(
-  env: NodeJS.ProcessEnv = {},
-  ciSetup: {[k: string]: string} = {},
-  defaults: {[k: string]: string} = {},
-): Generator<[string, string]> {
-  const automatic = {
-    PROJECT_ID: () => defaultProject(),
-    RUN_ID: () => uniqueId(),
-    SERVICE_ACCOUNT: () => '',
-  };
-  console.info('Environment variables:');
-  const vars = [...listVars(env, ciSetup, defaults, automatic)];
-  const subs = Object.fromEntries(vars.map(([key, {value}]) => [key, value]));
-  for (const [key, {value, source}] of vars) {
-    const result = substitute(subs, value);
-    console.info(`  ${key}: ${JSON.stringify(result)} (${source})`);
-    yield [key, result];
-  }
+export function affectedWithTag(
+  config: Config,
+  diffs: string[],
+  tag: string,
+  checkoutPath = '.',
+): string[] {
+  const packages = affected(config, diffs, checkoutPath);
+  return filterTag(config, packages, tag, true, checkoutPath);
 }
 
 /**
- * List secret variables based on the config file and ci-setup file.
+ * Removes the packages that have a tag in their ci-setup.
  *
- * @param env environment variables
- * @param ciSetup ci-setup secrets
- * @param defaults secrets default values from the config file
- * @returns generator of the secrets
+ * @param config config object
+ * @param packages package paths, relative to the checkout path
+ * @param tag tag to exclude, like 'long-running'
+ * @param checkoutPath path to the repository checkout
+ * @returns packages without the tag
  */
-export function* listSecrets(
-  env: NodeJS.ProcessEnv = {},
-  ciSetup: {[k: string]: string} = {},
-  defaults: {[k: string]: string} = {},
-): Generator<[string, string]> {
-  const automatic = {
-    // Set global secret for the Service Account identity token
-    // Use in place of 'gcloud auth print-identity-token' or auth.getIdTokenClient
-    // usage: curl -H 'Bearer: $ID_TOKEN' https://
-    ID_TOKEN: () => getIdToken(env.PROJECT_ID),
-  };
-  console.info('Secrets:');
-  const vars = listVars(env, ciSetup, defaults, automatic, accessSecret);
-  for (const [key, {value: value, source}] of vars) {
-    // ⚠️ DO NOT print the secret value.
-    console.info(`  ${key}: "***" (${source})`);
-    yield [key, value];
-  }
+export function excludeTag(
+  config: Config,
+  packages: string[],
+  tag: string,
+  checkoutPath = '.',
+): string[] {
+  return filterTag(config, packages, tag, false, checkoutPath);
 }
 
 /**
- * List variables based on the config file and ci-setup file.
+ * Keeps the packages that have, or don't have, a tag.
  *
- * @param env environment variables
- * @param ciSetup ci-setup variables
- * @param defaults variables default values from the config file
- * @param automatic automatic variables
- * @param transform optional function to apply to the variable values
- * @returns generator of the variables
+ * @param config config object
+ * @param packages package paths, relative to the checkout path
+ * @param tag tag to look for
+ * @param tagged whether to keep the packages with the tag or without it
+ * @param checkoutPath path to the repository checkout
+ * @returns filtered packages, the all packages marker is always kept
  */
-export function* listVars(
-  env: NodeJS.ProcessEnv = {},
-  ciSetup: {[k: string]: string} = {},
-  defaults: {[k: string]: string} = {},
-  automatic: {[k: string]: () => string} = {},
-  transform: (value: string) => string = x => x,
-): Generator<[string, {value: string; source: string}]> {
-  for (const key in {...automatic, ...defaults, ...ciSetup}) {
-    if (key in env) {
-      // 1) User defined via an environment variable.
-      const value = env[key] || '';
-      yield [key, {value, source: 'user-defined'}];
-    } else if (key in ciSetup) {
-      // 2) From the local ci-setup.json file.
-      const value = transform(ciSetup[key]);
-      yield [key, {value, source: 'ci-setup.json'}];
-    } else if (key in defaults) {
-      // 3) Defaults from the config file.
-      const value = transform(defaults[key]);
-      yield [key, {value, source: 'default value'}];
-    } else if (key in automatic) {
-      // 4) Automatic variables.
-      const value = automatic[key]();
-      yield [key, {value, source: 'automatic var'}];
-    } else {
-      // Unreachable.
-      throw new Error(`Undefined variable: ${key}`);
-    }
-  }
+function filterTag(
+  config: Config,
+  packages: string[],
+  tag: string,
+  tagged: boolean,
+  checkoutPath: string,
+): string[] {
+  return packages.filter(
+    pkg =>
+      pkg === allPackages ||
+      packageTags(config, pkg, checkoutPath).includes(tag) === tagged,
+  );
 }
 
 /**
- * Loads and validates a config file.
+ * Gets the tags of a package, from its ci-setup and the defaults.
  *
- * @param filePath path to the config file
- * @returns config object
+ * @param config config object
+ * @param pkg package path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns package tags
  */
-export function loadConfig(filePath: string): Config {
-  const config: Config = loadJsonc(filePath);
+export function packageTags(
+  config: Config,
+  pkg: string,
+  checkoutPath = '.',
+): string[] {
+  return asArray(loadPackage(config, pkg, checkoutPath).ciSetup.tags) || [];
+}
 
-  // Default values.
-  if (!config.match) {
-    config.match = ['*'];
-  }
+// Gets the group names of a package, or an empty list if it has no group.
+// A package can be in several groups.
+export type PackageGrouper = (
+  config: Config,
+  pkg: string,
+  checkoutPath: string,
+) => string[];
 
-  // Validation.
-  const errors = validateConfig(config);
-  if (errors.length > 0) {
+// CODEOWNERS rules by config, then by checkout path, so grouping by owner
+// reads the file once.
+const codeownersRuleLists = new WeakMap<
+  Config,
+  Map<string, CodeownersRule[]>
+>();
+
+// Ways to group the affected packages, like one CI job per product area.
+export const packageGroupers: Readonly<{[name: string]: PackageGrouper}> = {
+  // Top-level directory, like `apps` for `apps/web`.
+  directory: (_config, pkg) => [toSlash(pkg).split('/')[0]],
+
+  // Presets with the package file, like `node` for a package.json.
+  preset: (config, pkg, checkoutPath) => {
+    const packageFile = findPackageFile(config, path.join(checkoutPath, pkg));
+    return Object.keys(configPresets).filter(
+      name =>
+        packageFile !== undefined &&
+        packageFileNames(configPresets[name]).some(file =>
+          isPackageFileName(file, packageFile),
+        ),
+    );
+  },
+
+  // Owners from the CODEOWNERS file.
+  owner: (config, pkg, checkoutPath) => {
+    const rules = cachedForRun(codeownersRuleLists, config, checkoutPath, () =>
+      loadCodeowners(checkoutPath),
+    );
+    return ownersFor(rules, pkg);
+  },
+
+  // Tags from the ci-setup, the all packages marker has no tags.
+  tag: (config, pkg, checkoutPath) =>
+    isPackageDir(config, path.join(checkoutPath, pkg))
+      ? packageTags(config, pkg, checkoutPath)
+      : [],
+};
+
+/**
+ * Groups packages, like the affected packages by top-level directory.
+ *
+ * Packages without a group are in the '' group, and the all packages
+ * marker is kept in its own '*' group.
+ *
+ * @param config config object
+ * @param packages package paths, relative to the checkout path
+ * @param groupBy one of the `packageGroupers`, or a custom grouper
+ * @param checkoutPath path to the repository checkout
+ * @returns packages of each group, in the same order as the packages
+ */
+export function groupPackages(
+  config: Config,
+  packages: string[],
+  groupBy: string | PackageGrouper,
+  checkoutPath = '.',
+): {[group: string]: string[]} {
+  const grouper =
+    typeof groupBy === 'function' ? groupBy : packageGroupers[groupBy];
+  if (!grouper) {
     throw new Error(
-      `❌ validation errors in config file: ${filePath}\n` +
-        errors.map(e => `- ${e}`).join('\n'),
+      message(
+        'E041',
+        `unknown group '${groupBy}', must be one of: ${Object.keys(packageGroupers).join(', ')}`,
+      ),
     );
   }
-
-  return config;
+  const groups: {[group: string]: string[]} = {};
+  for (const pkg of packages) {
+    const names =
+      pkg === allPackages ? [allPackages] : grouper(config, pkg, checkoutPath);
+    for (const name of names.length > 0 ? names : ['']) {
+      groups[name] = [...(groups[name] || []), pkg];
+    }
+  }
+  return groups;
 }
 
 /**
- * Loads and validates a CI setup file.
+ * Applies the 'max-affected' limit to the affected packages.
  *
  * @param config config object
- * @param packagePath path to the package
- * @returns ci-setup object
+ * @param packages affected packages
+ * @returns affected packages within the limit
  */
-export function loadCISetup(config: Config, packagePath: string): CISetup {
-  const defaultNames = ['ci-setup.jsonc', 'ci-setup.json'];
-  const filenames = asArray(config['ci-setup-filename']) || defaultNames;
-  for (const filename of filenames) {
-    const ciSetupPath = path.join(packagePath, filename);
-    if (fs.existsSync(ciSetupPath)) {
-      const ciSetup: CISetup = loadJsonc(ciSetupPath);
-      const errors = validateCISetup(config, ciSetup);
-      if (errors.length > 0) {
-        throw new Error(
-          `❌ validation errors in CI setup file: ${ciSetupPath}\n` +
-            errors.map(e => `- ${e}`).join('\n') +
-            (config['ci-setup-help-url']
-              ? `\nSee ${config['ci-setup-help-url']}`
-              : '') +
-            '\n',
-        );
-      }
-      return ciSetup;
-    }
+export function limitAffected(
+  config: Config,
+  packages: AffectedPackage[],
+): AffectedPackage[] {
+  const maxAffected = config['max-affected'];
+  if (maxAffected === undefined || packages.length <= maxAffected) {
+    return packages;
+  }
+  const reason = `${packages.length} packages affected, more than the 'max-affected' limit of ${maxAffected}`;
+  switch (config['max-affected-action'] || 'fail') {
+    case 'cap':
+      console.error(
+        message('W008', `${reason}, only the first ${maxAffected} are kept.`),
+      );
+      return packages.slice(0, maxAffected);
+    case 'all':
+      console.error(message('W009', `${reason}, returning '${allPackages}'.`));
+      return [{path: allPackages, reasons: [reason]}];
+    default:
+      throw new Error(message('E022', reason));
   }
-  console.debug(`No CI setup found for '${packagePath}'`);
-  return {};
 }
 
 /**
- * Loads a JSON with Comments (JSONC) file.
+ * Finds the packages that depend on the changed packages.
  *
- * @param filePath path to the JSONC file
- * @returns JSON object
+ * Each configured dependency resolver understands a package manager,
+ * like Go modules, and finds the packages that depend on the changes.
+ *
+ * @param config config object
+ * @param packageDiffs mapping of each changed package to its diffs
+ * @param checkoutPath path to the repository checkout
+ * @param edges filled in with the packages each visited package depends on
+ * @returns mapping of each dependent package to the reasons it's affected
  */
-export function loadJsonc(filePath: string) {
-  const jsoncData = fs.readFileSync(filePath, 'utf8');
-  const jsonData = jsoncData
-    .replaceAll(/\s*\/\*.*?\*\//gs, '') // remove multi-line comments
-    .replaceAll(/(^\s*|[,{}[\]"\d]\s*)\/\/.*/gm, '$1'); // remove single-line comments
-  return JSON.parse(jsonData);
+export function dependents(
+  config: Config,
+  packageDiffs: Map<string, string[]>,
+  checkoutPath: string,
+  edges = new Map<string, Set<string>>(),
+): Map<string, string[]> {
+  const result = new Map<string, string[]>();
+  for (const name of asArray(config.dependencies) || []) {
+    const resolve = dependencyResolvers[name];
+    const resolved = resolve(config, packageDiffs, checkoutPath, edges);
+    for (const [pkg, reasons] of resolved) {
+      result.set(pkg, [...(result.get(pkg) || []), ...reasons]);
+    }
+  }
+  return result;
 }
 
 /**
- * Applies variable interpolation to the given variables.
+ * Finds the dependencies between packages, for all the configured
+ * package managers.
  *
- * @param subs variable substitutions
- * @param value original value
- * @returns value after substitutions
+ * @param config config object
+ * @param packages package paths, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns packages each package depends on
  */
-export function substitute(subs: {[k: string]: string}, value: string): string {
-  for (const key in subs) {
-    const re = new RegExp(`\\$(${key}\\b|\\{\\s*${key}\\s*\\})`, 'g');
-    // JavaScript doesn't allow lazy substitutions, so we check if
-    // the substitution needs to be done first.
-    if (value.match(re)) {
-      // Substitute recursively to handle nested substitutions.
-      // Since JS doesn't do lazy evaluation, this is technically
-      // O(n^2) worst case, but in reality we should only have a
-      // handful of variables with a couple of levels of recursion.
-      // Doing graph traversals or topological sort should not be
-      // needed, unless we get into a pathological case.
-      value = value.replaceAll(re, substitute(subs, subs[key]));
+export function dependencyEdges(
+  config: Config,
+  packages: string[],
+  checkoutPath: string,
+): Map<string, Set<string>> {
+  const edges = new Map<string, Set<string>>();
+  for (const name of asArray(config.dependencies) || []) {
+    const graph = dependencyGraphs[name](config, packages, checkoutPath);
+    for (const [pkg, dependencies] of graph) {
+      for (const dependency of dependencies) {
+        addEdge(edges, pkg, dependency);
+      }
     }
   }
-  return value;
+  return edges;
 }
 
+// Finds the packages that depend on the changed packages for a package
+// manager. It also adds the package level dependencies it visits to the
+// edges, mapping each package to the packages it depends on.
+type DependencyResolver = (
+  config: Config,
+  packageDiffs: Map<string, string[]>,
+  checkoutPath: string,
+  edges: Map<string, Set<string>>,
+) => Map<string, string[]>;
+
 /**
- * Generates a random alphanumeric ID.
+ * Adds a dependency between two packages.
  *
- * @param length length of the ID
- * @returns random alhpanumeric string
+ * @param edges packages each package depends on
+ * @param pkg dependent package
+ * @param dependency package it depends on
  */
-export function uniqueId(length = 6) {
-  const min = 2 ** 32;
-  const max = 2 ** 64;
-  return Math.floor(Math.random() * max + min)
-    .toString(36)
-    .slice(0, length);
+function addEdge(
+  edges: Map<string, Set<string>>,
+  pkg: string,
+  dependency: string,
+) {
+  if (!edges.has(pkg)) {
+    edges.set(pkg, new Set());
+  }
+  edges.get(pkg)?.add(dependency);
 }
 
+const dependencyResolvers: {[name: string]: DependencyResolver} = {
+  go: goDependents,
+  npm: npmDependents,
+  bazel: bazelDependents,
+};
+
+// Finds the dependencies between all the packages for a package manager,
+// mapping each package to the packages it depends on.
+type DependencyGraph = (
+  config: Config,
+  packages: string[],
+  checkoutPath: string,
+) => Map<string, Set<string>>;
+
+const dependencyGraphs: {[name: string]: DependencyGraph} = {
+  go: goGraph,
+  npm: npmGraph,
+  bazel: bazelGraph,
+};
+
+export type GoMod = {
+  // Module path, like example.com/my-module.
+  module: string;
+
+  // Required module paths.
+  requires: string[];
+
+  // Replaced module paths, mapped to their replacement path or module.
+  replaces: {[module: string]: string};
+};
+
+export type GoWork = {
+  // Module directories, relative to the go.work file.
+  uses: string[];
+
+  // Replaced module paths, mapped to their replacement path or module.
+  // They apply to every module in the workspace, over their own.
+  replaces: {[module: string]: string};
+};
+
 /**
- * Gets the default project ID from gcloud.
+ * Parses a go.mod file.
  *
- * @returns default project ID
+ * @param text go.mod file contents
+ * @returns module path, requirements, and replacements
  */
-function defaultProject(): string {
-  const cmd = 'gcloud config get-value project';
-  return execSync(cmd).toString().trim();
+export function parseGoMod(text: string): GoMod {
+  const gomod: GoMod = {module: '', requires: [], replaces: {}};
+  for (const [kind, fields] of goDirectives(text)) {
+    if (kind === 'module') {
+      gomod.module = fields[0];
+    } else if (kind === 'require' && fields[0]) {
+      gomod.requires.push(fields[0]);
+    } else if (kind === 'replace') {
+      addGoReplace(gomod.replaces, fields);
+    }
+  }
+  return gomod;
 }
 
 /**
- * Accesses a secret from Secret Manager.
+ * Parses a go.work file.
  *
- * @param secretPath secret in the format project-id/secret-id
- * @returns secret value
+ * @param text go.work file contents
+ * @returns module directories and replacements
  */
-function accessSecret(secretPath: string): string {
-  const [projectId, ...secretIdParts] = secretPath.split('/');
-  const secretId = secretIdParts.join('/');
-  const cmd = `gcloud --project=${projectId} secrets versions access "latest" --secret=${secretId}`;
-  return execSync(cmd).toString();
+export function parseGoWork(text: string): GoWork {
+  const gowork: GoWork = {uses: [], replaces: {}};
+  for (const [kind, fields] of goDirectives(text)) {
+    if (kind === 'use' && fields[0]) {
+      gowork.uses.push(fields[0]);
+    } else if (kind === 'replace') {
+      addGoReplace(gowork.replaces, fields);
+    }
+  }
+  return gowork;
 }
 
 /**
- * Gets the identity token from gcloud.
+ * Lists the directives of a go.mod or go.work file.
  *
- * @param projectId Google Cloud project ID
- * @returns identity token
+ * Directives in a block, like `require (...)`, are listed one by one.
+ *
+ * @param text file contents
+ * @returns directive name and arguments, in file order
  */
-function getIdToken(projectId?: string): string {
-  if (projectId) {
-    const cmd = `gcloud --project=${projectId} auth print-identity-token`;
-    return execSync(cmd).toString().trim();
+function goDirectives(text: string): [string, string[]][] {
+  const directives: [string, string[]][] = [];
+  let block = '';
+  for (const rawLine of text.split('\n')) {
+    const line = rawLine.replace(/\/\/.*/, '').trim();
+    if (line === '') {
+      continue;
+    }
+    if (line === ')') {
+      block = '';
+      continue;
+    }
+    let kind = block;
+    let args = line;
+    if (!block) {
+      const directive = line.match(/^(\w+)\s*(\(?)(.*)$/);
+      if (!directive) {
+        continue;
+      }
+      if (directive[2] === '(') {
+        block = directive[1];
+        continue;
+      }
+      kind = directive[1];
+      args = directive[3].trim();
+    }
+    const fields = args.split(/\s+/).map(field => field.replace(/"/g, ''));
+    directives.push([kind, fields]);
   }
-  return '';
+  return directives;
 }
 
 /**
- * Normalizes (string | string[]) into string[]
+ * Adds a `replace` directive to the replacements.
  *
- * @param x string or string[] or undefined
- * @returns string[] or undefined
+ * @param replaces replaced module paths, updated in place
+ * @param fields directive arguments, like `example.com/lib => ../lib`
  */
-function asArray(x: string | string[] | undefined): string[] | undefined {
-  // If undefined, return undefined.
-  if (!x) {
-    return undefined;
+function addGoReplace(replaces: {[module: string]: string}, fields: string[]) {
+  const arrow = fields.indexOf('=>');
+  if (arrow > 0) {
+    replaces[fields[0]] = fields[arrow + 1];
   }
-  // If it's a single string, return a single-element array.
-  return Array.isArray(x) ? x : [x];
 }
 
-// For validation, the data comes from JSON files, so they can be anything.
-// There are no type guarantees, so many of these functions take
-// parameters of type `any` and validate the type at runtime.
-/* eslint-disable @typescript-eslint/no-explicit-any */
-
 /**
- * Validates the config file.
+ * Finds the Go modules that import the changed Go packages.
+ *
+ * Like `go list -deps`, it follows the imports of every Go package in the
+ * repository, so a change in a package affects every module that imports
+ * it, directly or transitively.
+ * Changes to go.mod or go.sum files affect every package in the module.
+ * Changes to go.work or go.work.sum files affect every module they use.
  *
  * @param config config object
- * @returns a list of validation errors
+ * @param packageDiffs mapping of each changed package to its diffs
+ * @param checkoutPath path to the repository checkout
+ * @param edges filled in with the modules each module depends on
+ * @returns mapping of each dependent module to the reasons it's affected
  */
-export function validateConfig(config: any): string[] {
-  // Undefined fields.
-  let errors = [];
-  const validFields = [
-    'package-file',
-    'ci-setup-filename',
-    'ci-setup-defaults',
-    'ci-setup-help-url',
-    'match',
-    'ignore',
-    'commands',
-    'exclude-packages',
-  ];
-  for (const key in config) {
-    if (!validFields.includes(key)) {
-      errors.push(`'${key}' is not a valid field`);
+function goDependents(
+  config: Config,
+  packageDiffs: Map<string, string[]>,
+  checkoutPath: string,
+  edges: Map<string, Set<string>>,
+): Map<string, string[]> {
+  const {modules, workspaces, importedBy, packageModule} = goModuleIndex(
+    config,
+    checkoutPath,
+  );
+
+  // Find the changed Go packages.
+  const result = new Map<string, string[]>();
+  const changed: string[] = [];
+  const changeModule = (pkg: string) => {
+    for (const [importPath, module] of packageModule) {
+      if (module === pkg) {
+        changed.push(importPath);
+      }
+    }
+  };
+  for (const [pkg, diffs] of packageDiffs) {
+    // A go.work change affects every module in the workspace.
+    for (const diff of diffs) {
+      const gowork = workspaces.get(toSlash(path.dirname(diff)));
+      if (!gowork || !goWorkFiles.includes(path.basename(diff))) {
+        continue;
+      }
+      for (const use of gowork.uses) {
+        const module = toSlash(path.join(path.dirname(diff), use));
+        changeModule(module);
+        if (modules.has(module) && !packageDiffs.has(module)) {
+          const reasons = result.get(module) || [];
+          result.set(module, [...reasons, `${diff} changed`]);
+        }
+      }
+    }
+    const gomod = modules.get(pkg);
+    if (!gomod) {
+      continue;
+    }
+    for (const diff of diffs) {
+      if (['go.mod', 'go.sum'].includes(path.basename(diff))) {
+        changeModule(pkg);
+      } else if (!goWorkFiles.includes(path.basename(diff))) {
+        changed.push(goImportPath(gomod, pkg, path.dirname(diff)));
+      }
     }
   }
 
-  if (config.commands) {
-    for (const name in config.commands) {
-      for (const key in config.commands[name]) {
-        if (!['pre', 'run', 'post'].includes(key)) {
-          errors.push(`'commands.${name}.${key}' is not a valid field`);
+  // Follow the imports transitively.
+  const visited = new Set(changed);
+  const queue = [...changed];
+  while (queue.length > 0) {
+    const importPath = queue.shift() || '';
+    for (const importer of importedBy.get(importPath) || []) {
+      const module = packageModule.get(importer) || '';
+      const dependency = packageModule.get(importPath);
+      if (dependency !== undefined && dependency !== module) {
+        addEdge(edges, module, dependency);
+      }
+      if (!packageDiffs.has(module)) {
+        const reason = `${importer} imports ${importPath}`;
+        const reasons = result.get(module) || [];
+        if (!reasons.includes(reason)) {
+          result.set(module, [...reasons, reason]);
         }
       }
+      if (!visited.has(importer)) {
+        visited.add(importer);
+        queue.push(importer);
+      }
     }
   }
+  return result;
+}
 
-  // Type checking.
-  errors = errors.concat(
-    checkStringOrStrings(config, 'package-file'),
-    checkStringOrStrings(config, 'ci-setup-filename'),
-    checkMappings(config['ci-setup-defaults'], 'ci-setup-defaults.env'),
-    checkMappings(config['ci-setup-defaults'], 'ci-setup-defaults.secrets'),
-    checkString(config, 'ci-setup-help-url'),
-    checkStringOrStrings(config, 'match'),
-    checkStringOrStrings(config, 'ignore'),
-    checkStringOrStrings(config, 'exclude-packages'),
-  );
-  for (const name in config.commands) {
-    errors = errors.concat(
-      checkStringOrStrings(config.commands[name], `commands.${name}.pre`),
-      checkStringOrStrings(config.commands[name], `commands.${name}.run`),
-      checkStringOrStrings(config.commands[name], `commands.${name}.post`),
-    );
+/**
+ * Finds the Go modules each Go module imports packages from.
+ *
+ * @param config config object
+ * @param _packages package paths, the Go modules are found from the go.mod
+ *   files instead
+ * @param checkoutPath path to the repository checkout
+ * @returns modules each module depends on
+ */
+function goGraph(
+  config: Config,
+  _packages: string[],
+  checkoutPath: string,
+): Map<string, Set<string>> {
+  const {importedBy, packageModule} = goModuleIndex(config, checkoutPath);
+  const edges = new Map<string, Set<string>>();
+  for (const [importPath, importers] of importedBy) {
+    const dependency = packageModule.get(importPath);
+    for (const importer of importers) {
+      const module = packageModule.get(importer) || '';
+      if (dependency !== undefined && dependency !== module) {
+        addEdge(edges, module, dependency);
+      }
+    }
   }
-  return errors;
+  return edges;
 }
 
 /**
- * Validates the CI setup file.
+ * Indexes the Go modules of the repository, and the imports of their Go
+ * packages.
  *
  * @param config config object
- * @param ciSetup ci-setup object
- * @returns a list of validation errors
+ * @param checkoutPath path to the repository checkout
+ * @returns modules by directory, workspaces by directory, Go packages that
+ *   import each Go package, and the module directory of each Go package
  */
-export function validateCISetup(config: Config, ciSetup: any): string[] {
-  // Undefined fields.
-  let errors = [];
-  const validFields = [
-    'env',
-    'secrets',
-    ...Object.keys(config['ci-setup-defaults'] || {}),
-  ];
-  for (const key in ciSetup) {
-    // Fields starting with underscore (_) are considered comments.
-    // They should not be considered as errors.
-    if (!key.startsWith('_') && !validFields.includes(key)) {
-      errors.push(`'${key}' is not a valid field`);
+function goModuleIndex(
+  config: Config,
+  checkoutPath: string,
+): {
+  modules: Map<string, GoMod>;
+  workspaces: Map<string, GoWork>;
+  importedBy: Map<string, Set<string>>;
+  packageModule: Map<string, string>;
+} {
+  // Find all the Go modules, and where each module path lives.
+  const modules = new Map<string, GoMod>();
+  const moduleDirs = new Map<string, string>();
+  const roots = configRoots(config);
+  const files = filesOf(config);
+  for (const root of roots) {
+    for (const pkg of findPackages(config, root, checkoutPath)) {
+      const gomodPath = path.join(checkoutPath, pkg, 'go.mod');
+      if (files.existsSync(gomodPath)) {
+        const gomod = parseGoMod(files.readFileSync(gomodPath, 'utf8'));
+        modules.set(pkg, gomod);
+        moduleDirs.set(gomod.module, pkg);
+      }
     }
   }
-
-  // Type checking.
-  errors = errors.concat(
-    checkMappings(ciSetup, 'env'),
-    checkMappings(ciSetup, 'secrets'),
-  );
-  if (config['ci-setup-defaults']) {
-    for (const key in config['ci-setup-defaults'] || {}) {
-      const ciSetupValue = ciSetup[key];
-      if (ciSetupValue === undefined) {
-        continue;
+  // Local replacements point to modules in the repository, and the
+  // workspace replacements win over the ones of its modules.
+  const workspaces = goWorkspaces(files, [...modules.keys()], checkoutPath);
+  const replacements: [string, GoWork['replaces']][] = [];
+  for (const [pkg, gomod] of modules) {
+    replacements.push([pkg, gomod.replaces]);
+  }
+  for (const [dir, gowork] of workspaces) {
+    replacements.push([dir, gowork.replaces]);
+  }
+  for (const [base, replaces] of replacements) {
+    for (const [module, replacement] of Object.entries(replaces)) {
+      const dir = toSlash(path.join(base, replacement));
+      if (replacement.startsWith('.') && modules.has(dir)) {
+        moduleDirs.set(module, dir);
       }
-      const defaultValue = config['ci-setup-defaults'][key];
-      if (typeof ciSetupValue !== typeof defaultValue) {
-        errors.push(
-          `'${key}' must be ${typeof defaultValue}, got: ${JSON.stringify(
-            ciSetupValue,
-          )}`,
-        );
+    }
+  }
+
+  // Index which Go packages import each Go package.
+  const importedBy = new Map<string, Set<string>>();
+  const packageModule = new Map<string, string>();
+  for (const [pkg, gomod] of modules) {
+    const goPkgs = goPackages(files, gomod, pkg, checkoutPath);
+    for (const [importPath, imports] of goPkgs) {
+      packageModule.set(importPath, pkg);
+      for (const imported of imports) {
+        const resolved = resolveGoImport(imported, moduleDirs, modules);
+        if (!importedBy.has(resolved)) {
+          importedBy.set(resolved, new Set());
+        }
+        importedBy.get(resolved)?.add(importPath);
       }
     }
   }
+  return {modules, workspaces, importedBy, packageModule};
+}
 
-  // TODO: check for undefined variable substitutions
-  return errors;
+// Files of a Go workspace, a change to them affects all its modules.
+const goWorkFiles = ['go.work', 'go.work.sum'];
+
+/**
+ * Finds the Go workspaces of the modules.
+ *
+ * Like the Go tool, a module uses the closest go.work file in its
+ * directory or its parents, if the file lists the module in a `use`
+ * directive.
+ *
+ * @param files file system to read the go.work files from
+ * @param modules module directories, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns workspaces used by any module, by the directory of their go.work
+ */
+function goWorkspaces(
+  files: FileSystem,
+  modules: string[],
+  checkoutPath: string,
+): Map<string, GoWork> {
+  const goworks = new Map<string, GoWork | null>();
+  const workspaces = new Map<string, GoWork>();
+  for (const pkg of modules) {
+    let dir = pkg;
+    while (!goworks.has(dir)) {
+      const goworkPath = path.join(checkoutPath, dir, 'go.work');
+      goworks.set(
+        dir,
+        files.existsSync(goworkPath)
+          ? parseGoWork(files.readFileSync(goworkPath, 'utf8'))
+          : null,
+      );
+      if (goworks.get(dir) || dir === '.') {
+        break;
+      }
+      dir = path.dirname(dir);
+    }
+    const gowork = goworks.get(dir);
+    const uses = gowork?.uses.map(use => toSlash(path.join(dir, use)));
+    if (gowork && uses?.includes(pkg)) {
+      workspaces.set(dir, gowork);
+    }
+  }
+  return workspaces;
 }
 
 /**
- * Generic helper to check the type of a field.
+ * Finds the npm workspaces that depend on the changed workspaces.
  *
- * @param kvs object with fields
- * @param key field to check
- * @param isType type checker function
- * @param err error message
- * @returns a list of validation errors
+ * The workspaces are read from the `workspaces` field of the root
+ * package.json file, or all packages with a package.json file if not set.
+ * Dependencies are followed transitively through the `dependencies`,
+ * `devDependencies`, `peerDependencies`, and `optionalDependencies` fields.
+ *
+ * @param config config object
+ * @param packageDiffs mapping of each changed package to its diffs
+ * @param checkoutPath path to the repository checkout
+ * @param edges filled in with the workspaces each workspace depends on
+ * @returns mapping of each dependent workspace to the reasons it's affected
  */
-function check(
-  kvs: any,
-  key: string,
-  isType: (x: any) => boolean,
-  err: string,
-): string[] {
-  // Fields are not required by default.
-  // Required fields must be checked explicitly.
-  const k = key.split('.').pop() || key;
-  if (kvs && kvs[k] && !isType(kvs[k])) {
-    return [`'${key}' must be ${err}, got: ${JSON.stringify(kvs[k])}`];
+function npmDependents(
+  config: Config,
+  packageDiffs: Map<string, string[]>,
+  checkoutPath: string,
+  edges: Map<string, Set<string>>,
+): Map<string, string[]> {
+  const {names, dependedBy} = npmWorkspaces(config, checkoutPath);
+
+  // Follow the dependencies transitively.
+  const result = new Map<string, string[]>();
+  const changed = [...packageDiffs.keys()].filter(pkg => names.has(pkg));
+  const visited = new Set(changed);
+  const queue = [...changed];
+  while (queue.length > 0) {
+    const pkg = queue.shift() || '';
+    const name = names.get(pkg) || pkg;
+    for (const dependent of dependedBy.get(name) || []) {
+      addEdge(edges, dependent, pkg);
+      if (!packageDiffs.has(dependent)) {
+        const reason = `${names.get(dependent)} depends on ${name}`;
+        result.set(dependent, [...(result.get(dependent) || []), reason]);
+      }
+      if (!visited.has(dependent)) {
+        visited.add(dependent);
+        queue.push(dependent);
+      }
+    }
   }
-  return [];
+  return result;
 }
 
-/**
- * Checks the type of a string field.
- *
- * @param kvs object with fields
- * @param key field to check
- * @returns a list of validation errors
- */
-function checkString(kvs: any, key: string): string[] {
-  return check(kvs, key, isString, 'string');
-}
+/**
+ * Finds the npm workspaces each npm workspace depends on.
+ *
+ * @param config config object
+ * @param _packages package paths, the workspaces are found from the root
+ *   package.json file instead
+ * @param checkoutPath path to the repository checkout
+ * @returns workspaces each workspace depends on
+ */
+function npmGraph(
+  config: Config,
+  _packages: string[],
+  checkoutPath: string,
+): Map<string, Set<string>> {
+  const {names, dependedBy} = npmWorkspaces(config, checkoutPath);
+  const edges = new Map<string, Set<string>>();
+  for (const [pkg, name] of names) {
+    for (const dependent of dependedBy.get(name) || []) {
+      if (dependent !== pkg) {
+        addEdge(edges, dependent, pkg);
+      }
+    }
+  }
+  return edges;
+}
+
+/**
+ * Indexes the npm workspaces by name, and which workspaces depend on each
+ * package name.
+ *
+ * @param config config object
+ * @param checkoutPath path to the repository checkout
+ * @returns name of each workspace, and the workspaces that depend on each
+ *   package name
+ */
+function npmWorkspaces(
+  config: Config,
+  checkoutPath: string,
+): {names: Map<string, string>; dependedBy: Map<string, Set<string>>} {
+  const files = filesOf(config);
+  const rootPackageJson = path.join(checkoutPath, 'package.json');
+  const rootManifest = files.existsSync(rootPackageJson)
+    ? loadJsonc(rootPackageJson, files)
+    : {};
+  const workspaces: string[] = (
+    Array.isArray(rootManifest.workspaces)
+      ? rootManifest.workspaces
+      : rootManifest.workspaces?.packages || ['**']
+  ).map((workspace: string) => workspace.replace(/^\.\//, ''));
+
+  // Index the workspaces by name, and which workspaces depend on each one.
+  const names = new Map<string, string>();
+  const dependedBy = new Map<string, Set<string>>();
+  const roots = configRoots(config);
+  const packages = roots.flatMap(root => [
+    ...findPackages(config, root, checkoutPath),
+  ]);
+  for (const pkg of packages) {
+    const packageJson = path.join(checkoutPath, pkg, 'package.json');
+    const isWorkspace = workspaces.some(
+      workspace => workspace === pkg || globToRegExp(workspace).test(pkg),
+    );
+    if (!isWorkspace || !files.existsSync(packageJson)) {
+      continue;
+    }
+    const manifest = loadJsonc(packageJson, files);
+    names.set(pkg, manifest.name || pkg);
+    const fields = [
+      'dependencies',
+      'devDependencies',
+      'peerDependencies',
+      'optionalDependencies',
+    ];
+    for (const field of fields) {
+      for (const dependency of Object.keys(manifest[field] || {})) {
+        if (!dependedBy.has(dependency)) {
+          dependedBy.set(dependency, new Set());
+        }
+        dependedBy.get(dependency)?.add(pkg);
+      }
+    }
+  }
+  return {names, dependedBy};
+}
+
+/**
+ * Finds the packages with Bazel targets that depend on the changed files.
+ *
+ * The dependencies come from `bazel query`, so they are as precise as the
+ * BUILD files: a change only affects the targets that depend on the changed
+ * files, directly or transitively, instead of whole directories.
+ * Changes to BUILD files affect every target in their Bazel package.
+ *
+ * @param config config object
+ * @param packageDiffs mapping of each changed package to its diffs
+ * @param checkoutPath path to the Bazel workspace
+ * @param edges filled in with the packages each package depends on
+ * @returns mapping of each dependent package to the reasons it's affected
+ */
+function bazelDependents(
+  config: Config,
+  packageDiffs: Map<string, string[]>,
+  checkoutPath: string,
+  edges: Map<string, Set<string>>,
+): Map<string, string[]> {
+  const packages = configRoots(config).flatMap(root => [
+    ...findPackages(config, root, checkoutPath),
+  ]);
+  const bazelPkgs = bazelPackages(checkoutPath);
+  const result = new Map<string, string[]>();
+  for (const [pkg, diffs] of packageDiffs) {
+    if (pkg === '.') {
+      continue;
+    }
+    for (const target of bazelRdeps(diffs, bazelPkgs, checkoutPath)) {
+      const dependent = packageOf(packages, bazelPackageOf(target));
+      if (dependent === undefined || dependent === pkg) {
+        continue;
+      }
+      addEdge(edges, dependent, pkg);
+      if (!packageDiffs.has(dependent)) {
+        const reason = `${target} depends on //${pkg}`;
+        const reasons = result.get(dependent) || [];
+        if (!reasons.includes(reason)) {
+          result.set(dependent, [...reasons, reason]);
+        }
+      }
+    }
+  }
+  return result;
+}
+
+/**
+ * Finds the Bazel targets affected by the diffs.
+ *
+ * These are the rules that depend on the changed files, directly or
+ * transitively, for CI to build and test only those targets.
+ *
+ * @param config config object
+ * @param diffs list of files changed
+ * @param checkoutPath path to the Bazel workspace
+ * @returns affected target labels, like //app:server
+ */
+export function affectedTargets(
+  config: Config,
+  diffs: string[],
+  checkoutPath: string,
+): string[] {
+  const match = asArray(withPresets(config).match) || ['*'];
+  const engine = matchEngine(config);
+  const matched = diffs
+    .map(toSlash)
+    .filter(
+      diff =>
+        isInRoots(config, diff) &&
+        matches(diff, match, engine) &&
+        ignoredBy(config, diff, checkoutPath) === null,
+    );
+  if (matched.length === 0) {
+    return [];
+  }
+  const bazelPkgs = bazelPackages(checkoutPath);
+  return bazelRdeps(matched, bazelPkgs, checkoutPath).sort();
+}
+
+/**
+ * Queries the rules that depend on some files.
+ *
+ * @param diffs list of files changed, relative to the workspace
+ * @param bazelPkgs Bazel packages of the workspace, see `bazelPackages`
+ * @param checkoutPath path to the Bazel workspace
+ * @returns rule labels
+ */
+function bazelRdeps(
+  diffs: string[],
+  bazelPkgs: string[],
+  checkoutPath: string,
+): string[] {
+  if (diffs.length === 0) {
+    return [];
+  }
+  const labels = new Set(diffs.map(diff => bazelLabel(diff, bazelPkgs)));
+  const set = [...labels].map(label => `"${label}"`).join(' ');
+  const query = `kind(rule, rdeps(//..., set(${set})))`;
+  return bazelQuery(['--output=label', query], checkoutPath)
+    .split('\n')
+    .filter(label => label.startsWith('//'));
+}
+
+/**
+ * Finds the packages each package depends on from the Bazel targets.
+ *
+ * A single query gets the dependencies of every target in the workspace.
+ *
+ * @param config config object
+ * @param packages package paths, relative to the checkout path
+ * @param checkoutPath path to the Bazel workspace
+ * @returns packages each package depends on
+ */
+function bazelGraph(
+  _config: Config,
+  packages: string[],
+  checkoutPath: string,
+): Map<string, Set<string>> {
+  const args = ['--output=graph', '--nograph:factored', '//...'];
+  const edges = new Map<string, Set<string>>();
+  for (const line of bazelQuery(args, checkoutPath).split('\n')) {
+    // Edges are like "//app:server" -> "//lib:lib".
+    const edge = line.match(/^\s*"([^"]+)"\s*->\s*"([^"]+)"/);
+    if (!edge) {
+      continue;
+    }
+    const pkg = packageOf(packages, bazelPackageOf(edge[1]));
+    const dependency = packageOf(packages, bazelPackageOf(edge[2]));
+    if (pkg && dependency && pkg !== dependency) {
+      addEdge(edges, pkg, dependency);
+    }
+  }
+  return edges;
+}
+
+/**
+ * Lists the Bazel packages of the workspace from a single query, instead of
+ * walking the workspace for BUILD files.
+ *
+ * @param checkoutPath path to the Bazel workspace
+ * @returns Bazel package paths, without the root package
+ */
+function bazelPackages(checkoutPath: string): string[] {
+  const args = ['--output=package', 'kind(".*", //...)'];
+  return bazelQuery(args, checkoutPath)
+    .split('\n')
+    .filter(pkg => pkg !== '');
+}
+
+/**
+ * Runs a Bazel query, keeping the partial results of failed targets.
+ *
+ * The Bazel binary can be changed with CUSTARD_BAZEL, like `bazelisk`.
+ *
+ * @param args query options and expression
+ * @param checkoutPath path to the Bazel workspace
+ * @returns query output
+ */
+function bazelQuery(args: string[], checkoutPath: string): string {
+  try {
+    return execFileSync(
+      process.env.CUSTARD_BAZEL || 'bazel',
+      ['query', '--keep_going', ...args],
+      {cwd: checkoutPath, encoding: 'utf8', stdio: ['ignore', 'pipe', 'pipe']},
+    );
+  } catch (e) {
+    // Exit code 3 means partial results, like for removed files or files
+    // that are not part of any target.
+    const {status, stdout} = e as {status: number | null; stdout: string};
+    if (status !== 3) {
+      throw e;
+    }
+    return stdout;
+  }
+}
+
+/**
+ * Gets the Bazel label of a file, like //lib:src/lib.go.
+ *
+ * The Bazel package is the closest one above the file, or the root one.
+ * For BUILD files, the label is every target in their Bazel package.
+ *
+ * @param diff file path, relative to the workspace
+ * @param bazelPkgs Bazel packages of the workspace, see `bazelPackages`
+ * @returns file label
+ */
+function bazelLabel(diff: string, bazelPkgs: string[]): string {
+  const pkg = packageOf(bazelPkgs, path.posix.dirname(diff)) ?? '';
+  if (bazelBuildFiles.includes(path.posix.basename(diff))) {
+    return `//${pkg}:all`;
+  }
+  return `//${pkg}:${path.posix.relative(pkg, diff)}`;
+}
+
+const bazelBuildFiles = ['BUILD.bazel', 'BUILD'];
+
+/**
+ * Gets the Bazel package of a label, like lib for //lib:lib.
+ *
+ * @param label target label
+ * @returns Bazel package path, '.' for the root package
+ */
+function bazelPackageOf(label: string): string {
+  return label.replace(/^\/\//, '').replace(/:.*$/, '') || '.';
+}
+
+/**
+ * Finds the package that contains a directory.
+ *
+ * @param packages package paths
+ * @param dir directory path
+ * @returns the innermost package containing the directory, if any
+ */
+function packageOf(packages: string[], dir: string): string | undefined {
+  return packages
+    .filter(pkg => isWithin(pkg, dir))
+    .sort((a, b) => b.length - a.length)[0];
+}
+
+/**
+ * Lists the Go packages in a module, with their imports.
+ *
+ * Nested modules, `vendor` and `testdata` directories are skipped,
+ * like the Go tool does.
+ *
+ * @param files file system to read the modules from
+ * @param gomod parsed go.mod file
+ * @param pkg module directory, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns mapping of each Go package import path to its imports
+ */
+function goPackages(
+  files: FileSystem,
+  gomod: GoMod,
+  pkg: string,
+  checkoutPath: string,
+): Map<string, Set<string>> {
+  const packages = new Map<string, Set<string>>();
+  const walk = (dir: string) => {
+    const entries = files.readdirSync(path.join(checkoutPath, dir), {
+      withFileTypes: true,
+    });
+    for (const file of entries) {
+      const filepath = path.join(dir, file.name);
+      if (file.isDirectory()) {
+        const skipped = ['vendor', 'testdata'].includes(file.name);
+        const nested = path.join(checkoutPath, filepath, 'go.mod');
+        if (!skipped && !files.existsSync(nested)) {
+          walk(filepath);
+        }
+      } else if (file.name.endsWith('.go')) {
+        const importPath = goImportPath(gomod, pkg, dir);
+        const imports = packages.get(importPath) || new Set<string>();
+        const sourcePath = path.join(checkoutPath, filepath);
+        const source = files.readFileSync(sourcePath, 'utf8');
+        for (const imported of goImports(source)) {
+          imports.add(imported);
+        }
+        packages.set(importPath, imports);
+      }
+    }
+  };
+  walk(pkg);
+  return packages;
+}
+
+/**
+ * Gets the imports of a Go source file.
+ *
+ * @param source Go source code
+ * @returns imported package paths
+ */
+export function goImports(source: string): string[] {
+  const imports = [];
+  const importSpec = /^\s*(?:[\w.]+\s+)?"([^"]+)"/;
+  let inBlock = false;
+  for (const line of source.split('\n')) {
+    if (inBlock) {
+      if (line.trim().startsWith(')')) {
+        inBlock = false;
+        continue;
+      }
+      const spec = line.match(importSpec);
+      if (spec) {
+        imports.push(spec[1]);
+      }
+    } else if (/^import\s*\(/.test(line)) {
+      inBlock = true;
+    } else if (line.startsWith('import ')) {
+      const spec = line.slice('import '.length).match(importSpec);
+      if (spec) {
+        imports.push(spec[1]);
+      }
+    }
+  }
+  return imports;
+}
+
+/**
+ * Gets the import path of a Go package directory.
+ *
+ * @param gomod parsed go.mod file of the module
+ * @param pkg module directory, relative to the checkout path
+ * @param dir package directory, relative to the checkout path
+ * @returns Go import path
+ */
+function goImportPath(gomod: GoMod, pkg: string, dir: string): string {
+  const relative = path.relative(pkg, dir).split(path.sep).join('/');
+  return relative ? `${gomod.module}/${relative}` : gomod.module;
+}
+
+/**
+ * Resolves a Go import through the local module replacements.
+ *
+ * @param imported imported package path
+ * @param moduleDirs module paths mapped to their directory
+ * @param modules Go modules by directory
+ * @returns import path of the package in the repository module
+ */
+function resolveGoImport(
+  imported: string,
+  moduleDirs: Map<string, string>,
+  modules: Map<string, GoMod>,
+): string {
+  for (const [module, dir] of moduleDirs) {
+    if (imported === module || imported.startsWith(`${module}/`)) {
+      const gomod = modules.get(dir);
+      if (gomod && gomod.module !== module) {
+        return gomod.module + imported.slice(module.length);
+      }
+    }
+  }
+  return imported;
+}
+
+export function matches(
+  fullPath: string,
+  patterns: string[],
+  engine = simpleMatcher,
+): boolean {
+  return matchingPattern(fullPath, patterns, engine) !== null;
+}
+
+// Matches paths against a single pattern.
+export type Matcher = {
+  matches(fullPath: string): boolean;
+};
+
+export type MatchOptions = {
+  // Match regardless of case, engines that don't support it can ignore it.
+  ignoreCase?: boolean;
+};
+
+// Creates a matcher for a pattern. It must throw if the pattern is not
+// valid, so configs are validated.
+export type MatchEngine = (pattern: string, options?: MatchOptions) => Matcher;
+
+// Engines for the 'match-engine' config field, by name. Custom engines are
+// passed with `withMatchEngine` instead.
+export const matchEngines: Readonly<{[name: string]: MatchEngine}> = {
+  simple: simpleMatcher,
+  gitignore: gitignoreMatcher,
+  regexp: regexpMatcher,
+};
+
+/**
+ * Gets the match engine of a config.
+ *
+ * @param config config object
+ * @returns match engine
+ */
+function matchEngine(config: Config): MatchEngine {
+  const engine =
+    config[matchEngineKey] ??
+    matchEngines[config['match-engine'] || 'simple'] ??
+    simpleMatcher;
+  const ignoreCase = config['case-insensitive'] || false;
+  if (!ignoreCase && !config['normalize-unicode']) {
+    return engine;
+  }
+  return (pattern, options) => {
+    const normalize = (text: string) => normalizePath(config, text);
+    const matcher = engine(normalize(pattern), {ignoreCase, ...options});
+    return {matches: fullPath => matcher.matches(normalize(fullPath))};
+  };
+}
+
+/**
+ * Normalizes a path to compare it, with the config 'normalize-unicode'.
+ *
+ * @param config config object
+ * @param filepath path or pattern
+ * @returns path in NFC form if the config normalizes Unicode, or as is
+ */
+function normalizePath(config: Config, filepath: string): string {
+  return config['normalize-unicode'] ? filepath.normalize('NFC') : filepath;
+}
+
+/**
+ * Gets the form of a path to compare it with other paths, with the config
+ * 'case-insensitive' and 'normalize-unicode'.
+ *
+ * @param config config object
+ * @param filepath path to compare
+ * @returns path that is equal for all the paths that are the same
+ */
+function comparablePath(config: Config, filepath: string): string {
+  const normalized = normalizePath(config, filepath);
+  return config['case-insensitive'] ? normalized.toLowerCase() : normalized;
+}
+
+/**
+ * Matches paths with the default rules, in order: an exact full path, an
+ * exact filename, a glob pattern, or a regular expression.
+ *
+ * @param pattern pattern to match
+ * @param options how to match
+ * @returns matcher
+ */
+function simpleMatcher(pattern: string, options: MatchOptions = {}): Matcher {
+  const flags = options.ignoreCase ? 'i' : '';
+  const same = (a: string, b: string) =>
+    options.ignoreCase ? a.toLowerCase() === b.toLowerCase() : a === b;
+  return {
+    matches: fullPath =>
+      same(pattern, fullPath) ||
+      same(pattern, path.posix.basename(fullPath)) ||
+      globToRegExp(pattern, flags).test(fullPath) ||
+      // Globs like `dir/**` are not valid regular expressions, skip those.
+      (isRegExp(`(^|/)${pattern}$`) &&
+        new RegExp(`(^|/)${pattern}$`, flags).test(fullPath)),
+  };
+}
+
+/**
+ * Matches paths like gitignore files do.
+ *
+ * A pattern with a slash at the start or in the middle is relative to the
+ * root, otherwise it matches at any depth. Patterns match directories and
+ * everything beneath them, and a pattern ending with a slash only matches
+ * directories.
+ *
+ * @param pattern gitignore pattern
+ * @param options how to match
+ * @returns matcher
+ */
+function gitignoreMatcher(
+  pattern: string,
+  options: MatchOptions = {},
+): Matcher {
+  const directoryOnly = pattern.endsWith('/');
+  // A leading `**/` matches at any depth, like no slash at all.
+  const trimmed = pattern.replace(/\/$/, '').replace(/^\*\*\//, '');
+  const anchored = !pattern.startsWith('**/') && trimmed.includes('/');
+  const glob = trimmed
+    .replace(/^\//, '')
+    .split(/(\/\*\*\/|\/\*\*$|\*|\?|\[[^\]]*\])/)
+    .map(token => {
+      switch (token) {
+        case '/**/':
+          return '(/.*)?/';
+        case '/**':
+          return '/.*';
+        case '*':
+          return '[^/]*';
+        case '?':
+          return '[^/]';
+        default:
+          return token.startsWith('[')
+            ? token.replace(/^\[!/, '[^')
+            : token.replace(/[.+^${}()|[\]\\]/g, '\\$&');
+      }
+    })
+    .join('');
+  const prefix = anchored ? '^' : '^(.*/)?';
+  const suffix = directoryOnly ? '/.*$' : '(/.*)?$';
+  const flags = options.ignoreCase ? 'i' : '';
+  const regexp = new RegExp(`${prefix}${glob}${suffix}`, flags);
+  return {matches: fullPath => regexp.test(fullPath)};
+}
+
+/**
+ * Matches paths with a regular expression, like `^(src|lib)/.*_test\.go$`.
+ *
+ * The expression is not anchored, use `^` and `$` to match full paths.
+ *
+ * @param pattern regular expression
+ * @param options how to match
+ * @returns matcher
+ */
+function regexpMatcher(pattern: string, options: MatchOptions = {}): Matcher {
+  // The default match pattern is not a valid regular expression,
+  // it matches everything like in the other engines.
+  const flags = options.ignoreCase ? 'i' : '';
+  const regexp = new RegExp(pattern === '*' ? '' : pattern, flags);
+  return {matches: fullPath => regexp.test(fullPath)};
+}
+
+/**
+ * Finds the ignore pattern that ignores a path.
+ *
+ * Patterns starting with `!` re-include paths ignored by previous patterns,
+ * and the last matching pattern wins, like in gitignore files.
+ * To ignore a path starting with `!`, escape it as `\!`.
+ *
+ * @param fullPath path to match
+ * @param patterns ignore patterns, in order
+ * @param engine how to match the patterns
+ * @returns the ignore pattern, or null if the path is not ignored
+ */
+export function ignoringPattern(
+  fullPath: string,
+  patterns: string[],
+  engine = simpleMatcher,
+): string | null {
+  let ignoredBy = null;
+  for (const pattern of patterns) {
+    if (pattern.startsWith('!')) {
+      if (matchingPattern(fullPath, [pattern.slice(1)], engine) !== null) {
+        ignoredBy = null;
+      }
+    } else {
+      const escaped = pattern.replace(/^\\!/, '!');
+      if (matchingPattern(fullPath, [escaped], engine) !== null) {
+        ignoredBy = pattern;
+      }
+    }
+  }
+  return ignoredBy;
+}
+
+/**
+ * Finds the pattern that ignores a path, from the config or from the
+ * `.custardignore` files.
+ *
+ * The config's 'ignore' patterns apply first, then the `.custardignore`
+ * files from the checkout root down to the path's directory. Like in
+ * gitignore files, their patterns are relative to their directory, the
+ * last matching pattern wins, and `!` re-includes ignored paths.
+ *
+ * With the config 'respect-gitignore', the `.gitignore` files apply too,
+ * each before the `.custardignore` file of its directory.
+ *
+ * @param config config object
+ * @param filepath path to match, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns the ignore pattern, prefixed with its file if it comes from an
+ *   ignore file, or null if the path is not ignored
+ */
+function ignoredBy(
+  config: Config,
+  filepath: string,
+  checkoutPath: string,
+): string | null {
+  filepath = toSlash(filepath);
+  const ignored = ignoringPattern(
+    filepath,
+    asArray(withPresets(config).ignore) || [],
+    matchEngine(config),
+  );
+  const filenames = config['respect-gitignore']
+    ? [gitignoreFilename, ignoreFilename]
+    : [ignoreFilename];
+  return ignoreFilesPattern(config, filepath, checkoutPath, filenames, ignored);
+}
+
+/**
+ * Finds the pattern that ignores a path from the ignore files, from the
+ * checkout root down to the path's directory.
+ *
+ * @param config config object
+ * @param filepath path to match, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param filenames ignore file names, in the order they apply in a directory
+ * @param ignored pattern that ignores the path before the ignore files
+ * @returns the ignore pattern, prefixed with its file, or null if the path
+ *   is not ignored
+ */
+function ignoreFilesPattern(
+  config: Config,
+  filepath: string,
+  checkoutPath: string,
+  filenames: string[],
+  ignored: string | null,
+): string | null {
+  // Directories keep their trailing slash for directory-only patterns.
+  const slash = filepath.endsWith('/') ? '/' : '';
+  const parents = filepath.replace(/\/$/, '').split('/').slice(0, -1);
+  let dir = '';
+  for (const part of ['', ...parents]) {
+    dir = path.posix.join(dir, part);
+    for (const filename of filenames) {
+      const ignoreFile = path.posix.join(dir, filename);
+      const rules = ignoreFileRules(config, ignoreFile, checkoutPath);
+      const relative = path.posix.relative(dir, filepath) + slash;
+      for (const {line, negated, matcher} of rules) {
+        if (matcher.matches(normalizePath(config, relative))) {
+          ignored = negated ? null : `${ignoreFile}: ${line}`;
+        }
+      }
+    }
+  }
+  return ignored;
+}
+
+// Parsed ignore files, by config and then by path. Every path checks the
+// ignore files of all its parent directories, so they are read once per
+// run instead of once per path.
+const ignoreFileRuleLists = new WeakMap<Config, Map<string, IgnoreRule[]>>();
+
+type IgnoreRule = {
+  // Line of the ignore file, to report which pattern ignored a path.
+  line: string;
+  // Pattern starts with `!`, it re-includes the paths it matches.
+  negated: boolean;
+  matcher: Matcher;
+};
+
+/**
+ * Reads and compiles the patterns of an ignore file.
+ *
+ * @param config config object
+ * @param ignoreFile ignore file path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns rules in file order, or none if the file doesn't exist
+ */
+function ignoreFileRules(
+  config: Config,
+  ignoreFile: string,
+  checkoutPath: string,
+): IgnoreRule[] {
+  const fullPath = path.join(checkoutPath, ignoreFile);
+  return cachedForRun(ignoreFileRuleLists, config, fullPath, () => {
+    const files = filesOf(config);
+    if (!files.existsSync(fullPath)) {
+      return [];
+    }
+    const rules: IgnoreRule[] = [];
+    for (const rawLine of files.readFileSync(fullPath, 'utf8').split('\n')) {
+      const line = rawLine.trim();
+      if (line === '' || line.startsWith('#')) {
+        continue;
+      }
+      const negated = line.startsWith('!');
+      const pattern = negated
+        ? line.slice(1)
+        : line.replace(/^\\([#!])/, '$1');
+      const matcher = gitignoreMatcher(normalizePath(config, pattern), {
+        ignoreCase: config['case-insensitive'],
+      });
+      rules.push({line, negated, matcher});
+    }
+    return rules;
+  });
+}
+
+/**
+ * Finds the first pattern that matches a path.
+ *
+ * @param fullPath path to match
+ * @param patterns patterns to match against
+ * @param engine how to match the patterns
+ * @returns the matching pattern, or null if none matches
+ */
+export function matchingPattern(
+  fullPath: string,
+  patterns: string[],
+  engine = simpleMatcher,
+): string | null {
+  fullPath = toSlash(fullPath);
+  for (const pattern of patterns) {
+    if (engine(pattern).matches(fullPath)) {
+      return pattern;
+    }
+  }
+  return null;
+}
+
+/**
+ * Converts a glob pattern into a regular expression.
+ *
+ * Node does not support glob patterns as part of the standard library,
+ * so to avoid third-party dependencies we convert them to a regex.
+ *
+ * @param pattern glob pattern
+ * @param flags regular expression flags, like 'i' to ignore case
+ * @returns regular expression matching full paths or their suffixes
+ */
+function globToRegExp(pattern: string, flags = ''): RegExp {
+  const glob = pattern
+    .split(/(\*\*|\*|\.)/)
+    .map(token => ({'**': '.*', '*': '[^/]*', '.': '\\.'})[token] ?? token)
+    .join('');
+  return new RegExp(`(^|/)${glob}$`, flags);
+}
+
+/**
+ * Checks if a string is a valid regular expression.
+ *
+ * @param pattern regular expression
+ * @returns true if the regular expression is valid
+ */
+function isRegExp(pattern: string): boolean {
+  try {
+    new RegExp(pattern);
+    return true;
+  } catch (_) {
+    return false;
+  }
+}
+
+/**
+ * Checks if a path is within any of the config roots.
+ *
+ * @param config config object
+ * @param filepath path relative to the checkout path
+ * @returns true if the path is within a root, or no roots are defined
+ */
+export function isInRoots(config: Config, filepath: string): boolean {
+  const roots = configRoots(config);
+  return roots.some(root => isWithin(root, filepath));
+}
+
+/**
+ * Converts a path to use forward slashes as separators.
+ *
+ * Paths are compared with forward slashes internally, so patterns and
+ * package paths work the same way on Windows.
+ * Backslashes are always considered separators, even on Linux and macOS,
+ * since diffs can come from Windows tools.
+ *
+ * @param filepath path to convert
+ * @returns path with forward slashes
+ */
+export function toSlash(filepath: string): string {
+  return filepath.replaceAll('\\', '/');
+}
+
+/**
+ * Gets the directories to look for packages.
+ *
+ * @param config config object
+ * @returns roots with forward slashes, defaults to the checkout path
+ */
+export function configRoots(config: Config): string[] {
+  return (asArray(config.roots) || ['.']).map(toSlash);
+}
+
+/**
+ * Gets the packages to always exclude.
+ *
+ * @param config config object
+ * @returns excluded packages with forward slashes
+ */
+function excludedPackages(config: Config): string[] {
+  return (asArray(config['exclude-packages']) || []).map(toSlash);
+}
+
+/**
+ * Checks if a package is excluded.
+ *
+ * Excluded packages must be exact full matches, unless 'exclude-subpackages'
+ * is set, then everything beneath them is excluded too.
+ *
+ * @param config config object
+ * @param pkg package path, relative to the checkout path
+ * @returns true if the package is excluded
+ */
+function isExcluded(config: Config, pkg: string): boolean {
+  const subpackages = config['exclude-subpackages'] || false;
+  const comparable = comparablePath(config, pkg);
+  return excludedPackages(config)
+    .map(excluded => comparablePath(config, excluded))
+    .some(
+      excluded =>
+        excluded === comparable ||
+        (subpackages && comparable.startsWith(`${excluded}/`)),
+    );
+}
+
+/**
+ * Checks if a path is within a directory.
+ *
+ * @param dir directory path
+ * @param filepath path to check
+ * @returns true if the path is the directory or inside it
+ */
+function isWithin(dir: string, filepath: string): boolean {
+  const relative = path.relative(dir, filepath);
+  return !relative.startsWith('..') && !path.isAbsolute(relative);
+}
+
+/**
+ * @deprecated use `explainDiff`, which also reports the matching patterns.
+ */
+export function fileMatchesConfig(config: Config, filepath: string): boolean {
+  const match = asArray(withPresets(config).match) || ['*'];
+  const ignore = asArray(withPresets(config).ignore) || [];
+  const engine = matchEngine(config);
+  return (
+    matches(filepath, match, engine) &&
+    ignoringPattern(filepath, ignore, engine) === null
+  );
+}
+
+/**
+ * @deprecated use `affectedDetailed`, which also handles global files.
+ */
+export function matchPackages(
+  config: Config,
+  paths: string[],
+  checkoutPath: string,
+): string[] {
+  return [...matchPackageDiffs(config, paths, checkoutPath).keys()];
+}
+
+/**
+ * Matches the diffs to their packages.
+ *
+ * @param config config object
+ * @param paths list of files changed
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the matching, checked on every diff
+ * @returns mapping of each package to the diffs that matched it
+ */
+export function matchPackageDiffs(
+  config: Config,
+  paths: string[],
+  checkoutPath: string,
+  signal?: AbortSignal,
+): Map<string, string[]> {
+  const packages = new Map<string, string[]>();
+  const sites = findSites(config, checkoutPath);
+  for (const filepath of paths) {
+    signal?.throwIfAborted();
+    addPackageDiff(config, filepath, checkoutPath, sites, packages);
+  }
+  return withoutExcluded(config, packages);
+}
+
+/**
+ * Matches a diff to its package, and adds it to the package diffs.
+ *
+ * @param config config object
+ * @param filepath file changed
+ * @param checkoutPath path to the repository checkout
+ * @param sites documentation sites, see `findSites`
+ * @param packages mapping of each package to its diffs, updated in place
+ */
+function addPackageDiff(
+  config: Config,
+  filepath: string,
+  checkoutPath: string,
+  sites: Site[],
+  packages: Map<string, string[]>,
+) {
+  const explanation = explainDiff(config, filepath, checkoutPath, sites);
+  if (explanation.package === null) {
+    if (explanation.reason === 'path does not exist') {
+      // The package directory does not exist, it might have been removed.
+      // We can't run anything on it, so skip it, see `removedPackages`.
+      console.error(
+        message(
+          'W002',
+          `path '${filepath}' does not exist, it might have been removed.`,
+        ),
+      );
+    }
+    return;
+  }
+  if (explanation.package === '.') {
+    // Warn which file was considered a global change for debugging.
+    console.error(message('W003', `Global file changed: ${filepath}`));
+  }
+  if (explanation.reason === 'archived package') {
+    console.error(
+      message('W004', `Skipping archived package: ${explanation.package}`),
+    );
+    return;
+  }
+  // A boundary groups its packages, a file outside them affects them all.
+  const targets =
+    explanation.reason === 'boundary'
+      ? findPackages(config, explanation.package, checkoutPath)
+      : [explanation.package];
+  for (const pkg of targets) {
+    packages.set(pkg, [...(packages.get(pkg) || []), filepath]);
+  }
+}
+
+/**
+ * Removes the excluded packages from the package diffs.
+ *
+ * @param config config object
+ * @param packages mapping of each package to its diffs, updated in place
+ * @returns the same mapping, without the excluded packages
+ */
+function withoutExcluded(
+  config: Config,
+  packages: Map<string, string[]>,
+): Map<string, string[]> {
+  for (const pkg of packages.keys()) {
+    if (isExcluded(config, pkg)) {
+      packages.delete(pkg);
+    }
+  }
+  return packages;
+}
+
+/**
+ * Finds the packages that have been removed from diffs.
+ *
+ * A package is removed when its package file was deleted and the directory
+ * is not a package anymore. These are skipped by `affected`, since there is
+ * nothing left to build, but CI might need to tear down their deployments.
+ *
+ * @param config config object
+ * @param diffs list of files changed
+ * @param checkoutPath path to the repository checkout
+ * @returns list of removed package paths
+ */
+export function removedPackages(
+  config: Config,
+  diffs: string[],
+  checkoutPath: string,
+): string[] {
+  const names = packageFileNames(config);
+  const removed = new Set<string>();
+  for (const diff of diffs.map(toSlash)) {
+    const dir = path.posix.dirname(diff);
+    if (
+      dir !== '.' &&
+      names.some(name => isPackageFileName(name, path.posix.basename(diff))) &&
+      !filesOf(config).existsSync(path.join(checkoutPath, diff)) &&
+      !isPackageDir(config, path.join(checkoutPath, dir)) &&
+      isInRoots(config, diff) &&
+      !isExcluded(config, dir)
+    ) {
+      removed.add(dir);
+    }
+  }
+  return [...removed].sort();
+}
+
+/**
+ * Checks if a file name is a package file, including globs like `*.csproj`.
+ *
+ * @param packageFile package file name or glob
+ * @param name file name to check
+ * @returns true if the file name matches
+ */
+function isPackageFileName(packageFile: string, name: string): boolean {
+  return packageFile.includes('*')
+    ? globToRegExp(packageFile).test(name)
+    : packageFile === name;
+}
+
+/**
+ * Lists all the filenames that can define a package.
+ *
+ * @param config config object
+ * @returns filenames from the package files, groups, and site generators
+ */
+function packageFileNames(config: Config): string[] {
+  const flatten = (packageFile: PackageFile): string[] => {
+    if (typeof packageFile === 'string') {
+      return [packageFile];
+    }
+    if (Array.isArray(packageFile)) {
+      return packageFile.flatMap(flatten);
+    }
+    return 'any' in packageFile
+      ? packageFile.any.flatMap(flatten)
+      : packageFile.all.flatMap(flatten);
+  };
+  const generators = asArray(config['site-generators']) || [];
+  return [
+    ...flatten(withPresets(config)['package-file'] || []),
+    ...generators.flatMap(generator => siteGeneratorFiles[generator] || []),
+  ];
+}
+
+/**
+ * Explains how a diff resolves to a package.
+ *
+ * @param config config object
+ * @param filepath file changed, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param sites documentation sites, found if not provided
+ * @returns explanation of the diff
+ */
+export function explainDiff(
+  config: Config,
+  filepath: string,
+  checkoutPath: string,
+  sites = findSites(config, checkoutPath),
+): DiffExplanation {
+  filepath = toSlash(filepath);
+  const explanation: DiffExplanation = {
+    diff: filepath,
+    match: matchingPattern(
+      filepath,
+      asArray(withPresets(config).match) || ['*'],
+      matchEngine(config),
+    ),
+    ignore: ignoredBy(config, filepath, checkoutPath),
+    package: null,
+    reason: '',
+  };
+  if (explanation.match === null) {
+    // The file doesn't match the config file, so skip it.
+    return {...explanation, reason: 'no match pattern'};
+  }
+  if (explanation.ignore !== null) {
+    return {...explanation, reason: 'ignored'};
+  }
+  if (!isInRoots(config, filepath)) {
+    // The file is outside the roots, custard must not touch it.
+    console.debug(`Skipping '${filepath}', it's outside the roots.`);
+    return {...explanation, reason: 'outside roots'};
+  }
+  console.trace(message('T001', `Resolving package for '${filepath}'`));
+  let pkg = getPackageDir(config, filepath, checkoutPath);
+  if (pkg === null) {
+    return {...explanation, reason: 'path does not exist'};
+  }
+  let reason = 'package file found';
+  if (pkg !== '.' && !isPackageDir(config, path.join(checkoutPath, pkg))) {
+    reason = 'boundary';
+  }
+  if (pkg === '.') {
+    // Site content can live outside of the site directory.
+    const site = sites.find(site =>
+      site.content.some(dir => isWithin(dir, filepath)),
+    );
+    if (!site) {
+      return {...explanation, package: pkg, reason: 'global file'};
+    }
+    pkg = site.path;
+    reason = 'site content';
+  }
+  if (isExcluded(config, pkg)) {
+    return {...explanation, package: pkg, reason: 'excluded package'};
+  }
+  if (isArchived(config, pkg, checkoutPath)) {
+    return {...explanation, package: pkg, reason: 'archived package'};
+  }
+  return {...explanation, package: pkg, reason};
+}
+
+/**
+ * Explains why a package was or was not affected by the diffs.
+ *
+ * This is the inverse of `explain`, it starts from a package instead
+ * of from the diffs.
+ *
+ * @param config config object
+ * @param pkg package path, relative to the checkout path
+ * @param diffs list of files changed
+ * @param checkoutPath path to the repository checkout
+ * @returns why the package was or was not affected
+ */
+export function whyNot(
+  config: Config,
+  pkg: string,
+  diffs: string[],
+  checkoutPath: string,
+): WhyNot {
+  pkg = toSlash(pkg);
+  const explanations = diffs
+    .map(diff => explainDiff(config, diff, checkoutPath))
+    .filter(e => isWithin(pkg, e.diff));
+  const whyNot = (reason: string) => ({
+    package: pkg,
+    selected: false,
+    reason,
+    diffs: explanations,
+  });
+  if (affected(config, diffs, checkoutPath).includes(pkg)) {
+    return {...whyNot('affected'), selected: true};
+  }
+  if (!filesOf(config).existsSync(path.join(checkoutPath, pkg))) {
+    return whyNot('path does not exist');
+  }
+  const isPackage =
+    isPackageDir(config, path.join(checkoutPath, pkg)) ||
+    isBoundary(config, pkg) ||
+    findSites(config, checkoutPath).some(site => site.path === pkg);
+  if (!isPackage) {
+    return whyNot('not a package');
+  }
+  if (isExcluded(config, pkg)) {
+    // Packages in the 'exclusions-file' are only excluded for a while.
+    const exclusion = config[exclusionsKey]?.find(
+      exclusion => toSlash(exclusion.path) === pkg,
+    );
+    return exclusion
+      ? {...whyNot('quarantined'), exclusion}
+      : whyNot('excluded package');
+  }
+  if (!isInRoots(config, pkg)) {
+    return whyNot('outside roots');
+  }
+  if (isArchived(config, pkg, checkoutPath)) {
+    return whyNot('archived package');
+  }
+  if (explanations.length === 0) {
+    return whyNot('no changes in package');
+  }
+  if (explanations.some(e => e.package !== null && e.package !== pkg)) {
+    return whyNot('changes in a nested package');
+  }
+  if (explanations.some(e => e.reason === 'ignored')) {
+    return whyNot('ignored');
+  }
+  return whyNot('no match pattern');
+}
+
+// Number of packages in the `mostAffected` list of a simulation.
+const mostAffectedCount = 10;
+
+/**
+ * Replays the diffs of past commits through a config, to measure the
+ * impact of config changes before making them.
+ *
+ * Packages are resolved against the current checkout, packages that
+ * were removed since are skipped.
+ *
+ * @param config config object
+ * @param history diffs of each commit
+ * @param checkoutPath path to the repository checkout
+ * @returns aggregate impact of the config
+ */
+export function simulate(
+  config: Config,
+  history: string[][],
+  checkoutPath: string,
+): Simulation {
+  const packages = configRoots(config).flatMap(root => [
+    ...findPackages(config, root, checkoutPath),
+  ]);
+  const selections: {[pkg: string]: number} = {};
+  for (const pkg of packages) {
+    selections[pkg] = 0;
+  }
+  let total = 0;
+  let maxAffected = 0;
+  let allAffected = 0;
+  for (const diffs of history) {
+    const selected = affected(config, diffs, checkoutPath);
+    for (const pkg of selected) {
+      selections[pkg] = (selections[pkg] || 0) + 1;
+    }
+    total += selected.length;
+    maxAffected = Math.max(maxAffected, selected.length);
+    if (packages.length > 0 && selected.length >= packages.length) {
+      allAffected++;
+    }
+  }
+  const averageAffected = history.length > 0 ? total / history.length : 0;
+  const mostAffected = Object.keys(selections)
+    .filter(pkg => selections[pkg] > 0)
+    .sort((a, b) => selections[b] - selections[a] || (a < b ? -1 : 1))
+    .slice(0, mostAffectedCount);
+  return {
+    commits: history.length,
+    averageAffected,
+    blastRadius: packages.length > 0 ? averageAffected / packages.length : 0,
+    maxAffected,
+    allAffected,
+    selections,
+    mostAffected,
+    neverSelected: packages.filter(pkg => selections[pkg] === 0).sort(),
+  };
+}
+
+/**
+ * Finds the packages that the top of a stack of changes affects, like a
+ * pull request stacked on other pull requests.
+ *
+ * The packages affected from the base to the parent already ran in the
+ * changes below, so only the packages that the changes from the parent to
+ * the head affect need to run, including the ones also affected below.
+ *
+ * @param config config object
+ * @param base base revision of the stack, like the main branch
+ * @param parent revision the top changes are stacked on, like `HEAD~1`
+ * @param head head revision of the stack, checked out at the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param vcs version control provider, defaults to the git command line
+ * @returns packages affected by the whole stack, by the changes below, and
+ *   added by the top changes
+ */
+export function stackedAffected(
+  config: Config,
+  base: string,
+  parent: string,
+  head: string,
+  checkoutPath = '.',
+  vcs: VCS = gitCli(checkoutPath),
+): StackedAffected {
+  return {
+    all: affected(config, vcs.diff(base, head), checkoutPath),
+    below: affected(config, vcs.diff(base, parent), checkoutPath),
+    added: affected(config, vcs.diff(parent, head), checkoutPath),
+  };
+}
+
+/**
+ * Compares the packages of two config versions, to review the impact of a
+ * config change.
+ *
+ * @param oldConfig config object before the change
+ * @param newConfig config object after the change
+ * @param checkoutPath path to the repository checkout
+ * @returns packages included, excluded, or with a different CI setup, and
+ *   the changed CI setup defaults
+ */
+export function configDiff(
+  oldConfig: Config,
+  newConfig: Config,
+  checkoutPath = '.',
+): ConfigDiff {
+  const packages = (config: Config) =>
+    configRoots(config)
+      .flatMap(root => [...findPackages(config, root, checkoutPath)])
+      .filter(pkg => !isExcluded(config, pkg));
+  const before = new Set(packages(oldConfig));
+  const after = new Set(packages(newConfig));
+  const ciSetup = (config: Config, pkg: string) =>
+    JSON.stringify(loadPackage(config, pkg, checkoutPath).ciSetup);
+  return {
+    included: [...after].filter(pkg => !before.has(pkg)).sort(),
+    excluded: [...before].filter(pkg => !after.has(pkg)).sort(),
+    changed: [...after]
+      .filter(
+        pkg =>
+          before.has(pkg) &&
+          ciSetup(oldConfig, pkg) !== ciSetup(newConfig, pkg),
+      )
+      .sort(),
+    defaults: defaultsChanges(
+      oldConfig['ci-setup-defaults'] || {},
+      newConfig['ci-setup-defaults'] || {},
+    ),
+  };
+}
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Compares two CI setup defaults field by field.
+ *
+ * Nested objects are compared by each of their fields, any other values
+ * like lists are compared as a whole.
+ *
+ * @param before defaults of the old config
+ * @param after defaults of the new config
+ * @param prefix dotted path of the defaults
+ * @returns changed fields, sorted by path
+ */
+function defaultsChanges(
+  before: any,
+  after: any,
+  prefix = '',
+): DefaultsChange[] {
+  const fields = new Set([...Object.keys(before), ...Object.keys(after)]);
+  const changes: DefaultsChange[] = [];
+  for (const field of [...fields].sort()) {
+    const a = before[field];
+    const b = after[field];
+    if (isObject(a) && isObject(b)) {
+      changes.push(...defaultsChanges(a, b, `${prefix}${field}.`));
+    } else if (JSON.stringify(a) !== JSON.stringify(b)) {
+      changes.push({field: `${prefix}${field}`, before: a, after: b});
+    }
+  }
+  return changes;
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
+
+/**
+ * Explains how the affected packages are computed from the diffs.
+ *
+ * This is a dry-run of `affected`, useful to debug why a package
+ * did or did not run.
+ *
+ * @param config config object
+ * @param diffs list of files changed
+ * @param checkoutPath path to the repository checkout
+ * @returns explanation report
+ */
+export function explain(
+  config: Config,
+  diffs: string[],
+  checkoutPath: string,
+): Explanation {
+  const sites = findSites(config, checkoutPath);
+  const explanations = diffs.map(diff =>
+    explainDiff(config, diff, checkoutPath, sites),
+  );
+  const excluded = explanations
+    .filter(e => e.reason === 'excluded package')
+    .map(e => e.package || '');
+  return {
+    diffs: explanations,
+    excluded: [...new Set(excluded)].sort(),
+    archived: archivedPackages(config, explanations, checkoutPath),
+    affected: affected(config, diffs, checkoutPath),
+  };
+}
+
+/**
+ * Finds the archived packages that the diffs would have affected otherwise.
+ *
+ * @param config config object
+ * @param explanations explanation of each diff, see `explainDiff`
+ * @param checkoutPath path to the repository checkout
+ * @returns archived package paths, sorted
+ */
+function archivedPackages(
+  config: Config,
+  explanations: DiffExplanation[],
+  checkoutPath: string,
+): string[] {
+  const archived = explanations
+    .filter(e => e.reason === 'archived package')
+    .map(e => e.package || '');
+  if (explanations.some(e => e.reason === 'global file')) {
+    // Archived packages are also skipped when all packages are affected.
+    for (const root of configRoots(config)) {
+      archived.push(...findArchivedPackages(config, root, checkoutPath));
+    }
+  }
+  return [...new Set(archived)].sort();
+}
+
+/**
+ * Creates a manifest with the full decision of which packages to run.
+ *
+ * The manifest is computed once, and later CI stages load it with
+ * `loadManifest` instead of computing it again.
+ *
+ * @param config config object
+ * @param diffs list of files changed
+ * @param checkoutPath path to the repository checkout
+ * @returns run manifest
+ */
+export function createManifest(
+  config: Config,
+  diffs: string[],
+  checkoutPath: string,
+): Manifest {
+  const affectedPackages = affectedDetailed(config, diffs, checkoutPath);
+  const sites = findSites(config, checkoutPath);
+  const explanations = diffs.map(diff =>
+    explainDiff(config, diff, checkoutPath, sites),
+  );
+  const ciSetup: {[pkg: string]: CISetup} = {};
+  for (const {path: pkg} of affectedPackages) {
+    if (pkg !== allPackages) {
+      ciSetup[pkg] = loadPackage(config, pkg, checkoutPath).ciSetup;
+    }
+  }
+  return {
+    'manifest-version': manifestVersion,
+    'custard-version': version,
+    'config-hash': configHash(config),
+    diffs,
+    changed: [...matchPackageDiffs(config, diffs, checkoutPath).keys()],
+    affected: affectedPackages,
+    removed: removedPackages(config, diffs, checkoutPath),
+    archived: archivedPackages(config, explanations, checkoutPath),
+    'ci-setup': ciSetup,
+  };
+}
+
+/**
+ * Loads a run manifest created by an earlier CI stage.
+ *
+ * @param filePath path to the manifest file
+ * @param config if provided, the config must be the one used to create it
+ * @returns run manifest
+ */
+export function loadManifest(filePath: string, config?: Config): Manifest {
+  const manifest: Manifest = JSON.parse(fs.readFileSync(filePath, 'utf8'));
+  const manifestFileVersion = manifest['manifest-version'];
+  if (manifestFileVersion !== manifestVersion) {
+    throw new Error(
+      message(
+        'E023',
+        `unsupported manifest version ${manifestFileVersion} in ${filePath}, expected ${manifestVersion}`,
+      ),
+    );
+  }
+  if (config && manifest['config-hash'] !== configHash(config)) {
+    throw new Error(
+      message(
+        'E024',
+        `manifest ${filePath} was created with a different config`,
+      ),
+    );
+  }
+  return {...manifest, archived: manifest.archived ?? []};
+}
+
+/**
+ * Hashes a config, independently of the order of its fields.
+ *
+ * @param config config object
+ * @returns SHA-256 hex digest
+ */
+export function configHash(config: Config): string {
+  const sortKeys = (_key: string, value: unknown) =>
+    value && typeof value === 'object' && !Array.isArray(value)
+      ? Object.fromEntries(Object.entries(value).sort())
+      : value;
+  const canonical = JSON.stringify(config, sortKeys);
+  return crypto.createHash('sha256').update(canonical).digest('hex');
+}
+
+/**
+ * Hashes the files of a package, for cache keys and change detection
+ * without git.
+ *
+ * Only the files that could affect the package count: files that match
+ * the config 'match' patterns and are not ignored, skipping nested packages
+ * and boundaries unless 'nested-packages' is parent. The digest covers the
+ * file paths and contents in a stable order, so it is the same on any
+ * machine with the same files.
+ *
+ * @param config config object
+ * @param pkg package path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns SHA-256 hex digest
+ */
+export function hashPackage(
+  config: Config,
+  pkg: string,
+  checkoutPath = '.',
+): string {
+  const hash = crypto.createHash('sha256');
+  const patterns = asArray(withPresets(config).match) || ['*'];
+  const engine = matchEngine(config);
+  const files = filesOf(config);
+  const walk = (dir: string) => {
+    const entries = files
+      .readdirSync(path.join(checkoutPath, dir), {withFileTypes: true})
+      .sort((a, b) => (a.name < b.name ? -1 : a.name > b.name ? 1 : 0));
+    for (const entry of entries) {
+      const filepath = toSlash(path.join(dir, entry.name));
+      if (entry.isDirectory()) {
+        const fullPath = path.join(checkoutPath, filepath);
+        const nested =
+          isBoundary(config, filepath) ||
+          (isPackageDir(config, fullPath) &&
+            config['nested-packages'] !== 'parent');
+        if (entry.name !== '.git' && !nested) {
+          walk(filepath);
+        }
+      } else if (
+        entry.isFile() &&
+        matchingPattern(filepath, patterns, engine) !== null &&
+        ignoredBy(config, filepath, checkoutPath) === null
+      ) {
+        hash.update(`${path.posix.relative(toSlash(pkg), filepath)}\0`);
+        const fullPath = path.join(checkoutPath, filepath);
+        // Other file systems only read text, which hashes to the same bytes.
+        hash.update(
+          files === fs
+            ? fs.readFileSync(fullPath)
+            : files.readFileSync(fullPath, 'utf8'),
+        );
+        hash.update('\0');
+      }
+    }
+  };
+  walk(pkg);
+  return hash.digest('hex');
+}
+
+/**
+ * Uses another file system to find the packages in, like an in-memory file
+ * system for tests.
+ *
+ * Finding packages, checking package directories, and loading ci-setup
+ * files with the returned config use it, including asynchronous ones like
+ * `validateSetupFiles`, and hashing packages. Config files are still read
+ * from the OS file system, and so is the 'package-index' file, since it's
+ * written back there. `rewriteSetupFiles` also writes to the OS file system.
+ *
+ * @param config config object
+ * @param files file system to use instead of the OS file system
+ * @returns a copy of the config that uses the file system
+ */
+export function withFileSystem(config: Config, files: FileSystem): Config {
+  return {...config, [fileSystemKey]: files};
+}
+
+/**
+ * Uses a custom match engine for the 'match' and 'ignore' patterns, instead
+ * of the config's 'match-engine'.
+ *
+ * Patterns are only checked with it when validating the returned config,
+ * since the config was loaded before.
+ *
+ * @param config config object
+ * @param engine match engine, like one that delegates to `matchEngines`
+ * @returns a copy of the config that uses the match engine
+ */
+export function withMatchEngine(config: Config, engine: MatchEngine): Config {
+  return {...config, [matchEngineKey]: engine};
+}
+
+/**
+ * Gets the file system to find the packages in.
+ *
+ * @param config config object
+ * @returns the config's file system, or the OS file system
+ */
+function filesOf(config: Config): FileSystem {
+  return config[fileSystemKey] ?? fs;
+}
+
+/**
+ * Reads a file without blocking other reads, if the file system can.
+ *
+ * @param files file system to read from
+ * @param filePath path to the file
+ * @param signal signal to cancel the read
+ * @returns file contents
+ */
+export async function readFileAsync(
+  files: FileSystem,
+  filePath: string,
+  signal?: AbortSignal,
+): Promise<string> {
+  if (files === fs) {
+    return fs.promises.readFile(filePath, {encoding: 'utf8', signal});
+  }
+  if (files.readFileAsync) {
+    return files.readFileAsync(filePath, signal);
+  }
+  return files.readFileSync(filePath, 'utf8');
+}
+
+/**
+ * Finds all the packages under a root directory recursively.
+ *
+ * Packages are yielded as they are found, before the whole directory tree
+ * is walked, unless the config has a 'package-index'.
+ *
+ * @param config config object
+ * @param root directory to search, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the walk, checked on every directory;
+ *   timers like `AbortSignal.timeout(ms)` only fire while the caller awaits
+ *   between the packages yielded
+ * @returns generator of package paths relative to the checkout path
+ */
+export function* findPackages(
+  config: Config,
+  root: string,
+  checkoutPath = '.',
+  signal?: AbortSignal,
+): Generator<string> {
+  for (const dir of packageDirs(config, root, checkoutPath, signal)) {
+    signal?.throwIfAborted();
+    if (!isArchived(config, dir, checkoutPath)) {
+      yield dir;
+    }
+  }
+}
+
+/**
+ * Finds the archived packages, which are skipped by `findPackages`.
+ *
+ * @param config config object
+ * @param root directory to search, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns generator of package paths relative to the checkout path
+ */
+export function* findArchivedPackages(
+  config: Config,
+  root: string,
+  checkoutPath = '.',
+): Generator<string> {
+  for (const dir of packageDirs(config, root, checkoutPath)) {
+    if (isArchived(config, dir, checkoutPath)) {
+      yield dir;
+    }
+  }
+}
+
+/**
+ * Checks if a package is archived, or has reached its end of life date.
+ *
+ * @param config config object
+ * @param dir package path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param today date to compare the end of life date against
+ * @returns true if the package is archived
+ */
+export function isArchived(
+  config: Config,
+  dir: string,
+  checkoutPath = '.',
+  today = new Date(),
+): boolean {
+  const defaults = ciSetupDefaults(config, dir, checkoutPath);
+  // Only these two fields are read, an invalid CI setup file fails when the
+  // package is loaded, not when any package is searched for.
+  let own: CISetup = {};
+  try {
+    own = readCISetup(config, path.join(checkoutPath, dir))?.ciSetup ?? {};
+  } catch {
+    // Not archived, so the package is loaded and reports the error.
+  }
+  const ciSetup = mergeCISetup(defaults, own);
+  if (ciSetup.archived === true) {
+    return true;
+  }
+  const eolDate = ciSetup['eol-date'];
+  return eolDate !== undefined && new Date(eolDate) <= today;
+}
+
+/**
+ * Gets the package directories under a root, including archived ones.
+ *
+ * Directories are yielded as the walk finds them, so callers can start
+ * working on the first packages before the walk finishes.
+ * If the config has a 'package-index', the directories come from the index,
+ * and the index file is updated with the changes.
+ *
+ * @param config config object
+ * @param root directory to search, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the walk
+ * @returns generator of package paths relative to the checkout path
+ */
+function* packageDirs(
+  config: Config,
+  root: string,
+  checkoutPath: string,
+  signal?: AbortSignal,
+): Generator<string> {
+  const indexFile = config['package-index'];
+  if (indexFile === undefined) {
+    const dirs = findPackageDirs(config, root, checkoutPath, signal);
+    yield* timedIter('walk', dirs);
+    return;
+  }
+  yield* timed('walk', () => {
+    const index = packageIndex(
+      config,
+      checkoutPath,
+      path.join(checkoutPath, indexFile),
+      signal,
+    );
+    const dirs = index.packageDirs(root);
+    index.save();
+    return dirs;
+  });
+}
+
+/**
+ * Opens a package index, which persists the package directories found.
+ *
+ * Directories whose modification time didn't change since the index was
+ * saved have the same subdirectories and package files, so they are not
+ * read again. Only the directories with added or removed entries are.
+ * The index is discarded if the config changes, and it's not used when
+ * following symlinks, since their targets can change without notice.
+ *
+ * @param config config object
+ * @param checkoutPath path to the repository checkout
+ * @param filePath path to the index file, it's created if it doesn't exist
+ * @param signal signal to cancel the walks
+ * @returns package index
+ */
+export function packageIndex(
+  config: Config,
+  checkoutPath: string,
+  filePath: string,
+  signal?: AbortSignal,
+): PackageIndex {
+  const hash = configHash(config);
+  let previous: {[dir: string]: PackageIndexEntry} = {};
+  if (fs.existsSync(filePath)) {
+    const data = JSON.parse(fs.readFileSync(filePath, 'utf8'));
+    if (
+      data['index-version'] === packageIndexVersion &&
+      data['config-hash'] === hash
+    ) {
+      previous = data.dirs;
+    } else {
+      console.debug(`Package index is outdated, rebuilding: ${filePath}`);
+    }
+  }
+  const dirs: {[dir: string]: PackageIndexEntry} = {};
+
+  const files = filesOf(config);
+  const entry = (dir: string): PackageIndexEntry => {
+    const fullPath = path.join(checkoutPath, dir);
+    // File systems without modification times are read every time.
+    const stat = files.statSync(fullPath, {throwIfNoEntry: false});
+    const mtime = stat?.mtimeMs ?? NaN;
+    const cached = previous[dir];
+    if (cached && cached.mtime === mtime) {
+      return cached;
+    }
+    console.debug(`Package index: reading ${fullPath}`);
+    const subdirs = files
+      .readdirSync(fullPath, {withFileTypes: true})
+      .filter(file => file.isDirectory())
+      .map(file => file.name);
+    return {
+      mtime,
+      subdirs,
+      package: isPackageDir(config, fullPath),
+    };
+  };
+
+  const walked: string[] = [];
+
+  const walk = function* (root: string): Generator<string> {
+    signal?.throwIfAborted();
+    dirs[root] = dirs[root] || entry(root);
+    for (const name of dirs[root].subdirs) {
+      const dir = toSlash(path.join(root, name));
+      if (isPruned(config, dir, checkoutPath)) {
+        continue;
+      }
+      dirs[dir] = entry(dir);
+      if (dirs[dir].package && !isExcluded(config, dir)) {
+        yield dir;
+      }
+      if (
+        dirs[dir].package &&
+        config['nested-packages'] === 'parent' &&
+        isPackageDir(config, path.join(checkoutPath, dir))
+      ) {
+        continue;
+      }
+      yield* walk(dir);
+    }
+  };
+
+  return {
+    packageDirs: root => {
+      if ((config.symlinks || 'skip') !== 'skip') {
+        return [...findPackageDirs(config, root, checkoutPath, signal)];
+      }
+      walked.push(toSlash(root));
+      return [...walk(toSlash(root))];
+    },
+
+    save: () => {
+      // Keep the directories of other roots, drop the removed ones.
+      const kept = Object.entries(previous).filter(
+        ([dir]) => !walked.some(root => isWithin(root, dir)),
+      );
+      const data = {
+        'index-version': packageIndexVersion,
+        'config-hash': hash,
+        dirs: {...Object.fromEntries(kept), ...dirs},
+      };
+      fs.writeFileSync(filePath, JSON.stringify(data));
+    },
+  };
+}
+
+/**
+ * Walks a directory for packages, including archived ones.
+ *
+ * @param config config object
+ * @param root directory to search, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the walk, checked on every directory
+ * @returns generator of package paths relative to the checkout path
+ */
+function* findPackageDirs(
+  config: Config,
+  root: string,
+  checkoutPath: string,
+  signal?: AbortSignal,
+  ancestors = new Set<string>(),
+): Generator<string> {
+  signal?.throwIfAborted();
+  const files = filesOf(config);
+  const policy = config.symlinks || 'skip';
+  if (policy === 'follow') {
+    // Real paths of the directories above, a symlink to any of them
+    // is a cycle.
+    ancestors = new Set(ancestors);
+    ancestors.add(files.realpathSync(path.join(checkoutPath, root)));
+  }
+  const entries = files.readdirSync(path.join(checkoutPath, root), {
+    withFileTypes: true,
+  });
+  for (const file of entries) {
+    const dir = toSlash(path.join(root, file.name));
+    const fullPath = path.join(checkoutPath, dir);
+    if (file.isSymbolicLink() && isDirectory(files, fullPath)) {
+      if (policy === 'error') {
+        throw new Error(
+          message('E025', `symlinked directory found: ${fullPath}`),
+        );
+      }
+      if (policy !== 'follow') {
+        console.debug(`Skipping symlinked directory: ${fullPath}`);
+        continue;
+      }
+    } else if (!file.isDirectory()) {
+      continue;
+    }
+    if (
+      policy === 'follow' &&
+      ancestors.has(files.realpathSync(fullPath))
+    ) {
+      console.error(message('W010', `Skipping symlink cycle: ${fullPath}`));
+      continue;
+    }
+    if (isPruned(config, dir, checkoutPath)) {
+      console.debug(`Pruning directory: ${fullPath}`);
+      continue;
+    }
+    const isPackage = isPackageDir(config, fullPath);
+    if (isPackage && !isExcluded(config, dir)) {
+      yield dir;
+    }
+    if (isPackage && config['nested-packages'] === 'parent') {
+      console.debug(`Skipping nested packages of: ${dir}`);
+      continue;
+    }
+    yield* findPackageDirs(config, dir, checkoutPath, signal, ancestors);
+  }
+}
+
+/**
+ * Checks if the search for packages skips a directory and everything
+ * beneath it, from the config 'prune', 'prune-ignored', and 'max-depth'.
+ *
+ * Like in gitignore files, files beneath a pruned directory can't be
+ * re-included, so no packages are found there.
+ *
+ * @param config config object
+ * @param dir directory path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns true if the directory is not searched
+ */
+function isPruned(config: Config, dir: string, checkoutPath: string): boolean {
+  dir = toSlash(dir);
+  const maxDepth = config['max-depth'];
+  if (maxDepth !== undefined && dir.split('/').length > maxDepth) {
+    return true;
+  }
+  // The trailing slash matches directory-only patterns, like `build/`.
+  const prune = asArray(config.prune) || [];
+  const ignoreCase = config['case-insensitive'];
+  const normalized = normalizePath(config, `${dir}/`);
+  if (
+    prune.some(pattern =>
+      gitignoreMatcher(normalizePath(config, pattern), {ignoreCase}).matches(
+        normalized,
+      ),
+    )
+  ) {
+    return true;
+  }
+  if (config['prune-ignored']) {
+    return ignoredBy(config, `${dir}/`, checkoutPath) !== null;
+  }
+  // Build outputs and vendored dependencies are never packages.
+  return (
+    (config['respect-gitignore'] || false) &&
+    ignoreFilesPattern(
+      config,
+      `${dir}/`,
+      checkoutPath,
+      [gitignoreFilename],
+      null,
+    ) !== null
+  );
+}
+
+/**
+ * Checks if a path is a directory, following symlinks.
+ *
+ * @param files file system to check in
+ * @param fullPath path to check
+ * @returns true if the path is a directory, false if broken or not a directory
+ */
+function isDirectory(files: FileSystem, fullPath: string): boolean {
+  try {
+    const stat = files.statSync(fullPath, {throwIfNoEntry: false});
+    return stat?.isDirectory() ?? false;
+  } catch {
+    return false;
+  }
+}
+
+/**
+ * Finds all packages with their metadata.
+ *
+ * Like `findPackages`, but it loads each package's package file and CI setup.
+ *
+ * @param config config object
+ * @param root directory to search, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the walk, checked on every directory;
+ *   timers like `AbortSignal.timeout(ms)` only fire while the caller awaits
+ *   between the packages yielded
+ * @returns generator of packages
+ */
+export function* findAllPackages(
+  config: Config,
+  root: string,
+  checkoutPath = '.',
+  signal?: AbortSignal,
+): Generator<Package> {
+  for (const dir of findPackages(config, root, checkoutPath, signal)) {
+    yield loadPackage(config, dir, checkoutPath);
+  }
+}
+
+/**
+ * Replaces the all packages marker, returned when the 'max-affected-action'
+ * is 'all', with the packages it stands for.
+ *
+ * @param config config object
+ * @param packages package paths, or the all packages marker
+ * @param checkoutPath path to the repository checkout
+ * @returns package paths
+ */
+export function expandAllPackages(
+  config: Config,
+  packages: string[],
+  checkoutPath = '.',
+): string[] {
+  if (!packages.includes(allPackages)) {
+    return packages;
+  }
+  return configRoots(config).flatMap(root => [
+    ...findPackages(config, root, checkoutPath),
+  ]);
+}
+
+// Sorted package paths of each config, by checkout path, for the value
+// providers. Resolving every package's CI setup would walk the
+// repository once per package otherwise.
+const sortedPackageLists = new WeakMap<Config, Map<string, string[]>>();
+
+/**
+ * Finds all the packages, sorted by path.
+ *
+ * @param config config object
+ * @param checkoutPath path to the repository checkout
+ * @returns package paths, sorted
+ */
+function sortedPackages(config: Config, checkoutPath: string): string[] {
+  return cachedForRun(sortedPackageLists, config, checkoutPath, () =>
+    configRoots(config)
+      .flatMap(root => [...findPackages(config, root, checkoutPath)])
+      .sort(),
+  );
+}
+
+/**
+ * Caches a value of a config until the current call returns to the event
+ * loop.
+ *
+ * Files can change between calls, like in a long-running server that
+ * keeps its config, but not during one, so the values read from them are
+ * only cached while the call runs.
+ *
+ * @param cache values by config, then by key
+ * @param config config object
+ * @param key key of the value, like a checkout path
+ * @param compute computes the value if it isn't cached
+ * @returns the cached value
+ */
+function cachedForRun<T>(
+  cache: WeakMap<Config, Map<string, T>>,
+  config: Config,
+  key: string,
+  compute: () => T,
+): T {
+  let values = cache.get(config);
+  if (!values) {
+    values = new Map<string, T>();
+    cache.set(config, values);
+    setImmediate(() => cache.delete(config)).unref();
+  }
+  if (!values.has(key)) {
+    values.set(key, compute());
+  }
+  return values.get(key)!;
+}
+
+/**
+ * Loads the metadata of a package.
+ *
+ * @param config config object
+ * @param dir package path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns package with its metadata
+ */
+export function loadPackage(
+  config: Config,
+  dir: string,
+  checkoutPath = '.',
+): Package {
+  if (dir === allPackages) {
+    throw new Error(
+      message(
+        'E053',
+        `'${allPackages}' stands for all packages, expand it with expandAllPackages`,
+      ),
+    );
+  }
+  const fullPath = path.join(checkoutPath, dir);
+  const packageFile = findPackageFile(config, fullPath);
+  if (packageFile === undefined) {
+    throw new Error(message('E001', `no package file found in: ${fullPath}`));
+  }
+  const defaults = ciSetupDefaults(config, dir, checkoutPath);
+  return {
+    path: dir,
+    packageFile,
+    ...packageMetadata(path.join(fullPath, packageFile), filesOf(config)),
+    ciSetup: interpolateCISetup(
+      resolveProviders(
+        mergeCISetup(defaults, loadCISetup(config, fullPath)),
+        dir,
+        () => sortedPackages(config, checkoutPath),
+      ),
+      dir,
+    ),
+  };
+}
+
+/**
+ * Reads the name and version from a package file.
+ *
+ * Only `package.json` and `go.mod` files are parsed, other package files
+ * return no metadata.
+ *
+ * @param filePath path to the package file
+ * @param files file system to read it from
+ * @returns name and version, if found
+ */
+export function packageMetadata(
+  filePath: string,
+  files: FileSystem = fs,
+): {
+  name?: string;
+  version?: string;
+} {
+  switch (path.basename(filePath)) {
+    case 'package.json': {
+      const {name, version} = loadJsonc(filePath, files);
+      return {
+        ...(typeof name === 'string' ? {name} : {}),
+        ...(typeof version === 'string' ? {version} : {}),
+      };
+    }
+    case 'go.mod': {
+      // Go modules are versioned by tags, so there is no version here.
+      const gomod = files.readFileSync(filePath, 'utf8');
+      const modulePath = gomod.match(/^module\s+"?([^\s"]+)"?/m);
+      return modulePath ? {name: modulePath[1]} : {};
+    }
+    default:
+      return {};
+  }
+}
+
+export function getPackageDir(
+  config: Config,
+  filepath: string,
+  checkoutPath: string,
+): string | null {
+  const dir = path.dirname(filepath);
+  if (!filesOf(config).existsSync(path.join(checkoutPath, dir))) {
+    console.trace(message('T002', `${dir}: does not exist, stop`));
+    return null;
+  }
+  if (dir === '.') {
+    console.trace(message('T002', `${dir}: reached the root, global file`));
+    return dir;
+  }
+  if (isPackageDir(config, path.join(checkoutPath, dir))) {
+    console.trace(message('T002', `${dir}: package file found, stop`));
+    return config['nested-packages'] === 'parent'
+      ? outermostPackageDir(config, dir, checkoutPath)
+      : dir;
+  }
+  if (isBoundary(config, dir)) {
+    console.trace(message('T002', `${dir}: boundary, stop`));
+    return dir;
+  }
+  console.trace(message('T002', `${dir}: no package file, checking parent`));
+  return getPackageDir(config, dir, checkoutPath);
+}
+
+/**
+ * Finds the outermost package a package is nested in, for configs where
+ * nested packages are part of their parent package.
+ *
+ * The search stops at the first boundary, like for any other file.
+ *
+ * @param config config object
+ * @param dir package path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns outermost package path, or the same package if not nested
+ */
+function outermostPackageDir(
+  config: Config,
+  dir: string,
+  checkoutPath: string,
+): string {
+  let outermost = dir;
+  let parent = dir;
+  while (!isBoundary(config, parent)) {
+    parent = path.dirname(parent);
+    if (parent === '.') {
+      break;
+    }
+    if (isPackageDir(config, path.join(checkoutPath, parent))) {
+      console.trace(message('T002', `${parent}: parent package found`));
+      outermost = parent;
+    }
+  }
+  return outermost;
+}
+
+/**
+ * Checks if a directory is a boundary, where the search for a package stops.
+ *
+ * @param config config object
+ * @param dir directory path, relative to the checkout path
+ * @returns true if the directory matches a boundary pattern
+ */
+export function isBoundary(config: Config, dir: string): boolean {
+  const boundaries = asArray(config.boundaries) || [];
+  // Only glob patterns, a regex like `teams/*` would also match `teams`.
+  const flags = config['case-insensitive'] ? 'i' : '';
+  const normalized = normalizePath(config, dir);
+  return boundaries.some(
+    boundary =>
+      comparablePath(config, boundary) === comparablePath(config, dir) ||
+      globToRegExp(normalizePath(config, boundary), flags).test(normalized),
+  );
+}
+
+export function isPackageDir(config: Config, dir: string): boolean {
+  return findPackageFile(config, dir) !== undefined;
+}
+
+/**
+ * Finds the file that defines a package, including documentation sites.
+ *
+ * @param config config object
+ * @param dir path to the directory
+ * @returns package file, or undefined if the directory is not a package
+ */
+export function findPackageFile(
+  config: Config,
+  dir: string,
+): string | undefined {
+  const generators = asArray(config['site-generators']) || [];
+  return matchPackageFile(
+    filesOf(config),
+    [
+      withPresets(config)['package-file'] || [],
+      ...generators.flatMap(generator => siteGeneratorFiles[generator] || []),
+    ],
+    dir,
+  );
+}
+
+/**
+ * Matches a package file group against a directory.
+ *
+ * @param files file system to look in
+ * @param packageFile package file or group of files
+ * @param dir path to the directory
+ * @returns first file of the matching group, or undefined if it doesn't match
+ */
+function matchPackageFile(
+  files: FileSystem,
+  packageFile: PackageFile,
+  dir: string,
+): string | undefined {
+  if (typeof packageFile === 'string' && packageFile.includes('*')) {
+    // Globs like `*.csproj` match any file name in the directory.
+    return listFiles(files, dir).find(name =>
+      isPackageFileName(packageFile, name),
+    );
+  }
+  if (typeof packageFile === 'string') {
+    return files.existsSync(path.join(dir, packageFile))
+      ? packageFile
+      : undefined;
+  }
+  if (!Array.isArray(packageFile) && 'all' in packageFile) {
+    const matches = packageFile.all.map(file =>
+      matchPackageFile(files, file, dir),
+    );
+    return matches.every(match => match !== undefined) ? matches[0] : undefined;
+  }
+  const group = Array.isArray(packageFile) ? packageFile : packageFile.any;
+  for (const file of group) {
+    const match = matchPackageFile(files, file, dir);
+    if (match !== undefined) {
+      return match;
+    }
+  }
+  return undefined;
+}
+
+// Files of the directories listed for glob package files, by file system
+// and directory. Adding or removing a file changes the directory's
+// modification time, so a listing is reused until then, but only while the
+// current call runs, like `cachedForRun`, so long-running processes don't
+// keep every directory they ever listed.
+const dirListings = new WeakMap<
+  FileSystem,
+  Map<string, {mtime: number; files: string[]}>
+>();
+
+/**
+ * Lists the files of a directory, sorted by name.
+ *
+ * Checking glob package files lists the same directories many times,
+ * like on every `isPackageDir` call, so the listings are cached.
+ *
+ * @param files file system to list the directory in
+ * @param dir path to the directory
+ * @returns file names, or an empty list if it's not a directory
+ */
+function listFiles(files: FileSystem, dir: string): string[] {
+  const stat = files.statSync(dir, {throwIfNoEntry: false});
+  if (!stat?.isDirectory()) {
+    return [];
+  }
+  let listings = dirListings.get(files);
+  if (!listings) {
+    listings = new Map();
+    dirListings.set(files, listings);
+    setImmediate(() => dirListings.delete(files)).unref();
+  }
+  const cached = listings.get(dir);
+  if (cached && cached.mtime === stat.mtimeMs) {
+    return cached.files;
+  }
+  const names = files
+    .readdirSync(dir, {withFileTypes: true})
+    .map(entry => entry.name)
+    .filter(name =>
+      files.statSync(path.join(dir, name), {throwIfNoEntry: false})?.isFile(),
+    )
+    .sort();
+  // File systems without modification times are listed every time.
+  if (stat.mtimeMs !== undefined) {
+    listings.set(dir, {mtime: stat.mtimeMs, files: names});
+  }
+  return names;
+}
+
+/**
+ * Finds the documentation sites built by the configured site generators.
+ *
+ * @param config config object
+ * @param checkoutPath path to the repository checkout
+ * @returns list of documentation sites
+ */
+export function findSites(config: Config, checkoutPath: string): Site[] {
+  const generators = asArray(config['site-generators']) || [];
+  if (generators.length === 0) {
+    return [];
+  }
+  const files = filesOf(config);
+  const sites = [];
+  const roots = configRoots(config);
+  for (const root of roots) {
+    for (const pkg of findPackages(config, root, checkoutPath)) {
+      const dir = path.join(checkoutPath, pkg);
+      const generator = generators.find(generator =>
+        siteGeneratorFiles[generator].some(file =>
+          files.existsSync(path.join(dir, file)),
+        ),
+      );
+      if (generator) {
+        const content = siteContent(files, generator, dir);
+        sites.push({
+          path: pkg,
+          generator,
+          content: content.map(dir => toSlash(path.join(pkg, dir))),
+        });
+      }
+    }
+  }
+  return sites;
+}
+
+/**
+ * Gets the content directories of a documentation site.
+ *
+ * @param files file system to read the site config from
+ * @param generator static site generator
+ * @param dir path to the site directory
+ * @returns content directories, relative to the site directory
+ */
+function siteContent(
+  files: FileSystem,
+  generator: string,
+  dir: string,
+): string[] {
+  switch (generator) {
+    case 'mdbook': {
+      const bookPath = path.join(dir, 'book.toml');
+      const book = parseToml(files.readFileSync(bookPath, 'utf8'));
+      return [book.book?.src || 'src'];
+    }
+    case 'hugo': {
+      for (const file of siteGeneratorFiles.hugo) {
+        const hugoPath = path.join(dir, file);
+        if (!files.existsSync(hugoPath)) {
+          continue;
+        }
+        if (file.endsWith('.yaml')) {
+          // Only the top level contentDir is read, without a YAML parser.
+          const text = files.readFileSync(hugoPath, 'utf8');
+          const contentDir = text.match(
+            /^contentDir:[ \t]*(["']?)([^"'#\r\n]*?)\1[ \t]*(#.*)?$/m,
+          );
+          return [contentDir?.[2] || 'content'];
+        }
+        const hugo = file.endsWith('.toml')
+          ? parseToml(files.readFileSync(hugoPath, 'utf8'))
+          : loadJsonc(hugoPath, files);
+        return [hugo.contentDir || 'content'];
+      }
+      return ['content'];
+    }
+    default:
+      // Docusaurus config files are JavaScript, use the default directories.
+      return ['docs', 'blog'];
+  }
+}
+
+// Directories that never affect packages, changes in them are not watched.
+const watchIgnored = ['.git', 'node_modules'];
+
+// Called with the affected packages and the changed files of each batch of
+// changes, see `watch`.
+export type WatchListener = (packages: string[], diffs: string[]) => void;
+
+/**
+ * Watches a checkout for changes, and reports the affected packages.
+ *
+ * Changes are batched until no more changes happen for the debounce time,
+ * so saving several files at once reports the affected packages only once.
+ *
+ * @param config config object, or a function that returns it for each batch
+ *   of changes, like with a new file system to list the directories again
+ * @param checkoutPath path to the repository checkout
+ * @param onAffected called with the affected packages and the changed files
+ * @param debounceMs time to wait for more changes, in milliseconds
+ * @returns function to stop watching
+ */
+export function watch(
+  config: Config | (() => Config),
+  checkoutPath: string,
+  onAffected: WatchListener,
+  debounceMs = 200,
+): () => void {
+  const changed = new Set<string>();
+  let timer: NodeJS.Timeout | undefined;
+  const watcher = fs.watch(checkoutPath, {recursive: true}, (_, filename) => {
+    if (!filename) {
+      return;
+    }
+    const diff = filename.split(path.sep).join('/');
+    if (diff.split('/').some(part => watchIgnored.includes(part))) {
+      return;
+    }
+    changed.add(diff);
+    clearTimeout(timer);
+    timer = setTimeout(() => {
+      const diffs = [...changed];
+      changed.clear();
+      try {
+        const current = typeof config === 'function' ? config() : config;
+        const packages = affected(current, diffs, checkoutPath);
+        if (packages.length > 0) {
+          onAffected(packages, diffs);
+        }
+      } catch (e) {
+        // Keep watching, the next change might fix it.
+        console.error(message('E002', `${e}`));
+      }
+    }, debounceMs);
+  });
+  return () => {
+    clearTimeout(timer);
+    watcher.close();
+  };
+}
+
+// Called with the new config when a watched config changes.
+export type ConfigListener = (config: Config) => void;
+
+export type ConfigWatcher = {
+  // The latest config that loaded successfully.
+  config(): Config;
+
+  // Calls the listener with the new config every time it changes.
+  // Returns a function to unsubscribe.
+  subscribe(listener: ConfigListener): () => void;
+
+  // Stops watching the config files.
+  close(): void;
+};
+
+/**
+ * Watches the config files, and reloads the config when they change.
+ *
+ * This is for long-running services that embed Custard, so they pick up
+ * config changes without restarting. Every file in the directories of the
+ * config files is watched, so patterns files next to them also reload it.
+ * Config URLs are loaded once, and never reloaded.
+ *
+ * If the new config fails to load, the error is logged and the previous
+ * config is kept. Subscribers are only notified when the config changes.
+ *
+ * @param filePath path to the config file, like in `loadConfig`
+ * @param profile profile to apply, if any
+ * @param debounceMs time to wait for more changes, in milliseconds
+ * @param files file system to find the packages in, see `withFileSystem`
+ * @returns config watcher
+ */
+export function watchConfig(
+  filePath: string,
+  profile = process.env.CUSTARD_PROFILE,
+  debounceMs = 200,
+  files: FileSystem = fs,
+): ConfigWatcher {
+  const load = () => withFileSystem(loadConfig(filePath, profile), files);
+  let config = load();
+  const listeners = new Set<ConfigListener>();
+  let timer: NodeJS.Timeout | undefined;
+  const reload = () => {
+    try {
+      const newConfig = load();
+      if (JSON.stringify(newConfig) === JSON.stringify(config)) {
+        return;
+      }
+      config = newConfig;
+    } catch (e) {
+      // Keep the previous config, the next change might fix it.
+      console.error(message('E030', `reloading ${filePath} failed: ${e}`));
+      return;
+    }
+    for (const listener of listeners) {
+      listener(config);
+    }
+  };
+  const dirs = new Set(
+    splitConfigPaths(filePath)
+      .filter(configPath => !isUrl(configPath))
+      .map(configPath => path.dirname(configPath)),
+  );
+  const watchers = [...dirs].map(dir =>
+    fs.watch(dir, () => {
+      clearTimeout(timer);
+      timer = setTimeout(reload, debounceMs);
+    }),
+  );
+  return {
+    config: () => config,
+    subscribe: listener => {
+      listeners.add(listener);
+      return () => {
+        listeners.delete(listener);
+      };
+    },
+    close: () => {
+      clearTimeout(timer);
+      for (const watcher of watchers) {
+        watcher.close();
+      }
+    },
+  };
+}
+
+/**
+ * Splits packages into shards, to run them in parallel jobs.
+ *
+ * Packages are distributed round-robin, so every shard gets a similar
+ * number of packages.
+ *
+ * @param packages list of packages
+ * @param shardCount total number of shards
+ * @param shardIndex shard to return, starting at 0
+ * @returns packages in the shard
+ */
+export function shard(
+  packages: string[],
+  shardCount: number,
+  shardIndex: number,
+): string[] {
+  checkShard(shardCount, shardIndex);
+  return packages.filter((_, i) => i % shardCount === shardIndex);
+}
+
+/**
+ * Splits packages into shards, balanced by their historical run time.
+ *
+ * The slowest packages are assigned first, each to the shard with the
+ * lowest total time so far.
+ * Packages without timings are assumed to take the average time.
+ *
+ * @param packages list of packages
+ * @param shardCount total number of shards
+ * @param shardIndex shard to return, starting at 0
+ * @param timings run time of each package, in any unit
+ * @returns packages in the shard
+ */
+export function shardByTimings(
+  packages: string[],
+  shardCount: number,
+  shardIndex: number,
+  timings: {[pkg: string]: number},
+): string[] {
+  checkShard(shardCount, shardIndex);
+  const times = timingsByPackage(timings);
+  const known = packages.filter(pkg => times.has(packageKey(pkg)));
+  const total = known.reduce(
+    (sum, pkg) => sum + (times.get(packageKey(pkg)) ?? 0),
+    0,
+  );
+  const average = known.length > 0 ? total / known.length : 1;
+  const duration = (pkg: string) => times.get(packageKey(pkg)) ?? average;
+  const sorted = [...packages].sort(
+    (a, b) => duration(b) - duration(a) || a.localeCompare(b),
+  );
+  const totals: number[] = new Array(shardCount).fill(0);
+  const shards: string[][] = totals.map(() => []);
+  for (const pkg of sorted) {
+    const i = totals.indexOf(Math.min(...totals));
+    totals[i] += duration(pkg);
+    shards[i].push(pkg);
+  }
+  // Keep the original order of the packages within the shard.
+  return packages.filter(pkg => shards[shardIndex].includes(pkg));
+}
+
+/**
+ * Normalizes a package path to look it up, like in a timings file, with
+ * forward slashes, and without a leading `./` or surrounding slashes.
+ *
+ * @param pkg package path, like from a packages file
+ * @returns package path to look up
+ */
+function packageKey(pkg: string): string {
+  const key = toSlash(pkg.trim())
+    .replace(/^(\.\/)+/, '')
+    .replace(/^\/+|\/+$/g, '');
+  return key || '.';
+}
+
+/**
+ * Indexes the timings by their normalized package path.
+ *
+ * @param timings run time of each package
+ * @returns run time of each package, by `packageKey`
+ */
+function timingsByPackage(timings: {
+  [pkg: string]: number;
+}): Map<string, number> {
+  return new Map(
+    Object.entries(timings).map(([pkg, time]) => [packageKey(pkg), time]),
+  );
+}
+
+/**
+ * Loads a timings file, a JSON object mapping packages to their run time.
+ *
+ * @param filePath path to the timings file
+ * @returns run time of each package
+ */
+export function loadTimings(filePath: string): {[pkg: string]: number} {
+  const timings = loadJsonc(filePath);
+  if (!isObject(timings)) {
+    throw new Error(
+      message('E003', `timings must be an object, got: ${filePath}`),
+    );
+  }
+  for (const [pkg, duration] of Object.entries(timings)) {
+    if (typeof duration !== 'number' || duration < 0) {
+      throw new Error(
+        message(
+          'E004',
+          `timing for '${pkg}' must be a non-negative number, got: ${JSON.stringify(duration)}`,
+        ),
+      );
+    }
+  }
+  return timings;
+}
+
+/**
+ * Checks the shard count and index, for the shard functions.
+ *
+ * @param shardCount number of shards, at least 1
+ * @param shardIndex index of the shard, from 0 to shardCount - 1
+ */
+function checkShard(shardCount: number, shardIndex: number) {
+  if (!Number.isInteger(shardCount) || shardCount < 1) {
+    throw new Error(
+      message('E005', `shard count must be at least 1, got: ${shardCount}`),
+    );
+  }
+  if (
+    !Number.isInteger(shardIndex) ||
+    shardIndex < 0 ||
+    shardIndex >= shardCount
+  ) {
+    throw new Error(
+      message(
+        'E006',
+        `shard index must be between 0 and ${shardCount - 1}, got: ${shardIndex}`,
+      ),
+    );
+  }
+}
+
+export type BuildWave = {
+  // Wave identifier, like Cloud Build step IDs.
+  id: string;
+
+  // Waves that must finish before this wave starts.
+  waitFor: string[];
+
+  // Packages to build concurrently in this wave.
+  packages: string[];
+};
+
+/**
+ * Plans the builds for the packages in waves, to respect a build quota.
+ *
+ * Submitting more builds than the concurrent build quota allows makes
+ * them queue, and they can time out before they start.
+ * Instead, each wave has at most `maxConcurrent` builds, and waits for
+ * the previous wave to finish.
+ * If timings are provided, the slowest packages are built first, so they
+ * don't hold the last wave.
+ *
+ * @param packages list of packages
+ * @param maxConcurrent maximum number of concurrent builds
+ * @param timings run time of each package, in any unit
+ * @returns build waves, in order
+ */
+export function planBuilds(
+  packages: string[],
+  maxConcurrent: number,
+  timings: {[pkg: string]: number} = {},
+): BuildWave[] {
+  if (!Number.isInteger(maxConcurrent) || maxConcurrent < 1) {
+    throw new Error(
+      message(
+        'E007',
+        `max concurrent builds must be at least 1, got: ${maxConcurrent}`,
+      ),
+    );
+  }
+  const times = timingsByPackage(timings);
+  const duration = (pkg: string) => times.get(packageKey(pkg)) ?? 0;
+  const sorted = [...packages].sort((a, b) => duration(b) - duration(a));
+  const waves: BuildWave[] = [];
+  for (let i = 0; i < sorted.length; i += maxConcurrent) {
+    const id = `wave-${waves.length}`;
+    const waitFor = waves.length > 0 ? [waves[waves.length - 1].id] : [];
+    waves.push({id, waitFor, packages: sorted.slice(i, i + maxConcurrent)});
+  }
+  return waves;
+}
+
+/**
+ * Run a command defined in the config file.
+ *
+ * Defines the environment variables and secrets, runs the command,
+ * and then cleans up the environment to its previous state.
+ *
+ * @param config config object
+ * @param cmd command to run
+ * @param paths paths to the packages
+ * @param env environment variables
+ * @param resolveSecret function to resolve secret values
+ */
+export function run(
+  config: Config,
+  cmd: Command,
+  paths: string[],
+  env = process.env,
+  resolveSecret: SecretResolver = accessSecret,
+) {
+  if (cmd.pre) {
+    const steps = asArray(cmd.pre) || [];
+    for (const step of steps) {
+      console.warn(`\n${message('I001', `[root]$ ${step}`)}`);
+      const start = Date.now();
+      execSync(step, {stdio: 'inherit'});
+      const end = Date.now();
+      console.info(`Done in ${Math.round((end - start) / 1000)}s`);
+    }
+  }
+  const failures = [];
+  if (cmd.run) {
+    for (const path of paths) {
+      console.warn(`\n${message('I002', 'Configuring ci-setup')}`);
+      const start = Date.now();
+      const defined = setup(config, path, env, resolveSecret);
+      const end = Date.now();
+      console.info(`Done in ${Math.round((end - start) / 1000)}s`);
+      try {
+        // For each path, stop on the first command failure.
+        const steps = asArray(cmd.run) || [];
+        for (const step of steps) {
+          console.warn(`\n${message('I001', `${path}$ ${step}`)}`);
+          const start = Date.now();
+          execSync(step, {stdio: 'inherit', cwd: path});
+          const end = Date.now();
+          console.info(`Done in ${Math.round((end - start) / 1000)}s`);
+        }
+      } catch (e) {
+        // Run all paths always, catch the exception and report errors.
+        console.error(`${e}`);
+        failures.push(path);
+      } finally {
+        // Clean up the environment variables that were defined.
+        // This keeps the environment clean for subsequent runs.
+        for (const envVar of defined) {
+          delete env[envVar];
+        }
+      }
+    }
+  }
+  if (cmd.post) {
+    const steps = asArray(cmd.post) || [];
+    for (const step of steps) {
+      console.warn(`\n${message('I001', `[root]$ ${step}`)}`);
+      const start = Date.now();
+      execSync(step, {stdio: 'inherit'});
+      const end = Date.now();
+      console.info(`Done in ${Math.round((end - start) / 1000)}s`);
+    }
+  }
+
+  if (paths.length > 1) {
+    console.info(`\n=== Summary (${paths.length} packages) ===`);
+    console.info(`  Passed: ${paths.length - failures.length}`);
+    console.info(`  Failed: ${failures.length}`);
+  }
+  if (failures.length > 0) {
+    throw new Error(`Failed:\n${failures.map(path => `- ${path}`).join('\n')}`);
+  }
+}
+
+/**
+ * Defines the environment variables and secrets.
+ *
+ * @param config config object
+ * @param packagePath path to the package, relative to the checkout path
+ * @param env environment variables
+ * @param resolveSecret function to resolve secret values
+ * @param checkoutPath path to the repository checkout
+ * @returns environment variables that were defined
+ */
+export function setup(
+  config: Config,
+  packagePath: string,
+  env = process.env,
+  resolveSecret: SecretResolver = accessSecret,
+  checkoutPath = '.',
+): string[] {
+  const defaults = ciSetupDefaults(config, packagePath, checkoutPath);
+  const ciSetup = loadCISetup(config, path.join(checkoutPath, packagePath));
+  console.debug(`ci-setup defaults: ${JSON.stringify(defaults, null, 2)}`);
+  console.debug(`ci-setup.json: ${JSON.stringify(ciSetup, null, 2)}`);
+
+  const definedBefore = new Set(Object.keys(env));
+  const vars = listEnv(env, ciSetup.env || {}, defaults.env || {});
+  for (const [key, value] of vars) {
+    env[key] = value;
+  }
+
+  // Export aliases required by tests.
+  env.GOOGLE_SAMPLES_PROJECT = env.PROJECT_ID;
+
+  const secrets = listSecrets(
+    env,
+    ciSetup.secrets || {},
+    defaults.secrets || {},
+    resolveSecret,
+  );
+  for (const [key, value] of secrets) {
+    env[key] = value;
+  }
+  return [...Object.keys(env)].filter(x => !definedBefore.has(x));
+}
+
+/**
+ * List environment variables based on the config file and ci-setup file.
+ *
+ * @param env environment variables
+ * @param ciSetup ci-setup variables
+ * @param defaults variables default values from the config file
+ * @returns generator of the environment variables
+ */
+export function* listEnv(
+  env: NodeJS.ProcessEnv = {},
+  ciSetup: {[k: string]: string} = {},
+  defaults: {[k: string]: string} = {},
+): Generator<[string, string]> {
+  const automatic = {
+    PROJECT_ID: () => defaultProject(),
+    RUN_ID: () => uniqueId(),
+    SERVICE_ACCOUNT: () => '',
+  };
+  console.info('Environment variables:');
+  const vars = [...listVars(env, ciSetup, defaults, automatic)];
+  const subs = Object.fromEntries(vars.map(([key, {value}]) => [key, value]));
+  for (const [key, {value, source}] of vars) {
+    const result = substitute(subs, value);
+    console.info(`  ${key}: ${JSON.stringify(result)} (${source})`);
+    yield [key, result];
+  }
+}
+
+/**
+ * List secret variables based on the config file and ci-setup file.
+ *
+ * @param env environment variables
+ * @param ciSetup ci-setup secrets
+ * @param defaults secrets default values from the config file
+ * @param resolveSecret function to resolve secret values
+ * @returns generator of the secrets
+ */
+export function* listSecrets(
+  env: NodeJS.ProcessEnv = {},
+  ciSetup: {[k: string]: string} = {},
+  defaults: {[k: string]: string} = {},
+  resolveSecret: SecretResolver = accessSecret,
+): Generator<[string, string]> {
+  const automatic = {
+    // Set global secret for the Service Account identity token
+    // Use in place of 'gcloud auth print-identity-token' or auth.getIdTokenClient
+    // usage: curl -H 'Bearer: $ID_TOKEN' https://
+    ID_TOKEN: () => getIdToken(env.PROJECT_ID),
+  };
+  console.info('Secrets:');
+  const vars = listVars(env, ciSetup, defaults, automatic, resolveSecret);
+  for (const [key, {value: value, source}] of vars) {
+    // ⚠️ DO NOT print the secret value.
+    console.info(`  ${key}: "***" (${source})`);
+    yield [key, value];
+  }
+}
+
+/**
+ * List variables based on the config file and ci-setup file.
+ *
+ * @param env environment variables
+ * @param ciSetup ci-setup variables
+ * @param defaults variables default values from the config file
+ * @param automatic automatic variables
+ * @param transform optional function to apply to the variable values
+ * @returns generator of the variables
+ */
+export function* listVars(
+  env: NodeJS.ProcessEnv = {},
+  ciSetup: {[k: string]: string} = {},
+  defaults: {[k: string]: string} = {},
+  automatic: {[k: string]: () => string} = {},
+  transform: (value: string, key: string) => string = x => x,
+): Generator<[string, {value: string; source: string}]> {
+  for (const key in {...automatic, ...defaults, ...ciSetup}) {
+    if (key in env) {
+      // 1) User defined via an environment variable.
+      const value = env[key] || '';
+      yield [key, {value, source: 'user-defined'}];
+    } else if (key in ciSetup) {
+      // 2) From the local ci-setup.json file.
+      const value = transform(ciSetup[key], key);
+      yield [key, {value, source: 'ci-setup.json'}];
+    } else if (key in defaults) {
+      // 3) Defaults from the config file.
+      const value = transform(defaults[key], key);
+      yield [key, {value, source: 'default value'}];
+    } else if (key in automatic) {
+      // 4) Automatic variables.
+      const value = automatic[key]();
+      yield [key, {value, source: 'automatic var'}];
+    } else {
+      // Unreachable.
+      throw new Error(`Undefined variable: ${key}`);
+    }
+  }
+}
+
+/**
+ * Loads match and ignore patterns from a patterns file.
+ *
+ * It looks like a gitignore file, but it isn't one: each line is a pattern
+ * to match, not to ignore, and lines starting with `!` are patterns to
+ * ignore, whatever their position, not files to match again.
+ * Blank lines and lines starting with `#` are skipped.
+ * A leading `/` is removed, so the match engine decides how the pattern is
+ * anchored, and a trailing `/` matches everything in the directory.
+ *
+ * @param filePath path to the patterns file
+ * @returns match and ignore patterns
+ */
+export function loadPatternsFile(filePath: string): {
+  match: string[];
+  ignore: string[];
+} {
+  return parsePatterns(fs.readFileSync(filePath, 'utf8'));
+}
+
+/**
+ * Parses match and ignore patterns, see `loadPatternsFile`.
+ *
+ * @param text patterns file contents
+ * @returns match and ignore patterns
+ */
+function parsePatterns(text: string): {
+  match: string[];
+  ignore: string[];
+} {
+  const patterns = {match: [] as string[], ignore: [] as string[]};
+  const lines = text.split('\n');
+  for (const rawLine of lines) {
+    let line = rawLine.trim();
+    if (line === '' || line.startsWith('#')) {
+      continue;
+    }
+    const negated = line.startsWith('!');
+    if (negated) {
+      line = line.slice(1);
+    }
+    // Escaped special characters at the start, like `\#` or `\!`.
+    line = line.replace(/^\\/, '').replace(/^\//, '');
+    if (line.endsWith('/')) {
+      line = `${line}**`;
+    }
+    (negated ? patterns.ignore : patterns.match).push(line);
+  }
+  return patterns;
+}
+
+/**
+ * Loads and validates a config file.
+ *
+ * The file path can be a list of config files separated by the platform
+ * path delimiter, like `base.jsonc:presubmit.jsonc`, see `loadConfigs`.
+ * Config files can also be URLs, see `configFetchers`.
+ *
+ * @param filePath path or URL to the config file
+ * @param profile profile to apply, if any
+ * @param fetchers functions to fetch config URLs, by protocol
+ * @returns config object
+ */
+export function loadConfig(
+  filePath: string,
+  profile = process.env.CUSTARD_PROFILE,
+  fetchers = configFetchers,
+): Config {
+  return loadConfigs(splitConfigPaths(filePath), profile, fetchers);
+}
+
+/**
+ * Splits a list of config files separated by the platform path delimiter.
+ *
+ * On Linux and macOS the delimiter is `:`, which URLs contain too, so a
+ * part is only joined back to the previous one after a URL scheme, like
+ * `https:`, or for the port right after a URL host, like `:8443/`.
+ * To pass other paths with the delimiter, call `loadConfigs` with a list.
+ *
+ * @param filePath paths or URLs to the config files
+ * @returns config file paths or URLs
+ */
+function splitConfigPaths(filePath: string): string[] {
+  const paths: string[] = [];
+  for (const part of filePath.split(path.delimiter)) {
+    const previous = paths[paths.length - 1] ?? '';
+    const isScheme = /^[a-z][a-z\d+.-]*$/i.test(previous);
+    const isHost = /^[a-z][a-z\d+.-]*:\/\/[^/]+$/i.test(previous);
+    if (
+      (isScheme && part.startsWith('//')) ||
+      (isHost && /^\d+(\/|$)/.test(part))
+    ) {
+      paths[paths.length - 1] += `${path.delimiter}${part}`;
+    } else {
+      paths.push(part);
+    }
+  }
+  return paths;
+}
+
+/**
+ * Loads, merges, and validates multiple config files.
+ *
+ * Later files override the fields of earlier files, mappings like
+ * 'ci-setup-defaults', 'commands', and 'profiles' are merged by key.
+ * Then the selected profile is applied on top of the merged config.
+ *
+ * @param filePaths paths or URLs to the config files
+ * @param profile profile to apply, if any
+ * @param fetchers functions to fetch config URLs, by protocol
+ * @returns config object
+ */
+export function loadConfigs(
+  filePaths: string[],
+  profile = process.env.CUSTARD_PROFILE,
+  fetchers = configFetchers,
+): Config {
+  let config: Config = {};
+  for (const filePath of filePaths) {
+    config = mergeConfig(config, loadConfigLayer(filePath, fetchers));
+  }
+
+  if (profile) {
+    const profiles = config.profiles || {};
+    if (!isObject(profiles[profile])) {
+      throw new Error(
+        message(
+          'E026',
+          `unknown profile: ${JSON.stringify(profile)}, expected one of: ${
+            Object.keys(profiles).join(', ') || '(none)'
+          }`,
+        ),
+      );
+    }
+    config = mergeConfig(config, profiles[profile]);
+  }
+  config = applyPresets(config);
+
+  // Default values.
+  if (!config.match) {
+    config.match = ['*'];
+  }
+
+  // Validation.
+  const errors = validateConfig(config);
+  if (errors.length > 0) {
+    throw new Error(
+      message(
+        'E008',
+        `validation errors in config file: ${filePaths.join(', ')}\n`,
+      ) + errors.map(e => `- ${e}`).join('\n'),
+    );
+  }
+
+  return config;
+}
+
+/**
+ * Loads a single config file, with its patterns file.
+ *
+ * @param filePath path or URL to the config file
+ * @param fetchers functions to fetch config URLs, by protocol
+ * @returns config object, without defaults nor validation
+ */
+function loadConfigLayer(
+  filePath: string,
+  fetchers: {[protocol: string]: ConfigFetcher},
+): Config {
+  const config = parseConfigFile(readConfig(filePath, fetchers), filePath);
+  const version = config['schema-version'] ?? 1;
+  if (isPositiveInteger(version) && version !== configSchemaVersion) {
+    const uses =
+      config['schema-version'] === undefined
+        ? 'has no config schema-version, version 1'
+        : `uses the config schema-version ${version},`;
+    const changes = migrateConfig(config);
+    console.error(
+      message(
+        'W011',
+        `${filePath} ${uses} upgraded to ${configSchemaVersion}:\n` +
+          changes.map(change => `- ${change}`).join('\n'),
+      ),
+    );
+  }
+  withMatchFile(config, filePath, fetchers);
+  withExclusionsFile(config, filePath, fetchers);
+  for (const name in config.profiles) {
+    if (isObject(config.profiles[name])) {
+      withMatchFile(config.profiles[name], filePath, fetchers);
+    }
+  }
+  return config;
+}
+
+/**
+ * Merges the patterns from the 'match-file' into 'match' and 'ignore'.
+ *
+ * @param config config object, modified in place
+ * @param configPath path or URL of the config file, the 'match-file' is
+ *   relative to it
+ * @param fetchers functions to fetch config URLs, by protocol
+ */
+function withMatchFile(
+  config: Config,
+  configPath: string,
+  fetchers: {[protocol: string]: ConfigFetcher},
+) {
+  const matchFile = config['match-file'];
+  if (typeof matchFile === 'string') {
+    const matchPath = isUrl(configPath)
+      ? new URL(matchFile, configPath).href
+      : path.join(path.dirname(configPath), matchFile);
+    const patterns = parsePatterns(readConfig(matchPath, fetchers));
+    if (patterns.match.length > 0) {
+      config.match = [...(asArray(config.match) || []), ...patterns.match];
+    }
+    if (patterns.ignore.length > 0) {
+      config.ignore = [...(asArray(config.ignore) || []), ...patterns.ignore];
+    }
+  }
+}
+
+/**
+ * Merges the packages from the 'exclusions-file' into 'exclude-packages'.
+ *
+ * Expired exclusions are still merged, with a warning to revisit them.
+ *
+ * @param config config object, modified in place
+ * @param configPath path or URL of the config file, the 'exclusions-file'
+ *   is relative to it
+ * @param fetchers functions to fetch config URLs, by protocol
+ */
+function withExclusionsFile(
+  config: Config,
+  configPath: string,
+  fetchers: {[protocol: string]: ConfigFetcher},
+) {
+  const exclusionsFile = config['exclusions-file'];
+  if (typeof exclusionsFile !== 'string') {
+    return;
+  }
+  const exclusionsPath = isUrl(configPath)
+    ? new URL(exclusionsFile, configPath).href
+    : path.join(path.dirname(configPath), exclusionsFile);
+  if (!isUrl(exclusionsPath) && !fs.existsSync(exclusionsPath)) {
+    // There are no exclusions until the first one is added.
+    return;
+  }
+  const exclusions = parseExclusions(
+    readConfig(exclusionsPath, fetchers),
+    exclusionsPath,
+  );
+  for (const exclusion of expiredExclusions(exclusions)) {
+    console.error(
+      message(
+        'W015',
+        `Exclusion of ${exclusion.path} expired on ${exclusion.expires}, still excluded: ${exclusion.reason}`,
+      ),
+    );
+  }
+  if (exclusions.length > 0) {
+    config[exclusionsKey] = exclusions;
+    config['exclude-packages'] = [
+      ...(asArray(config['exclude-packages']) || []),
+      ...exclusions.map(exclusion => exclusion.path),
+    ];
+  }
+}
+
+/**
+ * Reads a config file, or fetches it if it's a URL.
+ *
+ * @param location path or URL to the file
+ * @param fetchers functions to fetch config URLs, by protocol
+ * @returns file contents
+ */
+function readConfig(
+  location: string,
+  fetchers: {[protocol: string]: ConfigFetcher},
+): string {
+  if (!isUrl(location)) {
+    return fs.readFileSync(location, 'utf8');
+  }
+  const protocol = new URL(location).protocol;
+  const fetcher = fetchers[protocol];
+  if (!fetcher) {
+    throw new Error(
+      message(
+        'E029',
+        `unsupported config URL: ${location}, expected one of: ${Object.keys(
+          fetchers,
+        ).join(', ')}`,
+      ),
+    );
+  }
+  console.debug(`Fetching config: ${location}`);
+  return fetcher(location);
+}
+
+/**
+ * Checks if a config location is a URL, like `https://` or `gs://`.
+ *
+ * @param location path or URL
+ * @returns true if it's a URL
+ */
+export function isUrl(location: string): boolean {
+  return /^[a-z][a-z\d+.-]*:\/\//i.test(location);
+}
+
+/**
+ * Adds the package files, match, and ignore patterns of the config presets.
+ *
+ * The presets come first, so the config's own ignore patterns can still
+ * re-include files with `!`. Applying the presets again changes nothing.
+ * With 'match-categories', the presets only match the files of those
+ * categories, see `matchCategories`, and the ci-setup files.
+ *
+ * @param config config object
+ * @returns config object with the presets applied
+ */
+export function applyPresets(config: Config): Config {
+  const names = (asArray(config.presets) || []).filter(
+    name => name in configPresets,
+  );
+  const categories = asArray(config['match-categories']) || [];
+  if (names.length === 0 && categories.length === 0) {
+    return config;
+  }
+  const presets = names.map(name => configPresets[name]);
+  // With categories, the presets only match the files of those categories.
+  // CI setup changes always affect their package, whatever the categories.
+  const setupNames = ['ci-setup.jsonc', 'ci-setup.json'];
+  const presetMatch =
+    categories.length > 0
+      ? [
+          ...categoryPatterns(names, categories),
+          ...(asArray(config['ci-setup-filename']) || setupNames),
+        ]
+      : presets.flatMap(preset => asArray(preset.match) || []);
+  const own = config['package-file'];
+  const patterns = (field: 'match' | 'ignore', presetPatterns: string[]) =>
+    unique([...presetPatterns, ...(asArray(config[field]) || [])]);
+  const applied: Config = {
+    ...config,
+    match: patterns('match', presetMatch),
+  };
+  if (presets.length > 0) {
+    applied['package-file'] = unique([
+      ...presets.flatMap(preset => preset['package-file'] || []),
+      ...(own === undefined ? [] : Array.isArray(own) ? own : [own]),
+    ]);
+  }
+  const ignore = patterns(
+    'ignore',
+    presets.flatMap(preset => asArray(preset.ignore) || []),
+  );
+  if (ignore.length > 0) {
+    applied.ignore = ignore;
+  }
+  return applied;
+}
+
+// Configs with their presets applied, by config. Every path checks the
+// patterns, so the presets are applied once per run instead of once per path.
+const presetConfigs = new WeakMap<Config, Map<string, Config>>();
+
+/**
+ * Applies the config presets once per call, for configs that were not
+ * loaded with `loadConfig`.
+ *
+ * @param config config object
+ * @returns config object with the presets applied
+ */
+function withPresets(config: Config): Config {
+  return cachedForRun(presetConfigs, config, '', () => applyPresets(config));
+}
+
+/**
+ * Gets the match patterns of some file categories.
+ *
+ * @param presets preset names, or none for every preset
+ * @param categories category names, like 'source' or 'build'
+ * @returns patterns of every category for every preset
+ */
+function categoryPatterns(presets: string[], categories: string[]): string[] {
+  const names = presets.length > 0 ? presets : Object.keys(matchCategories);
+  return unique(
+    names.flatMap(name =>
+      categories.flatMap(category => matchCategories[name]?.[category] || []),
+    ),
+  );
+}
+
+/**
+ * Removes the repeated strings of a list, keeping the first ones.
+ *
+ * @param items list of items
+ * @returns items without repeated strings
+ */
+function unique<T>(items: T[]): T[] {
+  return items.filter(
+    (item, i) => typeof item !== 'string' || items.indexOf(item) === i,
+  );
+}
+
+/**
+ * Merges two configs, the overlay fields replace the base fields.
+ *
+ * The 'ci-setup-defaults' are merged like ci-setup files, and the
+ * 'ci-setup-scoped-defaults', 'commands', and 'profiles' are merged by key.
+ *
+ * @param base config object
+ * @param overlay config object with the values to override
+ * @returns merged config object
+ */
+function mergeConfig(base: Config, overlay: Config): Config {
+  const merged: Config = {...base, ...overlay};
+  if (base['ci-setup-defaults'] && overlay['ci-setup-defaults']) {
+    merged['ci-setup-defaults'] = mergeCISetup(
+      base['ci-setup-defaults'],
+      overlay['ci-setup-defaults'],
+    );
+  }
+  if (base['ci-setup-scoped-defaults'] && overlay['ci-setup-scoped-defaults']) {
+    merged['ci-setup-scoped-defaults'] = {
+      ...base['ci-setup-scoped-defaults'],
+      ...overlay['ci-setup-scoped-defaults'],
+    };
+  }
+  if (base.commands && overlay.commands) {
+    merged.commands = {...base.commands, ...overlay.commands};
+  }
+  if (base.profiles && overlay.profiles) {
+    merged.profiles = {...base.profiles};
+    for (const name in overlay.profiles) {
+      merged.profiles[name] = mergeConfig(
+        merged.profiles[name] || {},
+        overlay.profiles[name],
+      );
+    }
+  }
+  return merged;
+}
+
+/**
+ * Gets the CI setup defaults for a package.
+ *
+ * Scoped defaults matching the package path are layered on top of the
+ * global defaults, in the order they are defined in the config file.
+ * Then the defaults files in the directories above the package are layered
+ * on top, from the checkout root down to the package's parent directory.
+ * With 'ci-setup-inherit', the ci-setup files of those directories are
+ * layered on top of the defaults file of their directory.
+ *
+ * @param config config object
+ * @param packagePath path to the package
+ * @param checkoutPath path to the repository checkout
+ * @returns ci-setup defaults for the package
+ */
+export function ciSetupDefaults(
+  config: Config,
+  packagePath: string,
+  checkoutPath = '.',
+): CISetup {
+  return ciSetupLayers(config, packagePath, checkoutPath).reduce(
+    (defaults, layer) => mergeCISetup(defaults, layer.ciSetup),
+    {},
+  );
+}
+
+/**
+ * Gets the layers of CI setup defaults for a package, with their source,
+ * in the order they are merged, see `ciSetupDefaults`.
+ *
+ * @param config config object
+ * @param packagePath path to the package
+ * @param checkoutPath path to the repository checkout
+ * @returns ci-setup defaults layers, skipping the missing files
+ */
+function ciSetupLayers(
+  config: Config,
+  packagePath: string,
+  checkoutPath: string,
+): {source: SetupSource; ciSetup: CISetup}[] {
+  const layers: {source: SetupSource; ciSetup: CISetup}[] = [
+    {
+      source: {layer: 'defaults', file: null},
+      ciSetup: config['ci-setup-defaults'] || {},
+    },
+  ];
+  const scoped = config['ci-setup-scoped-defaults'] || {};
+  for (const pattern in scoped) {
+    if (matches(packagePath, [pattern])) {
+      console.debug(`ci-setup scoped defaults '${pattern}': ${packagePath}`);
+      layers.push({
+        source: {layer: 'scoped-defaults', file: null, pattern},
+        ciSetup: scoped[pattern],
+      });
+    }
+  }
+  const relative = toSlash(
+    path.relative(checkoutPath, path.resolve(checkoutPath, packagePath)),
+  );
+  if (relative.startsWith('..') || path.isAbsolute(relative)) {
+    // Outside the checkout, there are no directories to look at.
+    return layers;
+  }
+  const defaultsNames = ['ci-setup-defaults.jsonc', 'ci-setup-defaults.json'];
+  const defaultsFilenames =
+    asArray(config['ci-setup-defaults-filename']) || defaultsNames;
+  const setupNames = ['ci-setup.jsonc', 'ci-setup.json'];
+  const setupFilenames = asArray(config['ci-setup-filename']) || setupNames;
+  const files = filesOf(config);
+  let dir = '';
+  for (const part of ['', ...relative.split('/').slice(0, -1)]) {
+    dir = path.posix.join(dir, part);
+    const fullPath = path.join(checkoutPath, dir);
+    const defaultsFile = existingFile(
+      files,
+      checkoutPath,
+      dir,
+      defaultsFilenames,
+    );
+    if (defaultsFile !== null) {
+      layers.push({
+        source: {layer: 'defaults-file', file: defaultsFile},
+        ciSetup: loadCISetupDefaults(config, fullPath),
+      });
+    }
+    const setupFile = existingFile(files, checkoutPath, dir, setupFilenames);
+    if (config['ci-setup-inherit'] && setupFile !== null) {
+      layers.push({
+        source: {layer: 'inherited', file: setupFile},
+        ciSetup: loadCISetup(config, fullPath),
+      });
+    }
+  }
+  return layers;
+}
+
+/**
+ * Finds the first file that exists in a directory.
+ *
+ * @param files file system to look in
+ * @param checkoutPath path to the repository checkout
+ * @param dir directory, relative to the checkout path
+ * @param filenames file names to look for, in order
+ * @returns path to the file relative to the checkout path, or null
+ */
+function existingFile(
+  files: FileSystem,
+  checkoutPath: string,
+  dir: string,
+  filenames: string[],
+): string | null {
+  const file = filenames
+    .map(filename => toSlash(path.join(dir, filename)))
+    .find(file => files.existsSync(path.join(checkoutPath, file)));
+  return file ?? null;
+}
+
+/**
+ * Loads and validates a CI setup defaults file from a directory.
+ *
+ * @param config config object
+ * @param dir path to the directory
+ * @returns ci-setup defaults, empty if the directory has no defaults file
+ */
+function loadCISetupDefaults(config: Config, dir: string): CISetup {
+  const defaultNames = ['ci-setup-defaults.jsonc', 'ci-setup-defaults.json'];
+  const filenames =
+    asArray(config['ci-setup-defaults-filename']) || defaultNames;
+  for (const filename of filenames) {
+    const defaultsPath = path.join(dir, filename);
+    if (filesOf(config).existsSync(defaultsPath)) {
+      console.debug(`ci-setup defaults file: ${defaultsPath}`);
+      const defaults: CISetup = timed('setup-read', () =>
+        loadJsonc(defaultsPath, filesOf(config)),
+      );
+      const errors = validateCISetupDefaults(config, defaults);
+      if (errors.length > 0) {
+        throw new Error(
+          message(
+            'E021',
+            `validation errors in CI setup defaults file: ${defaultsPath}\n`,
+          ) + errors.map(e => `- ${e}`).join('\n'),
+        );
+      }
+      return defaults;
+    }
+  }
+  return {};
+}
+
+/**
+ * Resolves the CI setup for a package, including its defaults.
+ *
+ * @param config config object
+ * @param packagePath path to the package
+ * @returns ci-setup object with all the defaults applied
+ */
+export function resolveCISetup(config: Config, packagePath: string): CISetup {
+  const defaults = ciSetupDefaults(config, packagePath);
+  return interpolateCISetup(
+    resolveProviders(
+      mergeCISetup(defaults, loadCISetup(config, packagePath)),
+      packagePath,
+      () => sortedPackages(config, '.'),
+    ),
+    packagePath,
+  );
+}
+
+/**
+ * Finds the CI setup file of a package.
+ *
+ * @param config config object
+ * @param dir package path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns path to the file, relative to the checkout path, or null if the
+ *   package has no CI setup file
+ */
+export function setupFilePath(
+  config: Config,
+  dir: string,
+  checkoutPath = '.',
+): string | null {
+  const setupNames = ['ci-setup.jsonc', 'ci-setup.json'];
+  const setupFilenames = asArray(config['ci-setup-filename']) || setupNames;
+  return existingFile(filesOf(config), checkoutPath, dir, setupFilenames);
+}
+
+/**
+ * Resolves the CI setup for a package like `resolveCISetup`, and records
+ * where each field comes from, to find out why a value is wrong.
+ *
+ * Values from value providers and interpolated values come from the
+ * layer that declared them.
+ *
+ * @param config config object
+ * @param dir package path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns ci-setup object, and the source of each field
+ */
+export function resolveCISetupDetailed(
+  config: Config,
+  dir: string,
+  checkoutPath = '.',
+): ResolvedCISetup {
+  const setupFile = setupFilePath(config, dir, checkoutPath);
+  const layers = [
+    ...ciSetupLayers(config, dir, checkoutPath),
+    {
+      source: {layer: 'package', file: setupFile},
+      ciSetup: loadCISetup(config, path.join(checkoutPath, dir)),
+    },
+  ];
+  const sources: {[field: string]: SetupSource} = {};
+  for (const {source, ciSetup} of layers) {
+    for (const field in ciSetup) {
+      if (field === 'env' || field === 'secrets') {
+        for (const name in ciSetup[field]) {
+          sources[`${field}.${name}`] = source;
+        }
+      } else {
+        sources[field] = source;
+      }
+    }
+  }
+  const merged = layers.reduce(
+    (ciSetup, layer) => mergeCISetup(ciSetup, layer.ciSetup),
+    {},
+  );
+  return {
+    ciSetup: interpolateCISetup(
+      resolveProviders(merged, dir, () => sortedPackages(config, checkoutPath)),
+      dir,
+    ),
+    sources,
+  };
+}
+
+/**
+ * Formats a resolved CI setup with the source of each value, one value
+ * per line, like `timeout: "15m"  # ci-setup-defaults.json (defaults-file)`.
+ *
+ * @param resolved ci-setup object and sources, see `resolveCISetupDetailed`
+ * @returns annotated ci-setup
+ */
+export function formatSetupSources(resolved: ResolvedCISetup): string {
+  const lines: string[] = [];
+  for (const field in resolved.ciSetup) {
+    const value = resolved.ciSetup[field];
+    const entries: [string, unknown][] =
+      (field === 'env' || field === 'secrets') && isObject(value)
+        ? Object.entries(value).map(([name, v]) => [`${field}.${name}`, v])
+        : [[field, value]];
+    for (const [key, v] of entries) {
+      const source = resolved.sources[key];
+      const from = source
+        ? `${source.file ?? source.pattern ?? 'config'} (${source.layer})`
+        : 'unknown';
+      lines.push(`${key}: ${JSON.stringify(v)}  # ${from}`);
+    }
+  }
+  return lines.join('\n');
+}
+
+/**
+ * Merges two CI setups, the env and secrets mappings are merged by key.
+ *
+ * @param base ci-setup object
+ * @param overlay ci-setup object with the values to override
+ * @returns merged ci-setup object
+ */
+export function mergeCISetup(base: CISetup, overlay: CISetup): CISetup {
+  const merged: CISetup = {...base, ...overlay};
+  if (base.env || overlay.env) {
+    merged.env = {...base.env, ...overlay.env};
+  }
+  if (base.secrets || overlay.secrets) {
+    merged.secrets = {...base.secrets, ...overlay.secrets};
+  }
+  return merged;
+}
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+// Computes a ci-setup value for a package, from the other fields of a
+// `{"$provider": name}` value. It must throw if the fields are not valid.
+export type ValueProvider = (
+  args: {[k: string]: any},
+  context: {
+    package: string;
+    field: string;
+    // All the package paths, sorted, to spread the values across them.
+    packages: () => string[];
+  },
+) => any;
+
+// Providers for computed ci-setup values, by name.
+// To use a custom provider, add it here before resolving the CI setups.
+export const valueProviders: {[name: string]: ValueProvider} = {
+  'round-robin': ({values}, {package: pkg, packages}) => {
+    // Packages are numbered by their place in the sorted package paths, so
+    // the value doesn't depend on the order they are resolved in.
+    const i = packages().filter(other => other < pkg).length;
+    return providerValues(values)[i % values.length];
+  },
+  random: ({values, seed = ''}, {package: pkg}) => {
+    const digest = crypto
+      .createHash('sha256')
+      .update(`${seed}${pkg}`)
+      .digest();
+    return providerValues(values)[digest.readUInt32BE(0) % values.length];
+  },
+  env: ({name, default: fallback}) => {
+    if (typeof name !== 'string') {
+      throw new Error(`'name' must be string, got: ${JSON.stringify(name)}`);
+    }
+    const value = process.env[name] ?? fallback;
+    if (value === undefined) {
+      throw new Error(`environment variable '${name}' is not defined`);
+    }
+    return value;
+  },
+};
+
+/**
+ * Checks the values to choose from of a provider.
+ *
+ * @param values values from the provider arguments
+ * @returns the values, if they're a non-empty array
+ */
+function providerValues(values: any): any[] {
+  if (!Array.isArray(values) || values.length === 0) {
+    throw new Error(
+      `'values' must be a non-empty array, got: ${JSON.stringify(values)}`,
+    );
+  }
+  return values;
+}
+
+/**
+ * Checks if a value is computed by a value provider.
+ *
+ * @param x any value
+ * @returns true if the value is a `{"$provider": name}` object
+ */
+function isProvided(x: any): boolean {
+  return isObject(x) && typeof x.$provider === 'string';
+}
+
+/**
+ * Computes the ci-setup values that come from value providers.
+ *
+ * @param ciSetup ci-setup object
+ * @param packagePath path to the package
+ * @param packages gets all the package paths, sorted
+ * @returns ci-setup object with the provided values
+ */
+function resolveProviders(
+  ciSetup: CISetup,
+  packagePath: string,
+  packages: () => string[],
+): CISetup {
+  const walk = (value: any, field: string): any => {
+    if (Array.isArray(value)) {
+      return value.map((item, i) => walk(item, `${field}[${i}]`));
+    }
+    if (!isObject(value)) {
+      return value;
+    }
+    if (isProvided(value)) {
+      const {$provider: name, ...args} = value;
+      const provider = valueProviders[name];
+      if (!provider) {
+        throw new Error(
+          message(
+            'E036',
+            `unknown value provider '${name}' for '${field}' in ${packagePath}, must be one of: ${Object.keys(valueProviders).join(', ')}`,
+          ),
+        );
+      }
+      try {
+        const pkg = toSlash(packagePath);
+        return provider(args, {package: pkg, field, packages});
+      } catch (e: any) {
+        throw new Error(
+          message(
+            'E036',
+            `value provider '${name}' failed for '${field}' in ${packagePath}: ${e.message}`,
+          ),
+        );
+      }
+    }
+    return Object.fromEntries(
+      Object.entries(value).map(([key, item]) => [
+        key,
+        walk(item, field ? `${field}.${key}` : key),
+      ]),
+    );
+  };
+  return walk(ciSetup, '');
+}
+
+/**
+ * Resolves the `${field}` references between ci-setup fields.
+ *
+ * Fields can reference other string, number, or boolean fields, and the
+ * built-in `package-path` and `package-name` (the last path component).
+ * The env and secrets are left as they are, their `${VAR}` references are
+ * environment variables. Unknown references are also left as they are.
+ *
+ * @param ciSetup ci-setup object
+ * @param packagePath path to the package
+ * @returns ci-setup object with the references resolved
+ */
+function interpolateCISetup(ciSetup: CISetup, packagePath: string): CISetup {
+  const builtins: {[k: string]: string} = {
+    'package-path': toSlash(packagePath),
+    'package-name': path.basename(packagePath),
+  };
+  const resolved: {[k: string]: string} = {};
+  const resolving: string[] = [];
+  const lookup = (name: string): string | undefined => {
+    const value = ciSetup[name];
+    if (!['string', 'number', 'boolean'].includes(typeof value)) {
+      return builtins[name];
+    }
+    if (name in resolved) {
+      return resolved[name];
+    }
+    if (resolving.includes(name)) {
+      const cycle = [...resolving.slice(resolving.indexOf(name)), name];
+      throw new Error(
+        message(
+          'E027',
+          `ci-setup field reference cycle in ${packagePath}: ${cycle.join(
+            ' -> ',
+          )}`,
+        ),
+      );
+    }
+    resolving.push(name);
+    resolved[name] = interpolate(`${value}`);
+    resolving.pop();
+    return resolved[name];
+  };
+  const interpolate = (value: string): string =>
+    value.replaceAll(/\$\{([\w-]+)\}/g, (ref, name) => lookup(name) ?? ref);
+  const walk = (value: any): any => {
+    if (typeof value === 'string') {
+      return interpolate(value);
+    }
+    if (Array.isArray(value)) {
+      return value.map(walk);
+    }
+    if (isObject(value)) {
+      return Object.fromEntries(
+        Object.entries(value).map(([k, v]) => [k, walk(v)]),
+      );
+    }
+    return value;
+  };
+
+  const result: CISetup = {};
+  for (const key in ciSetup) {
+    if (key === 'env' || key === 'secrets') {
+      result[key] = ciSetup[key];
+    } else if (typeof ciSetup[key] === 'string') {
+      result[key] = lookup(key);
+    } else {
+      result[key] = walk(ciSetup[key]);
+    }
+  }
+  return result;
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
+
+/**
+ * Reads a CI setup file without validating it.
+ *
+ * @param config config object
+ * @param packagePath path to the package
+ * @returns ci-setup object with its file and field positions, or null if
+ *   the package has no CI setup file
+ */
+function readCISetup(
+  config: Config,
+  packagePath: string,
+): {
+  ciSetup: CISetup;
+  ciSetupPath: string;
+  positions: {[keyPath: string]: Position};
+} | null {
+  const defaultNames = ['ci-setup.jsonc', 'ci-setup.json'];
+  const filenames = asArray(config['ci-setup-filename']) || defaultNames;
+  const files = filesOf(config);
+  for (const filename of filenames) {
+    const ciSetupPath = path.join(packagePath, filename);
+    if (files.existsSync(ciSetupPath)) {
+      return timed('setup-read', () => {
+        const {value, positions} = parseJsoncDocument(
+          files.readFileSync(ciSetupPath, 'utf8'),
+          ciSetupPath,
+        );
+        try {
+          const ciSetup = extendCISetup(files, value, ciSetupPath);
+          return {ciSetup, ciSetupPath, positions};
+        } catch (e) {
+          throw new Error(message('E033', (e as Error).message));
+        }
+      });
+    }
+  }
+  return null;
+}
+
+/**
+ * Loads and validates a CI setup file.
+ *
+ * @param config config object
+ * @param packagePath path to the package
+ * @returns ci-setup object
+ */
+export function loadCISetup(config: Config, packagePath: string): CISetup {
+  const read = readCISetup(config, packagePath);
+  if (!read) {
+    console.debug(`No CI setup found for '${packagePath}'`);
+    return {};
+  }
+  const {ciSetup, ciSetupPath, positions} = read;
+  const setupErrors = timed('validate', () => [
+    ...ciSetupErrors(config, ciSetup),
+    ...requiredErrors(config, ciSetup),
+    ...policyErrors(config, ciSetupPath, ciSetup),
+  ]);
+  const errors = setupErrors.map(error => {
+    const position = positions[error.field || ''];
+    return position
+      ? `${ciSetupPath}:${position.line}:${position.column}: ${error.message}`
+      : error.message;
+  });
+  if (errors.length > 0) {
+    throw new Error(
+      message('E009', `validation errors in CI setup file: ${ciSetupPath}\n`) +
+        errors.map(e => `- ${e}`).join('\n') +
+        (config['ci-setup-help-url']
+          ? `\nSee ${config['ci-setup-help-url']}`
+          : '') +
+        '\n',
+    );
+  }
+  const warned = config[deprecationsWarnedKey];
+  if (warned && !warned.has(ciSetupPath)) {
+    warned.add(ciSetupPath);
+    for (const error of deprecatedFields(config, ciSetup)) {
+      const position = positions[error.field || ''];
+      const location = position
+        ? `${ciSetupPath}:${position.line}:${position.column}`
+        : ciSetupPath;
+      console.error(message('W013', `${location}: ${error.message}`));
+    }
+  }
+  return ciSetup;
+}
+
+/**
+ * Checks the CI setup files against policies, on top of the field
+ * validation, when loading the packages or validating the setup files.
+ *
+ * @param config config object
+ * @param validators policies every CI setup file must follow, by name
+ * @returns a copy of the config that checks the policies
+ */
+export function withCISetupValidators(
+  config: Config,
+  validators: {[name: string]: CISetupValidator},
+): Config {
+  return {
+    ...config,
+    [setupValidatorsKey]: {...config[setupValidatorsKey], ...validators},
+  };
+}
+
+/**
+ * Checks a CI setup file against the policies of a config, see
+ * `withCISetupValidators`.
+ *
+ * @param config config object
+ * @param setupPath path to the CI setup file
+ * @param ciSetup ci-setup object
+ * @returns a policy error for each violation
+ */
+function policyErrors(
+  config: Config,
+  setupPath: string,
+  ciSetup: CISetup,
+): Omit<SetupError, 'path' | 'line' | 'column'>[] {
+  const validators = config[setupValidatorsKey] ?? {};
+  return Object.entries(validators).flatMap(([name, validator]) =>
+    validator(setupPath, ciSetup).map(violation => ({
+      field: violation.field,
+      kind: 'policy',
+      message: `${violation.message} (policy: ${name})`,
+    })),
+  );
+}
+
+/**
+ * Warns about the deprecated fields of the CI setup files loaded with the
+ * returned config, once per file.
+ *
+ * Library calls only report them from `validateSetupFiles`, the command
+ * line warns on every run, including every run of `watch`.
+ *
+ * @param config config object
+ * @returns a copy of the config that warns about deprecated fields
+ */
+function withDeprecationWarnings(config: Config): Config {
+  return {...config, [deprecationsWarnedKey]: new Set<string>()};
+}
+
+/**
+ * Finds the deprecated fields that a CI setup uses.
+ *
+ * @param config config object
+ * @param ciSetup ci-setup object
+ * @returns a deprecated-field warning for each deprecated field used
+ */
+function deprecatedFields(
+  config: Config,
+  ciSetup: CISetup,
+): Omit<SetupError, 'path' | 'line' | 'column'>[] {
+  return Object.entries(config['ci-setup-deprecated'] || {})
+    .filter(([field]) => ciSetup[field] !== undefined)
+    .map(([field, hint]) => ({
+      field,
+      kind: 'deprecated-field',
+      message: `'${field}' is deprecated, ${hint}`,
+    }));
+}
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Merges the CI setup file that a CI setup file extends with `_extends`.
+ *
+ * The path is relative to the file, and it must be in the same directory
+ * or a directory above, like `../shared-setup.json`. Extended files can
+ * extend other files too, and the fields of the extending file win.
+ *
+ * @param files file system to read the extended files from
+ * @param ciSetup ci-setup object
+ * @param ciSetupPath path to the ci-setup file
+ * @param chain files extended so far, to detect cycles
+ * @returns ci-setup object with the extended files merged, without `_extends`
+ */
+function extendCISetup(
+  files: FileSystem,
+  ciSetup: any,
+  ciSetupPath: string,
+  chain: string[] = [],
+): CISetup {
+  if (!isObject(ciSetup) || ciSetup._extends === undefined) {
+    return ciSetup;
+  }
+  const {_extends: extendsPath, ...own} = ciSetup;
+  if (typeof extendsPath !== 'string') {
+    throw new Error(
+      `'_extends' in ${ciSetupPath} must be a string, got: ${JSON.stringify(
+        extendsPath,
+      )}`,
+    );
+  }
+  const basePath = path.join(path.dirname(ciSetupPath), extendsPath);
+  const below = path.relative(
+    path.dirname(basePath),
+    path.dirname(ciSetupPath),
+  );
+  if (below.startsWith('..') || path.isAbsolute(below)) {
+    throw new Error(
+      `'_extends' in ${ciSetupPath} must be a file in the same directory or a directory above, got: ${extendsPath}`,
+    );
+  }
+  const extending = [...chain, path.resolve(ciSetupPath)];
+  if (extending.includes(path.resolve(basePath))) {
+    const cycle = [...extending, path.resolve(basePath)];
+    throw new Error(`ci-setup '_extends' cycle: ${cycle.join(' -> ')}`);
+  }
+  if (!files.existsSync(basePath)) {
+    throw new Error(`'_extends' in ${ciSetupPath} not found: ${basePath}`);
+  }
+  console.debug(`ci-setup ${ciSetupPath} extends: ${basePath}`);
+  const base = extendCISetup(
+    files,
+    loadJsonc(basePath, files),
+    basePath,
+    extending,
+  );
+  return mergeCISetup(base, own);
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
+
+/**
+ * Validates the CI setup files of all packages, including archived ones.
+ *
+ * Files are read concurrently, and all errors are collected instead of
+ * stopping at the first invalid file. Deprecated fields are reported too,
+ * as `deprecated-field` warnings.
+ *
+ * @param config config object
+ * @param checkoutPath path to the repository checkout
+ * @param concurrency maximum number of files read at the same time
+ * @param signal signal to cancel the validation, checked before every file
+ *   read, like `AbortSignal.timeout(ms)`
+ * @returns validation errors of all the CI setup files
+ */
+export async function validateSetupFiles(
+  config: Config,
+  checkoutPath = '.',
+  concurrency = 16,
+  signal?: AbortSignal,
+): Promise<SetupError[]> {
+  const fileSystem = filesOf(config);
+  const files = setupFiles(config, checkoutPath, signal);
+  const errors: SetupError[][] = [];
+  let next = 0;
+  const worker = async () => {
+    while (next < files.length) {
+      signal?.throwIfAborted();
+      const i = next++;
+      const filePath = files[i];
+      const text = await readFileAsync(fileSystem, filePath, signal);
+      let document;
+      try {
+        document = parseJsoncDocument(text, filePath);
+      } catch (e) {
+        const {reason, line, column} = e as JsoncSyntaxError;
+        errors[i] = [
+          {
+            path: filePath,
+            field: null,
+            kind: 'parse-error',
+            message: `invalid JSON: ${reason}`,
+            line,
+            column,
+          },
+        ];
+        continue;
+      }
+      const {value, positions} = document;
+      let ciSetup: CISetup;
+      try {
+        ciSetup = extendCISetup(fileSystem, value, filePath);
+      } catch (e) {
+        errors[i] = [
+          {
+            path: filePath,
+            field: '_extends',
+            kind: 'invalid-value',
+            message: (e as Error).message,
+            line: positions._extends?.line ?? null,
+            column: positions._extends?.column ?? null,
+          },
+        ];
+        continue;
+      }
+      errors[i] = [
+        ...ciSetupErrors(config, ciSetup),
+        ...requiredErrors(config, ciSetup),
+        ...policyErrors(config, filePath, ciSetup),
+        ...deprecatedFields(config, ciSetup),
+      ].map(error => ({
+        path: filePath,
+        ...error,
+        line: positions[error.field || '']?.line ?? null,
+        column: positions[error.field || '']?.column ?? null,
+      }));
+    }
+  };
+  const workers = Math.min(concurrency, files.length);
+  await Promise.all(Array.from({length: workers}, worker));
+  // Keep the errors in the same order as the files.
+  return errors.flat();
+}
+
+/**
+ * Finds the CI setup files of all packages, including archived ones.
+ *
+ * @param config config object
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the search
+ * @returns paths to the CI setup files
+ */
+function setupFiles(
+  config: Config,
+  checkoutPath: string,
+  signal?: AbortSignal,
+): string[] {
+  const defaultNames = ['ci-setup.jsonc', 'ci-setup.json'];
+  const filenames = asArray(config['ci-setup-filename']) || defaultNames;
+  return configRoots(config)
+    .flatMap(root => [...packageDirs(config, root, checkoutPath, signal)])
+    .map(dir =>
+      filenames
+        .map(filename => path.join(checkoutPath, dir, filename))
+        .find(filePath => filesOf(config).existsSync(filePath)),
+    )
+    .filter(filePath => filePath !== undefined);
+}
+
+/**
+ * Rewrites a top-level field in the CI setup files of all packages.
+ *
+ * The files are edited in place, so comments, key order, and formatting
+ * are kept. All the files are rewritten in memory first, so an error in
+ * any file leaves every file unchanged.
+ *
+ * @param config config object
+ * @param rewrite change to apply to each file
+ * @param checkoutPath path to the repository checkout
+ * @param dryRun only find the files that would change, without writing them
+ * @returns paths to the files that changed
+ */
+export function rewriteSetupFiles(
+  config: Config,
+  rewrite: SetupRewrite,
+  checkoutPath = '.',
+  dryRun = false,
+): string[] {
+  const files = filesOf(config);
+  const changed = setupFiles(config, checkoutPath)
+    .map(filePath => {
+      const text = files.readFileSync(filePath, 'utf8');
+      const rewritten = rewriteSetupText(text, rewrite, filePath);
+      return {filePath, text, rewritten};
+    })
+    .filter(({text, rewritten}) => rewritten !== text);
+  if (!dryRun) {
+    for (const {filePath, rewritten} of changed) {
+      fs.writeFileSync(filePath, rewritten);
+    }
+  }
+  return changed.map(({filePath}) => filePath);
+}
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Rewrites a top-level field in the text of a CI setup file.
+ *
+ * Only the text of the field changes: renaming keeps its value and
+ * comments, deleting removes its line, and a default is added after the
+ * last field with the same indentation.
+ *
+ * @param text CI setup file contents
+ * @param rewrite change to apply
+ * @param source file name for the error messages
+ * @returns new file contents, the same text if nothing changed
+ */
+export function rewriteSetupText(
+  text: string,
+  rewrite: SetupRewrite,
+  source = '<ci-setup>',
+): string {
+  const {value, spans} = parseJsoncDocument(text, source);
+  if (!isObject(value)) {
+    throw new Error(message('E040', `${source}: ci-setup must be an object`));
+  }
+  const {action, field} = rewrite;
+  const members = Object.entries(spans)
+    .filter(([, span]) => span.depth === 0)
+    .sort(([, a], [, b]) => a.start - b.start);
+  const index = members.findIndex(([key]) => key === field);
+  const span = index < 0 ? null : members[index][1];
+  switch (action) {
+    case 'rename': {
+      const to = rewrite.to || '';
+      if (span === null || to === field) {
+        return text;
+      }
+      if (value[to] !== undefined) {
+        throw new Error(
+          message(
+            'E040',
+            `${source}: can't rename '${field}' to '${to}', it's already set`,
+          ),
+        );
+      }
+      return splice(text, span.start, span.keyEnd, JSON.stringify(to));
+    }
+    case 'delete': {
+      if (span === null) {
+        return text;
+      }
+      const lineStart = text.lastIndexOf('\n', span.start - 1) + 1;
+      const ownLine = /^[ \t]*$/.test(text.slice(lineStart, span.start));
+      const end = span.comma === null ? span.end : span.comma + 1;
+      // On its own line, the whole line goes, with its trailing comment.
+      const trailing = ownLine ? /^[ \t]*(\/\/[^\n]*)?\n?/ : /^[ \t]*/;
+      const rest = text.slice(end);
+      const restEnd = end + rest.length - rest.replace(trailing, '').length;
+      const previous = index > 0 ? members[index - 1][1] : null;
+      if (span.comma === null && previous && previous.comma !== null) {
+        // The last field, the comma of the previous one goes with it, but
+        // the comment after that comma stays.
+        if (!ownLine) {
+          return splice(text, previous.comma, span.end, '');
+        }
+        const previousLineEnd = text.indexOf('\n', previous.comma) + 1;
+        const deleted = splice(text, previousLineEnd, restEnd, '');
+        return splice(deleted, previous.comma, previous.comma + 1, '');
+      }
+      return splice(text, ownLine ? lineStart : span.start, restEnd, '');
+    }
+    case 'set-default': {
+      if (span !== null) {
+        return text;
+      }
+      const json = JSON.stringify(rewrite.value);
+      const member = `${JSON.stringify(field)}: ${json}`;
+      const root = spans[''];
+      if (members.length === 0) {
+        const inner = text.slice(root.start + 1, root.end - 1);
+        return /^\s*$/.test(inner)
+          ? splice(text, root.start + 1, root.end - 1, `\n  ${member}\n`)
+          : splice(text, root.start + 1, root.start + 1, `\n  ${member}`);
+      }
+      const last = members[members.length - 1][1];
+      const lineStart = text.lastIndexOf('\n', last.start - 1) + 1;
+      const indent = text.slice(lineStart, last.start);
+      const separator = /^[ \t]*$/.test(indent) ? `\n${indent}` : ' ';
+      // Keep the trailing comma, if the last field has one.
+      if (last.comma === null) {
+        return splice(text, last.end, last.end, `,${separator}${member}`);
+      }
+      const after = last.comma + 1;
+      return splice(text, after, after, `${separator}${member},`);
+    }
+    default:
+      throw new Error(
+        message(
+          'E040',
+          `unknown ci-setup rewrite '${action}', must be one of: ${setupRewriteActions.join(', ')}`,
+        ),
+      );
+  }
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
+
+/**
+ * Replaces a part of a text.
+ *
+ * @param text original text
+ * @param start offset of the first character to replace
+ * @param end offset after the last character to replace
+ * @param replacement text to insert instead
+ * @returns new text
+ */
+function splice(
+  text: string,
+  start: number,
+  end: number,
+  replacement: string,
+): string {
+  return text.slice(0, start) + replacement + text.slice(end);
+}
+
+/**
+ * Loads a JSON with Comments (JSONC) file.
+ *
+ * @param filePath path to the JSONC file
+ * @param files file system to read it from
+ * @returns JSON object
+ */
+export function loadJsonc(filePath: string, files: FileSystem = fs) {
+  return parseJsonc(files.readFileSync(filePath, 'utf8'), filePath);
+}
+
+/**
+ * Parses JSON with Comments (JSONC) text.
+ *
+ * Syntax errors report the line and column, and the key being parsed.
+ *
+ * @param jsoncData JSONC text
+ * @param source file name for the error messages
+ * @returns JSON object
+ */
+export function parseJsonc(jsoncData: string, source = '<jsonc>') {
+  return parseJsoncDocument(jsoncData, source).value;
+}
+
+// Line and column in a text, both starting at 1.
+type Position = {line: number; column: number};
+
+// Syntax error with the position where parsing failed.
+type JsoncSyntaxError = Error & Position & {reason: string};
+
+// Offsets of an object member in a JSONC text, to edit it in place.
+type Span = {
+  // Offset of the key's opening quote.
+  start: number;
+
+  // Offset after the key's closing quote.
+  keyEnd: number;
+
+  // Offset after the value.
+  end: number;
+
+  // Offset of the comma after the value, or null if there is none.
+  comma: number | null;
+
+  // Nesting level, 0 for the members of the top-level object.
+  depth: number;
+};
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Parses JSONC text, keeping the position of every key.
+ *
+ * Comments are skipped by the tokenizer instead of removed beforehand,
+ * so positions match the original text. Trailing commas are allowed.
+ * Key paths are dotted, with array indices in brackets, like `jobs[0].name`.
+ *
+ * The spans of the members are also kept by key path, and the span of
+ * the top-level value by the empty key path, from its first character to
+ * the offset after its last one.
+ *
+ * @param text JSONC text
+ * @param source file name for the error messages
+ * @returns parsed value, and the position and span of each key path
+ */
+function parseJsoncDocument(
+  text: string,
+  source: string,
+): {
+  value: any;
+  positions: {[keyPath: string]: Position};
+  spans: {[keyPath: string]: Span};
+} {
+  let pos = 0;
+  let line = 1;
+  let column = 1;
+  const positions: {[keyPath: string]: Position} = {};
+  const spans: {[keyPath: string]: Span} = {};
+  const keys: string[] = [];
+  const keyPath = (path: string[]) =>
+    path.map((k, i) => (i === 0 || k.startsWith('[') ? k : `.${k}`)).join('');
+
+  const fail = (reason: string): never => {
+    if (keys.length > 0) {
+      reason += ` in '${keyPath(keys)}'`;
+    }
+    const error = new Error(
+      message('E028', `${source}:${line}:${column}: ${reason}`),
+    );
+    throw Object.assign(error, {reason, line, column});
+  };
+  const got = () =>
+    pos < text.length ? JSON.stringify(text[pos]) : 'end of file';
+  const advance = (n = 1) => {
+    for (let i = 0; i < n; i++, pos++) {
+      if (text[pos] === '\n') {
+        line++;
+        column = 1;
+      } else {
+        column++;
+      }
+    }
+  };
+  const skip = () => {
+    while (pos < text.length) {
+      if (/\s/.test(text[pos])) {
+        advance();
+      } else if (text.startsWith('//', pos)) {
+        while (pos < text.length && text[pos] !== '\n') {
+          advance();
+        }
+      } else if (text.startsWith('/*', pos)) {
+        const end = text.indexOf('*/', pos + 2);
+        if (end < 0) {
+          fail('unterminated comment');
+        }
+        advance(end + 2 - pos);
+      } else {
+        return;
+      }
+    }
+  };
+  const parseString = (): string => {
+    const start = pos;
+    advance();
+    while (text[pos] !== '"') {
+      if (pos >= text.length || text[pos] === '\n') {
+        fail('unterminated string');
+      }
+      advance(text[pos] === '\\' ? 2 : 1);
+    }
+    advance();
+    try {
+      return JSON.parse(text.slice(start, pos));
+    } catch {
+      return fail(`invalid string ${text.slice(start, pos)}`);
+    }
+  };
+  const literal = /true|false|null|-?\d+(?:\.\d+)?(?:[eE][+-]?\d+)?/y;
+  const parseValue = (): any => {
+    skip();
+    if (text[pos] === '{') {
+      advance();
+      const object: {[k: string]: any} = {};
+      for (;;) {
+        skip();
+        if (text[pos] === '}') {
+          advance();
+          return object;
+        }
+        if (text[pos] !== '"') {
+          fail(`expected a key or '}', got ${got()}`);
+        }
+        const keyPosition = {line, column};
+        const start = pos;
+        const key = parseString();
+        const keyEnd = pos;
+        positions[keyPath([...keys, key])] = keyPosition;
+        skip();
+        if (text[pos] !== ':') {
+          fail(`expected ':' after key ${JSON.stringify(key)}, got ${got()}`);
+        }
+        advance();
+        keys.push(key);
+        Object.defineProperty(object, key, {
+          value: parseValue(),
+          enumerable: true,
+          writable: true,
+          configurable: true,
+        });
+        keys.pop();
+        const depth = keys.length;
+        const span: Span = {start, keyEnd, end: pos, comma: null, depth};
+        spans[keyPath([...keys, key])] = span;
+        skip();
+        if (text[pos] === ',') {
+          span.comma = pos;
+          advance();
+        } else if (text[pos] !== '}') {
+          fail(`expected ',' or '}', got ${got()}`);
+        }
+      }
+    }
+    if (text[pos] === '[') {
+      advance();
+      const array = [];
+      for (;;) {
+        skip();
+        if (text[pos] === ']') {
+          advance();
+          return array;
+        }
+        keys.push(`[${array.length}]`);
+        array.push(parseValue());
+        keys.pop();
+        skip();
+        if (text[pos] === ',') {
+          advance();
+        } else if (text[pos] !== ']') {
+          fail(`expected ',' or ']', got ${got()}`);
+        }
+      }
+    }
+    if (text[pos] === '"') {
+      return parseString();
+    }
+    literal.lastIndex = pos;
+    const match = literal.exec(text);
+    if (!match) {
+      return fail(`unexpected ${got()}`);
+    }
+    advance(match[0].length);
+    return JSON.parse(match[0]);
+  };
+
+  skip();
+  const start = pos;
+  const value = parseValue();
+  spans[''] = {start, keyEnd: start, end: pos, comma: null, depth: -1};
+  skip();
+  if (pos < text.length) {
+    fail(`unexpected ${got()} after the value`);
+  }
+  return {value, positions, spans};
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
+
+/**
+ * Upgrades a config to the current schema version, in place.
+ *
+ * Each migration keeps the behavior the config had in its version, like
+ * setting a field to its old default. Configs without a 'schema-version'
+ * were written before it existed, so they are upgraded from version 1.
+ *
+ * @param config config object, it's modified
+ * @returns description of each change
+ */
+export function migrateConfig(config: Config): string[] {
+  const version = config['schema-version'] ?? 1;
+  if (!isPositiveInteger(version)) {
+    // Invalid versions are reported by `validateConfig`.
+    return [];
+  }
+  if (version > configSchemaVersion) {
+    throw new Error(
+      message(
+        'E035',
+        `unsupported config schema-version ${version}, this version of Custard supports up to ${configSchemaVersion}, upgrade Custard to use this config`,
+      ),
+    );
+  }
+  const changes: string[] = [];
+  for (let from = version; from < configSchemaVersion; from++) {
+    changes.push(...configMigrations[from](config));
+  }
+  if (config['schema-version'] !== configSchemaVersion) {
+    config['schema-version'] = configSchemaVersion;
+    changes.push(`set 'schema-version' to ${configSchemaVersion}`);
+  }
+  return changes;
+}
+
+/**
+ * Upgrades a config from schema version 1 to 2.
+ *
+ * Version 2 made 'ignore' patterns starting with `!` re-include files,
+ * and started loading ci-setup defaults files from package directories.
+ *
+ * @param config config object, it's modified
+ * @returns description of each change
+ */
+function migrateConfigV1(config: Config): string[] {
+  const changes: string[] = [];
+  const profiles = Object.values(config.profiles || {});
+  for (const target of [config, ...profiles.filter(isObject)]) {
+    const ignore = isStringOrStrings(target.ignore)
+      ? asArray(target.ignore) || []
+      : [];
+    if (ignore.some(pattern => pattern.startsWith('!'))) {
+      target.ignore = ignore.map(pattern =>
+        pattern.startsWith('!') ? `\\${pattern}` : pattern,
+      );
+      changes.push(
+        "escaped the 'ignore' patterns starting with '!', they re-include files since version 2",
+      );
+    }
+  }
+  if (config['ci-setup-defaults-filename'] === undefined) {
+    config['ci-setup-defaults-filename'] = [];
+    changes.push(
+      "set 'ci-setup-defaults-filename' to [], ci-setup defaults files are loaded since version 2",
+    );
+  }
+  return changes;
+}
+
+/**
+ * Loads a config file, in JSON, JSONC, or TOML format.
+ *
+ * For `pyproject.toml` files, the config is read from `[tool.custard]`.
+ *
+ * @param filePath path to the config file
+ * @returns config object
+ */
+export function loadConfigFile(filePath: string): Config {
+  return parseConfigFile(fs.readFileSync(filePath, 'utf8'), filePath);
+}
+
+/**
+ * Parses a config file, the format is chosen by the file name.
+ *
+ * @param text config file contents
+ * @param filePath path or URL to the config file
+ * @returns config object
+ */
+function parseConfigFile(text: string, filePath: string): Config {
+  const name = isUrl(filePath) ? new URL(filePath).pathname : filePath;
+  if (path.extname(name) !== '.toml') {
+    return parseJsonc(text, filePath);
+  }
+  const data = parseToml(text);
+  if (path.basename(name) === 'pyproject.toml') {
+    return data.tool?.custard || {};
+  }
+  return data;
+}
+
+/**
+ * Marshals a config to JSONC.
+ *
+ * Fields keep the order they have in the config object, and the fields
+ * that are not set are listed at the end as comments with their defaults.
+ *
+ * @param config config object
+ * @returns JSONC document
+ */
+export function marshalConfig(config: Config): string {
+  const indent = (value: unknown) =>
+    JSON.stringify(value, null, 2).replaceAll('\n', '\n  ');
+  const fields = Object.entries(config).map(
+    ([key, value]) => `  ${JSON.stringify(key)}: ${indent(value)}`,
+  );
+  const defaults = Object.entries(configDefaults)
+    .filter(([key]) => !(key in config))
+    .map(
+      ([key, value]) =>
+        `  // ${JSON.stringify(key)}: ${JSON.stringify(value)}`,
+    );
+  const lines = [fields.join(',\n')];
+  if (defaults.length > 0) {
+    lines.push('  // Defaults:', ...defaults);
+  }
+  return `{\n${lines.filter(line => line).join('\n')}\n}\n`;
+}
+
+/**
+ * Writes a config as JSONC, see `marshalConfig`.
+ *
+ * @param config config object
+ * @param out anything with a write method, like a file or HTTP response
+ */
+export function saveConfig(
+  config: Config,
+  out: {write: (chunk: string) => unknown},
+) {
+  out.write(marshalConfig(config));
+}
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Parses a TOML document.
+ *
+ * This supports the subset of TOML needed for config files:
+ * tables, arrays of tables, dotted keys, strings, numbers, booleans,
+ * arrays, and inline tables. Dates and times are parsed as strings.
+ *
+ * @param text TOML document
+ * @returns parsed object
+ */
+export function parseToml(text: string): {[k: string]: any} {
+  const root: {[k: string]: any} = {};
+  let table = root;
+  let pos = 0;
+
+  const fail = (msg: string): never => {
+    const line = text.slice(0, pos).split('\n').length;
+    throw new Error(`TOML line ${line}: ${msg}`);
+  };
+  const skipSpaces = () => {
+    while (text[pos] === ' ' || text[pos] === '\t') {
+      pos++;
+    }
+  };
+  const skipComment = () => {
+    if (text[pos] === '#') {
+      while (pos < text.length && text[pos] !== '\n') {
+        pos++;
+      }
+    }
+  };
+  const skipBlanks = () => {
+    while (pos < text.length) {
+      if (' \t\r\n'.includes(text[pos])) {
+        pos++;
+      } else if (text[pos] === '#') {
+        skipComment();
+      } else {
+        break;
+      }
+    }
+  };
+  const unescape = (value: string) =>
+    value.replace(
+      /\\(u[0-9a-fA-F]{4}|U[0-9a-fA-F]{8}|\r?\n\s*|.)/g,
+      (_, escape: string) => {
+        const escapes: {[k: string]: string} = {
+          b: '\b',
+          t: '\t',
+          n: '\n',
+          f: '\f',
+          r: '\r',
+          '"': '"',
+          '\\': '\\',
+        };
+        if (escape[0] === 'u' || escape[0] === 'U') {
+          return String.fromCodePoint(parseInt(escape.slice(1), 16));
+        }
+        if (escape[0] === '\r' || escape[0] === '\n') {
+          // Line ending backslash, trims the following whitespace.
+          return '';
+        }
+        return escapes[escape] ?? fail(`invalid escape: \\${escape}`);
+      },
+    );
+  const parseString = (): string => {
+    const quote = text[pos];
+    if (text.startsWith(quote.repeat(3), pos)) {
+      // Multi-line string, the first newline is trimmed.
+      const end = text.indexOf(quote.repeat(3), pos + 3);
+      if (end < 0) {
+        fail('unterminated string');
+      }
+      const value = text.slice(pos + 3, end).replace(/^\r?\n/, '');
+      pos = end + 3;
+      return quote === '"' ? unescape(value) : value;
+    }
+    let end = pos + 1;
+    while (end < text.length && text[end] !== quote && text[end] !== '\n') {
+      end += quote === '"' && text[end] === '\\' ? 2 : 1;
+    }
+    if (text[end] !== quote) {
+      fail('unterminated string');
+    }
+    const value = text.slice(pos + 1, end);
+    pos = end + 1;
+    return quote === '"' ? unescape(value) : value;
+  };
+  const parseKey = (): string[] => {
+    const keys = [];
+    for (;;) {
+      skipSpaces();
+      if (text[pos] === '"' || text[pos] === "'") {
+        keys.push(parseString());
+      } else {
+        const bare = /^[A-Za-z0-9_-]+/.exec(text.slice(pos));
+        if (!bare) {
+          return fail('expected a key');
+        }
+        keys.push(bare[0]);
+        pos += bare[0].length;
+      }
+      skipSpaces();
+      if (text[pos] !== '.') {
+        return keys;
+      }
+      pos++;
+    }
+  };
+  const getTable = (obj: {[k: string]: any}, keys: string[]) => {
+    for (const key of keys) {
+      obj[key] ??= {};
+      // For arrays of tables, the last table defined is the current one.
+      obj = Array.isArray(obj[key])
+        ? obj[key][obj[key].length - 1]
+        : obj[key];
+      if (typeof obj !== 'object' || Array.isArray(obj)) {
+        fail(`'${keys.join('.')}' is not a table`);
+      }
+    }
+    return obj;
+  };
+  const setKey = (obj: {[k: string]: any}, keys: string[], value: any) => {
+    const parent = getTable(obj, keys.slice(0, -1));
+    const key = keys[keys.length - 1];
+    if (key in parent) {
+      fail(`duplicate key: ${keys.join('.')}`);
+    }
+    parent[key] = value;
+  };
+  const parseValue = (): any => {
+    skipSpaces();
+    const c = text[pos];
+    if (c === '"' || c === "'") {
+      return parseString();
+    }
+    if (c === '[') {
+      pos++;
+      const array = [];
+      for (;;) {
+        skipBlanks();
+        if (text[pos] === ']') {
+          pos++;
+          return array;
+        }
+        array.push(parseValue());
+        skipBlanks();
+        if (text[pos] === ',') {
+          pos++;
+        } else if (text[pos] !== ']') {
+          fail("expected ',' or ']'");
+        }
+      }
+    }
+    if (c === '{') {
+      pos++;
+      const inline = {};
+      skipSpaces();
+      if (text[pos] === '}') {
+        pos++;
+        return inline;
+      }
+      for (;;) {
+        const keys = parseKey();
+        if (text[pos] !== '=') {
+          fail("expected '='");
+        }
+        pos++;
+        setKey(inline, keys, parseValue());
+        skipSpaces();
+        if (text[pos] === '}') {
+          pos++;
+          return inline;
+        }
+        if (text[pos] !== ',') {
+          fail("expected ',' or '}'");
+        }
+        pos++;
+      }
+    }
+    for (const [literal, value] of [
+      ['true', true],
+      ['false', false],
+    ] as const) {
+      if (text.startsWith(literal, pos)) {
+        pos += literal.length;
+        return value;
+      }
+    }
+    // Dates and times are kept as strings, like 1979-05-27T07:32:00Z.
+    const date =
+      /^(\d{4}-\d{2}-\d{2}([Tt ]\d{2}:\d{2}:\d{2}(\.\d+)?([Zz]|[+-]\d{2}:\d{2})?)?|\d{2}:\d{2}:\d{2}(\.\d+)?)/.exec(
+        text.slice(pos),
+      );
+    if (date) {
+      pos += date[0].length;
+      return date[0];
+    }
+    const number = /^[+-]?\d[\d_]*(\.\d[\d_]*)?([eE][+-]?\d+)?/.exec(
+      text.slice(pos),
+    );
+    if (number) {
+      pos += number[0].length;
+      return Number(number[0].replaceAll('_', ''));
+    }
+    return fail('unsupported value');
+  };
+
+  for (;;) {
+    skipBlanks();
+    if (pos >= text.length) {
+      return root;
+    }
+    if (text[pos] === '[') {
+      // Table header: [table] or [[array.of.tables]]
+      const isArray = text.startsWith('[[', pos);
+      pos += isArray ? 2 : 1;
+      const keys = parseKey();
+      if (!text.startsWith(isArray ? ']]' : ']', pos)) {
+        fail("expected ']'");
+      }
+      pos += isArray ? 2 : 1;
+      if (isArray) {
+        const parent = getTable(root, keys.slice(0, -1));
+        const key = keys[keys.length - 1];
+        parent[key] ??= [];
+        if (!Array.isArray(parent[key])) {
+          fail(`'${keys.join('.')}' is not an array of tables`);
+        }
+        table = {};
+        parent[key].push(table);
+      } else {
+        table = getTable(root, keys);
+      }
+    } else {
+      const keys = parseKey();
+      if (text[pos] !== '=') {
+        fail("expected '='");
+      }
+      pos++;
+      setKey(table, keys, parseValue());
+    }
+    skipSpaces();
+    skipComment();
+    if (pos < text.length && text[pos] !== '\n' && text[pos] !== '\r') {
+      fail('expected a new line');
+    }
+  }
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
+
+/**
+ * Applies variable interpolation to the given variables.
+ *
+ * @param subs variable substitutions
+ * @param value original value
+ * @returns value after substitutions
+ */
+export function substitute(subs: {[k: string]: string}, value: string): string {
+  for (const key in subs) {
+    const re = new RegExp(`\\$(${key}\\b|\\{\\s*${key}\\s*\\})`, 'g');
+    // JavaScript doesn't allow lazy substitutions, so we check if
+    // the substitution needs to be done first.
+    if (value.match(re)) {
+      // Substitute recursively to handle nested substitutions.
+      // Since JS doesn't do lazy evaluation, this is technically
+      // O(n^2) worst case, but in reality we should only have a
+      // handful of variables with a couple of levels of recursion.
+      // Doing graph traversals or topological sort should not be
+      // needed, unless we get into a pathological case.
+      value = value.replaceAll(re, substitute(subs, subs[key]));
+    }
+  }
+  return value;
+}
+
+/**
+ * Parses a duration, like 500ms, 90s, 15m, 1h30m, or 1.5h.
+ *
+ * @param text duration with a unit for each number: ms, s, m, or h
+ * @returns duration in milliseconds, or null if it's not a valid duration
+ */
+export function parseDuration(text: string): number | null {
+  const units: {[unit: string]: number} = {
+    ms: 1,
+    s: 1000,
+    m: 60 * 1000,
+    h: 60 * 60 * 1000,
+  };
+  if (!/^(\d+(\.\d+)?(ms|s|m|h))+$/.test(text)) {
+    return null;
+  }
+  let total = 0;
+  for (const [, value, , unit] of text.matchAll(/(\d+(\.\d+)?)(ms|s|m|h)/g)) {
+    total += Number(value) * units[unit];
+  }
+  return total;
+}
+
+/**
+ * Parses an amount of memory, like 512Mi, 4Gi, or 2G.
+ *
+ * @param text number with an optional unit: k, M, G, T, Ki, Mi, Gi, or Ti
+ * @returns amount of memory in bytes, or null if it's not valid
+ */
+export function parseMemory(text: string): number | null {
+  const units: {[unit: string]: number} = {
+    '': 1,
+    k: 1e3,
+    M: 1e6,
+    G: 1e9,
+    T: 1e12,
+    Ki: 2 ** 10,
+    Mi: 2 ** 20,
+    Gi: 2 ** 30,
+    Ti: 2 ** 40,
+  };
+  const match = text.match(/^(\d+(?:\.\d+)?)(k|Ki|[MGT]i?)?$/);
+  if (!match) {
+    return null;
+  }
+  return Number(match[1]) * units[match[2] ?? ''];
+}
+
+/**
+ * Generates a random alphanumeric ID.
+ *
+ * @param length length of the ID
+ * @returns random alhpanumeric string
+ */
+export function uniqueId(length = 6) {
+  const min = 2 ** 32;
+  const max = 2 ** 64;
+  return Math.floor(Math.random() * max + min)
+    .toString(36)
+    .slice(0, length);
+}
+
+/**
+ * Gets the default project ID from gcloud.
+ *
+ * @returns default project ID
+ */
+function defaultProject(): string {
+  const cmd = 'gcloud config get-value project';
+  return execSync(cmd).toString().trim();
+}
+
+/**
+ * Parses a Secret Manager secret path.
+ *
+ * Supported formats:
+ * - secret-id, in the gcloud default project
+ * - project-id/secret-id
+ * - projects/project-id/secrets/secret-id
+ * - projects/project-id/secrets/secret-id/versions/version
+ *
+ * @param secretPath secret path
+ * @returns the secret parts, or null if the format is not valid
+ */
+export function parseSecretPath(
+  secretPath: string,
+): {project: string | null; secret: string; version: string} | null {
+  const full = secretPath.match(
+    /^projects\/([^/]+)\/secrets\/([^/]+)(?:\/versions\/([^/]+))?$/,
+  );
+  if (full) {
+    const [, project, secret, version] = full;
+    return {project, secret, version: version || 'latest'};
+  }
+  const short = secretPath.match(/^([^/]+)\/([^/]+)$/);
+  if (short) {
+    const [, project, secret] = short;
+    return {project, secret, version: 'latest'};
+  }
+  // Secret ids alone were the only format before the project was required.
+  if (/^[\w-]+$/.test(secretPath)) {
+    return {project: null, secret: secretPath, version: 'latest'};
+  }
+  return null;
+}
+
+/**
+ * Accesses a secret from Secret Manager.
+ *
+ * @param secretPath secret path, see parseSecretPath for the formats
+ * @returns secret value
+ */
+export function accessSecret(secretPath: string): string {
+  const secret = parseSecretPath(secretPath);
+  if (!secret) {
+    throw new Error(`Invalid secret path: ${secretPath}`);
+  }
+  const project = secret.project ? `--project=${secret.project} ` : '';
+  const cmd = `gcloud ${project}secrets versions access "${secret.version}" --secret=${secret.secret}`;
+  return execSync(cmd).toString();
+}
+
+/**
+ * Creates a secret resolver that reads secrets from environment variables
+ * named after their secret id, like API_KEY for `my-project/api-key`.
+ *
+ * This is useful for CI runners that inject the secrets themselves, under
+ * their Secret Manager names. Secrets already defined under the variable
+ * they're exported as are used as they are, without resolving them.
+ *
+ * @param env environment variables
+ * @returns secret resolver
+ */
+export function envSecret(env = process.env): SecretResolver {
+  return (secretPath, name) => {
+    const secret = parseSecretPath(secretPath);
+    const variable = (secret?.secret ?? secretPath)
+      .toUpperCase()
+      .replace(/[^A-Z0-9_]/g, '_');
+    const value = env[variable];
+    if (value === undefined) {
+      throw new Error(
+        `Secret '${name}' (${secretPath}) is not defined in the environment as ${variable}.`,
+      );
+    }
+    return value;
+  };
+}
+
+/**
+ * Gets a secret resolver by name.
+ *
+ * @param name one of: secret-manager, env
+ * @param env environment variables
+ * @returns secret resolver
+ */
+export function secretResolver(
+  name: string,
+  env = process.env,
+): SecretResolver {
+  switch (name) {
+    case 'secret-manager':
+      return accessSecret;
+    case 'env':
+      return envSecret(env);
+    default:
+      throw new Error(
+        `Unknown secret resolver '${name}', must be one of: secret-manager, env`,
+      );
+  }
+}
+
+/**
+ * Gets the identity token from gcloud.
+ *
+ * @param projectId Google Cloud project ID
+ * @returns identity token
+ */
+function getIdToken(projectId?: string): string {
+  if (projectId) {
+    const cmd = `gcloud --project=${projectId} auth print-identity-token`;
+    return execSync(cmd).toString().trim();
+  }
+  return '';
+}
+
+/**
+ * Normalizes (string | string[]) into string[]
+ *
+ * @param x string or string[] or undefined
+ * @returns string[] or undefined
+ */
+function asArray(x: string | string[] | undefined): string[] | undefined {
+  // If undefined, return undefined.
+  if (!x) {
+    return undefined;
+  }
+  // If it's a single string, return a single-element array.
+  return Array.isArray(x) ? x : [x];
+}
+
+// For validation, the data comes from JSON files, so they can be anything.
+// There are no type guarantees, so many of these functions take
+// parameters of type `any` and validate the type at runtime.
+/* eslint-disable @typescript-eslint/no-explicit-any */
+
+/**
+ * Validates the config file.
+ *
+ * @param config config object
+ * @returns a list of validation errors
+ */
+export function validateConfig(config: any): string[] {
+  // Undefined fields.
+  let errors = [];
+  const validFields = [
+    'schema-version',
+    'package-file',
+    'presets',
+    'match-categories',
+    'ci-setup-filename',
+    'ci-setup-defaults-filename',
+    'ci-setup-inherit',
+    'ci-setup-defaults',
+    'ci-setup-scoped-defaults',
+    'ci-setup-help-url',
+    'ci-setup-required',
+    'ci-setup-deprecated',
+    'match',
+    'ignore',
+    'match-file',
+    'match-engine',
+    'case-insensitive',
+    'normalize-unicode',
+    'commands',
+    'exclude-packages',
+    'exclusions-file',
+    'exclude-subpackages',
+    'nested-packages',
+    'roots',
+    'boundaries',
+    'prune',
+    'prune-ignored',
+    'respect-gitignore',
+    'max-depth',
+    'dependencies',
+    'site-generators',
+    'max-affected',
+    'max-affected-action',
+    'affected-order',
+    'symlinks',
+    'package-index',
+    'profiles',
+  ];
+  for (const key in config) {
+    if (!validFields.includes(key)) {
+      errors.push(`'${key}' is not a valid field`);
+    }
+  }
+
+  const schemaVersion = config['schema-version'];
+  if (isPositiveInteger(schemaVersion) && schemaVersion > configSchemaVersion) {
+    errors.push(
+      `'schema-version' must be at most ${configSchemaVersion}, got: ${schemaVersion}, upgrade Custard to use this config`,
+    );
+  }
+  for (const name of asArray(config.dependencies) || []) {
+    if (typeof name === 'string' && !(name in dependencyResolvers)) {
+      errors.push(
+        `'dependencies' must be one of: ${Object.keys(
+          dependencyResolvers,
+        ).join(', ')}, got: ${JSON.stringify(name)}`,
+      );
+    }
+  }
+  const action = config['max-affected-action'];
+  if (typeof action === 'string' && !maxAffectedActions.includes(action)) {
+    errors.push(
+      `'max-affected-action' must be one of: ${maxAffectedActions.join(
+        ', ',
+      )}, got: ${JSON.stringify(action)}`,
+    );
+  }
+  const order = config['affected-order'];
+  if (typeof order === 'string' && !affectedOrders.includes(order)) {
+    errors.push(
+      `'affected-order' must be one of: ${affectedOrders.join(
+        ', ',
+      )}, got: ${JSON.stringify(order)}`,
+    );
+  }
+  for (const name of asArray(config.presets) || []) {
+    if (typeof name === 'string' && !(name in configPresets)) {
+      errors.push(
+        `'presets' must be one of: ${Object.keys(configPresets).join(
+          ', ',
+        )}, got: ${JSON.stringify(name)}`,
+      );
+    }
+  }
+  const categories = unique(
+    Object.values(matchCategories).flatMap(Object.keys),
+  ).sort();
+  for (const name of asArray(config['match-categories']) || []) {
+    if (typeof name === 'string' && !categories.includes(name)) {
+      errors.push(
+        `'match-categories' must be one of: ${categories.join(
+          ', ',
+        )}, got: ${JSON.stringify(name)}`,
+      );
+    }
+  }
+  if (isPackageFile(config['package-file'])) {
+    for (const name of packageFileNames(config)) {
+      if (name.includes('*') && name.includes('/')) {
+        errors.push(
+          `'package-file' globs only match file names, got: ${JSON.stringify(name)}`,
+        );
+      }
+    }
+  }
+  const engine = config['match-engine'];
+  if (config.presets && engine === 'regexp') {
+    errors.push(
+      "'presets' use glob patterns, they can't be used with the regexp 'match-engine'",
+    );
+  }
+  if (config['match-categories'] && engine === 'regexp') {
+    errors.push(
+      "'match-categories' use glob patterns, they can't be used with the regexp 'match-engine'",
+    );
+  }
+  if (typeof engine === 'string' && !(engine in matchEngines)) {
+    errors.push(
+      `'match-engine' must be one of: ${Object.keys(matchEngines).join(
+        ', ',
+      )}, got: ${JSON.stringify(engine)}`,
+    );
+  }
+  const symlinks = config.symlinks;
+  if (typeof symlinks === 'string' && !symlinkPolicies.includes(symlinks)) {
+    errors.push(
+      `'symlinks' must be one of: ${symlinkPolicies.join(
+        ', ',
+      )}, got: ${JSON.stringify(symlinks)}`,
+    );
+  }
+  const nested = config['nested-packages'];
+  if (typeof nested === 'string' && !nestedPackagesModes.includes(nested)) {
+    errors.push(
+      `'nested-packages' must be one of: ${nestedPackagesModes.join(
+        ', ',
+      )}, got: ${JSON.stringify(nested)}`,
+    );
+  }
+  for (const generator of asArray(config['site-generators']) || []) {
+    if (typeof generator === 'string' && !(generator in siteGeneratorFiles)) {
+      errors.push(
+        `'site-generators' must be one of: ${Object.keys(
+          siteGeneratorFiles,
+        ).join(', ')}, got: ${JSON.stringify(generator)}`,
+      );
+    }
+  }
+
+  if (config.commands) {
+    for (const name in config.commands) {
+      for (const key in config.commands[name]) {
+        if (!['pre', 'run', 'post'].includes(key)) {
+          errors.push(`'commands.${name}.${key}' is not a valid field`);
+        }
+      }
+    }
+  }
+
+  // Type checking.
+  errors = errors.concat(
+    check(config, 'schema-version', isPositiveInteger, 'a positive integer'),
+    checkPackageFile(config),
+    checkStringOrStrings(config, 'presets'),
+    checkStringOrStrings(config, 'match-categories'),
+    checkStringOrStrings(config, 'ci-setup-filename'),
+    checkStringOrStrings(config, 'ci-setup-defaults-filename'),
+    check(config, 'ci-setup-inherit', isBoolean, 'boolean'),
+    checkMappings(config['ci-setup-defaults'], 'ci-setup-defaults.env'),
+    checkMappings(config['ci-setup-defaults'], 'ci-setup-defaults.secrets'),
+    checkSecretPaths(config['ci-setup-defaults'], 'ci-setup-defaults.secrets'),
+    checkString(config, 'ci-setup-help-url'),
+    checkStringOrStrings(config, 'ci-setup-required'),
+    checkMappings(config, 'ci-setup-deprecated'),
+    checkStringOrStrings(config, 'match'),
+    checkStringOrStrings(config, 'ignore'),
+    checkString(config, 'match-file'),
+    checkString(config, 'match-engine'),
+    checkPatterns(config),
+    checkStringOrStrings(config, 'exclude-packages'),
+    checkString(config, 'exclusions-file'),
+    check(config, 'exclude-subpackages', isBoolean, 'boolean'),
+    check(config, 'case-insensitive', isBoolean, 'boolean'),
+    check(config, 'normalize-unicode', isBoolean, 'boolean'),
+    checkString(config, 'nested-packages'),
+    checkStringOrStrings(config, 'roots'),
+    checkStringOrStrings(config, 'boundaries'),
+    checkStringOrStrings(config, 'prune'),
+    check(config, 'prune-ignored', isBoolean, 'boolean'),
+    check(config, 'respect-gitignore', isBoolean, 'boolean'),
+    check(config, 'max-depth', isPositiveInteger, 'a positive integer'),
+    checkStringOrStrings(config, 'dependencies'),
+    checkStringOrStrings(config, 'site-generators'),
+    check(config, 'max-affected', isPositiveInteger, 'a positive integer'),
+    checkString(config, 'max-affected-action'),
+    checkString(config, 'affected-order'),
+    checkString(config, 'symlinks'),
+    checkString(config, 'package-index'),
+    checkScopedDefaults(config),
+    checkProviders(config['ci-setup-defaults'], 'ci-setup-defaults'),
+    checkProviders(
+      config['ci-setup-scoped-defaults'],
+      'ci-setup-scoped-defaults',
+    ),
+    checkProfiles(config),
+  );
+  for (const name in config.commands) {
+    errors = errors.concat(
+      checkStringOrStrings(config.commands[name], `commands.${name}.pre`),
+      checkStringOrStrings(config.commands[name], `commands.${name}.run`),
+      checkStringOrStrings(config.commands[name], `commands.${name}.post`),
+    );
+  }
+  return errors;
+}
+
+/**
+ * Checks that the value providers used in a value exist.
+ *
+ * @param value value to check, like the ci-setup defaults
+ * @param field path of the value, for the error messages
+ * @returns a list of validation errors
+ */
+function checkProviders(value: any, field: string): string[] {
+  if (Array.isArray(value)) {
+    return value.flatMap((item, i) => checkProviders(item, `${field}[${i}]`));
+  }
+  if (!isObject(value)) {
+    return [];
+  }
+  if (isProvided(value) && !(value.$provider in valueProviders)) {
+    return [
+      `'${field}.$provider' must be one of: ${Object.keys(valueProviders).join(
+        ', ',
+      )}, got: ${JSON.stringify(value.$provider)}`,
+    ];
+  }
+  return Object.keys(value).flatMap(key =>
+    checkProviders(value[key], `${field}.${key}`),
+  );
+}
+
+/**
+ * Checks that each profile is a valid config, without nested profiles.
+ *
+ * @param config config object
+ * @returns a list of validation errors
+ */
+function checkProfiles(config: any): string[] {
+  const profiles = config.profiles;
+  if (profiles === undefined) {
+    return [];
+  }
+  if (!isObject(profiles)) {
+    return [
+      `'profiles' must be {name: config} mappings, got: ${JSON.stringify(
+        profiles,
+      )}`,
+    ];
+  }
+  const errors = [];
+  for (const name in profiles) {
+    if (!isObject(profiles[name])) {
+      errors.push(
+        `'profiles.${name}' must be a config object, got: ${JSON.stringify(
+          profiles[name],
+        )}`,
+      );
+      continue;
+    }
+    if ('profiles' in profiles[name]) {
+      errors.push(`'profiles.${name}': profiles cannot be nested`);
+    }
+    const profile = {...profiles[name]};
+    delete profile.profiles;
+    for (const err of validateConfig(profile)) {
+      errors.push(`'profiles.${name}': ${err}`);
+    }
+  }
+  return errors;
+}
+
+/**
+ * Validates the CI setup file.
+ *
+ * @param config config object
+ * @param ciSetup ci-setup object
+ * @returns a list of validation errors
+ */
+export function validateCISetup(config: Config, ciSetup: any): string[] {
+  return timed('validate', () =>
+    [
+      ...ciSetupErrors(config, ciSetup),
+      ...requiredErrors(config, ciSetup),
+    ].map(error => error.message),
+  );
+}
+
+/**
+ * Validates CI setup defaults, like a defaults file or the
+ * 'ci-setup-scoped-defaults'.
+ *
+ * Defaults are partial, they're merged into the packages' CI setup files,
+ * which are the ones that must set the 'ci-setup-required' fields.
+ *
+ * @param config config object
+ * @param defaults ci-setup defaults object
+ * @returns a list of validation errors
+ */
+function validateCISetupDefaults(config: Config, defaults: any): string[] {
+  return timed('validate', () =>
+    ciSetupErrors(config, defaults).map(error => error.message),
+  );
+}
+
+/**
+ * Validates a CI setup object, with the field and kind of each error.
+ *
+ * @param config config object
+ * @param ciSetup ci-setup object
+ * @returns a list of validation errors, without their path
+ */
+function ciSetupErrors(
+  config: Config,
+  ciSetup: any,
+): Omit<SetupError, 'path' | 'line' | 'column'>[] {
+  // Undefined fields.
+  const errors: Omit<SetupError, 'path' | 'line' | 'column'>[] = [];
+  const validFields = [
+    'env',
+    'secrets',
+    'archived',
+    'eol-date',
+    'cloud-build',
+    'tags',
+    'timeout',
+    'published-image',
+    'base-image',
+    'priority',
+    'estimated-duration',
+    'ignore-changes',
+    'resources',
+    ...Object.keys(config['ci-setup-defaults'] || {}),
+    ...Object.keys(config['ci-setup-deprecated'] || {}),
+  ];
+  for (const key in ciSetup) {
+    // Fields starting with underscore (_) are considered comments.
+    // They should not be considered as errors.
+    if (!key.startsWith('_') && !validFields.includes(key)) {
+      const message = `'${key}' is not a valid field`;
+      errors.push({field: key, kind: 'unknown-field', message});
+    }
+  }
+
+  // Type checking.
+  const typeErrors: [string, string, string[]][] = [
+    ['env', 'invalid-type', checkMappings(ciSetup, 'env')],
+    ['secrets', 'invalid-type', checkMappings(ciSetup, 'secrets')],
+    ['secrets', 'invalid-value', checkSecretPaths(ciSetup, 'secrets')],
+    [
+      'archived',
+      'invalid-type',
+      check(ciSetup, 'archived', isBoolean, 'boolean'),
+    ],
+    [
+      'eol-date',
+      'invalid-value',
+      check(ciSetup, 'eol-date', isDate, 'a YYYY-MM-DD date'),
+    ],
+    ['cloud-build', 'invalid-type', checkString(ciSetup, 'cloud-build')],
+    ['tags', 'invalid-type', checkStringOrStrings(ciSetup, 'tags')],
+    [
+      'timeout',
+      'invalid-value',
+      check(ciSetup, 'timeout', isDuration, 'a duration like 90s or 1h30m'),
+    ],
+    [
+      'published-image',
+      'invalid-type',
+      checkString(ciSetup, 'published-image'),
+    ],
+    ['base-image', 'invalid-type', checkString(ciSetup, 'base-image')],
+    [
+      'priority',
+      'invalid-type',
+      check(ciSetup, 'priority', isInteger, 'an integer'),
+    ],
+    [
+      'estimated-duration',
+      'invalid-value',
+      check(
+        ciSetup,
+        'estimated-duration',
+        isDuration,
+        'a duration like 90s or 1h30m',
+      ),
+    ],
+    [
+      'ignore-changes',
+      'invalid-value',
+      check(
+        ciSetup,
+        'ignore-changes',
+        isLineRules,
+        'a list of line rules with files, lines, or between',
+      ),
+    ],
+    [
+      'resources',
+      'invalid-value',
+      check(
+        ciSetup,
+        'resources',
+        isResources,
+        'resources with cpu, memory like 4Gi, gpu, or regions',
+      ),
+    ],
+  ];
+  for (const [field, kind, messages] of typeErrors) {
+    errors.push(...messages.map(message => ({field, kind, message})));
+  }
+  // The defaults are the schema, nested objects and arrays included.
+  const defaults = config['ci-setup-defaults'] || {};
+  for (const key in defaults) {
+    if (ciSetup[key] === undefined || key === 'env' || key === 'secrets') {
+      continue;
+    }
+    for (const message of shapeErrors(ciSetup[key], defaults[key], key)) {
+      errors.push({field: key, kind: 'invalid-type', message});
+    }
+  }
+
+  // TODO: check for undefined variable substitutions
+  return errors;
+}
+
+/**
+ * Checks the 'ci-setup-required' fields of a package's CI setup file.
+ *
+ * @param config config object
+ * @param ciSetup ci-setup object
+ * @returns a list of missing field errors, without their path
+ */
+function requiredErrors(
+  config: Config,
+  ciSetup: any,
+): Omit<SetupError, 'path' | 'line' | 'column'>[] {
+  const errors: Omit<SetupError, 'path' | 'line' | 'column'>[] = [];
+  for (const required of asArray(config['ci-setup-required']) || []) {
+    const keys = required.split('.');
+    for (const field of missingFields(ciSetup, keys, '')) {
+      const message = `'${field}' is required`;
+      errors.push({field: keys[0], kind: 'missing-field', message});
+    }
+  }
+  return errors;
+}
+
+/**
+ * Checks that a value has the same shape as its default value.
+ *
+ * Objects are checked by key, only for the keys in the default value.
+ * Array elements are checked against the first element of the default
+ * value, empty arrays and null default values accept anything.
+ *
+ * @param value value to check
+ * @param expected default value, used as the schema
+ * @param field path of the field, for the error messages
+ * @returns a list of validation errors
+ */
+function shapeErrors(value: any, expected: any, field: string): string[] {
+  if (expected === null || isProvided(expected) || isProvided(value)) {
+    // Provided values are only known when resolving the CI setup.
+    return [];
+  }
+  if (typeName(value) !== typeName(expected)) {
+    return [
+      `'${field}' must be ${typeName(expected)}, got: ${JSON.stringify(value)}`,
+    ];
+  }
+  const errors = [];
+  if (Array.isArray(expected)) {
+    if (expected.length > 0) {
+      for (let i = 0; i < value.length; i++) {
+        errors.push(...shapeErrors(value[i], expected[0], `${field}[${i}]`));
+      }
+    }
+  } else if (isObject(expected)) {
+    for (const key in expected) {
+      if (value[key] !== undefined) {
+        errors.push(
+          ...shapeErrors(value[key], expected[key], `${field}.${key}`),
+        );
+      }
+    }
+  }
+  return errors;
+}
+
+/**
+ * Gets the type of a value, telling arrays and null apart from objects.
+ *
+ * @param x any value
+ * @returns type name
+ */
+function typeName(x: any): string {
+  if (Array.isArray(x)) {
+    return 'array';
+  }
+  return x === null ? 'null' : typeof x;
+}
+
+/**
+ * Finds the required fields missing in a value.
+ *
+ * Nested fields are only required if their parent object is defined,
+ * and fields inside arrays are required in every element.
+ *
+ * @param value value to check
+ * @param keys path of the required field, split by dots
+ * @param prefix path of the value, for the error messages
+ * @returns the paths of the missing fields
+ */
+function missingFields(value: any, keys: string[], prefix: string): string[] {
+  if (Array.isArray(value)) {
+    return value.flatMap((x, i) => missingFields(x, keys, `${prefix}[${i}]`));
+  }
+  if (!isObject(value) || keys.length === 0) {
+    return [];
+  }
+  const [key, ...rest] = keys;
+  const field = prefix ? `${prefix}.${key}` : key;
+  if (value[key] === undefined) {
+    return rest.length === 0 ? [field] : [];
+  }
+  return missingFields(value[key], rest, field);
+}
+
+/**
+ * Generic helper to check the type of a field.
+ *
+ * @param kvs object with fields
+ * @param key field to check
+ * @param isType type checker function
+ * @param err error message
+ * @returns a list of validation errors
+ */
+function check(
+  kvs: any,
+  key: string,
+  isType: (x: any) => boolean,
+  err: string,
+): string[] {
+  // Fields are not required by default.
+  // Required fields must be checked explicitly.
+  const k = key.split('.').pop() || key;
+  if (kvs && kvs[k] && !isType(kvs[k])) {
+    return [`'${key}' must be ${err}, got: ${JSON.stringify(kvs[k])}`];
+  }
+  return [];
+}
+
+/**
+ * Checks the type of a string field.
+ *
+ * @param kvs object with fields
+ * @param key field to check
+ * @returns a list of validation errors
+ */
+function checkString(kvs: any, key: string): string[] {
+  return check(kvs, key, isString, 'string');
+}
+
+/**
+ * Checks the type of a string or string[] field.
+ *
+ * @param kvs object with fields
+ * @param key field to check
+ * @returns a list of validation errors
+ */
+function checkStringOrStrings(kvs: any, key: string): string[] {
+  return check(kvs, key, isStringOrStrings, 'string or string[]');
+}
+
+/**
+ * Checks the type of the package file field, including nested groups.
+ *
+ * @param config config object
+ * @returns a list of validation errors
+ */
+function checkPackageFile(config: any): string[] {
+  return check(
+    config,
+    'package-file',
+    isPackageFile,
+    'string, string[], or {any: [...]} and {all: [...]} groups',
+  );
+}
+
+/**
+ * Checks that the match engine accepts the 'match' and 'ignore' patterns.
+ *
+ * @param config config object
+ * @returns a list of validation errors
+ */
+function checkPatterns(config: any): string[] {
+  const engine = config[matchEngineKey] ?? matchEngines[config['match-engine']];
+  if (!engine) {
+    return [];
+  }
+  const errors = [];
+  for (const key of ['match', 'ignore']) {
+    const patterns = config[key];
+    if (!isStringOrStrings(patterns)) {
+      continue;
+    }
+    for (const pattern of asArray(patterns) || []) {
+      try {
+        engine(pattern.replace(/^!/, ''));
+      } catch (e) {
+        errors.push(`'${key}' has an invalid pattern: ${e}`);
+      }
+    }
+  }
+  return errors;
+}
+
+/**
+ * Checks the type of a {string: string} mapping field.
+ *
+ * @param kvs object with fields
+ * @param key field to check
+ * @returns a list of validation errors
+ */
+function checkMappings(kvs: any, key: string): string[] {
+  return check(kvs, key, isMapStringString, '{string: string} mappings');
+}
+
+/**
+ * Checks the scoped CI setup defaults against the global defaults.
+ *
+ * @param config config object
+ * @returns a list of validation errors
+ */
+function checkScopedDefaults(config: any): string[] {
+  const key = 'ci-setup-scoped-defaults';
+  const scoped = config[key];
+  if (scoped === undefined) {
+    return [];
+  }
+  if (!isObject(scoped)) {
+    return [
+      `'${key}' must be {pattern: ci-setup} mappings, got: ${JSON.stringify(
+        scoped,
+      )}`,
+    ];
+  }
+  const errors = [];
+  for (const pattern in scoped) {
+    if (!isObject(scoped[pattern])) {
+      errors.push(
+        `'${key}.${pattern}' must be a ci-setup object, got: ${JSON.stringify(
+          scoped[pattern],
+        )}`,
+      );
+      continue;
+    }
+    for (const err of validateCISetupDefaults(config, scoped[pattern])) {
+      errors.push(`'${key}.${pattern}': ${err}`);
+    }
+  }
+  return errors;
+}
+
+/**
+ * Checks the format of the secret paths in a {string: string} mapping field.
+ *
+ * @param kvs object with fields
+ * @param key field to check
+ * @returns a list of validation errors
+ */
+function checkSecretPaths(kvs: any, key: string): string[] {
+  const k = key.split('.').pop() || key;
+  if (!kvs || !isMapStringString(kvs[k])) {
+    // Type errors are reported by checkMappings.
+    return [];
+  }
+  const errors = [];
+  for (const name in kvs[k]) {
+    if (parseSecretPath(kvs[k][name]) === null) {
+      errors.push(
+        `'${key}.${name}' must be 'secret-id', 'project-id/secret-id', or ` +
+          `'projects/project-id/secrets/secret-id', got: ${JSON.stringify(
+            kvs[k][name],
+          )}`,
+      );
+    }
+  }
+  return errors;
+}
+
+/**
+ * Checks if a value is a string.
+ *
+ * @param x value to check
+ * @returns true if the value is a string
+ */
+function isString(x: any): boolean {
+  return typeof x === 'string';
+}
+
+/**
+ * Checks if a value is an array of a certain type.
+ *
+ * @param xs array to check
+ * @param isType type checker function
+ * @returns true if the value is an array of the given type
+ */
+function isArray(xs: any, isType: (x: any) => boolean): boolean {
+  if (!Array.isArray(xs)) {
+    return false;
+  }
+  for (const x of xs) {
+    if (!isType(x)) {
+      return false;
+    }
+  }
+  return true;
+}
+
+/**
+ * Checks if a value is a boolean.
+ *
+ * @param x value to check
+ * @returns true if the value is a boolean
+ */
+function isBoolean(x: any): boolean {
+  return typeof x === 'boolean';
+}
+
+/**
+ * Checks if a value is an integer.
+ *
+ * @param x value to check
+ * @returns true if the value is a whole number, negative ones included
+ */
+function isInteger(x: any): boolean {
+  return Number.isInteger(x);
+}
+
+/**
+ * Checks if a value is a positive integer.
+ *
+ * @param x value to check
+ * @returns true if the value is an integer greater than zero
+ */
+function isPositiveInteger(x: any): boolean {
+  return Number.isInteger(x) && x > 0;
+}
+
+/**
+ * Checks if a value is a date in YYYY-MM-DD format.
+ *
+ * @param x value to check
+ * @returns true if the value is a valid date
+ */
+export function isDate(x: any): boolean {
+  return (
+    typeof x === 'string' &&
+    /^\d{4}-\d{2}-\d{2}$/.test(x) &&
+    !isNaN(new Date(x).getTime())
+  );
+}
+
+/**
+ * Checks if a value is a duration, like 90s or 1h30m.
+ *
+ * @param x value to check
+ * @returns true if the value is a valid duration
+ */
+function isDuration(x: any): boolean {
+  return typeof x === 'string' && parseDuration(x) !== null;
+}
+
+/**
+ * Checks if a value is a list of line rules, with valid regular
+ * expressions.
+ *
+ * @param x value to check
+ * @returns true if every rule is valid, see `LineRule`
+ */
+function isLineRules(x: any): boolean {
+  const fields = ['files', 'lines', 'between'];
+  const isRule = (rule: any) =>
+    isObject(rule) &&
+    Object.keys(rule).every(key => fields.includes(key)) &&
+    (rule.files === undefined || isStringOrStrings(rule.files)) &&
+    (rule.lines === undefined ||
+      (typeof rule.lines === 'string' && isRegExp(rule.lines))) &&
+    (rule.between === undefined ||
+      (isArray(rule.between, isString) &&
+        rule.between.length === 2 &&
+        rule.between.every(isRegExp)));
+  return Array.isArray(x) && x.every(isRule);
+}
+
+/**
+ * Checks if a value is a package's resources.
+ *
+ * @param x value to check
+ * @returns true if every resource is valid, see `Resources`
+ */
+function isResources(x: any): boolean {
+  const fields = ['cpu', 'memory', 'gpu', 'regions'];
+  const isAmount = (n: any) =>
+    n === undefined || (typeof n === 'number' && n >= 0);
+  return (
+    isObject(x) &&
+    Object.keys(x).every(key => fields.includes(key)) &&
+    isAmount(x.cpu) &&
+    isAmount(x.gpu) &&
+    (x.memory === undefined ||
+      (typeof x.memory === 'string' && parseMemory(x.memory) !== null)) &&
+    (x.regions === undefined || isArray(x.regions, isString))
+  );
+}
+
+/**
+ * Checks if a value is a plain object.
+ *
+ * @param x value to check
+ * @returns true if the value is an object and not an array or null
+ */
+function isObject(x: any): boolean {
+  return typeof x === 'object' && x !== null && !Array.isArray(x);
+}
+
+/**
+ * Checks if a value is a string or an array of strings.
+ *
+ * @param x value to check
+ * @returns true if the value is a string or an array of strings
+ */
+function isStringOrStrings(x: any): boolean {
+  return isString(x) || isArray(x, isString);
+}
+
+/**
+ * Checks if a value is a package file or a group of package files.
+ *
+ * @param x value to check
+ * @returns true if the value is a valid package file
+ */
+function isPackageFile(x: any): boolean {
+  if (isString(x)) {
+    return true;
+  }
+  if (Array.isArray(x)) {
+    return isArray(x, isPackageFile);
+  }
+  if (!isObject(x) || Object.keys(x).length !== 1) {
+    return false;
+  }
+  const group = x.any ?? x.all;
+  return Array.isArray(group) && group.every(isPackageFile);
+}
+
+/**
+ * Checks if a value is a {string: string} mapping.
+ *
+ * @param kvs value to check
+ * @returns true if the value is a {string: string} mapping
+ */
+function isMapStringString(kvs: any): boolean {
+  if (typeof kvs !== 'object') {
+    return false;
+  }
+  for (const key in kvs) {
+    if (typeof key !== 'string' || typeof kvs[key] !== 'string') {
+      return false;
+    }
+  }
+  return true;
+}
+/* eslint-enable  @typescript-eslint/no-explicit-any */
+
+/**
+ * Main function to run the script.
+ *
+ * @param argv command line arguments
+ * @param newFiles creates the file system to find the packages in, see
+ *   `withFileSystem`, once for each run
+ * @returns when the command finishes, or once it's running for `watch` and
+ *   `server`
+ */
+async function main(
+  argv: string[],
+  newFiles: () => FileSystem = () => fs,
+): Promise<void> {
+  // Configs loaded by the commands find their packages in a new file system.
+  const loadCliConfig = (configPath: string) =>
+    withDeprecationWarnings(withFileSystem(loadConfig(configPath), newFiles()));
+  const mainUsage = usage(
+    '[affected | federated | removed | explain | why-not | resolve | manifest | simulate | config-diff | init | validate | migrate | exclude | rewrite | diff | stacked | pr-files | github-actions | shard | plan | schedule | cloud-build | pipeline | owners | summary | source-digest | graph | env | run | exec | watch | server | version | help] [options]',
+  );
+  switch (argv[2]) {
+    case 'affected': {
+      const usageRun = usage(
+        'affected <config-path> <diffs-file | -> <checkout-path> [tag | !tag]... [--quiet | --print0] [--patch]',
+      );
+      const outputFlags = ['--quiet', '--print0', '--patch'];
+      const [quiet, print0, patch] = outputFlags.map(flag =>
+        argv.includes(flag),
+      );
+      const args = argv.filter(arg => !outputFlags.includes(arg));
+      const configPath = args[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const diffsFile = args[4];
+      if (!diffsFile) {
+        console.error('Please provide the diffs file path.');
+        throw new Error(usageRun);
+      }
+      let checkoutPath = args[5];
+      if (!checkoutPath) {
+        console.error(
+          "No checkout path supplied. Assuming current directory ('.')",
+        );
+        checkoutPath = '.';
+      }
+      const output = (affectedPackages: string[]) => {
+        let packages = affectedPackages;
+        for (const tag of args.slice(6)) {
+          packages = tag.startsWith('!')
+            ? excludeTag(config, packages, tag.slice(1), checkoutPath)
+            : filterTag(config, packages, tag, true, checkoutPath);
+        }
+        recordMetric('affected-packages', packages.length);
+        const groupBy = process.env.CUSTARD_GROUP_BY;
+        if (quiet) {
+          // Only the exit code, for shell conditions.
+          process.exitCode = packages.length > 0 ? 0 : 1;
+        } else if (groupBy) {
+          // A JSON object, for a CI job per group.
+          const groups = groupPackages(config, packages, groupBy, checkoutPath);
+          console.log(JSON.stringify(groups, null, 2));
+        } else if (print0) {
+          // NUL separated, for `xargs -0`.
+          process.stdout.write(packages.map(pkg => `${pkg}\0`).join(''));
+        } else {
+          for (const pkg of packages) {
+            console.log(pkg);
+          }
+        }
+      };
+      // Compare the global lockfiles against the base revision, if set.
+      const lockfileBase = process.env.CUSTARD_LOCKFILE_BASE;
+      if (
+        diffsFile === '-' &&
+        !patch &&
+        !lockfileBase &&
+        !process.env.CUSTARD_STALE_IMAGES
+      ) {
+        // Match the diffs from stdin as they arrive.
+        await affectedFromReader(config, process.stdin, checkoutPath).then(
+          output,
+          e => {
+            console.error(e.message);
+            process.exitCode = quiet ? 2 : 1;
+          },
+        );
+        break;
+      }
+      const text = fs.readFileSync(diffsFile === '-' ? 0 : diffsFile, 'utf8');
+      // A unified diff skips the changes to the lines each package ignores.
+      const diffs = patch
+        ? parseUnifiedDiff(text).map(file => file.path)
+        : splitDiffs(text);
+      let packages = lockfileBase
+        ? affectedLockfiles(
+            config,
+            diffs,
+            checkoutPath,
+            gitShow(checkoutPath, lockfileBase),
+          )
+        : patch
+          ? affectedFromPatch(config, text, checkoutPath)
+          : affectedDetailed(config, diffs, checkoutPath);
+      // Also rebuild the packages with stale images, with the inspector.
+      const inspector = process.env.CUSTARD_STALE_IMAGES;
+      if (inspector) {
+        if (!(inspector in imageInspectors)) {
+          console.error(
+            `Please set CUSTARD_STALE_IMAGES to one of: ${Object.keys(imageInspectors).join(', ')}`,
+          );
+          throw new Error(usageRun);
+        }
+        packages = addStaleImages(
+          config,
+          packages,
+          checkoutPath,
+          imageInspectors[inspector],
+        );
+      }
+      output(packages.map(pkg => pkg.path));
+      break;
+    }
+
+    case 'federated': {
+      const usageRun = usage(
+        'federated <diffs-file> [checkout-path] [config-filename]',
+      );
+      const diffsFile = argv[3];
+      if (!diffsFile) {
+        console.error('Please provide the diffs file path.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = argv[4] || '.';
+      const configs = findConfigs(checkoutPath, argv[5]);
+      const diffs = splitDiffs(fs.readFileSync(diffsFile, 'utf8'));
+      const result = federatedAffected(configs, diffs, checkoutPath);
+      console.log(JSON.stringify(result, null, 2));
+      break;
+    }
+
+    case 'removed': {
+      const usageRun = usage(
+        'removed <config-path> <diffs-file> [checkout-path]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const diffsFile = argv[4];
+      if (!diffsFile) {
+        console.error('Please provide the diffs file path.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = argv[5] || '.';
+      const diffs = splitDiffs(fs.readFileSync(diffsFile, 'utf8'));
+      for (const pkg of removedPackages(config, diffs, checkoutPath)) {
+        console.log(pkg);
+      }
+      break;
+    }
+
+    case 'explain': {
+      const usageRun = usage(
+        'explain <config-path> <diffs-file> [checkout-path]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const diffsFile = argv[4];
+      if (!diffsFile) {
+        console.error('Please provide the diffs file path.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = argv[5] || '.';
+      const diffs = splitDiffs(fs.readFileSync(diffsFile, 'utf8'));
+      const report = explain(config, diffs, checkoutPath);
+      console.log(JSON.stringify(report, null, 2));
+      break;
+    }
+
+    case 'resolve': {
+      const usageRun = usage(
+        'resolve <config-path> <package-path> [checkout-path] [--json]',
+      );
+      const json = argv.includes('--json');
+      const args = argv.filter(arg => arg !== '--json');
+      const configPath = args[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const packagePath = args[4];
+      if (!packagePath) {
+        console.error('Please provide the package path.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = args[5] || '.';
+      const resolved = resolveCISetupDetailed(
+        config,
+        packagePath,
+        checkoutPath,
+      );
+      console.log(
+        json ? JSON.stringify(resolved, null, 2) : formatSetupSources(resolved),
+      );
+      break;
+    }
+
+    case 'manifest': {
+      const usageRun = usage(
+        'manifest <config-path> <diffs-file> [checkout-path]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const diffsFile = argv[4];
+      if (!diffsFile) {
+        console.error('Please provide the diffs file path.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = argv[5] || '.';
+      const diffs = splitDiffs(fs.readFileSync(diffsFile, 'utf8'));
+      const manifest = createManifest(config, diffs, checkoutPath);
+      console.log(JSON.stringify(manifest, null, 2));
+      break;
+    }
+
+    case 'why-not': {
+      const usageRun = usage(
+        'why-not <config-path> <diffs-file> <package-path> [checkout-path]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const diffsFile = argv[4];
+      if (!diffsFile) {
+        console.error('Please provide the diffs file path.');
+        throw new Error(usageRun);
+      }
+      const pkg = argv[5];
+      if (!pkg) {
+        console.error('Please provide the package path.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = argv[6] || '.';
+      const diffs = splitDiffs(fs.readFileSync(diffsFile, 'utf8'));
+      const report = whyNot(config, pkg, diffs, checkoutPath);
+      console.log(JSON.stringify(report, null, 2));
+      break;
+    }
+
+    case 'config-diff': {
+      const usageRun = usage(
+        'config-diff <old-config-path> <new-config-path> [checkout-path]',
+      );
+      const oldConfigPath = argv[3];
+      const newConfigPath = argv[4];
+      if (!oldConfigPath || !newConfigPath) {
+        console.error('Please provide the old and new config file paths.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = argv[5] || '.';
+      const report = configDiff(
+        loadCliConfig(oldConfigPath),
+        loadCliConfig(newConfigPath),
+        checkoutPath,
+      );
+      console.log(JSON.stringify(report, null, 2));
+      break;
+    }
+
+    case 'simulate': {
+      const usageRun = usage(
+        'simulate <config-path> <since | commits | range> [checkout-path]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const since = argv[4];
+      if (!since) {
+        console.error(
+          'Please provide how far back to go, like 30d, 100, or v1.0..HEAD.',
+        );
+        throw new Error(usageRun);
+      }
+      const checkoutPath = argv[5] || '.';
+      const history = gitHistory(checkoutPath, since);
+      const report = simulate(config, history, checkoutPath);
+      console.log(JSON.stringify(report, null, 2));
+      break;
+    }
+
+    case 'migrate': {
+      const usageRun = usage('migrate <config-path>');
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadConfigFile(configPath);
+      for (const change of migrateConfig(config)) {
+        console.error(`- ${change}`);
+      }
+      saveConfig(config, process.stdout);
+      break;
+    }
+
+    case 'exclude': {
+      const usageRun = usage(
+        'exclude <config-path> <package-path> <reason | --remove> [expires]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const pkg = argv[4];
+      if (!pkg) {
+        console.error('Please provide the package path.');
+        throw new Error(usageRun);
+      }
+      const filePath = exclusionsPath(configPath);
+      if (argv[5] === '--remove') {
+        if (!removeExclusion(filePath, pkg)) {
+          console.error(`${pkg} is not in ${filePath}`);
+          process.exitCode = 1;
+        }
+        break;
+      }
+      const reason = argv[5];
+      if (!reason) {
+        console.error('Please provide the reason to exclude the package.');
+        throw new Error(usageRun);
+      }
+      const exclusion = addExclusion(filePath, pkg, reason, argv[6]);
+      console.log(JSON.stringify(exclusion, null, 2));
+      break;
+    }
+
+    case 'rewrite': {
+      const usageRun = usage(
+        'rewrite <config-path> <rename <field> <new-name> | set-default <field> <json-value> | delete <field>> [checkout-path] [--dry-run]',
+      );
+      const dryRun = argv.includes('--dry-run');
+      const args = argv.filter(arg => arg !== '--dry-run');
+      const configPath = args[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const [action, field, arg] = args.slice(4, 7);
+      if (!setupRewriteActions.includes(action) || !field) {
+        console.error('Please provide the rewrite action and the field.');
+        throw new Error(usageRun);
+      }
+      const rewrite: SetupRewrite = {action, field};
+      if (action !== 'delete') {
+        if (arg === undefined) {
+          console.error(
+            action === 'rename'
+              ? 'Please provide the new field name.'
+              : 'Please provide the default value as JSON.',
+          );
+          throw new Error(usageRun);
+        }
+        if (action === 'rename') {
+          rewrite.to = arg;
+        } else {
+          rewrite.value = parseJsonc(arg, 'value');
+        }
+      }
+      const checkoutPath = args[action === 'delete' ? 6 : 7] || '.';
+      const files = rewriteSetupFiles(config, rewrite, checkoutPath, dryRun);
+      for (const filePath of files) {
+        console.log(filePath);
+      }
+      break;
+    }
+
+    case 'init': {
+      const usageRun = usage('init [config-path] [checkout-path] [--yes]');
+      const yes = argv.includes('--yes');
+      const args = argv.filter(arg => arg !== '--yes');
+      const configPath = args[3] || 'config.jsonc';
+      if (fs.existsSync(configPath)) {
+        console.error(`Config file already exists: ${configPath}`);
+        throw new Error(usageRun);
+      }
+      const proposal = proposeConfig(args[4] || '.');
+      const write = (config: Config | null) => {
+        if (config === null) {
+          console.error('Cancelled, no config written.');
+          process.exitCode = 1;
+          return;
+        }
+        writeInitConfig(config, configPath);
+        console.error(`Config written to: ${configPath}`);
+      };
+      if (yes) {
+        // Accept the proposed config, for scripts.
+        write(proposal.config);
+        break;
+      }
+      const io = {input: process.stdin, output: process.stderr};
+      await initWizard(proposal, io)
+        .then(write)
+        .catch(e => {
+          console.error(e.message);
+          process.exitCode = 1;
+        });
+      break;
+    }
+
+    case 'source-digest': {
+      const usageRun = usage(
+        'source-digest <config-path> <package-path> [checkout-path]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const pkg = argv[4];
+      if (!pkg) {
+        console.error('Please provide the package path.');
+        throw new Error(usageRun);
+      }
+      console.log(sourceDigest(config, pkg, argv[5] || '.'));
+      break;
+    }
+
+    case 'validate': {
+      const usageRun = usage(
+        'validate <config-path> [checkout-path] [text | junit | sarif]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const checkoutPath = argv[4] || '.';
+      const format = argv[5] || 'text';
+      if (!reportFormats.includes(format)) {
+        console.error(`Please provide a report format, got: ${format}`);
+        throw new Error(usageRun);
+      }
+      const concurrency = fileConcurrency();
+      await validateSetupFiles(config, checkoutPath, concurrency)
+        .then(errors => {
+          const report = setupErrorsReport(format, errors, checkoutPath);
+          if (format === 'text') {
+            // Errors go to stderr, like the other commands.
+            if (report) {
+              console.error(report);
+            }
+          } else {
+            console.log(report);
+          }
+          // Deprecated fields are only warnings, they don't fail.
+          const failures = errors.filter(
+            error => error.kind !== 'deprecated-field',
+          );
+          recordMetric('validation-errors', failures.length);
+          if (failures.length > 0) {
+            process.exitCode = 1;
+          }
+        })
+        .catch(e => {
+          console.error(e.message);
+          process.exitCode = 1;
+        });
+      break;
+    }
+
+    case 'diff': {
+      const usageRun = usage('diff <vcs> <base> <head> [repo-path]');
+      const name = argv[3];
+      if (!name) {
+        console.error(
+          'Please provide the VCS: git, git-local, git-native, hg, or file.',
+        );
+        throw new Error(usageRun);
+      }
+      const base = argv[4];
+      const head = argv[5];
+      if (!base || !head) {
+        console.error('Please provide the base and head revisions.');
+        throw new Error(usageRun);
+      }
+      const repo = argv[6] || '.';
+      for (const diff of vcsProvider(name, repo).diff(base, head)) {
+        console.log(diff);
+      }
+      break;
+    }
+
+    case 'stacked': {
+      const usageRun = usage(
+        'stacked <config-path> <base> <parent> <head> [checkout-path] [vcs]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const [base, parent, head] = argv.slice(4, 7);
+      if (!base || !parent || !head) {
+        console.error('Please provide the base, parent, and head revisions.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = argv[7] || '.';
+      const vcs = vcsProvider(argv[8] || 'git', checkoutPath);
+      const stack = stackedAffected(
+        config,
+        base,
+        parent,
+        head,
+        checkoutPath,
+        vcs,
+      );
+      for (const pkg of stack.added) {
+        console.log(pkg);
+      }
+      break;
+    }
+
+    case 'pr-files': {
+      const usageRun = usage('pr-files <owner/repo> <pull-number>');
+      const repo = argv[3];
+      if (!repo) {
+        console.error('Please provide the repository, like owner/repo.');
+        throw new Error(usageRun);
+      }
+      const pullNumber = Number(argv[4]);
+      if (!Number.isInteger(pullNumber) || pullNumber <= 0) {
+        console.error('Please provide the pull request number.');
+        throw new Error(usageRun);
+      }
+      await pullRequestFiles(githubClient(), repo, pullNumber)
+        .then(files => {
+          for (const file of files) {
+            console.log(file);
+          }
+        })
+        .catch(e => {
+          console.error(e.message);
+          process.exitCode = 1;
+        });
+      break;
+    }
+
+    case 'github-actions': {
+      const usageRun = usage(
+        'github-actions <config-path> [checkout-path] [vcs]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const checkoutPath = argv[4] || '.';
+      const vcs = vcsProvider(argv[5] || 'git', checkoutPath);
+      for (const pkg of githubActions(config, checkoutPath, vcs)) {
+        console.log(pkg.path);
+      }
+      break;
+    }
 
-/**
- * Checks the type of a string or string[] field.
- *
- * @param kvs object with fields
- * @param key field to check
- * @returns a list of validation errors
- */
-function checkStringOrStrings(kvs: any, key: string): string[] {
-  return check(kvs, key, isStringOrStrings, 'string or string[]');
-}
+    case 'shard': {
+      const usageRun = usage(
+        'shard <packages-file> <shard-count> <shard-index> [timings-file]',
+      );
+      const packagesFile = argv[3];
+      if (!packagesFile) {
+        console.error('Please provide the packages file path.');
+        throw new Error(usageRun);
+      }
+      if (!argv[4] || !argv[5]) {
+        console.error('Please provide the shard count and shard index.');
+        throw new Error(usageRun);
+      }
+      const shardCount = Number(argv[4]);
+      const shardIndex = Number(argv[5]);
+      const packages = fs
+        .readFileSync(packagesFile, 'utf8')
+        .split('\n')
+        .filter(pkg => pkg.trim() !== '');
+      const timingsFile = argv[6];
+      const packagesShard = timingsFile
+        ? shardByTimings(
+            packages,
+            shardCount,
+            shardIndex,
+            loadTimings(timingsFile),
+          )
+        : shard(packages, shardCount, shardIndex);
+      for (const pkg of packagesShard) {
+        console.log(pkg);
+      }
+      break;
+    }
 
-/**
- * Checks the type of a {string: string} mapping field.
- *
- * @param kvs object with fields
- * @param key field to check
- * @returns a list of validation errors
- */
-function checkMappings(kvs: any, key: string): string[] {
-  return check(kvs, key, isMapStringString, '{string: string} mappings');
-}
+    case 'plan': {
+      const usageRun = usage(
+        'plan <packages-file> <max-concurrent> [timings-file]',
+      );
+      const packagesFile = argv[3];
+      if (!packagesFile) {
+        console.error('Please provide the packages file path.');
+        throw new Error(usageRun);
+      }
+      if (!argv[4]) {
+        console.error('Please provide the maximum concurrent builds.');
+        throw new Error(usageRun);
+      }
+      const packages = fs
+        .readFileSync(packagesFile, 'utf8')
+        .split('\n')
+        .filter(pkg => pkg.trim() !== '');
+      const timingsFile = argv[5];
+      const timings = timingsFile ? loadTimings(timingsFile) : {};
+      const waves = planBuilds(packages, Number(argv[4]), timings);
+      console.log(JSON.stringify(waves, null, 2));
+      break;
+    }
 
-/**
- * Checks if a value is a string.
- *
- * @param x value to check
- * @returns true if the value is a string
- */
-function isString(x: any): boolean {
-  return typeof x === 'string';
-}
+    case 'schedule': {
+      const usageRun = usage(
+        'schedule <config-path> <packages-file> <quotas-file> [checkout-path]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const packagesFile = argv[4];
+      if (!packagesFile) {
+        console.error('Please provide the packages file path.');
+        throw new Error(usageRun);
+      }
+      const quotasFile = argv[5];
+      if (!quotasFile) {
+        console.error('Please provide the quotas file path.');
+        throw new Error(usageRun);
+      }
+      const packages = fs
+        .readFileSync(packagesFile, 'utf8')
+        .split('\n')
+        .filter(pkg => pkg.trim() !== '');
+      const waves = scheduleResources(
+        config,
+        packages,
+        loadQuotas(quotasFile),
+        argv[6] || '.',
+      );
+      console.log(JSON.stringify(waves, null, 2));
+      break;
+    }
 
-/**
- * Checks if a value is an array of a certain type.
- *
- * @param xs array to check
- * @param isType type checker function
- * @returns true if the value is an array of the given type
- */
-function isArray(xs: any, isType: (x: any) => boolean): boolean {
-  if (!Array.isArray(xs)) {
-    return false;
-  }
-  for (const x of xs) {
-    if (!isType(x)) {
-      return false;
+    case 'cloud-build': {
+      const usageRun = usage(
+        'cloud-build <config-path> <packages-file> [checkout-path]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const packagesFile = argv[4];
+      if (!packagesFile) {
+        console.error('Please provide the packages file path.');
+        throw new Error(usageRun);
+      }
+      const packages = fs
+        .readFileSync(packagesFile, 'utf8')
+        .split('\n')
+        .filter(pkg => pkg.trim() !== '');
+      const checkoutPath = argv[5] || '.';
+      const build = cloudBuildConfig(config, packages, checkoutPath);
+      console.log(JSON.stringify(build, null, 2));
+      break;
     }
-  }
-  return true;
-}
 
-/**
- * Checks if a value is a string or an array of strings.
- *
- * @param x value to check
- * @returns true if the value is a string or an array of strings
- */
-function isStringOrStrings(x: any): boolean {
-  return isString(x) || isArray(x, isString);
-}
+    case 'pipeline': {
+      const generators = Object.keys(pipelineGenerators).join(' | ');
+      const usageRun = usage(
+        `pipeline <config-path> <packages-file> <${generators}> [field] [checkout-path]`,
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const packagesFile = argv[4];
+      if (!packagesFile) {
+        console.error('Please provide the packages file path.');
+        throw new Error(usageRun);
+      }
+      const name = argv[5];
+      if (!name) {
+        console.error(`Please provide the CI system: ${generators}.`);
+        throw new Error(usageRun);
+      }
+      const packages = fs
+        .readFileSync(packagesFile, 'utf8')
+        .split('\n')
+        .filter(pkg => pkg.trim() !== '');
+      const pipeline = generatePipeline(
+        name,
+        config,
+        packages,
+        argv[7] || '.',
+        {
+          field: argv[6] || 'test-command',
+          image: process.env.CUSTARD_PIPELINE_IMAGE,
+        },
+      );
+      console.log(JSON.stringify(pipeline, null, 2));
+      break;
+    }
 
-/**
- * Checks if a value is a {string: string} mapping.
- *
- * @param kvs value to check
- * @returns true if the value is a {string: string} mapping
- */
-function isMapStringString(kvs: any): boolean {
-  if (typeof kvs !== 'object') {
-    return false;
-  }
-  for (const key in kvs) {
-    if (typeof key !== 'string' || typeof kvs[key] !== 'string') {
-      return false;
+    case 'owners': {
+      const usageRun = usage(
+        'owners <packages-file> [checkout-path] [json | markdown]',
+      );
+      const packagesFile = argv[3];
+      if (!packagesFile) {
+        console.error('Please provide the packages file path.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = argv[4] || '.';
+      const format = argv[5] || 'json';
+      const packages = fs
+        .readFileSync(packagesFile, 'utf8')
+        .split('\n')
+        .filter(pkg => pkg.trim() !== '');
+      const groups = affectedByOwner(loadCodeowners(checkoutPath), packages);
+      console.log(
+        format === 'markdown'
+          ? ownersSummary(groups)
+          : JSON.stringify(groups, null, 2),
+      );
+      break;
     }
-  }
-  return true;
-}
-/* eslint-enable  @typescript-eslint/no-explicit-any */
 
-/**
- * Main function to run the script.
- *
- * @param argv command line arguments
- */
-function main(argv: string[]) {
-  const mainUsage = usage('[affected | run | version | help] [options]');
-  switch (argv[2]) {
-    case 'affected': {
+    case 'summary': {
       const usageRun = usage(
-        'affected <config-path> <diffs-file> <checkout-path>',
+        'summary <config-path> <diffs-file | -> [checkout-path]',
       );
       const configPath = argv[3];
       if (!configPath) {
         console.error('Please provide the config file path.');
         throw new Error(usageRun);
       }
-      const config = loadConfig(configPath);
+      const config = loadCliConfig(configPath);
       const diffsFile = argv[4];
       if (!diffsFile) {
         console.error('Please provide the diffs file path.');
         throw new Error(usageRun);
       }
-      let checkoutPath = argv[5];
-      if (!checkoutPath) {
-        console.error(
-          "No checkout path supplied. Assuming current directory ('.')",
+      const checkoutPath = argv[5] || '.';
+      const diffs = splitDiffs(
+        fs.readFileSync(diffsFile === '-' ? 0 : diffsFile, 'utf8'),
+      );
+      const packages = affectedDetailed(config, diffs, checkoutPath);
+      console.log(
+        affectedSummary(config, packages, checkoutPath, {
+          owners: loadCodeowners(checkoutPath),
+          linkBase: summaryLinkBase(),
+        }),
+      );
+      break;
+    }
+
+    case 'graph': {
+      const usageRun = usage(
+        'graph <config-path> <diffs-file> [checkout-path] [dot | mermaid] [--affected-only]',
+      );
+      const affectedOnly = argv.includes('--affected-only');
+      const args = argv.filter(arg => arg !== '--affected-only');
+      const configPath = args[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const diffsFile = args[4];
+      if (!diffsFile) {
+        console.error('Please provide the diffs file path.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = args[5] || '.';
+      const format = args[6] || 'dot';
+      if (!graphFormats.includes(format)) {
+        console.error(`Please provide a graph format, got: ${format}`);
+        throw new Error(usageRun);
+      }
+      const diffs = splitDiffs(fs.readFileSync(diffsFile, 'utf8'));
+      const graph = packageGraph(
+        config,
+        checkoutPath,
+        affected(config, diffs, checkoutPath),
+      );
+      process.stdout.write(
+        formatGraph(format, affectedOnly ? affectedSubgraph(graph) : graph),
+      );
+      break;
+    }
+
+    case 'env': {
+      const usageRun = usage(
+        'env <config-path> <packages-file> [checkout-path] [dotenv | json] [filename]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const packagesFile = argv[4];
+      if (!packagesFile) {
+        console.error('Please provide the packages file path.');
+        throw new Error(usageRun);
+      }
+      const checkoutPath = argv[5] || '.';
+      const format = argv[6] || 'dotenv';
+      if (!envFormats.includes(format)) {
+        console.error(`Please provide an env format, got: ${format}`);
+        throw new Error(usageRun);
+      }
+      const packages = fs
+        .readFileSync(packagesFile, 'utf8')
+        .split('\n')
+        .filter(pkg => pkg.trim() !== '');
+      const options = {prefix: process.env.CUSTARD_ENV_PREFIX};
+      if (format === 'json') {
+        const env = envMap(config, packages, checkoutPath, options);
+        console.log(JSON.stringify(env, null, 2));
+      } else {
+        const filename = argv[7] || '.env';
+        const files = writeEnvFiles(
+          config,
+          packages,
+          checkoutPath,
+          filename,
+          options,
         );
-        checkoutPath = '.';
+        for (const file of files) {
+          console.log(file);
+        }
       }
-      const diffs = fs.readFileSync(diffsFile, 'utf8').trim().split('\n');
-      const packages = affected(config, diffs, checkoutPath);
-      for (const pkg of packages) {
-        console.log(pkg);
+      break;
+    }
+
+    case 'exec': {
+      const usageRun = usage(
+        'exec <config-path> <packages-file> [field] [checkout-path]',
+      );
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const packagesFile = argv[4];
+      if (!packagesFile) {
+        console.error('Please provide the packages file path.');
+        throw new Error(usageRun);
       }
+      const packages = fs
+        .readFileSync(packagesFile, 'utf8')
+        .split('\n')
+        .filter(pkg => pkg.trim() !== '');
+      const resolveSecret = secretResolver(
+        process.env.CUSTARD_SECRETS_FROM || 'secret-manager',
+      );
+      const cacheLocation = process.env.CUSTARD_RESULTS_CACHE;
+      const options = {
+        field: argv[5] || 'test-command',
+        checkoutPath: argv[6] || '.',
+        resolveSecret,
+        cache: cacheLocation ? openResultsCache(cacheLocation) : undefined,
+      };
+      await execPackages(config, packages, options)
+        .then(report => {
+          console.log(formatReport(report));
+          const ran = report.passed + report.failed + report.timedOut;
+          if (options.cache && report.cached + ran > 0) {
+            const rate = report.cached / (report.cached + ran);
+            recordMetric('cache-hit-rate', rate);
+          }
+          if (report.failed > 0 || report.timedOut > 0) {
+            process.exitCode = 1;
+          }
+        })
+        .catch(e => {
+          console.error(e.message);
+          process.exitCode = 1;
+        });
       break;
     }
 
@@ -892,7 +9139,7 @@ function main(argv: string[]) {
         console.error('Please provide the config file path.');
         throw new Error(usageRun);
       }
-      const config = loadConfig(configPath);
+      const config = loadCliConfig(configPath);
       const command = argv[4];
       if (!command) {
         console.error('Please provide the command to run.');
@@ -910,7 +9157,71 @@ function main(argv: string[]) {
         console.error('Please provide one or more package paths.');
         throw new Error(usageRun);
       }
-      run(config, cmd, paths);
+      const resolveSecret = secretResolver(
+        process.env.CUSTARD_SECRETS_FROM || 'secret-manager',
+      );
+      run(config, cmd, paths, process.env, resolveSecret);
+      break;
+    }
+
+    case 'watch': {
+      const usageRun = usage('watch <config-path> <command> [checkout-path]');
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const config = loadCliConfig(configPath);
+      const command = argv[4];
+      if (!command) {
+        console.error('Please provide the command to run.');
+        throw new Error(usageRun);
+      }
+      const cmd = (config.commands || {})[command];
+      if (!cmd) {
+        throw new Error(`No command '${command}' defined in ${configPath}.`);
+      }
+      const checkoutPath = argv[5] || '.';
+      const resolveSecret = secretResolver(
+        process.env.CUSTARD_SECRETS_FROM || 'secret-manager',
+      );
+      console.info(`Watching '${checkoutPath}' for changes, Ctrl+C to stop.`);
+      // Each batch of changes lists the directories again.
+      const newConfig = () =>
+        withDeprecationWarnings(withFileSystem(config, newFiles()));
+      watch(newConfig, checkoutPath, packages => {
+        const paths = packages.map(pkg => path.join(checkoutPath, pkg));
+        try {
+          run(config, cmd, paths, process.env, resolveSecret);
+        } catch (e) {
+          // Failures are reported, but keep watching for the next change.
+          console.error(`${e}`);
+        }
+      });
+      break;
+    }
+
+    case 'server': {
+      const usageRun = usage('server <config-path> [port] [checkout-path]');
+      const configPath = argv[3];
+      if (!configPath) {
+        console.error('Please provide the config file path.');
+        throw new Error(usageRun);
+      }
+      const port = Number(argv[4] || process.env.PORT || 8080);
+      const checkoutPath = argv[5] || '.';
+      const watcher = watchConfig(configPath, process.env.CUSTARD_PROFILE);
+      const server = webhookServer({
+        // Each webhook checks out other commits, so it lists them again.
+        config: () =>
+          withDeprecationWarnings(withFileSystem(watcher.config(), newFiles())),
+        checkoutPath,
+        callbackUrl: process.env.CUSTARD_CALLBACK_URL,
+        cloudBuildTrigger: process.env.CUSTARD_CLOUD_BUILD_TRIGGER,
+      });
+      server.listen(port, () =>
+        console.info(`Listening for webhooks on port ${port}.`),
+      );
       break;
     }
 
@@ -931,22 +9242,45 @@ function main(argv: string[]) {
     }
 
     default: {
-      // Only throw an error if running the script directly.
-      // Otherwise, this file is being imported (for example, on tests).
-      if (argv[1] && argv[1].match(/custard\.(ts|js)$|^-$/)) {
-        throw new Error(mainUsage);
-      }
+      throw new Error(mainUsage);
     }
   }
 }
 
-/* eslint-disable @typescript-eslint/no-explicit-any */
-/* eslint-disable n/no-process-exit */
-try {
-  main(process.argv);
-} catch (e: any) {
-  console.error(e.message);
-  process.exit(1);
+// Only run the command line interface if running the script directly.
+// Otherwise, this file is being imported (for example, on tests).
+if (process.argv[1] && process.argv[1].match(/custard\.(ts|js)$|^-$/)) {
+  /* eslint-disable @typescript-eslint/no-explicit-any */
+  /* eslint-disable n/no-process-exit */
+  const runCli = async () => {
+    const metricsLocation = process.env.CUSTARD_METRICS;
+    const sink = metricsLocation ? openMetricsSink(metricsLocation) : null;
+    // Network file systems are retried and stat in batches.
+    const fsOptions = resilientOptions();
+    const newFiles = () =>
+      fsOptions ? resilientFileSystem(fs, fsOptions) : fs;
+    try {
+      // Asynchronous commands, like `validate`, are timed until they finish.
+      const {stats} = await withStatsAsync(() => main(process.argv, newFiles));
+      if (process.env.CUSTARD_STATS) {
+        console.error(message('I005', `Stats: ${formatStats(stats)}`));
+      }
+      recordStats(stats);
+    } finally {
+      // Failed runs push the metrics they recorded too.
+      if (sink) {
+        await pushMetrics(sink, metricLabels());
+      }
+    }
+  };
+  runCli().catch((e: any) => {
+    console.error(e.message);
+    // Like grep, `affected --quiet` already exits with 1 when nothing is
+    // affected, other commands keep exiting with 1 on errors.
+    const quiet =
+      process.argv[2] === 'affected' && process.argv.includes('--quiet');
+    process.exit(quiet ? 2 : 1);
+  });
+  /* eslint-enable n/no-process-exit */
+  /* eslint-enable @typescript-eslint/no-explicit-any */
 }
-/* eslint-enable n/no-process-exit */
-/* eslint-enable @typescript-eslint/no-explicit-any */
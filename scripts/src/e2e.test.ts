@@ -0,0 +1,227 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// End to end tests, these run the full pipeline like CI does:
+// git diff -> custard affected -> list of packages.
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {execFileSync, spawnSync} from 'node:child_process';
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+
+// Run the script next to this file, either the source or compiled one.
+const script = path.join(
+  import.meta.dirname,
+  `custard${path.extname(import.meta.filename)}`,
+);
+
+/**
+ * Runs the custard script, like CI does.
+ *
+ * @param args command line arguments
+ * @returns standard output
+ */
+function custard(...args: string[]): string {
+  return execFileSync(process.execPath, [script, ...args], {
+    encoding: 'utf8',
+    stdio: ['ignore', 'pipe', 'ignore'],
+  });
+}
+
+/**
+ * Runs the custard script, and gets its exit code.
+ *
+ * @param args command line arguments
+ * @returns exit code, and standard output
+ */
+function custardStatus(...args: string[]): {status: number; stdout: string} {
+  const result = spawnSync(process.execPath, [script, ...args], {
+    encoding: 'utf8',
+    stdio: ['ignore', 'pipe', 'ignore'],
+  });
+  return {status: result.status ?? -1, stdout: result.stdout};
+}
+
+/**
+ * Writes the diffs between a ref and HEAD for the affected command.
+ *
+ * @param repo path to the repository
+ * @param base base ref
+ * @returns path to the diffs file
+ */
+function writeDiffs(repo: string, base: string): string {
+  const diffsFile = path.join(repo, '.git', 'diffs.txt');
+  fs.writeFileSync(diffsFile, testing.gitDiff(repo, base).join('\n'));
+  return diffsFile;
+}
+
+/**
+ * Gets the affected packages from the changes between two refs.
+ *
+ * @param repo path to the repository
+ * @param base base ref
+ * @returns affected packages
+ */
+function affected(repo: string, base: string): string[] {
+  const diffsFile = path.join(repo, '.git', 'diffs.txt');
+  fs.writeFileSync(diffsFile, testing.gitDiff(repo, base).join('\n'));
+  const configPath = path.join(repo, 'config.jsonc');
+  const stdout = custard('affected', configPath, diffsFile, repo);
+  return stdout.split('\n').filter(pkg => pkg !== '');
+}
+
+describe('e2e', () => {
+  const tree = {
+    'config.jsonc': JSON.stringify({
+      'package-file': 'package.json',
+      ignore: ['README.md'],
+    }),
+    'README.md': '# Samples',
+    'a/package.json': '{}',
+    'a/index.js': '',
+    'b/package.json': '{}',
+    'b/index.js': '',
+    'c/package.json': '{}',
+    'c/index.js': '',
+  };
+  let repo = '';
+  beforeEach(() => {
+    repo = testing.gitInit(tree);
+  });
+  afterEach(() => testing.cleanup(repo));
+
+  it('changed package', () => {
+    testing.gitCommit(repo, {write: {'a/index.js': 'changed'}});
+    expect(affected(repo, 'main~1')).to.deep.equal(['a']);
+  });
+
+  it('ignored files', () => {
+    testing.gitCommit(repo, {write: {'README.md': '# Changed'}});
+    expect(affected(repo, 'main~1')).to.deep.equal([]);
+  });
+
+  it('global file', () => {
+    testing.gitCommit(repo, {write: {'global.txt': ''}});
+    expect(affected(repo, 'main~1').sort()).to.deep.equal(['a', 'b', 'c']);
+  });
+
+  it('renamed across packages', () => {
+    testing.gitCommit(repo, {move: {'a/index.js': 'b/moved.js'}});
+    expect(affected(repo, 'main~1').sort()).to.deep.equal(['a', 'b']);
+  });
+
+  it('removed package', () => {
+    testing.gitCommit(repo, {remove: ['c']});
+    expect(affected(repo, 'main~1')).to.deep.equal([]);
+  });
+
+  it('multiple commits since the base ref', () => {
+    const base = testing.gitCommit(repo, {write: {'c/index.js': 'base'}});
+    testing.gitCommit(repo, {write: {'a/index.js': 'first'}});
+    testing.gitCommit(repo, {write: {'b/index.js': 'second'}});
+    expect(affected(repo, base).sort()).to.deep.equal(['a', 'b']);
+  });
+
+  it('quiet', () => {
+    const configPath = path.join(repo, 'config.jsonc');
+    testing.gitCommit(repo, {write: {'a/index.js': 'changed'}});
+    const changed = writeDiffs(repo, 'main~1');
+    expect(
+      custardStatus('affected', configPath, changed, repo, '--quiet'),
+    ).to.deep.equal({status: 0, stdout: ''});
+    testing.gitCommit(repo, {write: {'README.md': '# Changed'}});
+    const ignored = writeDiffs(repo, 'main~1');
+    expect(
+      custardStatus('affected', configPath, ignored, repo, '--quiet'),
+    ).to.deep.equal({status: 1, stdout: ''});
+    const missing = path.join(repo, 'missing.txt');
+    expect(
+      custardStatus('affected', configPath, missing, repo, '--quiet').status,
+    ).to.equal(2);
+    expect(
+      custardStatus('explain', configPath, missing, repo, '--quiet').status,
+    ).to.equal(1);
+  });
+
+  it('print0', () => {
+    testing.gitCommit(repo, {write: {'global.txt': ''}});
+    const diffsFile = writeDiffs(repo, 'main~1');
+    const configPath = path.join(repo, 'config.jsonc');
+    const stdout = custard('affected', configPath, diffsFile, repo, '--print0');
+    expect(stdout).to.equal('a\0b\0c\0');
+  });
+
+  it('diffs from stdin', () => {
+    testing.gitCommit(repo, {write: {'a/index.js': 'a', 'c/index.js': 'c'}});
+    const configPath = path.join(repo, 'config.jsonc');
+    const diffs = testing.gitDiff(repo, 'main~1');
+    const stdout = execFileSync(
+      process.execPath,
+      [script, 'affected', configPath, '-', repo],
+      {encoding: 'utf8', input: diffs.join('\0'), stdio: 'pipe'},
+    );
+    expect(stdout).to.equal('a\nc\n');
+  });
+
+  it('stacked', () => {
+    testing.gitCommit(repo, {write: {'a/index.js': 'below'}});
+    testing.gitCommit(repo, {
+      write: {'a/index.js': 'top', 'b/index.js': 'top'},
+    });
+    const configPath = path.join(repo, 'config.jsonc');
+    const args = [configPath, 'main~2', 'main~1', 'main', repo];
+    expect(custard('stacked', ...args)).to.equal('a\nb\n');
+  });
+
+  it('deprecated fields', () => {
+    testing.gitCommit(repo, {
+      write: {
+        'deprecated.jsonc': JSON.stringify({
+          'package-file': 'package.json',
+          'ci-setup-deprecated': {'node-image': "use 'node-version' instead"},
+        }),
+        'a/ci-setup.json': '{"node-image": "node:18", "tags": ["web"]}',
+        'a/index.js': 'changed',
+      },
+    });
+    const diffsFile = writeDiffs(repo, 'main~1');
+    const configPath = path.join(repo, 'deprecated.jsonc');
+    const {stdout, stderr} = spawnSync(
+      process.execPath,
+      [script, 'affected', configPath, diffsFile, repo, 'web', '!gpu'],
+      {encoding: 'utf8'},
+    );
+    expect(stdout).to.equal('a\n');
+    const warnings = stderr
+      .split('\n')
+      .filter(line => line.includes("'node-image' is deprecated"));
+    expect(warnings).to.have.lengthOf(1);
+  });
+
+  it('explain', () => {
+    testing.gitCommit(repo, {write: {'README.md': '', 'c/index.js': 'x'}});
+    const diffsFile = path.join(repo, '.git', 'diffs.txt');
+    fs.writeFileSync(diffsFile, testing.gitDiff(repo, 'main~1').join('\n'));
+    const configPath = path.join(repo, 'config.jsonc');
+    const report = JSON.parse(custard('explain', configPath, diffsFile, repo));
+    expect(report.diffs.map((d: {reason: string}) => d.reason)).to.deep.equal([
+      'ignored',
+      'package file found',
+    ]);
+    expect(report.affected).to.deep.equal(['c']);
+  });
+});
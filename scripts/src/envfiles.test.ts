@@ -0,0 +1,118 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import type {Config} from './custard.ts';
+import {envMap, formatDotenv, packageEnv, writeEnvFiles} from './envfiles.ts';
+
+describe('envfiles', () => {
+  const config: Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {
+      'node-version': 20,
+      'python-version': null,
+      matrix: {},
+      env: {NODE_ENV: 'test'},
+    },
+  };
+  let checkoutPath = '';
+  beforeEach(() => {
+    checkoutPath = testing.materialize({
+      'web/package.json': '{}',
+      'web/ci-setup.json': JSON.stringify({
+        env: {GREETING: 'hello world'},
+        secrets: {TOKEN: 'projects/p/secrets/token'},
+        tags: ['gpu', 'long-running'],
+        archived: false,
+        matrix: {os: ['linux']},
+      }),
+      'api/package.json': '{}',
+      'api/ci-setup.json': JSON.stringify({env: {NODE_VERSION: '22'}}),
+    });
+  });
+  afterEach(() => testing.cleanup(checkoutPath));
+
+  it('packageEnv', () => {
+    expect(packageEnv(config, 'web', checkoutPath)).to.deep.equal({
+      ARCHIVED: 'false',
+      GREETING: 'hello world',
+      NODE_ENV: 'test',
+      NODE_VERSION: '20',
+      TAGS: 'gpu,long-running',
+    });
+  });
+
+  it('prefix', () => {
+    const env = packageEnv(config, 'api', checkoutPath, {prefix: 'CI_'});
+    expect(env).to.deep.equal({
+      CI_NODE_VERSION: '20',
+      NODE_ENV: 'test',
+      NODE_VERSION: '22',
+    });
+  });
+
+  it('collisions', () => {
+    expect(() => packageEnv(config, 'api', checkoutPath)).to.throw(
+      "api: NODE_VERSION is defined by both 'env.NODE_VERSION' and 'node-version'",
+    );
+  });
+
+  it('writeEnvFiles', () => {
+    const files = writeEnvFiles(config, ['web'], checkoutPath);
+    expect(files).to.deep.equal([path.join(checkoutPath, 'web', '.env')]);
+    expect(fs.readFileSync(files[0], 'utf8')).to.equal(
+      [
+        'ARCHIVED=false',
+        'GREETING="hello world"',
+        'NODE_ENV=test',
+        'NODE_VERSION=20',
+        'TAGS=gpu,long-running',
+        '',
+      ].join('\n'),
+    );
+  });
+
+  it('envMap', () => {
+    const env = envMap(config, ['web'], checkoutPath, {prefix: 'CI_'});
+    expect(Object.keys(env)).to.deep.equal(['web']);
+    expect(env.web.CI_TAGS).to.equal('gpu,long-running');
+  });
+
+  it('formatDotenv', () => {
+    const env = {
+      A: 'a b',
+      B: 'say "hi"',
+      C: '$HOME\\bin',
+      D: 'x\ny',
+      E: '',
+      F: '`id`',
+    };
+    expect(formatDotenv(env)).to.equal(
+      [
+        'A="a b"',
+        'B="say \\"hi\\""',
+        'C="\\$HOME\\\\bin"',
+        'D="x\\ny"',
+        'E=',
+        'F="\\`id\\`"',
+        '',
+      ].join('\n'),
+    );
+  });
+});
@@ -0,0 +1,210 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Environment files from the resolved ci-setup of each package, so later
+// build steps can load them instead of translating the ci-setup themselves:
+// - dotenv, a `.env` file in each package directory.
+// - JSON, a single map with the environment of each package.
+//
+// The ci-setup `env` is exported as is, and the other fields are exported
+// with their names in upper case, like `node-version` as NODE_VERSION.
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {expandAllPackages, loadPackage} from './custard.ts';
+import type {CISetup, Config} from './custard.ts';
+import {message} from './log.ts';
+
+export const envFormats = ['dotenv', 'json'];
+
+export type EnvOptions = {
+  // Prefix for the variables of the ci-setup fields, like 'CI_'.
+  // The ci-setup `env` variables never have a prefix.
+  prefix?: string;
+};
+
+// Fields that are never exported, secrets are only resolved by `setup`.
+const skippedFields = ['env', 'secrets'];
+
+/**
+ * Gets the environment variables of a package from its resolved ci-setup.
+ *
+ * Numbers and booleans are converted to strings, lists of them are joined
+ * with commas, and null values and objects are skipped.
+ * Two fields with the same variable name, like `node-version` and
+ * `NODE_VERSION` in `env`, are an error instead of one silently winning.
+ *
+ * @param config config object
+ * @param pkg package path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param options how to name the variables
+ * @returns environment variables, sorted by name
+ */
+export function packageEnv(
+  config: Config,
+  pkg: string,
+  checkoutPath = '.',
+  options: EnvOptions = {},
+): {[name: string]: string} {
+  const {ciSetup} = loadPackage(config, pkg, checkoutPath);
+  const sources = new Map<string, string>();
+  const env: {[name: string]: string} = {};
+  const add = (name: string, source: string, value: string) => {
+    const other = sources.get(name);
+    if (other !== undefined) {
+      throw new Error(
+        message(
+          'E037',
+          `${pkg}: ${name} is defined by both ${other} and ${source}`,
+        ),
+      );
+    }
+    sources.set(name, source);
+    env[name] = value;
+  };
+  for (const [name, value] of Object.entries(ciSetup.env || {})) {
+    add(name, `'env.${name}'`, `${value}`);
+  }
+  for (const [field, value] of Object.entries(ciSetup)) {
+    const envValue = skippedFields.includes(field) ? null : toEnvValue(value);
+    if (envValue !== null) {
+      add(envName(field, options.prefix || ''), `'${field}'`, envValue);
+    }
+  }
+  return Object.fromEntries(
+    Object.entries(env).sort(([a], [b]) => (a < b ? -1 : a > b ? 1 : 0)),
+  );
+}
+
+/**
+ * Writes a dotenv file in each package directory.
+ *
+ * Existing files with the same name are replaced.
+ *
+ * @param config config object
+ * @param packages package paths, relative to the checkout path, or the all
+ *   packages marker
+ * @param checkoutPath path to the repository checkout
+ * @param filename name of the file in each package, defaults to `.env`
+ * @param options how to name the variables
+ * @returns paths to the files written
+ */
+export function writeEnvFiles(
+  config: Config,
+  packages: string[],
+  checkoutPath = '.',
+  filename = '.env',
+  options: EnvOptions = {},
+): string[] {
+  const paths = expandAllPackages(config, packages, checkoutPath);
+  return paths.map(pkg => {
+    const env = packageEnv(config, pkg, checkoutPath, options);
+    const filePath = path.join(checkoutPath, pkg, filename);
+    fs.writeFileSync(filePath, formatDotenv(env));
+    return filePath;
+  });
+}
+
+/**
+ * Gets the environment variables of all the packages, for a JSON file.
+ *
+ * @param config config object
+ * @param packages package paths, relative to the checkout path, or the all
+ *   packages marker
+ * @param checkoutPath path to the repository checkout
+ * @param options how to name the variables
+ * @returns environment variables of each package
+ */
+export function envMap(
+  config: Config,
+  packages: string[],
+  checkoutPath = '.',
+  options: EnvOptions = {},
+): {[pkg: string]: {[name: string]: string}} {
+  return Object.fromEntries(
+    expandAllPackages(config, packages, checkoutPath).map(pkg => [
+      pkg,
+      packageEnv(config, pkg, checkoutPath, options),
+    ]),
+  );
+}
+
+/**
+ * Formats environment variables as a dotenv file.
+ *
+ * Values with spaces or special characters are double quoted, escaping
+ * backslashes, quotes, dollar signs, backticks, and newlines, so sourcing
+ * the file from a shell doesn't run commands.
+ *
+ * @param env environment variables
+ * @returns dotenv file contents
+ */
+export function formatDotenv(env: {[name: string]: string}): string {
+  return Object.entries(env)
+    .map(([name, value]) => `${name}=${quoteDotenv(value)}\n`)
+    .join('');
+}
+
+/**
+ * Quotes a dotenv value if it has characters that need it.
+ *
+ * @param value variable value
+ * @returns value to write in a dotenv file
+ */
+function quoteDotenv(value: string): string {
+  if (/^[\w@%+=:,./-]*$/.test(value)) {
+    return value;
+  }
+  const escaped = value
+    .replaceAll('\\', '\\\\')
+    .replaceAll('"', '\\"')
+    .replaceAll('$', '\\$')
+    .replaceAll('`', '\\`')
+    .replaceAll('\n', '\\n');
+  return `"${escaped}"`;
+}
+
+/**
+ * Converts a ci-setup field name into an environment variable name.
+ *
+ * @param field ci-setup field name, like 'node-version'
+ * @param prefix prefix for the variable name
+ * @returns variable name, like NODE_VERSION
+ */
+function envName(field: string, prefix: string): string {
+  const name = `${prefix}${field}`.toUpperCase().replace(/[^A-Z0-9_]/g, '_');
+  return /^[0-9]/.test(name) ? `_${name}` : name;
+}
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Converts a ci-setup value into an environment variable value.
+ *
+ * @param value ci-setup value
+ * @returns string value, or null if it can't be exported
+ */
+function toEnvValue(value: CISetup[string]): string | null {
+  const isScalar = (x: any) =>
+    ['string', 'number', 'boolean'].includes(typeof x);
+  if (isScalar(value)) {
+    return `${value}`;
+  }
+  if (Array.isArray(value) && value.every(isScalar)) {
+    return value.join(',');
+  }
+  return null;
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
@@ -0,0 +1,150 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import * as path from 'node:path';
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {affected, loadConfig, whyNot} from './custard.ts';
+import {
+  addExclusion,
+  exclusionsPath,
+  expiredExclusions,
+  loadExclusions,
+  parseExclusions,
+  removeExclusion,
+} from './exclusions.ts';
+
+describe('exclusions', () => {
+  const today = new Date('2025-10-16T12:00:00Z');
+
+  it('add and remove', () => {
+    const dir = testing.materialize({
+      'config.json': JSON.stringify({
+        'package-file': 'pkg.txt',
+        'exclusions-file': 'exclusions.json',
+      }),
+    });
+    try {
+      const filePath = exclusionsPath(path.join(dir, 'config.json'));
+      expect(filePath).to.equal(path.join(dir, 'exclusions.json'));
+      expect(loadExclusions(filePath)).to.deep.equal([]);
+      addExclusion(filePath, 'web/', 'flaky, see #1', undefined, today);
+      addExclusion(filePath, 'api', 'broken, see #2', '2025-12-31', today);
+      addExclusion(filePath, 'web', 'flaky, see #3', undefined, today);
+      expect(loadExclusions(filePath)).to.deep.equal([
+        {
+          path: 'api',
+          reason: 'broken, see #2',
+          expires: '2025-12-31',
+          added: '2025-10-16',
+        },
+        {path: 'web', reason: 'flaky, see #3', added: '2025-10-16'},
+      ]);
+      expect(removeExclusion(filePath, 'api')).to.equal(true);
+      expect(removeExclusion(filePath, 'api')).to.equal(false);
+      const remaining = loadExclusions(filePath);
+      expect(remaining.map(exclusion => exclusion.path)).to.deep.equal(['web']);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('invalid exclusions', () => {
+    expect(() => addExclusion('unused.json', 'api', ' ')).to.throw(
+      "'reason' is required for api",
+    );
+    expect(() => addExclusion('unused.json', 'api', 'why', '31/12')).to.throw(
+      '\'expires\' must be a YYYY-MM-DD date, got: "31/12"',
+    );
+    expect(() => parseExclusions('{}', 'x.json')).to.throw(
+      'exclusions must be a list, got: x.json',
+    );
+    expect(() =>
+      parseExclusions('[{"path": "api", "reason": "x", "owner": "me"}]', 'x'),
+    ).to.throw("invalid exclusion in x: 'owner' is not a valid field");
+  });
+
+  it('expired exclusions', () => {
+    const exclusions = [
+      {path: 'a', reason: 'x', expires: '2025-10-15'},
+      {path: 'b', reason: 'x', expires: '2025-10-16'},
+      {path: 'c', reason: 'x'},
+    ];
+    expect(expiredExclusions(exclusions, today)).to.deep.equal([
+      exclusions[0],
+    ]);
+  });
+
+  it('load config', () => {
+    const dir = testing.materialize({
+      'config.json': JSON.stringify({
+        'package-file': 'pkg.txt',
+        'exclude-packages': ['tools'],
+        'exclusions-file': 'exclusions.json',
+      }),
+      'exclusions.json': JSON.stringify([
+        {path: 'api', reason: 'broken', expires: '2000-01-01'},
+      ]),
+      'api/pkg.txt': '',
+      'web/pkg.txt': '',
+      'tools/pkg.txt': '',
+    });
+    const error = console.error;
+    const warnings: string[] = [];
+    console.error = (text: string) => warnings.push(text);
+    try {
+      const config = loadConfig(path.join(dir, 'config.json'));
+      expect(warnings.join('\n')).to.include(
+        'Exclusion of api expired on 2000-01-01, still excluded: broken',
+      );
+      expect(config['exclude-packages']).to.deep.equal(['tools', 'api']);
+      const diffs = ['api/a.txt', 'web/a.txt', 'tools/a.txt'];
+      expect(affected(config, diffs, dir)).to.deep.equal(['web']);
+      expect(whyNot(config, 'tools', diffs, dir).reason).to.equal(
+        'excluded package',
+      );
+      const report = whyNot(config, 'api', diffs, dir);
+      expect(report.reason).to.equal('quarantined');
+      expect(report.exclusion).to.deep.equal({
+        path: 'api',
+        reason: 'broken',
+        expires: '2000-01-01',
+      });
+    } finally {
+      console.error = error;
+      testing.cleanup(dir);
+    }
+  });
+
+  it('no exclusions file', () => {
+    const dir = testing.materialize({
+      'config.json': '{"package-file": "pkg.txt"}',
+    });
+    try {
+      expect(() => exclusionsPath(path.join(dir, 'config.json'))).to.throw(
+        "'exclusions-file' is not set in",
+      );
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('config URL', () => {
+    expect(() => exclusionsPath('https://example.com/config.json')).to.throw(
+      "the exclusions of a config URL can't be edited",
+    );
+  });
+});
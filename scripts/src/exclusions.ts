@@ -0,0 +1,230 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Excluded packages with the reason they are excluded and until when, so
+// the exclusions don't outlive the problem they worked around.
+//
+// The exclusions live in their own file, the config's 'exclusions-file',
+// so tools can add and remove them without rewriting the config. They are
+// merged into 'exclude-packages' when the config is loaded, and expired
+// exclusions are still honored, but with a warning.
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {
+  isDate,
+  isUrl,
+  loadConfigFile,
+  parseJsonc,
+  toSlash,
+} from './custard.ts';
+import {message} from './log.ts';
+
+export type Exclusion = {
+  // Package path, relative to the checkout path.
+  path: string;
+
+  // Why the package is excluded, like a link to the issue.
+  reason: string;
+
+  // Date to revisit the exclusion, like '2025-12-31', if any.
+  expires?: string;
+
+  // Date the exclusion was added, like '2025-06-30'.
+  added?: string;
+};
+
+/**
+ * Parses an exclusions file.
+ *
+ * @param text exclusions file contents, a JSON or JSONC list
+ * @param source file name for the error messages
+ * @returns exclusions
+ */
+export function parseExclusions(text: string, source: string): Exclusion[] {
+  const exclusions = parseJsonc(text, source);
+  if (!Array.isArray(exclusions)) {
+    throw new Error(
+      message('E048', `exclusions must be a list, got: ${source}`),
+    );
+  }
+  for (const exclusion of exclusions) {
+    const error = exclusionError(exclusion);
+    if (error) {
+      throw new Error(
+        message('E048', `invalid exclusion in ${source}: ${error}`),
+      );
+    }
+  }
+  return exclusions;
+}
+
+/**
+ * Loads an exclusions file.
+ *
+ * @param filePath path to the exclusions file
+ * @returns exclusions, or an empty list if the file doesn't exist
+ */
+export function loadExclusions(filePath: string): Exclusion[] {
+  if (!fs.existsSync(filePath)) {
+    return [];
+  }
+  return parseExclusions(fs.readFileSync(filePath, 'utf8'), filePath);
+}
+
+/**
+ * Writes an exclusions file, sorted by package path.
+ *
+ * @param filePath path to the exclusions file
+ * @param exclusions exclusions to write
+ */
+export function saveExclusions(filePath: string, exclusions: Exclusion[]) {
+  const sorted = [...exclusions].sort((a, b) => (a.path < b.path ? -1 : 1));
+  fs.writeFileSync(filePath, JSON.stringify(sorted, null, 2) + '\n');
+}
+
+/**
+ * Adds an exclusion to an exclusions file, or replaces the exclusion of
+ * the same package.
+ *
+ * @param filePath path to the exclusions file, created if needed
+ * @param pkg package path, relative to the checkout path
+ * @param reason why the package is excluded
+ * @param expires date to revisit the exclusion, like '2025-12-31'
+ * @param today date the exclusion is added
+ * @returns the exclusion added
+ */
+export function addExclusion(
+  filePath: string,
+  pkg: string,
+  reason: string,
+  expires?: string,
+  today = new Date(),
+): Exclusion {
+  const exclusion: Exclusion = {
+    path: toSlash(pkg).replace(/\/$/, ''),
+    reason,
+    ...(expires === undefined ? {} : {expires}),
+    added: today.toISOString().slice(0, 10),
+  };
+  const error = exclusionError(exclusion);
+  if (error) {
+    throw new Error(message('E048', `invalid exclusion: ${error}`));
+  }
+  const exclusions = loadExclusions(filePath).filter(
+    other => other.path !== exclusion.path,
+  );
+  saveExclusions(filePath, [...exclusions, exclusion]);
+  return exclusion;
+}
+
+/**
+ * Removes the exclusion of a package from an exclusions file.
+ *
+ * @param filePath path to the exclusions file
+ * @param pkg package path, relative to the checkout path
+ * @returns true if the package was excluded
+ */
+export function removeExclusion(filePath: string, pkg: string): boolean {
+  const target = toSlash(pkg).replace(/\/$/, '');
+  const exclusions = loadExclusions(filePath);
+  const remaining = exclusions.filter(exclusion => exclusion.path !== target);
+  if (remaining.length === exclusions.length) {
+    return false;
+  }
+  saveExclusions(filePath, remaining);
+  return true;
+}
+
+/**
+ * Finds the exclusions past their expiry date.
+ *
+ * @param exclusions exclusions to check
+ * @param today date to compare against
+ * @returns expired exclusions
+ */
+export function expiredExclusions(
+  exclusions: Exclusion[],
+  today = new Date(),
+): Exclusion[] {
+  const date = today.toISOString().slice(0, 10);
+  return exclusions.filter(
+    exclusion => exclusion.expires !== undefined && exclusion.expires < date,
+  );
+}
+
+/**
+ * Finds the exclusions file of a config file, from its 'exclusions-file'.
+ *
+ * Only local config files have an exclusions file that can be edited,
+ * config URLs are read only.
+ *
+ * @param configPath path to the config file
+ * @returns path to the exclusions file
+ */
+export function exclusionsPath(configPath: string): string {
+  if (isUrl(configPath)) {
+    throw new Error(
+      message(
+        'E049',
+        `the exclusions of a config URL can't be edited, use a local config file: ${configPath}`,
+      ),
+    );
+  }
+  const exclusionsFile = loadConfigFile(configPath)['exclusions-file'];
+  if (typeof exclusionsFile !== 'string') {
+    throw new Error(
+      message('E049', `'exclusions-file' is not set in: ${configPath}`),
+    );
+  }
+  return path.join(path.dirname(configPath), exclusionsFile);
+}
+
+/**
+ * Checks an exclusion.
+ *
+ * @param exclusion exclusion to check
+ * @returns the error, or null if it's valid
+ */
+/* eslint-disable @typescript-eslint/no-explicit-any */
+function exclusionError(exclusion: any): string | null {
+  const fields = ['path', 'reason', 'expires', 'added'];
+  if (
+    typeof exclusion !== 'object' ||
+    exclusion === null ||
+    Array.isArray(exclusion)
+  ) {
+    return `must be an object, got: ${JSON.stringify(exclusion)}`;
+  }
+  const unknown = Object.keys(exclusion).find(key => !fields.includes(key));
+  if (unknown !== undefined) {
+    return `'${unknown}' is not a valid field`;
+  }
+  if (typeof exclusion.path !== 'string' || exclusion.path === '') {
+    return `'path' must be a package path, got: ${JSON.stringify(exclusion.path)}`;
+  }
+  if (typeof exclusion.reason !== 'string' || exclusion.reason.trim() === '') {
+    return `'reason' is required for ${exclusion.path}`;
+  }
+  for (const key of ['expires', 'added']) {
+    const date = exclusion[key];
+    if (date !== undefined && !isDate(date)) {
+      return `'${key}' must be a YYYY-MM-DD date, got: ${JSON.stringify(date)}`;
+    }
+  }
+  return null;
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
@@ -0,0 +1,180 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {execPackages, formatReport} from './exec.ts';
+import {openResultsCache} from './results-cache.ts';
+import type {Config} from './custard.ts';
+
+describe('execPackages', () => {
+  const config: Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {
+      'test-command': null,
+      env: {GREETING: 'hello'},
+    },
+  };
+  const checkoutPath = testing.materialize({
+    'a/package.json': '{}',
+    'a/ci-setup.json': JSON.stringify({
+      'test-command': ['echo $GREETING ${package-name}', 'echo err >&2'],
+    }),
+    'b/package.json': '{}',
+    'b/ci-setup.json': JSON.stringify({
+      'test-command': ['exit 3', 'echo unreachable'],
+    }),
+    'c/package.json': '{}',
+    'd/package.json': '{}',
+    'd/ci-setup.json': JSON.stringify({
+      'test-command': 'echo $GREETING',
+      env: {GREETING: 'bye'},
+    }),
+  });
+  after(() => testing.cleanup(checkoutPath));
+  // Automatic variables are already defined, so nothing calls gcloud.
+  const env = {
+    PATH: process.env.PATH,
+    PROJECT_ID: 'my-project',
+    RUN_ID: 'run',
+    SERVICE_ACCOUNT: '',
+    ID_TOKEN: '',
+  };
+
+  it('runs each package', async () => {
+    const report = await execPackages(config, ['a', 'b', 'c', 'd'], {
+      checkoutPath,
+      concurrency: 2,
+      env,
+    });
+    expect(report.passed).to.equal(2);
+    expect(report.failed).to.equal(1);
+    expect(report.skipped).to.equal(1);
+    const [a, b, c, d] = report.results;
+    expect(a.status).to.equal('passed');
+    expect(a.output).to.equal('hello a\nerr\n');
+    expect(b.status).to.equal('failed');
+    expect(b.steps).to.deep.equal(['exit 3']);
+    expect(b.exitCode).to.equal(3);
+    expect(c.status).to.equal('skipped');
+    // Each package has its own environment.
+    expect(d.output).to.equal('bye\n');
+    expect(env).to.not.have.property('GREETING');
+  });
+
+  it('defaults files in the checkout', async () => {
+    const dir = testing.materialize({
+      'team/ci-setup-defaults.json': '{"env": {"GREETING": "hi"}}',
+      'team/e/package.json': '{}',
+      'team/e/ci-setup.json': '{"test-command": "echo $GREETING"}',
+    });
+    try {
+      const report = await execPackages(config, ['team/e'], {
+        checkoutPath: dir,
+        env,
+      });
+      expect(report.results[0].output).to.equal('hi\n');
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('other field', async () => {
+    const report = await execPackages(config, ['a'], {
+      checkoutPath,
+      field: 'deploy-command',
+      env,
+    });
+    expect(report.skipped).to.equal(1);
+  });
+
+  it('timeout', async () => {
+    const dir = testing.materialize({
+      'slow/package.json': '{}',
+      'slow/ci-setup.json': JSON.stringify({
+        'test-command': ['echo started', 'sleep 10', 'echo unreachable'],
+        timeout: '200ms',
+      }),
+      'fast/package.json': '{}',
+      'fast/ci-setup.json': JSON.stringify({
+        'test-command': 'echo done',
+        timeout: '1m',
+      }),
+    });
+    try {
+      const start = Date.now();
+      const report = await execPackages(config, ['slow', 'fast'], {
+        checkoutPath: dir,
+        env,
+      });
+      expect(Date.now() - start).to.be.below(5000);
+      expect(report.timedOut).to.equal(1);
+      expect(report.passed).to.equal(1);
+      const [slow] = report.results;
+      expect(slow.status).to.equal('timed-out');
+      expect(slow.steps).to.deep.equal(['echo started', 'sleep 10']);
+      expect(slow.output).to.equal('started\nTimed out after 200ms\n');
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('results cache', async () => {
+    const dir = testing.materialize({
+      'a/package.json': '{}',
+      'a/ci-setup.json': JSON.stringify({'test-command': 'echo ran'}),
+      'b/package.json': '{}',
+      'b/ci-setup.json': JSON.stringify({'test-command': 'exit 1'}),
+    });
+    // The cache is outside the checkout, it would be a global file inside.
+    const cacheDir = testing.materialize({});
+    const cache = openResultsCache(cacheDir);
+    try {
+      const options = {checkoutPath: dir, env, cache};
+      const first = await execPackages(config, ['a', 'b'], options);
+      expect(first.passed).to.equal(1);
+      expect(first.failed).to.equal(1);
+      const second = await execPackages(config, ['a', 'b'], options);
+      expect(second.cached).to.equal(1);
+      // Failed results are not cached.
+      expect(second.failed).to.equal(1);
+      expect(second.results[0].status).to.equal('cached');
+      expect(second.results[0].output).to.equal('');
+    } finally {
+      testing.cleanup(dir);
+      testing.cleanup(cacheDir);
+    }
+  });
+
+  it('format report', async () => {
+    const report = await execPackages(config, ['b', 'c'], {checkoutPath, env});
+    expect(formatReport(report)).to.equal(
+      [
+        '=== b (failed) ===',
+        '$ exit 3',
+        '',
+        '=== Summary (2 packages) ===',
+        '  Passed: 0',
+        '  Failed: 1',
+        '  Timed out: 0',
+        '  Cached: 0',
+        '  Skipped: 1',
+        'Failed:',
+        '- b',
+      ].join('\n'),
+    );
+  });
+});
@@ -0,0 +1,339 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Runs a command from each package's ci-setup, like its `test-command`.
+//
+// Unlike `run`, packages run concurrently, so each package gets its own copy
+// of the environment, and its output is captured instead of interleaved.
+
+import * as os from 'node:os';
+import * as path from 'node:path';
+import {spawn} from 'node:child_process';
+import {
+  accessSecret,
+  expandAllPackages,
+  loadPackage,
+  parseDuration,
+  setup,
+} from './custard.ts';
+import type {Config, SecretResolver} from './custard.ts';
+import {message} from './log.ts';
+import {cacheDependencyEdges, packageCacheKey} from './results-cache.ts';
+import type {CachedResult, ResultsCache} from './results-cache.ts';
+
+export type ExecOptions = {
+  // The ci-setup field with the command to run, defaults to 'test-command'.
+  // It can be a single command or a list of steps.
+  field?: string;
+
+  // Maximum number of packages running at the same time,
+  // defaults to the number of CPUs.
+  concurrency?: number;
+
+  // Path to the repository checkout, defaults to the current directory.
+  checkoutPath?: string;
+
+  // Environment for the commands, the ci-setup env and secrets are added
+  // to a copy of it for each package.
+  env?: NodeJS.ProcessEnv;
+
+  // Function to resolve secret values.
+  resolveSecret?: SecretResolver;
+
+  // Signal to cancel the whole run, the running commands are stopped.
+  signal?: AbortSignal;
+
+  // Cache of the package results, packages with a cached result for the
+  // same inputs are not run again, see `openResultsCache`.
+  cache?: ResultsCache;
+};
+
+export type ExecResult = {
+  // Path to the package, relative to the checkout path.
+  package: string;
+
+  // One of: passed, failed, timed-out if it ran longer than the ci-setup
+  // `timeout`, cached if it already passed with the same inputs, or skipped
+  // if the package has no command.
+  // A null or empty command also skips the package, so the field can be
+  // declared in 'ci-setup-defaults' for the packages to set it.
+  status: string;
+
+  // Steps that ran, the failed step is the last one.
+  steps: string[];
+
+  // Exit code of the last step, or null if it didn't exit normally.
+  exitCode: number | null;
+
+  // Standard output and error of all the steps, in the order they arrived.
+  output: string;
+
+  // How long the package took to run, in milliseconds.
+  duration: number;
+};
+
+export type ExecReport = {
+  passed: number;
+  failed: number;
+  timedOut: number;
+  cached: number;
+  skipped: number;
+
+  // Results of each package, in the same order as the packages.
+  results: ExecResult[];
+};
+
+/**
+ * Runs the ci-setup command of each package.
+ *
+ * The steps of a package run in order, and stop at the first failure.
+ * A package with a ci-setup `timeout` is stopped when it runs longer,
+ * the timeout covers all its steps.
+ * All packages run even if some fail, check the report for failures.
+ *
+ * @param config config object
+ * @param packages package paths, relative to the checkout path, or the all
+ *   packages marker
+ * @param options how to run the commands
+ * @returns results of all the packages
+ */
+export async function execPackages(
+  config: Config,
+  packages: string[],
+  options: ExecOptions = {},
+): Promise<ExecReport> {
+  const field = options.field ?? 'test-command';
+  const concurrency = options.concurrency ?? os.availableParallelism();
+  const checkoutPath = options.checkoutPath ?? '.';
+  const env = options.env ?? process.env;
+  const resolveSecret = options.resolveSecret ?? accessSecret;
+  const paths = expandAllPackages(config, packages, checkoutPath);
+
+  const edges = options.cache
+    ? cacheDependencyEdges(config, checkoutPath)
+    : new Map<string, Set<string>>();
+
+  const results: ExecResult[] = [];
+  let next = 0;
+  const worker = async () => {
+    while (next < paths.length) {
+      options.signal?.throwIfAborted();
+      const i = next++;
+      const pkg = paths[i];
+      const start = Date.now();
+      const ciSetup = loadPackage(config, pkg, checkoutPath).ciSetup;
+      const command = ciSetup[field];
+      if (!command || command.length === 0) {
+        results[i] = {
+          package: pkg,
+          status: 'skipped',
+          steps: [],
+          exitCode: null,
+          output: '',
+          duration: 0,
+        };
+        continue;
+      }
+      const cacheKey = options.cache
+        ? packageCacheKey(config, pkg, checkoutPath, field, edges)
+        : '';
+      if (options.cache?.get(cacheKey)) {
+        console.info(message('I003', `${pkg}: cached`));
+        results[i] = {
+          package: pkg,
+          status: 'cached',
+          steps: [],
+          exitCode: 0,
+          output: '',
+          duration: 0,
+        };
+        continue;
+      }
+      const packagePath = path.join(checkoutPath, pkg);
+      const pkgEnv = {...env};
+      setup(config, pkg, pkgEnv, resolveSecret, checkoutPath);
+      const timeout = ciSetup.timeout ? parseDuration(ciSetup.timeout) : null;
+      const timeoutSignal =
+        timeout === null ? undefined : AbortSignal.timeout(timeout);
+      const signals = [timeoutSignal, options.signal].filter(
+        signal => signal !== undefined,
+      );
+      const signal = signals.length > 0 ? AbortSignal.any(signals) : undefined;
+      const result: ExecResult = {
+        package: pkg,
+        status: 'passed',
+        steps: [],
+        exitCode: 0,
+        output: '',
+        duration: 0,
+      };
+      for (const step of Array.isArray(command) ? command : [command]) {
+        result.steps.push(step);
+        const {exitCode, output} = await execStep(
+          step,
+          packagePath,
+          pkgEnv,
+          signal,
+        );
+        result.exitCode = exitCode;
+        result.output += output;
+        options.signal?.throwIfAborted();
+        if (timeoutSignal?.aborted) {
+          result.status = 'timed-out';
+          result.output += `Timed out after ${ciSetup.timeout}\n`;
+          break;
+        }
+        if (exitCode !== 0) {
+          result.status = 'failed';
+          break;
+        }
+      }
+      result.duration = Date.now() - start;
+      if (options.cache && result.status === 'passed') {
+        cacheResult(options.cache, cacheKey, {
+          package: pkg,
+          field,
+          duration: result.duration,
+          cachedAt: new Date().toISOString(),
+        });
+      }
+      console.info(
+        message(
+          'I003',
+          `${pkg}: ${result.status} in ${Math.round(result.duration / 1000)}s`,
+        ),
+      );
+      results[i] = result;
+    }
+  };
+  const workers = Math.min(concurrency, paths.length);
+  await Promise.all(Array.from({length: workers}, worker));
+
+  const count = (status: string) =>
+    results.filter(result => result.status === status).length;
+  return {
+    passed: count('passed'),
+    failed: count('failed'),
+    timedOut: count('timed-out'),
+    cached: count('cached'),
+    skipped: count('skipped'),
+    results,
+  };
+}
+
+/**
+ * Caches a passed result, a cache that can't be written only warns, since
+ * the package already passed.
+ *
+ * @param cache results cache
+ * @param key cache key of the package
+ * @param result result to cache
+ */
+function cacheResult(cache: ResultsCache, key: string, result: CachedResult) {
+  try {
+    cache.put(key, result);
+  } catch (e) {
+    console.error(
+      message('W012', `${result.package}: caching the result failed: ${e}`),
+    );
+  }
+}
+
+/**
+ * Runs a shell command, capturing its output.
+ *
+ * @param command shell command
+ * @param cwd directory to run the command in
+ * @param env environment variables
+ * @param signal signal to stop the command
+ * @returns exit code and the interleaved stdout and stderr
+ */
+function execStep(
+  command: string,
+  cwd: string,
+  env: NodeJS.ProcessEnv,
+  signal?: AbortSignal,
+): Promise<{exitCode: number | null; output: string}> {
+  return new Promise(resolve => {
+    const chunks: Buffer[] = [];
+    // In its own process group, so stopping it also stops its children.
+    const child = spawn(command, {cwd, env, shell: true, detached: true});
+    const stop = () => {
+      try {
+        process.kill(-child.pid!, 'SIGKILL');
+      } catch {
+        // It already exited.
+      }
+    };
+    if (signal?.aborted) {
+      stop();
+    }
+    signal?.addEventListener('abort', stop, {once: true});
+    child.stdout.on('data', chunk => chunks.push(chunk));
+    child.stderr.on('data', chunk => chunks.push(chunk));
+    child.on('error', e => {
+      signal?.removeEventListener('abort', stop);
+      chunks.push(Buffer.from(`${e}\n`));
+      resolve({exitCode: null, output: Buffer.concat(chunks).toString()});
+    });
+    child.on('close', exitCode => {
+      signal?.removeEventListener('abort', stop);
+      resolve({exitCode, output: Buffer.concat(chunks).toString()});
+    });
+  });
+}
+
+/**
+ * Formats a report for the CI logs.
+ *
+ * The output of each package is grouped, followed by a summary.
+ *
+ * @param report results of all the packages
+ * @returns report text
+ */
+export function formatReport(report: ExecReport): string {
+  const lines = [];
+  for (const result of report.results) {
+    if (result.status === 'skipped' || result.status === 'cached') {
+      continue;
+    }
+    lines.push(`=== ${result.package} (${result.status}) ===`);
+    for (const step of result.steps) {
+      lines.push(`$ ${step}`);
+    }
+    lines.push(result.output.trimEnd());
+  }
+  const total = report.results.length;
+  lines.push(
+    `=== Summary (${total} packages) ===`,
+    `  Passed: ${report.passed}`,
+    `  Failed: ${report.failed}`,
+    `  Timed out: ${report.timedOut}`,
+    `  Cached: ${report.cached}`,
+    `  Skipped: ${report.skipped}`,
+  );
+  const failed = report.results.filter(result => result.status === 'failed');
+  if (failed.length > 0) {
+    lines.push('Failed:', ...failed.map(result => `- ${result.package}`));
+  }
+  const timedOut = report.results.filter(
+    result => result.status === 'timed-out',
+  );
+  if (timedOut.length > 0) {
+    lines.push('Timed out:', ...timedOut.map(result => `- ${result.package}`));
+  }
+  return lines.join('\n');
+}
@@ -0,0 +1,80 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {federatedAffected, findConfigs} from './federation.ts';
+
+describe('federation', () => {
+  const checkoutPath = testing.materialize({
+    'python/.custard.json': '{"package-file": "pyproject.toml"}',
+    'python/api/pyproject.toml': '',
+    'python/api/main.py': '',
+    'python/ml/pyproject.toml': '',
+    'go/.custard.json': '{"package-file": "go.mod"}',
+    'go/go.work': '',
+    'go/cmd/server/go.mod': '',
+    'go/cmd/server/main.go': '',
+    'go/tools/.custard.json': '{"package-file": "go.mod"}',
+    'go/tools/lint/go.mod': '',
+    'go/tools/lint/main.go': '',
+    'node_modules/dep/.custard.json': '{}',
+    'README.md': '',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('findConfigs', () => {
+    const configs = findConfigs(checkoutPath);
+    const paths = configs.map(({root, configPath}) => [root, configPath]);
+    expect(paths).to.deep.equal([
+      ['go', 'go/.custard.json'],
+      ['go/tools', 'go/tools/.custard.json'],
+      ['python', 'python/.custard.json'],
+    ]);
+    expect(configs[2].config['package-file']).to.equal('pyproject.toml');
+  });
+
+  it('no configs', () => {
+    expect(() => findConfigs(checkoutPath, 'missing.json')).to.throw(
+      `no missing.json config files found in: ${checkoutPath}`,
+    );
+  });
+
+  it('namespaces the affected packages', () => {
+    const diffs = ['python/api/main.py', 'go/tools/lint/main.go', 'README.md'];
+    const result = federatedAffected(
+      findConfigs(checkoutPath),
+      diffs,
+      checkoutPath,
+    );
+    expect(result).to.deep.equal({
+      go: [],
+      'go/tools': [{path: 'go/tools/lint', reasons: ['lint/main.go changed']}],
+      python: [{path: 'python/api', reasons: ['api/main.py changed']}],
+    });
+  });
+
+  it('global files only affect their subtree', () => {
+    const result = federatedAffected(
+      findConfigs(checkoutPath),
+      ['go/go.work'],
+      checkoutPath,
+    );
+    expect(result.go.map(pkg => pkg.path)).to.deep.equal(['go/cmd/server']);
+    expect(result['go/tools']).to.deep.equal([]);
+    expect(result.python).to.deep.equal([]);
+  });
+});
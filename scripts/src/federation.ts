@@ -0,0 +1,192 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Federated configs, for monorepos where each subtree has its own config,
+// like `python/.custard.json` and `go/.custard.json`, instead of a single
+// config for every language.
+//
+// Each config governs the files in its subtree, except for the nested
+// subtrees with their own config, and its paths are relative to its
+// subtree, like when the subtree is the checkout path.
+// The affected packages of each config are namespaced by their subtree.
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {affectedDetailed, allPackages, loadConfig, toSlash} from './custard.ts';
+import type {AffectedPackage, Config} from './custard.ts';
+import {message} from './log.ts';
+
+// Config file name to look for in every directory.
+export const federatedConfigFilename = '.custard.json';
+
+// Directories never searched for config files.
+const skippedDirs = ['.git', 'node_modules'];
+
+export type FederatedConfig = {
+  // Subtree the config governs, relative to the checkout path, '.' for
+  // the whole repository.
+  root: string;
+
+  // Path to the config file, relative to the checkout path.
+  configPath: string;
+
+  config: Config;
+};
+
+// Affected packages of each subtree, with their paths relative to the
+// checkout path, or the all packages marker if all the subtree's packages
+// are affected.
+export type FederatedAffected = {[root: string]: AffectedPackage[]};
+
+/**
+ * Finds the config files of every subtree.
+ *
+ * @param checkoutPath path to the repository checkout
+ * @param filename config file name, like `.custard.json`
+ * @returns configs, sorted by subtree
+ */
+export function findConfigs(
+  checkoutPath = '.',
+  filename = federatedConfigFilename,
+): FederatedConfig[] {
+  const configs: FederatedConfig[] = [];
+  const walk = (dir: string) => {
+    const entries = fs.readdirSync(path.join(checkoutPath, dir), {
+      withFileTypes: true,
+    });
+    for (const entry of entries) {
+      if (entry.isFile() && entry.name === filename) {
+        const configPath = path.posix.join(dir, filename);
+        configs.push({
+          root: dir,
+          configPath,
+          config: loadConfig(path.join(checkoutPath, configPath)),
+        });
+      } else if (entry.isDirectory() && !skippedDirs.includes(entry.name)) {
+        walk(path.posix.join(dir, entry.name));
+      }
+    }
+  };
+  walk('.');
+  if (configs.length === 0) {
+    throw new Error(
+      message('E044', `no ${filename} config files found in: ${checkoutPath}`),
+    );
+  }
+  return configs.sort((a, b) => (a.root < b.root ? -1 : 1));
+}
+
+/**
+ * Finds the affected packages of every subtree.
+ *
+ * Each diff belongs to the deepest subtree that contains it, and diffs
+ * outside every subtree are skipped. Each config then finds its affected
+ * packages as if its subtree was the checkout path, without looking into
+ * its nested subtrees.
+ *
+ * @param configs configs of every subtree, see `findConfigs`
+ * @param diffs list of files changed, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns affected packages, by subtree
+ */
+export function federatedAffected(
+  configs: FederatedConfig[],
+  diffs: string[],
+  checkoutPath = '.',
+): FederatedAffected {
+  const result: FederatedAffected = {};
+  const subtreeDiffs = new Map<string, string[]>(
+    configs.map(({root}) => [root, []]),
+  );
+  for (const diff of diffs.map(toSlash)) {
+    const owner = subtreeOf(configs, diff);
+    if (owner === undefined) {
+      console.debug(`Skipping diff outside every subtree: ${diff}`);
+      continue;
+    }
+    subtreeDiffs.get(owner.root)!.push(path.posix.relative(owner.root, diff));
+  }
+  for (const {root, config} of configs) {
+    const rootDiffs = subtreeDiffs.get(root)!;
+    if (rootDiffs.length === 0) {
+      result[root] = [];
+      continue;
+    }
+    const packages = affectedDetailed(
+      subtreeConfig(config, root, configs),
+      rootDiffs,
+      path.join(checkoutPath, root),
+    );
+    result[root] = packages.map(pkg => ({
+      ...pkg,
+      path:
+        pkg.path === allPackages
+          ? allPackages
+          : path.posix.join(root, pkg.path),
+    }));
+  }
+  return result;
+}
+
+/**
+ * Finds the deepest subtree that contains a path.
+ *
+ * @param configs configs of every subtree
+ * @param filepath path relative to the checkout path
+ * @returns the subtree's config, or undefined if outside every subtree
+ */
+function subtreeOf(
+  configs: FederatedConfig[],
+  filepath: string,
+): FederatedConfig | undefined {
+  return configs
+    .filter(({root}) => contains(root, filepath))
+    .sort((a, b) => b.root.length - a.root.length)[0];
+}
+
+/**
+ * Prunes the nested subtrees from a config, so they are only governed by
+ * their own config.
+ *
+ * @param config config of the subtree
+ * @param root subtree of the config
+ * @param configs configs of every subtree
+ * @returns config with the nested subtrees pruned
+ */
+function subtreeConfig(
+  config: Config,
+  root: string,
+  configs: FederatedConfig[],
+): Config {
+  const nested = configs
+    .filter(other => other.root !== root && contains(root, other.root))
+    .map(other => `/${path.posix.relative(root, other.root)}/`);
+  if (nested.length === 0) {
+    return config;
+  }
+  return {...config, prune: [...[config.prune ?? []].flat(), ...nested]};
+}
+
+/**
+ * Checks if a subtree contains a path.
+ *
+ * @param root subtree, '.' for the whole repository
+ * @param filepath path relative to the checkout path
+ * @returns true if the path is inside the subtree
+ */
+function contains(root: string, filepath: string): boolean {
+  return root === '.' || filepath.startsWith(`${root}/`);
+}
@@ -0,0 +1,190 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {
+  eventDiffs,
+  eventRefs,
+  githubActions,
+  matrix,
+  stepSummary,
+  writeOutputs,
+} from './github-actions.ts';
+
+describe('github actions', () => {
+  it('pull request event', () => {
+    const event = {pull_request: {base: {sha: 'b'}, head: {sha: 'h'}}};
+    expect(eventRefs('pull_request', event)).to.deep.equal({
+      base: 'b',
+      head: 'h',
+      mergeBase: true,
+    });
+  });
+
+  it('pull request diffs from the merge base', () => {
+    const diffs: string[][] = [];
+    const vcs = {
+      diff: (base: string, head: string) => {
+        diffs.push([base, head]);
+        return [];
+      },
+      mergeBase: (base: string, head: string) => `${base}-${head}`,
+    };
+    eventDiffs(vcs, {base: 'b', head: 'h', mergeBase: true});
+    eventDiffs(vcs, {base: 'b', head: 'h'});
+    expect(diffs).to.deep.equal([
+      ['b-h', 'h'],
+      ['b', 'h'],
+    ]);
+  });
+
+  it('merge group event', () => {
+    const event = {merge_group: {base_sha: 'b', head_sha: 'h'}};
+    expect(eventRefs('merge_group', event)).to.deep.equal({
+      base: 'b',
+      head: 'h',
+    });
+  });
+
+  it('push event', () => {
+    const event = {before: 'b', after: 'h'};
+    expect(eventRefs('push', event)).to.deep.equal({base: 'b', head: 'h'});
+  });
+
+  it('push event to a new branch', () => {
+    const event = {before: '0'.repeat(40), after: 'h'};
+    expect(eventRefs('push', event)).to.deep.equal({base: 'h~1', head: 'h'});
+  });
+
+  it('unsupported event', () => {
+    expect(() => eventRefs('schedule', {})).to.throw(
+      "unsupported GitHub Actions event 'schedule'",
+    );
+  });
+
+  it('matrix', () => {
+    expect(JSON.parse(matrix(['a', 'b']))).to.deep.equal({
+      package: ['a', 'b'],
+    });
+  });
+
+  it('step summary', () => {
+    const summary = stepSummary([
+      {path: 'a', reasons: ['a/x.js changed', 'a|b']},
+    ]);
+    expect(summary).to.equal(
+      [
+        '## 🍮 Affected packages',
+        '',
+        '| Package | Reasons |',
+        '| --- | --- |',
+        '| `a` | a/x.js changed<br>a\\|b |',
+        '',
+      ].join('\n'),
+    );
+  });
+
+  it('step summary columns', () => {
+    const owners = {heading: 'Owners', cell: () => '@org/web'};
+    const summary = stepSummary(
+      [{path: 'web', reasons: ['web/app.ts changed']}],
+      [owners],
+      '1 package affected.',
+    );
+    expect(summary).to.equal(
+      [
+        '## 🍮 Affected packages',
+        '',
+        '1 package affected.',
+        '',
+        '| Package | Reasons | Owners |',
+        '| --- | --- | --- |',
+        '| `web` | web/app.ts changed | @org/web |',
+        '',
+      ].join('\n'),
+    );
+  });
+
+  it('step summary escapes cells', () => {
+    const summary = stepSummary([{path: 'we`b', reasons: ['line 1\nline 2']}]);
+    expect(summary).to.include('| `` we`b `` | line 1<br>line 2 |');
+  });
+
+  it('step summary no packages', () => {
+    expect(stepSummary([])).to.equal(
+      '## 🍮 Affected packages\n\nNo packages affected.\n',
+    );
+  });
+
+  it('write outputs', () => {
+    const dir = testing.materialize({});
+    try {
+      const outputPath = path.join(dir, 'output');
+      writeOutputs({single: 'x', multi: 'a\nb'}, outputPath);
+      const lines = fs.readFileSync(outputPath, 'utf8').split('\n');
+      expect(lines[0]).to.equal('single=x');
+      expect(lines[1]).to.match(/^multi<<custard_.+$/);
+      expect(lines.slice(2, 4)).to.deep.equal(['a', 'b']);
+      expect(lines[4]).to.equal(lines[1].split('<<')[1]);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  describe('workflow run', () => {
+    const env = {...process.env};
+    let repo = '';
+    beforeEach(() => {
+      repo = testing.gitInit({
+        'a/package.json': '{}',
+        'b/package.json': '{}',
+      });
+    });
+    afterEach(() => {
+      process.env = env;
+      testing.cleanup(repo);
+    });
+
+    it('writes outputs and summary', () => {
+      const base = testing.gitCommit(repo, {write: {'b/index.js': ''}});
+      const head = testing.gitCommit(repo, {write: {'a/index.js': ''}});
+      const eventPath = path.join(repo, '.git', 'event.json');
+      fs.writeFileSync(eventPath, JSON.stringify({before: base, after: head}));
+      process.env = {
+        ...env,
+        GITHUB_EVENT_NAME: 'push',
+        GITHUB_EVENT_PATH: eventPath,
+        GITHUB_OUTPUT: path.join(repo, '.git', 'output'),
+        GITHUB_STEP_SUMMARY: path.join(repo, '.git', 'summary'),
+      };
+      const config = {'package-file': 'package.json'};
+      const packages = githubActions(config, repo);
+      expect(packages.map(pkg => pkg.path)).to.deep.equal(['a']);
+      const output = fs.readFileSync(path.join(repo, '.git', 'output'), 'utf8');
+      expect(output).to.equal(
+        'packages=["a"]\nmatrix={"package":["a"]}\ncount=1\nremoved=[]\n',
+      );
+      const summary = fs.readFileSync(
+        path.join(repo, '.git', 'summary'),
+        'utf8',
+      );
+      expect(summary).to.contain('| `a` | a/index.js changed |');
+    });
+  });
+});
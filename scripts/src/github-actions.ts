@@ -0,0 +1,279 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// GitHub Actions integration, the glue every workflow needs to run
+// Custard: read the event, diff the commits, find the affected packages,
+// and write them as step outputs and a job summary.
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+
+import * as fs from 'node:fs';
+import * as crypto from 'node:crypto';
+import {affectedDetailed, allPackages, removedPackages} from './custard.ts';
+import type {AffectedPackage, Config} from './custard.ts';
+import {gitCli} from './vcs.ts';
+import type {VCS} from './vcs.ts';
+import {message} from './log.ts';
+
+export type EventRefs = {
+  // Commit to compare against.
+  base: string;
+  // Commit being tested.
+  head: string;
+  // Whether to compare against the commit where head forked from base,
+  // so the changes made to the base branch since are not included.
+  mergeBase?: boolean;
+};
+
+// Pushes to a new branch have no previous commit.
+const nullSha = '0000000000000000000000000000000000000000';
+
+/**
+ * Gets the base and head commits from a GitHub Actions event.
+ *
+ * @param eventName event name, like pull_request or push
+ * @param event event payload
+ * @returns base and head commits
+ */
+export function eventRefs(eventName: string, event: any): EventRefs {
+  switch (eventName) {
+    case 'pull_request':
+    case 'pull_request_target':
+      return {
+        base: event.pull_request.base.sha,
+        head: event.pull_request.head.sha,
+        mergeBase: true,
+      };
+    case 'merge_group':
+      return {
+        base: event.merge_group.base_sha,
+        head: event.merge_group.head_sha,
+      };
+    case 'push':
+      // On new branches, compare against the parent commit.
+      return {
+        base: event.before === nullSha ? `${event.after}~1` : event.before,
+        head: event.after,
+      };
+    default:
+      throw new Error(
+        message(
+          'E010',
+          `unsupported GitHub Actions event '${eventName}', must be one of: pull_request, pull_request_target, merge_group, push`,
+        ),
+      );
+  }
+}
+
+/**
+ * Lists the files changed between the commits of an event.
+ *
+ * Pull requests are compared against their merge base, like
+ * `git diff base...head`, if the VCS provider can find it.
+ *
+ * @param vcs version control provider
+ * @param refs base and head commits
+ * @returns list of files changed
+ */
+export function eventDiffs(vcs: VCS, refs: EventRefs): string[] {
+  const base =
+    refs.mergeBase && vcs.mergeBase
+      ? vcs.mergeBase(refs.base, refs.head)
+      : refs.base;
+  return vcs.diff(base, refs.head);
+}
+
+/**
+ * Loads the base and head commits of the current workflow run.
+ *
+ * @param eventName event name, defaults to GITHUB_EVENT_NAME
+ * @param eventPath event payload file, defaults to GITHUB_EVENT_PATH
+ * @returns base and head commits
+ */
+export function loadEventRefs(
+  eventName = process.env.GITHUB_EVENT_NAME,
+  eventPath = process.env.GITHUB_EVENT_PATH,
+): EventRefs {
+  if (!eventName || !eventPath) {
+    throw new Error(
+      message(
+        'E011',
+        'GITHUB_EVENT_NAME and GITHUB_EVENT_PATH must be set, is this running on GitHub Actions?',
+      ),
+    );
+  }
+  return eventRefs(eventName, JSON.parse(fs.readFileSync(eventPath, 'utf8')));
+}
+
+/**
+ * Creates a job matrix with one job per package.
+ *
+ * Use it as `strategy.matrix: ${{ fromJSON(needs.<job>.outputs.matrix) }}`,
+ * and each job gets its package as `matrix.package`.
+ *
+ * @param packages list of packages
+ * @returns matrix JSON
+ */
+export function matrix(packages: string[]): string {
+  return JSON.stringify({package: packages});
+}
+
+// A column of the job summary table, after the packages and their reasons.
+export type SummaryColumn = {
+  // Column heading.
+  heading: string;
+
+  // Markdown of the cell of a package, escaped with `escapeCell`.
+  cell: (pkg: AffectedPackage) => string;
+};
+
+/**
+ * Creates the job summary for the affected packages.
+ *
+ * @param packages affected packages with their reasons
+ * @param columns more columns for each package, like their owners
+ * @param description line before the table, like the number of packages
+ * @returns summary markdown
+ */
+export function stepSummary(
+  packages: AffectedPackage[],
+  columns: SummaryColumn[] = [],
+  description?: string,
+): string {
+  const lines = ['## 🍮 Affected packages', ''];
+  if (packages.length === 0) {
+    lines.push('No packages affected.');
+    return lines.join('\n') + '\n';
+  }
+  if (description) {
+    lines.push(description, '');
+  }
+  const headings = ['Package', 'Reasons', ...columns.map(col => col.heading)];
+  lines.push(
+    `| ${headings.join(' | ')} |`,
+    `| ${headings.map(() => '---').join(' | ')} |`,
+  );
+  for (const pkg of packages) {
+    const cells = [
+      pkg.path === allPackages ? 'All packages' : codeCell(pkg.path),
+      pkg.reasons.map(escapeCell).join('<br>'),
+      ...columns.map(col => col.cell(pkg)),
+    ];
+    lines.push(`| ${cells.join(' | ')} |`);
+  }
+  return lines.join('\n') + '\n';
+}
+
+/**
+ * Escapes the text of a table cell.
+ *
+ * @param text cell text
+ * @returns text with its pipes escaped and its line breaks as `<br>`
+ */
+export function escapeCell(text: string): string {
+  return text.replace(/\|/g, '\\|').replace(/\r?\n/g, '<br>');
+}
+
+/**
+ * Formats the text of a table cell as code.
+ *
+ * @param text cell text, like a package path
+ * @returns code span, fenced with more backticks than the text has in a row
+ */
+export function codeCell(text: string): string {
+  const longest = Math.max(0, ...(text.match(/`+/g) ?? []).map(s => s.length));
+  const fence = '`'.repeat(longest + 1);
+  // Code spans drop one space on each side, so text can start with a fence.
+  const padded = longest > 0 ? ` ${text} ` : text;
+  return `${fence}${escapeCell(padded)}${fence}`;
+}
+
+/**
+ * Writes step outputs.
+ *
+ * @param outputs output values by name
+ * @param outputPath outputs file, defaults to GITHUB_OUTPUT
+ */
+export function writeOutputs(
+  outputs: {[name: string]: string},
+  outputPath = process.env.GITHUB_OUTPUT,
+) {
+  if (!outputPath) {
+    throw new Error(
+      message('E012', 'GITHUB_OUTPUT must be set to write step outputs'),
+    );
+  }
+  for (const [name, value] of Object.entries(outputs)) {
+    if (value.includes('\n')) {
+      // Multiline values need a delimiter that's not part of the value.
+      const delimiter = `custard_${crypto.randomUUID()}`;
+      const heredoc = `${name}<<${delimiter}\n${value}\n${delimiter}\n`;
+      fs.appendFileSync(outputPath, heredoc);
+    } else {
+      fs.appendFileSync(outputPath, `${name}=${value}\n`);
+    }
+  }
+}
+
+/**
+ * Appends markdown to the job summary.
+ *
+ * @param markdown summary markdown
+ * @param summaryPath summary file, defaults to GITHUB_STEP_SUMMARY
+ */
+export function writeSummary(
+  markdown: string,
+  summaryPath = process.env.GITHUB_STEP_SUMMARY,
+) {
+  if (!summaryPath) {
+    throw new Error(
+      message('E013', 'GITHUB_STEP_SUMMARY must be set to write a summary'),
+    );
+  }
+  fs.appendFileSync(summaryPath, markdown);
+}
+
+/**
+ * Finds the affected packages of the current workflow run, and writes
+ * them as step outputs and a job summary.
+ *
+ * Outputs:
+ * - `packages`: JSON list of affected packages.
+ * - `matrix`: JSON job matrix, with one `package` per job.
+ * - `count`: number of affected packages, to skip jobs when it's 0.
+ *
+ * @param config config object
+ * @param checkoutPath path to the repository checkout
+ * @param vcs version control provider, defaults to the git command line
+ * @returns affected packages with their reasons
+ */
+export function githubActions(
+  config: Config,
+  checkoutPath = '.',
+  vcs: VCS = gitCli(checkoutPath),
+): AffectedPackage[] {
+  const diffs = eventDiffs(vcs, loadEventRefs());
+  const packages = affectedDetailed(config, diffs, checkoutPath);
+  const paths = packages.map(pkg => pkg.path);
+  writeOutputs({
+    packages: JSON.stringify(paths),
+    matrix: matrix(paths),
+    count: `${paths.length}`,
+    removed: JSON.stringify(removedPackages(config, diffs, checkoutPath)),
+  });
+  writeSummary(stepSummary(packages));
+  return packages;
+}
@@ -0,0 +1,180 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as github from './github.ts';
+
+type Call = {url: string; headers: {[k: string]: string}};
+
+/**
+ * Creates a fake fetch that returns the given responses in order.
+ *
+ * @param responses responses to return
+ * @returns fake fetch, and the list of calls made to it
+ */
+function fakeFetch(responses: Response[]) {
+  const calls: Call[] = [];
+  const fetch = async (url: string, init: {headers: {[k: string]: string}}) => {
+    calls.push({url, headers: init.headers});
+    const response = responses.shift();
+    if (!response) {
+      throw new Error(`unexpected request: ${url}`);
+    }
+    return response;
+  };
+  return {fetch: fetch as unknown as typeof globalThis.fetch, calls};
+}
+
+function json(data: unknown, status = 200, headers = {}): Response {
+  return new Response(JSON.stringify(data), {status, headers});
+}
+
+describe('githubClient', () => {
+  const sleeps: number[] = [];
+  const options = {
+    token: 'my-token',
+    sleep: async (ms: number) => {
+      sleeps.push(ms);
+    },
+    random: () => 0.5,
+    now: () => 1_000_000,
+  };
+  beforeEach(() => sleeps.splice(0));
+
+  it('request', async () => {
+    const {fetch, calls} = fakeFetch([json({number: 1})]);
+    const client = github.githubClient({...options, fetch});
+    const pr = await client.request('GET', '/repos/o/r/pulls/1');
+    expect(pr).to.deep.equal({number: 1});
+    expect(calls[0].url).to.equal('https://api.github.com/repos/o/r/pulls/1');
+    expect(calls[0].headers.authorization).to.equal('Bearer my-token');
+  });
+
+  it('revalidates cached responses', async () => {
+    const {fetch, calls} = fakeFetch([
+      json({number: 1}, 200, {etag: '"abc"'}),
+      new Response(null, {status: 304}),
+    ]);
+    const client = github.githubClient({...options, fetch});
+    await client.request('GET', '/repos/o/r/pulls/1');
+    const pr = await client.request('GET', '/repos/o/r/pulls/1');
+    expect(pr).to.deep.equal({number: 1});
+    expect(calls[1].headers['if-none-match']).to.equal('"abc"');
+  });
+
+  it('retries server errors with backoff', async () => {
+    const {fetch} = fakeFetch([
+      json({}, 502),
+      json({}, 503),
+      json({number: 1}),
+    ]);
+    const client = github.githubClient({...options, fetch});
+    const pr = await client.request('GET', '/repos/o/r/pulls/1');
+    expect(pr).to.deep.equal({number: 1});
+    expect(sleeps).to.deep.equal([750, 1500]);
+  });
+
+  it('retries secondary rate limits after retry-after', async () => {
+    const {fetch} = fakeFetch([
+      json({}, 403, {'retry-after': '30'}),
+      json({number: 1}),
+    ]);
+    const client = github.githubClient({...options, fetch});
+    await client.request('GET', '/repos/o/r/pulls/1');
+    expect(sleeps).to.deep.equal([30_000]);
+  });
+
+  it('waits for the rate limit to reset', async () => {
+    const exhausted = {
+      'x-ratelimit-remaining': '0',
+      'x-ratelimit-reset': '1010', // 10 seconds from now
+    };
+    const {fetch} = fakeFetch([json([], 200, exhausted), json([])]);
+    const client = github.githubClient({...options, fetch});
+    await client.request('GET', '/a');
+    await client.request('GET', '/b');
+    expect(sleeps).to.deep.equal([10_000]);
+  });
+
+  it('does not retry client errors', async () => {
+    const {fetch, calls} = fakeFetch([json({}, 404)]);
+    const client = github.githubClient({...options, fetch});
+    let error = '';
+    await client.request('GET', '/a').catch(e => (error = e.message));
+    expect(error).to.contain('GitHub GET https://api.github.com/a: 404');
+    expect(calls.length).to.equal(1);
+  });
+
+  it('gives up after max retries', async () => {
+    const {fetch, calls} = fakeFetch([json({}, 500), json({}, 500)]);
+    const client = github.githubClient({...options, fetch, maxRetries: 1});
+    let error = '';
+    await client.request('GET', '/a').catch(e => (error = e.message));
+    expect(error).to.contain('500');
+    expect(calls.length).to.equal(2);
+  });
+
+  it('paginate', async () => {
+    const next = {link: '<https://api.github.com/a?page=2>; rel="next"'};
+    const {fetch, calls} = fakeFetch([json([1, 2], 200, next), json([3])]);
+    const client = github.githubClient({...options, fetch});
+    const items = [];
+    for await (const item of client.paginate('/a')) {
+      items.push(item);
+    }
+    expect(items).to.deep.equal([1, 2, 3]);
+    expect(calls[1].url).to.equal('https://api.github.com/a?page=2');
+  });
+
+  it('limits concurrent requests', async () => {
+    let inFlight = 0;
+    let maxInFlight = 0;
+    const fetch = (async () => {
+      inFlight++;
+      maxInFlight = Math.max(maxInFlight, inFlight);
+      await new Promise(resolve => setTimeout(resolve, 1));
+      inFlight--;
+      return json({});
+    }) as unknown as typeof globalThis.fetch;
+    const client = github.githubClient({...options, fetch, concurrency: 2});
+    const paths = ['/a', '/b', '/c', '/d', '/e'];
+    await Promise.all(paths.map(path => client.request('GET', path)));
+    expect(maxInFlight).to.equal(2);
+  });
+});
+
+describe('nextLink', () => {
+  it('next page', () => {
+    const link =
+      '<https://api.github.com/a?page=3>; rel="next", ' +
+      '<https://api.github.com/a?page=5>; rel="last"';
+    expect(github.nextLink(link)).to.equal('https://api.github.com/a?page=3');
+  });
+  it('last page', () => {
+    const link = '<https://api.github.com/a?page=1>; rel="first"';
+    expect(github.nextLink(link)).to.equal(null);
+    expect(github.nextLink(null)).to.equal(null);
+  });
+});
+
+describe('backoff', () => {
+  it('exponential with jitter', () => {
+    expect(github.backoff(0, () => 0)).to.equal(500);
+    expect(github.backoff(0, () => 1)).to.equal(1000);
+    expect(github.backoff(3, () => 1)).to.equal(8000);
+    expect(github.backoff(20, () => 1)).to.equal(60_000);
+  });
+});
@@ -0,0 +1,248 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Shared GitHub API client for the GitHub integrations.
+// It is careful with the API quota, since it runs on every pull request:
+// - GET responses are cached, and revalidated with ETags.
+//   Revalidated responses (304 Not Modified) do not count against the quota.
+// - Requests wait for the rate limit to reset when it runs out.
+// - Failed requests are retried with exponential backoff and jitter.
+// - Concurrent requests are limited, so batches don't trigger abuse limits.
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+
+import {message} from './log.ts';
+
+export type GitHubClientOptions = {
+  // Token to authenticate, defaults to the GITHUB_TOKEN environment variable.
+  token?: string;
+
+  // API base URL, defaults to https://api.github.com.
+  baseUrl?: string;
+
+  // Maximum number of retries for failed requests, defaults to 3.
+  maxRetries?: number;
+
+  // Maximum number of requests in flight, defaults to 4.
+  concurrency?: number;
+
+  // Dependencies, they can be replaced for testing.
+  fetch?: typeof fetch;
+  sleep?: (ms: number) => Promise<void>;
+  random?: () => number;
+  now?: () => number;
+};
+
+export type GitHubClient = {
+  // Sends a request, returns the parsed JSON response.
+  request: (method: string, path: string, body?: any) => Promise<any>;
+
+  // Sends GET requests following the pagination links,
+  // yields every item of the paginated array responses.
+  paginate: (path: string) => AsyncGenerator<any>;
+};
+
+// Cached GET response, by URL, with the ETag to revalidate it and the
+// URL of its next page, if any.
+type CacheEntry = {etag: string; data: any; next: string | null};
+
+/**
+ * Creates a GitHub API client.
+ *
+ * The client keeps its cache and rate limit state, so share a single
+ * client across all the integrations.
+ *
+ * @param options client options
+ * @returns GitHub client
+ */
+export function githubClient(options: GitHubClientOptions = {}): GitHubClient {
+  const token = options.token ?? process.env.GITHUB_TOKEN;
+  const baseUrl = options.baseUrl ?? 'https://api.github.com';
+  const maxRetries = options.maxRetries ?? 3;
+  const concurrency = options.concurrency ?? 4;
+  const fetchFn = options.fetch ?? fetch;
+  const sleep = options.sleep ?? defaultSleep;
+  const random = options.random ?? Math.random;
+  const now = options.now ?? Date.now;
+
+  const cache = new Map<string, CacheEntry>();
+  let rateLimitReset = 0; // when the quota resets, in milliseconds
+  let inFlight = 0;
+  const queue: (() => void)[] = [];
+
+  const acquire = async () => {
+    if (inFlight >= concurrency) {
+      await new Promise<void>(resolve => queue.push(resolve));
+    }
+    inFlight++;
+  };
+  const release = () => {
+    inFlight--;
+    queue.shift()?.();
+  };
+
+  const send = async (method: string, url: string, body?: any) => {
+    const headers: {[k: string]: string} = {
+      accept: 'application/vnd.github+json',
+      'x-github-api-version': '2022-11-28',
+    };
+    if (token) {
+      headers.authorization = `Bearer ${token}`;
+    }
+    const cached = method === 'GET' ? cache.get(url) : undefined;
+    if (cached) {
+      headers['if-none-match'] = cached.etag;
+    }
+    if (body !== undefined) {
+      headers['content-type'] = 'application/json';
+    }
+
+    for (let attempt = 0; ; attempt++) {
+      const wait = rateLimitReset - now();
+      if (wait > 0) {
+        console.error(
+          message('W006', `GitHub rate limit exceeded, waiting ${wait}ms`),
+        );
+        await sleep(wait);
+      }
+      const response = await fetchFn(url, {
+        method,
+        headers,
+        body: body === undefined ? undefined : JSON.stringify(body),
+      });
+      if (response.headers.get('x-ratelimit-remaining') === '0') {
+        const reset = Number(response.headers.get('x-ratelimit-reset'));
+        rateLimitReset = reset * 1000;
+      }
+      if (response.status === 304 && cached) {
+        console.debug(`GitHub ${method} ${url}: not modified, using cache`);
+        return cached;
+      }
+      if (response.ok) {
+        const text = await response.text();
+        const entry = {
+          etag: response.headers.get('etag') ?? '',
+          data: text ? JSON.parse(text) : null,
+          next: nextLink(response.headers.get('link')),
+        };
+        if (method === 'GET' && entry.etag) {
+          cache.set(url, entry);
+        }
+        return entry;
+      }
+      if (attempt >= maxRetries || !isRetryable(response)) {
+        throw new Error(
+          message(
+            'E014',
+            `GitHub ${method} ${url}: ${response.status} ${response.statusText}\n`,
+          ) +
+            (await response.text()),
+        );
+      }
+      const retryAfter = Number(response.headers.get('retry-after'));
+      // Rate limit resets are waited for before sending the next attempt.
+      const delay = retryAfter ? retryAfter * 1000 : backoff(attempt, random);
+      console.error(
+        message(
+          'W007',
+          `GitHub ${method} ${url}: ${response.status}, retrying in ${delay}ms`,
+        ),
+      );
+      await sleep(delay);
+    }
+  };
+
+  const limited = async (method: string, url: string, body?: any) => {
+    await acquire();
+    try {
+      return await send(method, url, body);
+    } finally {
+      release();
+    }
+  };
+
+  const toUrl = (path: string) =>
+    path.startsWith('https://') ? path : `${baseUrl}${path}`;
+
+  return {
+    request: async (method, path, body) =>
+      (await limited(method, toUrl(path), body)).data,
+
+    paginate: async function* (path) {
+      let url: string | null = toUrl(path);
+      while (url) {
+        const page = await limited('GET', url);
+        yield* page.data;
+        url = page.next;
+      }
+    },
+  };
+}
+
+/**
+ * Checks if a failed request can be retried.
+ *
+ * Server errors and rate limits are retried, other client errors are not.
+ *
+ * @param response failed response
+ * @returns true if the request can be retried
+ */
+function isRetryable(response: Response): boolean {
+  if (response.status >= 500 || response.status === 429) {
+    return true;
+  }
+  // Secondary rate limits respond with 403 and a retry-after header.
+  return (
+    response.status === 403 &&
+    (response.headers.has('retry-after') ||
+      response.headers.get('x-ratelimit-remaining') === '0')
+  );
+}
+
+/**
+ * Exponential backoff with jitter, so concurrent jobs don't retry in sync.
+ *
+ * @param attempt attempt number, starting at 0
+ * @param random random number generator between 0 and 1
+ * @returns delay in milliseconds
+ */
+export function backoff(attempt: number, random = Math.random): number {
+  const delay = Math.min(1000 * 2 ** attempt, 60_000);
+  return Math.round(delay / 2 + (random() * delay) / 2);
+}
+
+/**
+ * Gets the next page URL from a Link header.
+ *
+ * @param link Link header value
+ * @returns next page URL, or null if this is the last page
+ */
+export function nextLink(link: string | null): string | null {
+  const next = (link ?? '').match(/<([^>]+)>;\s*rel="next"/);
+  return next ? next[1] : null;
+}
+
+/**
+ * Waits before retrying a request.
+ *
+ * @param ms time to wait, in milliseconds
+ * @returns when the time has passed
+ */
+function defaultSleep(ms: number): Promise<void> {
+  return new Promise(resolve => setTimeout(resolve, ms));
+}
+
+/* eslint-enable @typescript-eslint/no-explicit-any */
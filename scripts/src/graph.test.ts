@@ -0,0 +1,103 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import type {Config} from './custard.ts';
+import {
+  affectedSubgraph,
+  graphDot,
+  graphMermaid,
+  packageGraph,
+} from './graph.ts';
+
+describe('package graph', () => {
+  const config: Config = {'package-file': 'package.json', dependencies: 'npm'};
+  const manifest = (name: string, dependencies = {}) =>
+    JSON.stringify({name, dependencies});
+  const checkoutPath = testing.materialize({
+    'package.json': JSON.stringify({workspaces: ['packages/*', 'apps/*']}),
+    'packages/shared/package.json': manifest('@org/shared'),
+    'packages/ui/package.json': manifest('@org/ui', {'@org/shared': '*'}),
+    'apps/web/package.json': manifest('web', {'@org/ui': '*'}),
+    'apps/cli/package.json': manifest('cli'),
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const affected = ['packages/ui', 'apps/web'];
+
+  it('packageGraph', () => {
+    expect(packageGraph(config, checkoutPath, affected)).to.deep.equal({
+      nodes: ['apps/cli', 'apps/web', 'packages/shared', 'packages/ui'],
+      edges: [
+        ['apps/web', 'packages/ui'],
+        ['packages/ui', 'packages/shared'],
+      ],
+      affected: ['packages/ui', 'apps/web'],
+    });
+  });
+
+  it('affectedSubgraph', () => {
+    const graph = packageGraph(config, checkoutPath, affected);
+    expect(affectedSubgraph(graph)).to.deep.equal({
+      nodes: ['apps/web', 'packages/ui'],
+      edges: [['apps/web', 'packages/ui']],
+      affected: ['packages/ui', 'apps/web'],
+    });
+  });
+
+  it('graphDot', () => {
+    const graph = packageGraph(config, checkoutPath, affected);
+    expect(graphDot(graph)).to.equal(
+      [
+        'digraph packages {',
+        '  rankdir=LR;',
+        '  node [shape=box];',
+        '  "apps/cli";',
+        '  "apps/web" [style=filled, fillcolor="#fde68a"];',
+        '  "packages/shared";',
+        '  "packages/ui" [style=filled, fillcolor="#fde68a"];',
+        '  "apps/web" -> "packages/ui";',
+        '  "packages/ui" -> "packages/shared";',
+        '}',
+        '',
+      ].join('\n'),
+    );
+  });
+
+  it('graphMermaid', () => {
+    const graph = packageGraph(config, checkoutPath, affected);
+    expect(graphMermaid(graph)).to.equal(
+      [
+        'flowchart LR',
+        '  p0["apps/cli"]',
+        '  p1["apps/web"]',
+        '  p2["packages/shared"]',
+        '  p3["packages/ui"]',
+        '  p1 --> p3',
+        '  p3 --> p2',
+        '  classDef affected fill:#fde68a,stroke:#b45309',
+        '  class p3,p1 affected',
+        '',
+      ].join('\n'),
+    );
+  });
+
+  it('no dependencies', () => {
+    const graph = packageGraph({'package-file': 'package.json'}, checkoutPath);
+    expect(graph.edges).to.deep.equal([]);
+    expect(graphMermaid(graph)).to.not.include('classDef');
+  });
+});
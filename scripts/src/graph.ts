@@ -0,0 +1,173 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Package graph diagrams, with the dependencies between the packages and the
+// affected packages highlighted:
+// - DOT, for Graphviz and other graph tools.
+// - Mermaid, which GitHub renders in Markdown, like PR summaries.
+
+import {configRoots, dependencyEdges, findPackages} from './custard.ts';
+import type {Config} from './custard.ts';
+
+export const graphFormats = ['dot', 'mermaid'];
+
+export type PackageGraph = {
+  // Package paths, relative to the checkout path, sorted.
+  nodes: string[];
+
+  // Dependencies as [package, dependency] pairs, sorted.
+  edges: [string, string][];
+
+  // Affected packages, highlighted in the diagrams.
+  affected: string[];
+};
+
+// Fill color of the affected packages.
+const affectedColor = '#fde68a';
+
+/**
+ * Creates the graph of all the packages and their dependencies.
+ *
+ * The edges come from the config `dependencies`, so a config without them
+ * has no edges.
+ *
+ * @param config config object
+ * @param checkoutPath path to the repository checkout
+ * @param affected affected packages to highlight, other paths are skipped
+ * @returns package graph
+ */
+export function packageGraph(
+  config: Config,
+  checkoutPath = '.',
+  affected: string[] = [],
+): PackageGraph {
+  const packages = configRoots(config).flatMap(root => [
+    ...findPackages(config, root, checkoutPath),
+  ]);
+  const dependencies = dependencyEdges(config, packages, checkoutPath);
+  const edges: [string, string][] = [];
+  for (const [pkg, dependsOn] of dependencies) {
+    for (const dependency of dependsOn) {
+      edges.push([pkg, dependency]);
+    }
+  }
+  edges.sort((a, b) => compare(a.join('\n'), b.join('\n')));
+  const nodes = [...new Set([...packages, ...edges.flat()])].sort();
+  return {
+    nodes,
+    edges,
+    affected: affected.filter(pkg => nodes.includes(pkg)),
+  };
+}
+
+/**
+ * Keeps only the affected packages and the dependencies between them.
+ *
+ * Large repositories have too many packages for a readable diagram,
+ * this keeps the part of the graph that a change touches.
+ *
+ * @param graph package graph
+ * @returns graph of the affected packages
+ */
+export function affectedSubgraph(graph: PackageGraph): PackageGraph {
+  const affected = new Set(graph.affected);
+  return {
+    nodes: graph.nodes.filter(pkg => affected.has(pkg)),
+    edges: graph.edges.filter(
+      ([pkg, dependency]) => affected.has(pkg) && affected.has(dependency),
+    ),
+    affected: graph.affected,
+  };
+}
+
+/**
+ * Formats the package graph in one of the graph formats.
+ *
+ * @param format one of: dot, mermaid
+ * @param graph package graph
+ * @returns diagram source
+ */
+export function formatGraph(format: string, graph: PackageGraph): string {
+  switch (format) {
+    case 'mermaid':
+      return graphMermaid(graph);
+    default:
+      return graphDot(graph);
+  }
+}
+
+/**
+ * Creates a Graphviz DOT diagram, edges point to the dependencies.
+ *
+ * @param graph package graph
+ * @returns DOT diagram source
+ */
+export function graphDot(graph: PackageGraph): string {
+  const quote = (text: string) =>
+    `"${text.replaceAll('\\', '\\\\').replaceAll('"', '\\"')}"`;
+  const affected = new Set(graph.affected);
+  const lines = ['digraph packages {', '  rankdir=LR;', '  node [shape=box];'];
+  for (const pkg of graph.nodes) {
+    const style = affected.has(pkg)
+      ? ` [style=filled, fillcolor="${affectedColor}"]`
+      : '';
+    lines.push(`  ${quote(pkg)}${style};`);
+  }
+  for (const [pkg, dependency] of graph.edges) {
+    lines.push(`  ${quote(pkg)} -> ${quote(dependency)};`);
+  }
+  lines.push('}');
+  return lines.join('\n') + '\n';
+}
+
+/**
+ * Creates a Mermaid flowchart, edges point to the dependencies.
+ *
+ * Package paths aren't valid Mermaid ids, so each node gets an id
+ * and the path as its label.
+ *
+ * @param graph package graph
+ * @returns Mermaid diagram source, without the Markdown code fence
+ */
+export function graphMermaid(graph: PackageGraph): string {
+  const ids = new Map(graph.nodes.map((pkg, i) => [pkg, `p${i}`]));
+  const label = (text: string) => `"${text.replaceAll('"', '#quot;')}"`;
+  const lines = ['flowchart LR'];
+  for (const pkg of graph.nodes) {
+    lines.push(`  ${ids.get(pkg)}[${label(pkg)}]`);
+  }
+  for (const [pkg, dependency] of graph.edges) {
+    lines.push(`  ${ids.get(pkg)} --> ${ids.get(dependency)}`);
+  }
+  if (graph.affected.length > 0) {
+    lines.push(
+      `  classDef affected fill:${affectedColor},stroke:#b45309`,
+      `  class ${graph.affected.map(pkg => ids.get(pkg)).join(',')} affected`,
+    );
+  }
+  return lines.join('\n') + '\n';
+}
+
+/**
+ * Compares two strings, for sorting.
+ *
+ * @param a first string
+ * @param b second string
+ * @returns negative if a comes first, positive if b comes first, or zero
+ */
+function compare(a: string, b: string): number {
+  return a < b ? -1 : a > b ? 1 : 0;
+}
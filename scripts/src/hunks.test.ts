@@ -0,0 +1,231 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {validateCISetup} from './custard.ts';
+import type {Config} from './custard.ts';
+import {affectedFromPatch, parseUnifiedDiff} from './hunks.ts';
+
+describe('parseUnifiedDiff', () => {
+  it('git diff', () => {
+    const patch = [
+      'diff --git a/api/main.py b/api/main.py',
+      'index 1111111..2222222 100644',
+      '--- a/api/main.py',
+      '+++ b/api/main.py',
+      '@@ -1,3 +1,3 @@',
+      ' import os',
+      '-# old comment',
+      '+# new comment',
+      ' print(os.name)',
+      '@@ -10,2 +10,3 @@ def main():',
+      ' x = 1',
+      '+y = 2',
+      ' z = 3',
+      'diff --git a/new.txt b/new.txt',
+      'new file mode 100644',
+      '--- /dev/null',
+      '+++ b/new.txt',
+      '@@ -0,0 +1 @@',
+      '+hello',
+      'diff --git a/logo.png b/logo.png',
+      'Binary files a/logo.png and b/logo.png differ',
+      'diff --git a/old.txt b/renamed.txt',
+      'similarity index 100%',
+      'rename from old.txt',
+      'rename to renamed.txt',
+      '',
+    ].join('\n');
+    expect(parseUnifiedDiff(patch)).to.deep.equal([
+      {
+        path: 'api/main.py',
+        oldPath: null,
+        lines: [
+          {kind: 'removed', text: '# old comment', newLine: 2},
+          {kind: 'added', text: '# new comment', newLine: 2},
+          {kind: 'added', text: 'y = 2', newLine: 11},
+        ],
+      },
+      {
+        path: 'new.txt',
+        oldPath: null,
+        lines: [{kind: 'added', text: 'hello', newLine: 1}],
+      },
+      {path: 'logo.png', oldPath: null, lines: null},
+      {path: 'renamed.txt', oldPath: 'old.txt', lines: []},
+    ]);
+  });
+
+  it('paths', () => {
+    const patch = [
+      'diff --git a/x b/y.txt b/x b/y.txt',
+      '--- a/x b/y.txt',
+      '+++ b/x b/y.txt',
+      '@@ -1 +1 @@',
+      '-a',
+      '+b',
+      'diff --git "a/caf\\303\\251.txt" "b/caf\\303\\251.txt"',
+      'Binary files "a/caf\\303\\251.txt" and "b/caf\\303\\251.txt" differ',
+      'diff --git a/old name.txt b/new.txt',
+      'similarity index 100%',
+      'rename from old name.txt',
+      'rename to new.txt',
+      '',
+    ].join('\n');
+    expect(parseUnifiedDiff(patch)).to.deep.equal([
+      {
+        path: 'x b/y.txt',
+        oldPath: null,
+        lines: [
+          {kind: 'removed', text: 'a', newLine: 1},
+          {kind: 'added', text: 'b', newLine: 1},
+        ],
+      },
+      {path: 'café.txt', oldPath: null, lines: null},
+      {path: 'new.txt', oldPath: 'old name.txt', lines: []},
+    ]);
+  });
+
+  it('no prefix', () => {
+    const patch = [
+      'diff --git a/main.py a/main.py',
+      '--- a/main.py',
+      '+++ a/main.py',
+      '@@ -1 +1 @@',
+      '-a',
+      '+b',
+      '',
+    ].join('\n');
+    expect(parseUnifiedDiff(patch).map(file => file.path)).to.deep.equal([
+      'a/main.py',
+    ]);
+  });
+
+  it('plain unified diff', () => {
+    const patch = [
+      '--- a.txt\t2025-01-01 00:00:00',
+      '+++ a.txt\t2025-01-02 00:00:00',
+      '@@ -1 +1 @@',
+      '-a',
+      '+b',
+      '\\ No newline at end of file',
+      '--- b.txt',
+      '+++ /dev/null',
+      '@@ -1 +0,0 @@',
+      '--- not a header',
+    ].join('\n');
+    expect(parseUnifiedDiff(patch)).to.deep.equal([
+      {
+        path: 'a.txt',
+        oldPath: null,
+        lines: [
+          {kind: 'removed', text: 'a', newLine: 1},
+          {kind: 'added', text: 'b', newLine: 1},
+        ],
+      },
+      {
+        path: 'b.txt',
+        oldPath: null,
+        lines: [{kind: 'removed', text: '-- not a header', newLine: 0}],
+      },
+    ]);
+  });
+});
+
+describe('affectedFromPatch', () => {
+  const config: Config = {'package-file': 'pkg.txt'};
+  const checkoutPath = testing.materialize({
+    'api/pkg.txt': '',
+    'api/ci-setup.json': JSON.stringify({
+      'ignore-changes': [
+        {files: '*.py', lines: '^\\s*#'},
+        {files: '*.yaml', between: ['^docs:', '^\\S']},
+      ],
+    }),
+    'api/main.py': 'import os\n# new comment\nprint(os.name)\n',
+    'api/app.yaml': 'name: api\ndocs:\n  summary: new\nruntime: python\n',
+    'web/pkg.txt': '',
+    'web/main.py': '# comment\n',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  const diff = (file: string, removed: string, added: string, line = 2) =>
+    [
+      `diff --git a/${file} b/${file}`,
+      `--- a/${file}`,
+      `+++ b/${file}`,
+      `@@ -${line} +${line} @@`,
+      `-${removed}`,
+      `+${added}`,
+      '',
+    ].join('\n');
+
+  it('skips ignored lines', () => {
+    const patch = diff('api/main.py', '# old comment', '# new comment');
+    expect(affectedFromPatch(config, patch, checkoutPath)).to.deep.equal([]);
+  });
+
+  it('keeps other lines', () => {
+    const patch = diff('api/main.py', 'import sys', 'import os', 1);
+    expect(affectedFromPatch(config, patch, checkoutPath)).to.deep.equal([
+      {path: 'api', reasons: ['api/main.py changed']},
+    ]);
+  });
+
+  it('skips blocks', () => {
+    const inside = diff('api/app.yaml', '  summary: old', '  summary: new', 3);
+    expect(affectedFromPatch(config, inside, checkoutPath)).to.deep.equal([]);
+    const outside = diff('api/app.yaml', 'runtime: go', 'runtime: python', 4);
+    expect(affectedFromPatch(config, outside, checkoutPath)).to.deep.equal([
+      {path: 'api', reasons: ['api/app.yaml changed']},
+    ]);
+  });
+
+  it('files without changed lines', () => {
+    const patch = [
+      'diff --git a/api/__init__.py b/api/__init__.py',
+      'new file mode 100644',
+      'index 0000000..e69de29',
+      'diff --git a/api/run.py b/api/run.py',
+      'old mode 100644',
+      'new mode 100755',
+      '',
+    ].join('\n');
+    expect(affectedFromPatch(config, patch, checkoutPath)).to.deep.equal([
+      {
+        path: 'api',
+        reasons: ['api/__init__.py changed', 'api/run.py changed'],
+      },
+    ]);
+  });
+
+  it('packages without rules', () => {
+    const patch = diff('web/main.py', '# old', '# comment', 1);
+    expect(affectedFromPatch(config, patch, checkoutPath)).to.deep.equal([
+      {path: 'web', reasons: ['web/main.py changed']},
+    ]);
+  });
+
+  it('validates the rules', () => {
+    const valid = {'ignore-changes': [{lines: '^#'}]};
+    expect(validateCISetup(config, valid)).to.deep.equal([]);
+    const invalid = {'ignore-changes': [{lines: '('}, {other: 1}]};
+    expect(validateCISetup(config, invalid)).to.deep.equal([
+      '\'ignore-changes\' must be a list of line rules with files, lines, or between, got: [{"lines":"("},{"other":1}]',
+    ]);
+  });
+});
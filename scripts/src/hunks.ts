@@ -0,0 +1,376 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Changed lines granularity, so edits that don't matter to a package, like
+// comments or a `docs:` block, don't affect it.
+//
+// The diffs come as a unified diff, like from `git diff`, and each package
+// declares the lines that don't matter in its ci-setup `ignore-changes`.
+// A file only counts as changed if any of its changed lines matters.
+// Files without line information, like binary files or renames, always
+// count as changed.
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {
+  affectedFromPackageDiffs,
+  loadPackage,
+  matchPackageDiffs,
+  matches,
+  toSlash,
+} from './custard.ts';
+import type {AffectedPackage, Config, LineRule} from './custard.ts';
+import {message} from './log.ts';
+import {timed} from './stats.ts';
+
+export type ChangedLine = {
+  kind: 'added' | 'removed';
+
+  // Line text, without the leading `+` or `-`.
+  text: string;
+
+  // Line number in the new file where the change is. Removed lines are
+  // right before this line.
+  newLine: number;
+};
+
+export type FileChanges = {
+  // Path to the file, relative to the checkout path.
+  path: string;
+
+  // Previous path, if the file was renamed.
+  oldPath: string | null;
+
+  // Changed lines, or null if the diff has no line information, like for
+  // binary files.
+  lines: ChangedLine[] | null;
+};
+
+/**
+ * Parses a unified diff, like from `git diff`, into the changed lines of
+ * each file.
+ *
+ * @param text unified diff
+ * @returns changes of each file, in the order of the diff
+ */
+export function parseUnifiedDiff(text: string): FileChanges[] {
+  const files: FileChanges[] = [];
+  let file: FileChanges | null = null;
+  let oldRemaining = 0;
+  let newRemaining = 0;
+  let newLine = 0;
+  // Whether the paths have the `a/` and `b/` prefixes, null until known.
+  let prefixed: boolean | null = null;
+  let oldDiffPath: string | null = null;
+  for (const line of text.split('\n')) {
+    if (file && (oldRemaining > 0 || newRemaining > 0)) {
+      if (line.startsWith('+')) {
+        file.lines?.push({kind: 'added', text: line.slice(1), newLine});
+        newLine++;
+        newRemaining--;
+      } else if (line.startsWith('-')) {
+        file.lines?.push({kind: 'removed', text: line.slice(1), newLine});
+        oldRemaining--;
+      } else if (!line.startsWith('\\')) {
+        newLine++;
+        oldRemaining--;
+        newRemaining--;
+      }
+      continue;
+    }
+    const hunk = line.match(/^@@ -\d+(?:,(\d+))? \+(\d+)(?:,(\d+))? @@/);
+    if (line.startsWith('diff --git ')) {
+      // The paths of renames may not be known until the lines below.
+      const paths = gitHeaderPaths(line.slice('diff --git '.length));
+      prefixed =
+        paths && paths[0].startsWith('a/') && paths[1].startsWith('b/');
+      const oldPath = paths ? withoutPrefix(paths[0], prefixed) : '';
+      const newPath = paths ? withoutPrefix(paths[1], prefixed) : '';
+      file = {
+        path: newPath,
+        oldPath: oldPath === newPath ? null : oldPath,
+        lines: [],
+      };
+      files.push(file);
+    } else if (line.startsWith('--- ')) {
+      // Plain unified diffs have no `diff --git` line before the paths.
+      if (!file || file.lines?.length !== 0) {
+        file = {path: '', oldPath: null, lines: []};
+        files.push(file);
+        prefixed = null;
+      }
+      oldDiffPath = diffPath(line);
+    } else if (line.startsWith('+++ ') && file) {
+      const newDiffPath = diffPath(line);
+      prefixed ??=
+        (oldDiffPath !== null || newDiffPath !== null) &&
+        (oldDiffPath === null || oldDiffPath.startsWith('a/')) &&
+        (newDiffPath === null || newDiffPath.startsWith('b/'));
+      const oldPath =
+        oldDiffPath === null ? null : withoutPrefix(oldDiffPath, prefixed);
+      const newPath =
+        newDiffPath === null ? null : withoutPrefix(newDiffPath, prefixed);
+      file.path = newPath ?? oldPath ?? file.path;
+      file.oldPath = newPath === null || oldPath === newPath ? null : oldPath;
+    } else if (line.startsWith('rename from ') && file) {
+      file.oldPath = quotedPath(line.slice('rename from '.length));
+    } else if (line.startsWith('rename to ') && file) {
+      file.path = quotedPath(line.slice('rename to '.length));
+    } else if (line.startsWith('Binary files ') && file) {
+      file.lines = null;
+    } else if (hunk && file) {
+      oldRemaining = Number(hunk[1] ?? 1);
+      newLine = Number(hunk[2]);
+      newRemaining = Number(hunk[3] ?? 1);
+    }
+  }
+  return files;
+}
+
+/**
+ * Finds the packages that have been affected from a unified diff, and why.
+ *
+ * Same as `affectedDetailed`, but a file whose changed lines all match the
+ * package's ci-setup `ignore-changes` rules doesn't affect the package.
+ *
+ * @param config config object
+ * @param patch unified diff, like from `git diff`
+ * @param checkoutPath path to the repository checkout
+ * @param signal signal to cancel the search, checked on every package,
+ *   see `affected`
+ * @returns list of affected packages with their reasons
+ */
+export function affectedFromPatch(
+  config: Config,
+  patch: string,
+  checkoutPath = '.',
+  signal?: AbortSignal,
+): AffectedPackage[] {
+  const changes = parseUnifiedDiff(patch);
+  const diffs = changes.flatMap(file =>
+    file.oldPath === null ? [file.path] : [file.oldPath, file.path],
+  );
+  const packageDiffs = timed('match', () =>
+    matchPackageDiffs(config, diffs, checkoutPath, signal),
+  );
+  for (const [pkg, pkgDiffs] of packageDiffs) {
+    signal?.throwIfAborted();
+    if (pkg === '.') {
+      continue;
+    }
+    const rules = loadPackage(config, pkg, checkoutPath).ciSetup[
+      'ignore-changes'
+    ];
+    if (!rules) {
+      continue;
+    }
+    const remaining = pkgDiffs.filter(diff => {
+      const file = changes.find(file => file.path === toSlash(diff));
+      if (!file || file.oldPath !== null || file.lines === null) {
+        return true;
+      }
+      const relative = path.posix.relative(pkg, file.path);
+      const fullPath = path.join(checkoutPath, file.path);
+      const text = fs.existsSync(fullPath)
+        ? fs.readFileSync(fullPath, 'utf8')
+        : null;
+      if (onlyIgnoredLines(rules, relative, file.lines, text)) {
+        console.error(
+          message('I007', `${file.path} only changed ignored lines`),
+        );
+        return false;
+      }
+      return true;
+    });
+    if (remaining.length > 0) {
+      packageDiffs.set(pkg, remaining);
+    } else {
+      packageDiffs.delete(pkg);
+    }
+  }
+  return affectedFromPackageDiffs(config, packageDiffs, checkoutPath, signal);
+}
+
+/**
+ * Checks if all the changed lines of a file match the rules.
+ *
+ * Blank lines match any rule of the file. A removed line is inside a
+ * `between` block if the line before it in the new file is. A file
+ * without changed lines, like a new empty file or a mode change, always
+ * matters.
+ *
+ * @param rules ci-setup `ignore-changes` rules
+ * @param relative file path, relative to the package
+ * @param lines changed lines
+ * @param text new file contents, or null if it was deleted
+ * @returns true if the changes don't matter
+ */
+function onlyIgnoredLines(
+  rules: LineRule[],
+  relative: string,
+  lines: ChangedLine[],
+  text: string | null,
+): boolean {
+  const fileRules = rules.filter(
+    rule => rule.files === undefined || matches(relative, [rule.files].flat()),
+  );
+  if (fileRules.length === 0 || lines.length === 0) {
+    return false;
+  }
+  const blocks = fileRules.map(rule =>
+    rule.between && text !== null ? blockLines(text, rule.between) : null,
+  );
+  return lines.every(
+    line =>
+      line.text.trim() === '' ||
+      fileRules.some((rule, i) => {
+        if (rule.lines && new RegExp(rule.lines).test(line.text)) {
+          return true;
+        }
+        // Removed lines are checked with the line before them.
+        const index =
+          line.kind === 'added' ? line.newLine - 1 : line.newLine - 2;
+        return blocks[i]?.[index] === true;
+      }),
+  );
+}
+
+/**
+ * Finds the lines of a file inside the blocks of a rule.
+ *
+ * @param text file contents
+ * @param between first line of a block, and first line after it
+ * @returns whether each line is inside a block, by line index
+ */
+function blockLines(text: string, [start, end]: [string, string]): boolean[] {
+  const startRe = new RegExp(start);
+  const endRe = new RegExp(end);
+  let inside = false;
+  return text.split('\n').map(line => {
+    if (startRe.test(line)) {
+      inside = true;
+    } else if (inside && endRe.test(line)) {
+      inside = false;
+    }
+    return inside;
+  });
+}
+
+/**
+ * Gets the path of a `---` or `+++` line of a unified diff.
+ *
+ * @param line `---` or `+++` line
+ * @returns path, with its prefix if any, or null for /dev/null
+ */
+function diffPath(line: string): string | null {
+  const text = line.slice(4);
+  // Plain unified diffs can have a timestamp after a tab.
+  const filePath = text.startsWith('"')
+    ? unquotePath(text)[0]
+    : text.split('\t')[0];
+  return filePath === '/dev/null' ? null : filePath;
+}
+
+/**
+ * Gets the old and new paths of a `diff --git` line.
+ *
+ * Unquoted paths can have spaces, so like `git apply`, they are only split
+ * if both have the same length, which is always the case without a rename.
+ *
+ * @param text `diff --git` line without the `diff --git ` part
+ * @returns old and new paths, with their prefixes if any, or null if they
+ *   can't be told apart
+ */
+function gitHeaderPaths(text: string): [string, string] | null {
+  if (text.startsWith('"')) {
+    const [oldPath, rest] = unquotePath(text);
+    return rest.startsWith(' ') ? [oldPath, quotedPath(rest.slice(1))] : null;
+  }
+  if (text.endsWith('"')) {
+    for (let i = text.indexOf(' "'); i >= 0; i = text.indexOf(' "', i + 1)) {
+      const [newPath, rest] = unquotePath(text.slice(i + 1));
+      if (rest === '') {
+        return [text.slice(0, i), newPath];
+      }
+    }
+  }
+  const middle = (text.length - 1) / 2;
+  if (text[middle] !== ' ') {
+    return null;
+  }
+  return [text.slice(0, middle), text.slice(middle + 1)];
+}
+
+/**
+ * Removes the `a/` or `b/` prefix of a diff path.
+ *
+ * @param filePath path from a diff
+ * @param prefixed whether the diff uses prefixes, without them a path can
+ *   be in a real `a` or `b` directory
+ * @returns path relative to the checkout path
+ */
+function withoutPrefix(filePath: string, prefixed: boolean | null): string {
+  return prefixed ? filePath.slice(2) : filePath;
+}
+
+/**
+ * Gets a path that git may have quoted, like in `rename from` lines.
+ *
+ * @param text path, C-quoted if it starts with `"`
+ * @returns path
+ */
+function quotedPath(text: string): string {
+  return text.startsWith('"') ? unquotePath(text)[0] : text;
+}
+
+/**
+ * Unquotes a path that git C-quoted for having special characters, like
+ * `"caf\303\251.txt"` for `café.txt`.
+ *
+ * @param text text starting with the quoted path
+ * @returns path, and the text after its closing quote
+ */
+function unquotePath(text: string): [string, string] {
+  const escapes: {[c: string]: number} = {
+    a: 7,
+    b: 8,
+    t: 9,
+    n: 10,
+    v: 11,
+    f: 12,
+    r: 13,
+    '"': 34,
+    '\\': 92,
+  };
+  // Octal escapes are UTF-8 bytes, so the path is decoded at the end.
+  const bytes: number[] = [];
+  let i = 1;
+  while (i < text.length && text[i] !== '"') {
+    const octal = text.slice(i).match(/^\\([0-7]{3})/);
+    if (octal) {
+      bytes.push(parseInt(octal[1], 8));
+      i += 4;
+    } else if (text[i] === '\\' && text[i + 1] in escapes) {
+      bytes.push(escapes[text[i + 1]]);
+      i += 2;
+    } else {
+      const char = String.fromCodePoint(text.codePointAt(i) ?? 0);
+      bytes.push(...Buffer.from(char));
+      i += char.length;
+    }
+  }
+  return [Buffer.from(bytes).toString('utf8'), text.slice(i + 1)];
+}
@@ -0,0 +1,216 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import * as testing from './testing.ts';
+import {affectedDetailed, hashPackage, validateCISetup} from './custard.ts';
+import type {Config} from './custard.ts';
+import {
+  addStaleImages,
+  baseDigestLabel,
+  imageInspectors,
+  sourceDigest,
+  sourceDigestLabel,
+  staleImages,
+} from './images.ts';
+
+describe('images', () => {
+  const config: Config = {'package-file': 'package.json'};
+  const checkoutPath = testing.materialize({
+    'fresh/package.json': '{}',
+    'fresh/ci-setup.json': JSON.stringify({
+      'published-image': 'registry/fresh:latest',
+      'base-image': 'node:22',
+    }),
+    'rebased/package.json': '{}',
+    'rebased/ci-setup.json': JSON.stringify({
+      'published-image': 'registry/rebased',
+      'base-image': 'node:22',
+    }),
+    'stale/package.json': '{}',
+    'stale/ci-setup.json': '{"published-image": "registry/stale:latest"}',
+    'unlabeled/package.json': '{}',
+    'unlabeled/ci-setup.json': '{"published-image": "registry/unlabeled"}',
+    'missing/package.json': '{}',
+    'missing/ci-setup.json': '{"published-image": "registry/missing"}',
+    'library/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  const inspected: string[] = [];
+  const labels = (image: string) => {
+    inspected.push(image);
+    switch (image) {
+      case 'registry/fresh:latest': {
+        const digest = sourceDigest(config, 'fresh', checkoutPath);
+        return {[sourceDigestLabel]: digest, [baseDigestLabel]: 'sha256:22'};
+      }
+      case 'registry/rebased': {
+        const digest = sourceDigest(config, 'rebased', checkoutPath);
+        return {[sourceDigestLabel]: digest, [baseDigestLabel]: 'sha256:21'};
+      }
+      case 'registry/stale:latest':
+        return {[sourceDigestLabel]: 'sha256:old'};
+      case 'registry/unlabeled':
+        return {maintainer: 'team'};
+      default:
+        return null;
+    }
+  };
+  const digest = (image: string) => (image === 'node:22' ? 'sha256:22' : null);
+  const inspector = {labels, digest};
+  beforeEach(() => {
+    inspected.length = 0;
+  });
+
+  it('sourceDigest', () => {
+    expect(sourceDigest(config, 'fresh', checkoutPath)).to.equal(
+      `sha256:${hashPackage(config, 'fresh', checkoutPath)}`,
+    );
+  });
+
+  it('staleImages', () => {
+    const packages = [
+      'fresh',
+      'rebased',
+      'stale',
+      'unlabeled',
+      'missing',
+      'library',
+    ];
+    expect(
+      staleImages(config, packages, checkoutPath, inspector),
+    ).to.deep.equal([
+      {
+        path: 'rebased',
+        reasons: ['base image node:22 changed to sha256:22'],
+      },
+      {
+        path: 'stale',
+        reasons: [
+          'image registry/stale:latest is stale, built from sha256:old',
+        ],
+      },
+      {
+        path: 'unlabeled',
+        reasons: [
+          'image registry/unlabeled has no custard.source-digest label',
+        ],
+      },
+      {path: 'missing', reasons: ['image registry/missing not found']},
+    ]);
+  });
+
+  it('addStaleImages', () => {
+    const affected = affectedDetailed(config, ['stale/index.js'], checkoutPath);
+    const packages = addStaleImages(config, affected, checkoutPath, inspector);
+    expect(packages.map(pkg => pkg.path)).to.deep.equal([
+      'missing',
+      'rebased',
+      'stale',
+      'unlabeled',
+    ]);
+    expect(packages[2].reasons).to.deep.equal(['stale/index.js changed']);
+    // Affected packages are rebuilt anyway, so their image isn't checked.
+    expect(inspected).to.not.include('registry/stale:latest');
+  });
+
+  it('max-affected applies to the stale images too', () => {
+    const capped: Config = {
+      ...config,
+      'max-affected': 2,
+      'max-affected-action': 'cap',
+    };
+    const affected = affectedDetailed(capped, ['stale/index.js'], checkoutPath);
+    const packages = addStaleImages(capped, affected, checkoutPath, inspector);
+    expect(packages.map(pkg => pkg.path)).to.deep.equal(['missing', 'rebased']);
+    const failing = {...capped, 'max-affected-action': 'fail'};
+    expect(() =>
+      addStaleImages(failing, affected, checkoutPath, inspector),
+    ).to.throw("more than the 'max-affected' limit of 2");
+  });
+
+  it('keeps the all packages marker', () => {
+    const all = [{path: '*', reasons: []}];
+    expect(addStaleImages(config, all, checkoutPath, inspector)).to.equal(all);
+    expect(inspected).to.deep.equal([]);
+  });
+
+  it('validation', () => {
+    expect(validateCISetup(config, {'published-image': 1})).to.deep.equal([
+      "'published-image' must be string, got: 1",
+    ]);
+    expect(validateCISetup(config, {'base-image': 1})).to.deep.equal([
+      "'base-image' must be string, got: 1",
+    ]);
+  });
+});
+
+describe('imageInspectors', () => {
+  const pathEnv = process.env.PATH;
+  const withCrane = (script: string | null, f: () => void) => {
+    const bin = testing.materialize(script === null ? {} : {crane: script});
+    if (script !== null) {
+      fs.chmodSync(path.join(bin, 'crane'), 0o755);
+    }
+    process.env.PATH = bin;
+    try {
+      f();
+    } finally {
+      process.env.PATH = pathEnv;
+      testing.cleanup(bin);
+    }
+  };
+
+  it('labels', () => {
+    const labels = '{"config": {"Labels": {"a": "b"}}}';
+    withCrane(`#!/bin/sh\necho '${labels}'\n`, () =>
+      expect(imageInspectors.crane.labels('registry/app')).to.deep.equal({
+        a: 'b',
+      }),
+    );
+  });
+
+  it('digest', () =>
+    withCrane('#!/bin/sh\necho sha256:abc\n', () =>
+      expect(imageInspectors.crane.digest('node:22')).to.equal('sha256:abc'),
+    ));
+
+  it('missing image', () => {
+    const error = 'MANIFEST_UNKNOWN: manifest unknown';
+    withCrane(`#!/bin/sh\necho '${error}' >&2\nexit 1\n`, () =>
+      expect(imageInspectors.crane.labels('registry/app')).to.be.null,
+    );
+  });
+
+  it('authentication error', () => {
+    const error = 'UNAUTHORIZED: authentication required';
+    withCrane(`#!/bin/sh\necho '${error}' >&2\nexit 1\n`, () =>
+      expect(() => imageInspectors.crane.labels('registry/app')).to.throw(
+        'UNAUTHORIZED',
+      ),
+    );
+  });
+
+  it('tool not installed', () =>
+    withCrane(null, () =>
+      expect(() => imageInspectors.crane.labels('registry/app')).to.throw(
+        'crane is not installed',
+      ),
+    ));
+});
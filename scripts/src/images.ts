@@ -0,0 +1,212 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Stale container images, so a package that publishes an image is affected
+// when its published image was not built from the current package files,
+// or from the current version of its base image, even without a diff, like
+// after a failed publish or a base image rebuild with security fixes.
+//
+// Images are labeled with the package's source digest and the digest of
+// their base image when they are built, and the package is stale when the
+// labels of its published image differ:
+//   docker build --label custard.source-digest=$(custard source-digest ...)
+//     --label custard.base-digest=$(crane digest <base-image>)
+
+import {execFileSync} from 'node:child_process';
+import {
+  allPackages,
+  configRoots,
+  findPackages,
+  hashPackage,
+  limitAffected,
+  loadPackage,
+} from './custard.ts';
+import type {AffectedPackage, Config} from './custard.ts';
+import {message} from './log.ts';
+
+// Image label with the source digest the image was built from.
+export const sourceDigestLabel = 'custard.source-digest';
+
+// Image label with the digest of the base image the image was built from.
+export const baseDigestLabel = 'custard.base-digest';
+
+export type ImageInspector = {
+  // Reads the labels of a remote image, or null if it doesn't exist.
+  labels: (image: string) => {[label: string]: string} | null;
+
+  // Reads the digest of a remote image, or null if it doesn't exist.
+  digest: (image: string) => string | null;
+};
+
+// Tools to read the labels of remote images, by name.
+export const imageInspectors: Readonly<{[name: string]: ImageInspector}> = {
+  crane: {
+    labels: image => {
+      const config = inspect('crane', ['config', image]);
+      return config === null ? null : JSON.parse(config).config?.Labels || {};
+    },
+    digest: image => inspect('crane', ['digest', image])?.trim() ?? null,
+  },
+  skopeo: {
+    labels: image => {
+      const info = inspect('skopeo', ['inspect', `docker://${image}`]);
+      return info === null ? null : JSON.parse(info).Labels || {};
+    },
+    digest: image => {
+      const info = inspect('skopeo', ['inspect', `docker://${image}`]);
+      return info === null ? null : JSON.parse(info).Digest;
+    },
+  },
+};
+
+/**
+ * Gets the source digest of a package, to label its image with.
+ *
+ * It changes with any change to the package files, see `hashPackage`.
+ *
+ * @param config config object
+ * @param pkg package path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @returns source digest
+ */
+export function sourceDigest(
+  config: Config,
+  pkg: string,
+  checkoutPath = '.',
+): string {
+  return `sha256:${hashPackage(config, pkg, checkoutPath)}`;
+}
+
+/**
+ * Adds the packages whose published image is stale to the affected ones.
+ *
+ * Only packages with a ci-setup `published-image` are checked, and the
+ * packages that are already affected are not, since they are rebuilt
+ * anyway. The 'max-affected' limit applies to all of them together.
+ *
+ * @param config config object
+ * @param packages affected packages
+ * @param checkoutPath path to the repository checkout
+ * @param inspector reads the labels of the published images
+ * @returns affected packages, with the stale ones
+ */
+export function addStaleImages(
+  config: Config,
+  packages: AffectedPackage[],
+  checkoutPath = '.',
+  inspector = imageInspectors.crane,
+): AffectedPackage[] {
+  if (packages.some(pkg => pkg.path === allPackages)) {
+    return packages;
+  }
+  const affected = new Set(packages.map(pkg => pkg.path));
+  const candidates = configRoots(config)
+    .flatMap(root => [...findPackages(config, root, checkoutPath)])
+    .filter(pkg => !affected.has(pkg));
+  const stale = staleImages(config, candidates, checkoutPath, inspector);
+  if (stale.length === 0) {
+    return packages;
+  }
+  const result = [...packages, ...stale];
+  if (config['affected-order'] !== 'topological') {
+    // Stale images don't change the packages, so nothing depends on them.
+    result.sort((a, b) => (a.path < b.path ? -1 : 1));
+  }
+  return limitAffected(config, result);
+}
+
+/**
+ * Finds the packages whose published image was not built from their
+ * current files, or from the current digest of their ci-setup
+ * `base-image`.
+ *
+ * @param config config object
+ * @param packages package paths, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param inspector reads the labels of the published images
+ * @returns stale packages, with the reason
+ */
+export function staleImages(
+  config: Config,
+  packages: string[],
+  checkoutPath = '.',
+  inspector = imageInspectors.crane,
+): AffectedPackage[] {
+  const stale: AffectedPackage[] = [];
+  for (const pkg of packages) {
+    const {ciSetup} = loadPackage(config, pkg, checkoutPath);
+    const image = ciSetup['published-image'];
+    if (!image) {
+      continue;
+    }
+    const labels = inspector.labels(image);
+    const digest = labels?.[sourceDigestLabel];
+    const baseImage = ciSetup['base-image'];
+    const baseDigest = baseImage ? inspector.digest(baseImage) : null;
+    if (labels === null) {
+      stale.push({path: pkg, reasons: [`image ${image} not found`]});
+    } else if (digest === undefined) {
+      stale.push({
+        path: pkg,
+        reasons: [`image ${image} has no ${sourceDigestLabel} label`],
+      });
+    } else if (digest !== sourceDigest(config, pkg, checkoutPath)) {
+      stale.push({
+        path: pkg,
+        reasons: [`image ${image} is stale, built from ${digest}`],
+      });
+    } else if (baseDigest !== null && labels[baseDigestLabel] !== baseDigest) {
+      stale.push({
+        path: pkg,
+        reasons: [`base image ${baseImage} changed to ${baseDigest}`],
+      });
+    }
+  }
+  return stale;
+}
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Runs a tool that prints the description of an image.
+ *
+ * Only a missing image is null. A missing tool or any other failure, like
+ * an authentication error, is an error, instead of reporting every image
+ * as stale.
+ *
+ * @param command tool to run
+ * @param args arguments, with the image
+ * @returns tool output, or null if the image doesn't exist
+ */
+function inspect(command: string, args: string[]): string | null {
+  try {
+    return execFileSync(command, args, {
+      encoding: 'utf8',
+      stdio: ['ignore', 'pipe', 'pipe'],
+    });
+  } catch (e: any) {
+    if (e.code === 'ENOENT') {
+      throw new Error(message('E055', `${command} is not installed`));
+    }
+    const stderr = `${e.stderr || ''}`.trim();
+    if (/manifest unknown|name unknown|not found/i.test(stderr)) {
+      return null;
+    }
+    throw new Error(
+      message('E056', `${command} ${args.join(' ')} failed: ${stderr}`),
+    );
+  }
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
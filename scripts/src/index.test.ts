@@ -0,0 +1,99 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as custard from './index.ts';
+
+describe('public interface', () => {
+  // Removing or renaming any of these breaks downstream tools.
+  // Only add new names here, and deprecate them before removing them.
+  it('v1 exports', () => {
+    expect(Object.keys(custard).sort()).to.deep.equal([
+      'accessSecret',
+      'affected',
+      'affectedDetailed',
+      'affectedFromReader',
+      'affectedTargets',
+      'affectedWithTag',
+      'allPackages',
+      'applyPresets',
+      'configDiff',
+      'configFetchers',
+      'configHash',
+      'configPresets',
+      'configSchemaVersion',
+      'createManifest',
+      'envSecret',
+      'excludeTag',
+      'expandAllPackages',
+      'explain',
+      'explainDiff',
+      'fileMatchesConfig',
+      'findAllPackages',
+      'findPackages',
+      'findSites',
+      'formatSetupSources',
+      'groupPackages',
+      'hashPackage',
+      'isArchived',
+      'loadCISetup',
+      'loadConfig',
+      'loadConfigs',
+      'loadManifest',
+      'loadPackage',
+      'loadTimings',
+      'manifestVersion',
+      'marshalConfig',
+      'matchCategories',
+      'matchEngines',
+      'matchPackages',
+      'migrateConfig',
+      'packageGroupers',
+      'packageIndex',
+      'packageTags',
+      'readDiffs',
+      'removedPackages',
+      'resolveCISetup',
+      'resolveCISetupDetailed',
+      'rewriteSetupFiles',
+      'rewriteSetupText',
+      'run',
+      'saveConfig',
+      'schedulingOrder',
+      'secretResolver',
+      'setupFilePath',
+      'setupRewriteActions',
+      'shard',
+      'shardByTimings',
+      'simulate',
+      'splitDiffs',
+      'stackedAffected',
+      'validateCISetup',
+      'validateConfig',
+      'validateSetupFiles',
+      'valueProviders',
+      'version',
+      'watch',
+      'watchConfig',
+      'whyNot',
+      'withCISetupValidators',
+      'withFileSystem',
+      'withMatchEngine',
+      'withStats',
+      'withStatsAsync',
+    ]);
+  });
+});
@@ -0,0 +1,148 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Stable public interface for tools built on top of Custard.
+//
+// Everything exported here is part of the v1 API, it won't change in
+// backwards incompatible ways until the next major version.
+// Everything else in `custard.ts` is an implementation detail, and can
+// change at any time, import from here instead.
+//
+// Deprecated functions are kept working until the next major version,
+// their documentation points to their replacements.
+
+// Types.
+export type {
+  AffectedPackage,
+  CISetup,
+  CISetupValidator,
+  Command,
+  Config,
+  ConfigDiff,
+  ConfigFetcher,
+  ConfigListener,
+  ConfigWatcher,
+  DefaultsChange,
+  DiffExplanation,
+  DirEntry,
+  Explanation,
+  FileStat,
+  FileSystem,
+  LineRule,
+  Manifest,
+  MatchEngine,
+  Matcher,
+  Package,
+  PackageGrouper,
+  PackageIndex,
+  ResolvedCISetup,
+  Resources,
+  SecretResolver,
+  SetupError,
+  SetupRewrite,
+  SetupSource,
+  Simulation,
+  Site,
+  StackedAffected,
+  ValueProvider,
+  WatchListener,
+  WhyNot,
+} from './custard.ts';
+export type {Stats, Tracer} from './stats.ts';
+
+// Config files.
+export {
+  applyPresets,
+  configFetchers,
+  configPresets,
+  configSchemaVersion,
+  loadConfig,
+  loadConfigs,
+  matchCategories,
+  formatSetupSources,
+  loadCISetup,
+  marshalConfig,
+  migrateConfig,
+  resolveCISetup,
+  resolveCISetupDetailed,
+  rewriteSetupFiles,
+  rewriteSetupText,
+  saveConfig,
+  setupFilePath,
+  setupRewriteActions,
+  validateConfig,
+  validateCISetup,
+  validateSetupFiles,
+  valueProviders,
+  version,
+  watchConfig,
+} from './custard.ts';
+
+// Affected packages.
+export {
+  affected,
+  affectedDetailed,
+  affectedFromReader,
+  affectedTargets,
+  affectedWithTag,
+  allPackages,
+  configDiff,
+  configHash,
+  createManifest,
+  excludeTag,
+  expandAllPackages,
+  explain,
+  explainDiff,
+  findAllPackages,
+  findPackages,
+  findSites,
+  groupPackages,
+  hashPackage,
+  isArchived,
+  loadManifest,
+  loadPackage,
+  manifestVersion,
+  matchEngines,
+  packageGroupers,
+  packageIndex,
+  packageTags,
+  readDiffs,
+  removedPackages,
+  simulate,
+  splitDiffs,
+  stackedAffected,
+  watch,
+  whyNot,
+  withCISetupValidators,
+  withFileSystem,
+  withMatchEngine,
+} from './custard.ts';
+export {withStats, withStatsAsync} from './stats.ts';
+
+// Running commands.
+export {
+  accessSecret,
+  envSecret,
+  loadTimings,
+  run,
+  schedulingOrder,
+  secretResolver,
+  shard,
+  shardByTimings,
+} from './custard.ts';
+
+// Deprecated.
+export {fileMatchesConfig, matchPackages} from './custard.ts';
@@ -0,0 +1,111 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {Readable} from 'node:stream';
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {findPackages, loadConfig} from './custard.ts';
+import {
+  commentedConfig,
+  initWizard,
+  proposeConfig,
+  validateInitConfig,
+  writeInitConfig,
+} from './init.ts';
+
+describe('init', () => {
+  const checkoutPath = testing.materialize({
+    'web/package.json': '{}',
+    'web/node_modules/left-pad/package.json': '{}',
+    'admin/package.json': '{}',
+    'api/go.mod': 'module example.com/api',
+    'README.md': '',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  const answers = (...lines: string[]) => {
+    const output: string[] = [];
+    const io = {
+      input: Readable.from(lines.map(line => `${line}\n`)),
+      output: {write: (chunk: string) => output.push(chunk)},
+    };
+    return {io, output};
+  };
+
+  it('proposeConfig', () => {
+    expect(proposeConfig(checkoutPath)).to.deep.equal({
+      config: {
+        'schema-version': 2,
+        presets: ['node', 'go'],
+        prune: ['node_modules/'],
+      },
+      packageFiles: {node: 2, go: 1},
+    });
+  });
+
+  it('accepts the proposed config', async () => {
+    const proposal = proposeConfig(checkoutPath);
+    const {io, output} = answers('', '', '');
+    expect(await initWizard(proposal, io)).to.deep.equal(proposal.config);
+    expect(output[0]).to.equal('Package files found: node (2), go (1)\n');
+  });
+
+  it('edits the proposed config', async () => {
+    const proposal = proposeConfig(checkoutPath);
+    const {io} = answers('node', '-', 'y');
+    expect(await initWizard(proposal, io)).to.deep.equal({
+      'schema-version': 2,
+      presets: ['node'],
+    });
+  });
+
+  it('cancels', async () => {
+    const {io} = answers('', '', 'no');
+    expect(await initWizard(proposeConfig(checkoutPath), io)).to.be.null;
+  });
+
+  it('commentedConfig', () => {
+    const text = commentedConfig({presets: ['node'], prune: 'dist/'});
+    expect(text.split('\n').slice(0, 5)).to.deep.equal([
+      '{',
+      '  // Package files, match, and ignore patterns for each language.',
+      '  "presets": [',
+      '    "node"',
+      '  ],',
+    ]);
+  });
+
+  it('validateInitConfig', () => {
+    expect(validateInitConfig({presets: []})).to.deep.equal([
+      'at least one preset is needed to find the packages',
+    ]);
+    expect(validateInitConfig({presets: ['node']})).to.deep.equal([]);
+  });
+
+  it('writeInitConfig', () => {
+    const configPath = path.join(checkoutPath, 'config.jsonc');
+    writeInitConfig(proposeConfig(checkoutPath).config, configPath);
+    const config = loadConfig(configPath);
+    const packages = [...findPackages(config, '.', checkoutPath)].sort();
+    expect(packages).to.deep.equal(['admin', 'api', 'web']);
+    expect(() => writeInitConfig({presets: ['node']}, configPath)).to.throw(
+      `config file already exists: ${configPath}`,
+    );
+    fs.rmSync(configPath);
+  });
+});
@@ -0,0 +1,230 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Interactive setup of a first config, for the `init` command.
+//
+// It looks at the repository for the package files of each preset, like
+// package.json or go.mod, and for the directories the presets ignore, like
+// node_modules. Then it proposes a config, lets the user confirm or edit it,
+// and writes it as JSONC with a comment explaining each field.
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import * as readline from 'node:readline';
+import {
+  applyPresets,
+  configPresets,
+  configSchemaVersion,
+  marshalConfig,
+  matchingPattern,
+  validateConfig,
+} from './custard.ts';
+import type {Config} from './custard.ts';
+import {message} from './log.ts';
+
+export type InitProposal = {
+  // Proposed config.
+  config: Config;
+
+  // Number of package files found for each preset, like {node: 12}.
+  packageFiles: {[preset: string]: number};
+};
+
+export type InitIO = {
+  // Where the answers come from, one per line, like stdin.
+  input: NodeJS.ReadableStream;
+
+  // Where the questions are written to, like stderr.
+  output: {write: (chunk: string) => unknown};
+};
+
+// Comments for the fields of the proposed config.
+const fieldComments: {[field: string]: string} = {
+  'schema-version':
+    'Version of the config schema this config was written for.',
+  presets: 'Package files, match, and ignore patterns for each language.',
+  prune: 'Directories where the search for packages does not descend.',
+};
+
+/**
+ * Proposes a config for a repository.
+ *
+ * Presets are sorted by how many package files they have, and the
+ * directories ignored by the presets are pruned, since they usually have
+ * vendored packages.
+ *
+ * @param checkoutPath path to the repository checkout
+ * @returns proposed config and what it was based on
+ */
+export function proposeConfig(checkoutPath = '.'): InitProposal {
+  const packageFiles: {[preset: string]: number} = {};
+  const prune = new Set<string>();
+  const ignoredDirs = presetIgnoredDirs();
+  const walk = (dir: string) => {
+    const entries = fs.readdirSync(path.join(checkoutPath, dir), {
+      withFileTypes: true,
+    });
+    for (const entry of entries) {
+      if (entry.isDirectory()) {
+        if (ignoredDirs.includes(entry.name)) {
+          prune.add(`${entry.name}/`);
+        } else if (entry.name !== '.git') {
+          walk(path.join(dir, entry.name));
+        }
+        continue;
+      }
+      for (const [name, preset] of Object.entries(configPresets)) {
+        const patterns = (preset['package-file'] as string[]) || [];
+        if (matchingPattern(entry.name, patterns) !== null) {
+          packageFiles[name] = (packageFiles[name] || 0) + 1;
+        }
+      }
+    }
+  };
+  walk('.');
+  const presets = Object.keys(packageFiles).sort(
+    (a, b) => packageFiles[b] - packageFiles[a] || a.localeCompare(b),
+  );
+  const config: Config = {
+    'schema-version': configSchemaVersion,
+    presets,
+  };
+  if (prune.size > 0) {
+    config.prune = [...prune].sort();
+  }
+  return {config, packageFiles};
+}
+
+/**
+ * Asks the user to confirm or edit a proposed config.
+ *
+ * Empty answers keep the proposed values, and `-` clears them.
+ *
+ * @param proposal proposed config
+ * @param io where to read the answers and write the questions
+ * @returns config to write, or null if the user cancelled
+ */
+export async function initWizard(
+  proposal: InitProposal,
+  io: InitIO,
+): Promise<Config | null> {
+  const rl = readline.createInterface({input: io.input, terminal: false});
+  // Lines are buffered, so answers written before the question are kept.
+  const lines = rl[Symbol.asyncIterator]();
+  const ask = async (question: string, proposed: string[]) => {
+    io.output.write(`${question} [${proposed.join(', ')}]: `);
+    const {value, done} = await lines.next();
+    const answer = done ? '' : value.trim();
+    if (answer === '-') {
+      return [];
+    }
+    return answer === ''
+      ? proposed
+      : answer
+          .split(',')
+          .map(item => item.trim())
+          .filter(item => item !== '');
+  };
+  try {
+    const found = Object.entries(proposal.packageFiles)
+      .map(([preset, count]) => `${preset} (${count})`)
+      .join(', ');
+    io.output.write(`Package files found: ${found || 'none'}\n`);
+    const config: Config = {...proposal.config};
+    config.presets = await ask(
+      `Presets, one or more of ${Object.keys(configPresets).join(', ')}`,
+      (proposal.config.presets as string[]) || [],
+    );
+    const prune = await ask(
+      'Directories to skip',
+      (proposal.config.prune as string[]) || [],
+    );
+    if (prune.length > 0) {
+      config.prune = prune;
+    } else {
+      delete config.prune;
+    }
+
+    io.output.write(`\n${commentedConfig(config)}\n`);
+    const [confirm] = await ask('Write this config? (yes/no)', ['yes']);
+    return /^y(es)?$/i.test(confirm) ? config : null;
+  } finally {
+    rl.close();
+  }
+}
+
+/**
+ * Checks that a config from the wizard can be used.
+ *
+ * @param config config to check
+ * @returns validation errors, or an empty list if it's valid
+ */
+export function validateInitConfig(config: Config): string[] {
+  if (((config.presets as string[]) || []).length === 0) {
+    return ['at least one preset is needed to find the packages'];
+  }
+  return validateConfig(applyPresets(config));
+}
+
+/**
+ * Writes a config from the wizard, without replacing an existing file.
+ *
+ * @param config config to write
+ * @param configPath path to the new config file
+ */
+export function writeInitConfig(config: Config, configPath: string) {
+  const errors = validateInitConfig(config);
+  if (errors.length > 0) {
+    throw new Error(
+      message('E042', `invalid config:\n- ${errors.join('\n- ')}`),
+    );
+  }
+  if (fs.existsSync(configPath)) {
+    throw new Error(
+      message('E057', `config file already exists: ${configPath}`),
+    );
+  }
+  fs.writeFileSync(configPath, commentedConfig(config));
+}
+
+/**
+ * Marshals a config to JSONC, with a comment before each field.
+ *
+ * @param config config object
+ * @returns JSONC document
+ */
+export function commentedConfig(config: Config): string {
+  return marshalConfig(config)
+    .split('\n')
+    .flatMap(line => {
+      const field = line.match(/^ {2}"([^"]+)":/)?.[1];
+      const comment = field && fieldComments[field];
+      return comment ? [`  // ${comment}`, line] : [line];
+    })
+    .join('\n');
+}
+
+/**
+ * Gets the directories the presets ignore everything in, like node_modules.
+ *
+ * @returns directory names
+ */
+function presetIgnoredDirs(): string[] {
+  return Object.values(configPresets)
+    .flatMap(preset => (preset.ignore as string[]) || [])
+    .map(pattern => pattern.match(/^([\w.-]+)\/\*\*$/)?.[1])
+    .filter((dir): dir is string => dir !== undefined);
+}
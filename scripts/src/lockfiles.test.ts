@@ -0,0 +1,213 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import type {Config} from './custard.ts';
+import {affectedLockfiles, changedDependencies} from './lockfiles.ts';
+
+const goSum = (net: string) =>
+  [
+    `golang.org/x/net ${net} h1:net=`,
+    `golang.org/x/net ${net}/go.mod h1:netmod=`,
+    'golang.org/x/text v0.3.0 h1:text=',
+    'golang.org/x/text v0.3.0/go.mod h1:textmod=',
+    '',
+  ].join('\n');
+
+const packageLock = (lodash: string) =>
+  JSON.stringify({
+    name: 'root',
+    lockfileVersion: 3,
+    packages: {
+      '': {name: 'root', workspaces: ['apps/*']},
+      'node_modules/express': {
+        version: '4.0.0',
+        dependencies: {'body-parser': '^1.0.0'},
+      },
+      'node_modules/body-parser': {
+        version: '1.0.0',
+        dependencies: {lodash: '^4.0.0'},
+      },
+      'node_modules/lodash': {version: lodash},
+      'node_modules/react': {version: '18.0.0'},
+    },
+  });
+
+describe('changedDependencies', () => {
+  it('go.sum', () => {
+    const changed = changedDependencies(
+      'go.sum',
+      goSum('v0.1.0'),
+      goSum('v0.2.0'),
+    );
+    expect(changed).to.deep.equal(['golang.org/x/net']);
+  });
+
+  it('go.mod', () => {
+    const before = 'module example.com/m\n\ngo 1.22\n\nrequire (\n\tgolang.org/x/net v0.1.0\n\tgolang.org/x/text v0.3.0 // indirect\n)\n';
+    const updated = before.replace('net v0.1.0', 'net v0.2.0');
+    expect(changedDependencies('go.mod', before, updated)).to.deep.equal([
+      'golang.org/x/net',
+    ]);
+    const newGo = before.replace('go 1.22', 'go 1.23');
+    expect(changedDependencies('go.mod', before, newGo)).to.equal(null);
+  });
+
+  it('package-lock.json', () => {
+    const changed = changedDependencies(
+      'package-lock.json',
+      packageLock('4.17.20'),
+      packageLock('4.17.21'),
+    );
+    expect(changed).to.deep.equal(['lodash']);
+    const invalid = changedDependencies('package-lock.json', '{', '{}');
+    expect(invalid).to.equal(null);
+  });
+
+  it('requirements.txt', () => {
+    const before = [
+      '--index-url https://pypi.example.com/simple',
+      'requests==2.31.0 \\',
+      '    --hash=sha256:abc',
+      'My_Package==1.0  # pinned',
+      '',
+    ].join('\n');
+    const after = before
+      .replace('2.31.0', '2.32.0')
+      .replace('# pinned', '# still pinned');
+    expect(
+      changedDependencies('requirements.txt', before, after),
+    ).to.deep.equal(['requests']);
+    const newIndex = before.replace('pypi.example.com', 'pypi.org');
+    expect(changedDependencies('requirements.txt', before, newIndex)).to.equal(
+      null,
+    );
+  });
+
+  it('unknown lockfile', () => {
+    expect(changedDependencies('Cargo.lock', 'a', 'b')).to.equal(null);
+  });
+});
+
+describe('affectedLockfiles', () => {
+  const config: Config = {'package-file': ['go.mod', 'package.json']};
+
+  it('go.sum', () => {
+    const dir = testing.materialize({
+      'go.sum': goSum('v0.2.0'),
+      'net/go.mod': 'module example.com/net\n\nrequire golang.org/x/net v0.2.0\n',
+      'text/go.mod': 'module example.com/text\n\nrequire golang.org/x/text v0.3.0\n',
+    });
+    try {
+      const readBase = (file: string) =>
+        file === 'go.sum' ? goSum('v0.1.0') : null;
+      const packages = affectedLockfiles(config, ['go.sum'], dir, readBase);
+      expect(packages).to.deep.equal([
+        {path: 'net', reasons: ['go.sum changed']},
+      ]);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('go imports', () => {
+    const gomod = (net: string) =>
+      `module example.com/m\n\nrequire golang.org/x/net ${net}\n`;
+    const dir = testing.materialize({
+      'go.mod': gomod('v0.2.0'),
+      'web/package.json': '{}',
+      'web/main.go': 'package main\n\nimport "golang.org/x/net/html"\n',
+      'cli/package.json': '{}',
+      'cli/main.go': 'package main\n\nimport "fmt"\n',
+    });
+    try {
+      const readBase = () => gomod('v0.1.0');
+      const packages = affectedLockfiles(config, ['go.mod'], dir, readBase);
+      expect(packages.map(pkg => pkg.path)).to.deep.equal(['web']);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('package-lock.json', () => {
+    const dir = testing.materialize({
+      'package-lock.json': packageLock('4.17.21'),
+      'apps/api/package.json': JSON.stringify({
+        dependencies: {express: '^4.0.0'},
+      }),
+      'apps/web/package.json': JSON.stringify({
+        dependencies: {react: '^18.0.0'},
+      }),
+    });
+    try {
+      const readBase = () => packageLock('4.17.20');
+      const packages = affectedLockfiles(
+        config,
+        ['package-lock.json'],
+        dir,
+        readBase,
+      );
+      expect(packages.map(pkg => pkg.path)).to.deep.equal(['apps/api']);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('packages using the global requirements.txt', () => {
+    const pyConfig: Config = {'package-file': 'pyproject.toml'};
+    const dir = testing.materialize({
+      'requirements.txt': 'flask==3.0.1\nrequests==2.31.0\n',
+      'api/pyproject.toml': '',
+      'api/requirements.txt': 'requests==2.31.0\n',
+      'web/pyproject.toml': '',
+    });
+    try {
+      const readBase = () => 'flask==3.0.0\nrequests==2.31.0\n';
+      const packages = affectedLockfiles(
+        pyConfig,
+        ['requirements.txt'],
+        dir,
+        readBase,
+      );
+      expect(packages.map(pkg => pkg.path)).to.deep.equal(['web']);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('falls back to a global change', () => {
+    const dir = testing.materialize({
+      'package-lock.json': packageLock('4.17.21'),
+      'apps/api/package.json': '{}',
+      'apps/web/package.json': '{}',
+    });
+    try {
+      const packages = affectedLockfiles(
+        config,
+        ['package-lock.json'],
+        dir,
+        () => null,
+      );
+      expect(packages.map(pkg => pkg.path)).to.deep.equal([
+        'apps/api',
+        'apps/web',
+      ]);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+});
@@ -0,0 +1,509 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Lockfile fingerprinting, so a change to a global lockfile only affects
+// the packages that depend on the changed dependencies, instead of all of
+// them.
+//
+// The lockfile is compared against its base revision. Lockfiles that can't
+// be compared, or with changes outside their dependencies like the Go
+// version of a go.mod file, are still global changes.
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {
+  affectedFromPackageDiffs,
+  configRoots,
+  findPackages,
+  goImports,
+  matchPackageDiffs,
+  parseGoMod,
+  toSlash,
+} from './custard.ts';
+import type {AffectedPackage, Config} from './custard.ts';
+import {message} from './log.ts';
+import {timed} from './stats.ts';
+
+export type Lockfile = {
+  // Entries of each dependency, like its versions and checksums.
+  dependencies: Map<string, string>;
+
+  // Dependencies required by each dependency, if the lockfile lists them.
+  requires: Map<string, string[]>;
+
+  // Dependencies required directly, if the lockfile tells them apart.
+  direct: Set<string>;
+
+  // Everything else in the lockfile, like the Go version.
+  rest: string;
+};
+
+// Reads a file at the base revision, relative to the repository root.
+// Returns null if the file does not exist at the base revision.
+export type BaseReader = (file: string) => string | null;
+
+const parsers: {[name: string]: (text: string) => Lockfile} = {
+  'go.mod': parseGoModLockfile,
+  'go.sum': parseGoSum,
+  'package-lock.json': parsePackageLock,
+  'requirements.txt': parseRequirements,
+};
+
+// Lockfile names that are compared by their dependencies.
+export const lockfileNames = Object.keys(parsers);
+
+/**
+ * Finds the packages that have been affected from diffs, and why, comparing
+ * the dependencies of the global lockfiles.
+ *
+ * Same as `affectedDetailed`, but a global lockfile that only changed some
+ * dependencies affects the packages that depend on them, instead of all
+ * packages.
+ *
+ * @param config config object
+ * @param diffs list of files changed
+ * @param checkoutPath path to the repository checkout
+ * @param readBase reads the lockfiles at the base revision
+ * @param signal signal to cancel the search, aborted before the call, see
+ *   `affected`
+ * @returns list of affected packages with their reasons
+ */
+export function affectedLockfiles(
+  config: Config,
+  diffs: string[],
+  checkoutPath: string,
+  readBase: BaseReader,
+  signal?: AbortSignal,
+): AffectedPackage[] {
+  const packageDiffs = timed('match', () =>
+    matchPackageDiffs(config, diffs, checkoutPath, signal),
+  );
+  const globalDiffs = packageDiffs.get('.') || [];
+  const lockfiles = globalDiffs.filter(diff =>
+    lockfileNames.includes(path.posix.basename(toSlash(diff))),
+  );
+  if (lockfiles.length === 0) {
+    return affectedFromPackageDiffs(config, packageDiffs, checkoutPath, signal);
+  }
+
+  const packages = configRoots(config).flatMap(root => [
+    ...findPackages(config, root, checkoutPath, signal),
+  ]);
+  const remaining = globalDiffs.filter(diff => !lockfiles.includes(diff));
+  for (const lockfile of lockfiles) {
+    const lockfilePath = path.join(checkoutPath, lockfile);
+    const before = readBase(toSlash(lockfile));
+    const after = fs.existsSync(lockfilePath)
+      ? fs.readFileSync(lockfilePath, 'utf8')
+      : null;
+    if (before === null || after === null) {
+      remaining.push(lockfile);
+      continue;
+    }
+    const changed = changedDependencies(lockfile, before, after);
+    if (changed === null) {
+      remaining.push(lockfile);
+      continue;
+    }
+    console.error(
+      message(
+        'I006',
+        `${lockfile} changed ${changed.length} dependencies: ${changed.join(', ')}`,
+      ),
+    );
+    const dependents = lockfileDependents(
+      lockfile,
+      changed,
+      packages,
+      checkoutPath,
+      [before, after].map(text => parseLockfile(lockfile, text)),
+    );
+    for (const pkg of dependents) {
+      packageDiffs.set(pkg, [...(packageDiffs.get(pkg) || []), lockfile]);
+    }
+  }
+  if (remaining.length > 0) {
+    packageDiffs.set('.', remaining);
+  } else {
+    packageDiffs.delete('.');
+  }
+  return affectedFromPackageDiffs(config, packageDiffs, checkoutPath, signal);
+}
+
+/**
+ * Parses a lockfile, chosen by its file name.
+ *
+ * @param filepath path to the lockfile, like go.sum or package-lock.json
+ * @param text lockfile contents
+ * @returns parsed lockfile, or null if unknown or invalid
+ */
+export function parseLockfile(filepath: string, text: string): Lockfile | null {
+  const parse = parsers[path.posix.basename(toSlash(filepath))];
+  if (!parse) {
+    return null;
+  }
+  try {
+    return parse(text);
+  } catch {
+    return null;
+  }
+}
+
+/**
+ * Compares two versions of a lockfile.
+ *
+ * @param filepath path to the lockfile, like go.sum or package-lock.json
+ * @param before lockfile contents at the base revision
+ * @param after lockfile contents at the head revision
+ * @returns added, removed, or updated dependencies, sorted, or null if
+ *   something other than the dependencies changed
+ */
+export function changedDependencies(
+  filepath: string,
+  before: string,
+  after: string,
+): string[] | null {
+  const a = parseLockfile(filepath, before);
+  const b = parseLockfile(filepath, after);
+  if (!a || !b || a.rest !== b.rest) {
+    return null;
+  }
+  const names = new Set([...a.dependencies.keys(), ...b.dependencies.keys()]);
+  return [...names]
+    .filter(name => a.dependencies.get(name) !== b.dependencies.get(name))
+    .sort();
+}
+
+/**
+ * Finds the packages that depend on the changed dependencies of a lockfile.
+ *
+ * npm dependencies that require a changed dependency, directly or
+ * transitively, also count as changed. Go packages without their own go.mod
+ * file depend on the modules they import, and on every changed module that
+ * the lockfile's go.mod file doesn't require directly, since it might be
+ * required by an imported one.
+ *
+ * @param lockfile path to the lockfile, relative to the checkout path
+ * @param changed changed dependencies
+ * @param packages packages to check, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param locks the lockfile at the base and head revisions
+ * @returns packages that depend on the changed dependencies
+ */
+function lockfileDependents(
+  lockfile: string,
+  changed: string[],
+  packages: string[],
+  checkoutPath: string,
+  locks: (Lockfile | null)[],
+): string[] {
+  const name = path.posix.basename(toSlash(lockfile));
+  if (name === 'go.mod' || name === 'go.sum') {
+    const gomodPath = path.join(checkoutPath, path.dirname(lockfile), 'go.mod');
+    const gomod = fs.existsSync(gomodPath)
+      ? parseGoModLockfile(fs.readFileSync(gomodPath, 'utf8'))
+      : null;
+    const transitive = changed.some(module => !gomod?.direct.has(module));
+    const dependsOn = (imported: string) =>
+      changed.some(
+        module => imported === module || imported.startsWith(`${module}/`),
+      );
+    return packages.filter(pkg => {
+      const pkgGomod = path.join(checkoutPath, pkg, 'go.mod');
+      if (fs.existsSync(pkgGomod)) {
+        const {requires} = parseGoMod(fs.readFileSync(pkgGomod, 'utf8'));
+        return requires.some(dependsOn);
+      }
+      const imports = goSourceImports(path.join(checkoutPath, pkg));
+      return imports !== null && (transitive || imports.some(dependsOn));
+    });
+  }
+
+  // Follow the dependencies that require the changed ones.
+  const requiredBy = new Map<string, Set<string>>();
+  for (const lock of locks) {
+    for (const [dependency, requires] of lock?.requires || []) {
+      for (const required of requires) {
+        if (!requiredBy.has(required)) {
+          requiredBy.set(required, new Set());
+        }
+        requiredBy.get(required)?.add(dependency);
+      }
+    }
+  }
+  const affectedDependencies = new Set(changed);
+  const queue = [...changed];
+  while (queue.length > 0) {
+    const dependency = queue.shift() || '';
+    for (const dependent of requiredBy.get(dependency) || []) {
+      if (!affectedDependencies.has(dependent)) {
+        affectedDependencies.add(dependent);
+        queue.push(dependent);
+      }
+    }
+  }
+  return packages.filter(pkg => {
+    const declared = declaredDependencies(name, path.join(checkoutPath, pkg));
+    // Packages without their own manifest use the global one.
+    return (
+      declared === null ||
+      declared.some(dependency => affectedDependencies.has(dependency))
+    );
+  });
+}
+
+/**
+ * Gets the dependencies a package declares for a kind of lockfile.
+ *
+ * @param lockfileName lockfile name, like package-lock.json
+ * @param dir package directory
+ * @returns dependency names, like in the lockfile, or null if the package
+ *   has no package.json or requirements.txt file of its own
+ */
+function declaredDependencies(
+  lockfileName: string,
+  dir: string,
+): string[] | null {
+  if (lockfileName === 'package-lock.json') {
+    const packageJson = path.join(dir, 'package.json');
+    if (!fs.existsSync(packageJson)) {
+      return null;
+    }
+    const manifest = JSON.parse(fs.readFileSync(packageJson, 'utf8'));
+    const fields = [
+      'dependencies',
+      'devDependencies',
+      'peerDependencies',
+      'optionalDependencies',
+    ];
+    return fields.flatMap(field => Object.keys(manifest[field] || {}));
+  }
+  const requirements = path.join(dir, 'requirements.txt');
+  if (!fs.existsSync(requirements)) {
+    return null;
+  }
+  return [
+    ...parseRequirements(fs.readFileSync(requirements, 'utf8')).dependencies,
+  ].map(([dependency]) => dependency);
+}
+
+/**
+ * Gets the imports of the Go source files in a directory and beneath it,
+ * skipping nested modules.
+ *
+ * @param dir directory to search
+ * @returns imported package paths, or null if there are no Go files
+ */
+function goSourceImports(dir: string): string[] | null {
+  const imports = new Set<string>();
+  let found = false;
+  const walk = (current: string) => {
+    for (const file of fs.readdirSync(current, {withFileTypes: true})) {
+      const filepath = path.join(current, file.name);
+      if (file.isDirectory()) {
+        const skipped = ['vendor', 'testdata'].includes(file.name);
+        if (!skipped && !fs.existsSync(path.join(filepath, 'go.mod'))) {
+          walk(filepath);
+        }
+      } else if (file.name.endsWith('.go')) {
+        found = true;
+        for (const imported of goImports(fs.readFileSync(filepath, 'utf8'))) {
+          imports.add(imported);
+        }
+      }
+    }
+  };
+  walk(dir);
+  return found ? [...imports] : null;
+}
+
+/**
+ * Parses a go.mod file as a lockfile.
+ *
+ * The required versions and replacements are the dependencies, the other
+ * directives like `go` and `toolchain` are the rest.
+ *
+ * @param text go.mod file contents
+ * @returns parsed lockfile
+ */
+function parseGoModLockfile(text: string): Lockfile {
+  const entries = new Map<string, string[]>();
+  const direct = new Set<string>();
+  const rest: string[] = [];
+  let block = '';
+  for (const rawLine of text.split('\n')) {
+    const indirect = /\/\/\s*indirect\b/.test(rawLine);
+    const line = rawLine.replace(/\/\/.*/, '').trim();
+    if (line === '') {
+      continue;
+    }
+    if (line === ')') {
+      block = '';
+      continue;
+    }
+    let kind = block;
+    let args = line;
+    if (!block) {
+      const directive = line.match(/^(\w+)\s*(\(?)(.*)$/);
+      if (directive && directive[2] === '(') {
+        block = directive[1];
+        continue;
+      }
+      kind = directive ? directive[1] : '';
+      args = directive ? directive[3].trim() : line;
+    }
+    const module = args.split(/\s+/)[0];
+    if (kind === 'require' || kind === 'replace') {
+      entries.set(module, [...(entries.get(module) || []), `${kind} ${args}`]);
+      if (kind === 'require' && !indirect) {
+        direct.add(module);
+      }
+    } else {
+      rest.push(`${kind} ${args}`);
+    }
+  }
+  return {
+    dependencies: joinEntries(entries),
+    requires: new Map(),
+    direct,
+    rest: rest.join('\n'),
+  };
+}
+
+/**
+ * Parses a go.sum file.
+ *
+ * @param text go.sum file contents
+ * @returns parsed lockfile, each module with its versions and hashes
+ */
+function parseGoSum(text: string): Lockfile {
+  const entries = new Map<string, string[]>();
+  for (const line of text.split('\n')) {
+    const [module, ...fields] = line.trim().split(/\s+/);
+    if (module) {
+      entries.set(module, [...(entries.get(module) || []), fields.join(' ')]);
+    }
+  }
+  return {
+    dependencies: joinEntries(entries),
+    requires: new Map(),
+    direct: new Set(),
+    rest: '',
+  };
+}
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+/**
+ * Parses a package-lock.json file, any lockfile version.
+ *
+ * Workspace entries are skipped, their changes are already in their own
+ * package.json files.
+ *
+ * @param text package-lock.json file contents
+ * @returns parsed lockfile, each package with its installed versions
+ */
+function parsePackageLock(text: string): Lockfile {
+  const lock = JSON.parse(text);
+  const entries = new Map<string, string[]>();
+  const requires = new Map<string, string[]>();
+  const add = (name: string, key: string, entry: any, required: string[]) => {
+    const {version, resolved, integrity} = entry;
+    const fingerprint = JSON.stringify([key, version, resolved, integrity]);
+    entries.set(name, [...(entries.get(name) || []), fingerprint]);
+    const previous = requires.get(name) || [];
+    requires.set(name, [...new Set([...previous, ...required])]);
+  };
+  if (lock.packages) {
+    // Lockfile version 2 and 3, entries by their node_modules path.
+    for (const [key, entry] of Object.entries<any>(lock.packages)) {
+      const marker = key.lastIndexOf('node_modules/');
+      if (marker < 0) {
+        continue;
+      }
+      const name = key.slice(marker + 'node_modules/'.length);
+      const required = [
+        'dependencies',
+        'optionalDependencies',
+        'peerDependencies',
+      ].flatMap(field => Object.keys(entry[field] || {}));
+      add(name, key, entry, required);
+    }
+  } else {
+    // Lockfile version 1, nested entries by name.
+    const walk = (dependencies: any, prefix: string) => {
+      for (const [name, entry] of Object.entries<any>(dependencies || {})) {
+        const key = `${prefix}${name}`;
+        add(name, key, entry, Object.keys(entry.requires || {}));
+        walk(entry.dependencies, `${key}/`);
+      }
+    };
+    walk(lock.dependencies, '');
+  }
+  const rest = {...lock, packages: undefined, dependencies: undefined};
+  return {
+    dependencies: joinEntries(entries),
+    requires,
+    direct: new Set(),
+    rest: JSON.stringify(rest),
+  };
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
+
+/**
+ * Parses a requirements.txt file.
+ *
+ * Names are normalized like pip does, so `My_Package` and `my-package` are
+ * the same dependency. Options like `--index-url` and requirements without
+ * a name, like URLs, are the rest.
+ *
+ * @param text requirements.txt file contents
+ * @returns parsed lockfile, each requirement with its specifiers and hashes
+ */
+function parseRequirements(text: string): Lockfile {
+  const entries = new Map<string, string[]>();
+  const rest: string[] = [];
+  for (const rawLine of text.replace(/\\\r?\n/g, ' ').split('\n')) {
+    const line = rawLine.replace(/(^|\s)#.*$/, '').trim();
+    if (line === '') {
+      continue;
+    }
+    const name = line.match(/^([A-Za-z0-9][A-Za-z0-9._-]*)/);
+    if (!name || line.startsWith('-')) {
+      rest.push(line);
+      continue;
+    }
+    const normalized = name[1].toLowerCase().replace(/[-_.]+/g, '-');
+    entries.set(normalized, [...(entries.get(normalized) || []), line]);
+  }
+  return {
+    dependencies: joinEntries(entries),
+    requires: new Map(),
+    direct: new Set(),
+    rest: rest.join('\n'),
+  };
+}
+
+/**
+ * Joins the entries of each dependency, so they compare in any order.
+ *
+ * @param entries lockfile entries of each dependency
+ * @returns sorted entries of each dependency, one per line
+ */
+function joinEntries(entries: Map<string, string[]>): Map<string, string> {
+  return new Map(
+    [...entries].map(([name, lines]) => [name, [...lines].sort().join('\n')]),
+  );
+}
@@ -0,0 +1,55 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import {message} from './log.ts';
+
+describe('message', () => {
+  it('emoji style', () => {
+    expect(message('E001', 'failed', 'emoji')).to.equal('❌ failed');
+    expect(message('W001', 'careful', 'emoji')).to.equal('⚠️ careful');
+    expect(message('I001', 'running', 'emoji')).to.equal('➜ running');
+  });
+
+  it('plain style', () => {
+    expect(message('E001', 'failed', 'plain')).to.equal(
+      'ERROR CUSTARD-E001: failed',
+    );
+    expect(message('W001', 'careful', 'plain')).to.equal(
+      'WARNING CUSTARD-W001: careful',
+    );
+    expect(message('I001', 'running', 'plain')).to.equal(
+      'INFO CUSTARD-I001: running',
+    );
+    expect(message('T001', 'resolving', 'plain')).to.equal(
+      'TRACE CUSTARD-T001: resolving',
+    );
+  });
+
+  it('plain style from the environment', () => {
+    const style = process.env.CUSTARD_LOG_STYLE;
+    process.env.CUSTARD_LOG_STYLE = 'plain';
+    try {
+      expect(message('E002', 'failed')).to.equal('ERROR CUSTARD-E002: failed');
+    } finally {
+      if (style === undefined) {
+        delete process.env.CUSTARD_LOG_STYLE;
+      } else {
+        process.env.CUSTARD_LOG_STYLE = style;
+      }
+    }
+  });
+});
@@ -0,0 +1,55 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Log messages with stable codes, so log-parsing automation can rely on
+// the code instead of the emoji or the exact English phrasing.
+//
+// Codes start with the level: E for errors, W for warnings, I for info,
+// and T for traces.
+// Once released, a code always means the same thing, and is never reused.
+//
+// Set CUSTARD_LOG_STYLE to choose how messages are written:
+// - emoji (default): ❌ message
+// - plain: ERROR CUSTARD-E001: message, plain ASCII for any log processor
+
+export const logStyles = ['emoji', 'plain'];
+
+const levels: {[code: string]: {name: string; emoji: string}} = {
+  E: {name: 'ERROR', emoji: '❌'},
+  W: {name: 'WARNING', emoji: '⚠️'},
+  I: {name: 'INFO', emoji: '➜'},
+  T: {name: 'TRACE', emoji: '🔍'},
+};
+
+/**
+ * Formats a log message in the current log style.
+ *
+ * @param code message code, like E001
+ * @param text message text
+ * @param style log style, defaults to CUSTARD_LOG_STYLE
+ * @returns formatted message
+ */
+export function message(
+  code: string,
+  text: string,
+  style = process.env.CUSTARD_LOG_STYLE || 'emoji',
+): string {
+  const level = levels[code[0]];
+  if (style === 'plain') {
+    return `${level.name} CUSTARD-${code}: ${text}`;
+  }
+  return `${level.emoji} ${text}`;
+}
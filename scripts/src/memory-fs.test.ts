@@ -0,0 +1,86 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import {
+  affected,
+  findPackages,
+  loadPackage,
+  validateSetupFiles,
+  withFileSystem,
+} from './custard.ts';
+import type {Config} from './custard.ts';
+import {memoryFileSystem} from './memory-fs.ts';
+
+describe('memory-fs', () => {
+  const files = memoryFileSystem({
+    '.custardignore': '*.md',
+    'web/package.json': '{}',
+    'web/ci-setup.json': '{"env": {"NODE_ENV": "test"}}',
+    'web/src/index.js': '',
+    'api/app.csproj': '',
+    'api/Program.cs': '',
+    'docs/README.md': '',
+  });
+  const config: Config = {'package-file': ['package.json', '*.csproj']};
+
+  it('finds packages', () => {
+    const packages = [...findPackages(withFileSystem(config, files), '.', '.')];
+    expect(packages).to.deep.equal(['api', 'web']);
+  });
+
+  it('finds affected packages', () => {
+    const diffs = ['web/src/index.js', 'api/Program.cs', 'docs/README.md'];
+    const packages = affected(withFileSystem(config, files), diffs, '.');
+    expect(packages).to.deep.equal(['api', 'web']);
+  });
+
+  it('loads ci-setup files', () => {
+    const pkg = loadPackage(withFileSystem(config, files), 'web', '.');
+    expect(pkg.ciSetup.env).to.deep.equal({NODE_ENV: 'test'});
+  });
+
+  it('validates ci-setup files', async () => {
+    const invalid = memoryFileSystem({
+      'web/package.json': '{}',
+      'web/ci-setup.json': '{"env": {"NODE_ENV": "test"}',
+    });
+    const errors = await validateSetupFiles(withFileSystem(config, invalid));
+    expect(errors.map(error => [error.path, error.kind])).to.deep.equal([
+      ['web/ci-setup.json', 'parse-error'],
+    ]);
+  });
+
+  it('keeps the OS file system in the original config', () => {
+    withFileSystem(config, files);
+    expect(() => loadPackage(config, 'web', '.')).to.throw(
+      'no package file found in: web',
+    );
+  });
+
+  it('reads files', () => {
+    expect(files.readFileSync('/web/package.json', 'utf8')).to.equal('{}');
+    expect(files.existsSync('web/src')).to.be.true;
+    expect(files.existsSync('web/missing')).to.be.false;
+    expect(() => files.readFileSync('web', 'utf8')).to.throw('ENOENT');
+    const entries = files.readdirSync('web', {withFileTypes: true});
+    expect(entries.map(e => [e.name, e.isDirectory()])).to.deep.equal([
+      ['ci-setup.json', false],
+      ['package.json', false],
+      ['src', true],
+    ]);
+  });
+});
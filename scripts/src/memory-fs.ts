@@ -0,0 +1,124 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// In-memory file system, to find packages without writing them to disk,
+// like in tests or from the files of an archive.
+//
+// Directories are implied by the paths of their files, and there are no
+// symlinks, so paths are their own real paths.
+
+import * as path from 'node:path';
+import {toSlash} from './custard.ts';
+import type {DirEntry, FileSystem} from './custard.ts';
+
+/**
+ * Creates a file system with the given files.
+ *
+ * Paths are relative to the root of the file system, and so are the paths
+ * it's called with, so the checkout path is usually `.`.
+ *
+ * @param files contents of each file, by path, like `web/package.json`
+ * @returns file system for `withFileSystem`
+ */
+export function memoryFileSystem(files: {
+  [filePath: string]: string;
+}): FileSystem {
+  const contents = new Map(
+    Object.entries(files).map(([filePath, text]) => [
+      normalize(filePath),
+      text,
+    ]),
+  );
+  const isDir = (dir: string) =>
+    dir === '.' ||
+    [...contents.keys()].some(filePath => filePath.startsWith(`${dir}/`));
+  const notFound = (filePath: string) =>
+    Object.assign(
+      new Error(`ENOENT: no such file or directory, '${filePath}'`),
+      {code: 'ENOENT'},
+    );
+  return {
+    existsSync: filePath => {
+      const key = normalize(filePath);
+      return contents.has(key) || isDir(key);
+    },
+    readFileSync: filePath => {
+      const text = contents.get(normalize(filePath));
+      if (text === undefined) {
+        throw notFound(filePath);
+      }
+      return text;
+    },
+    readdirSync: dir => {
+      const key = normalize(dir);
+      if (!isDir(key)) {
+        throw notFound(dir);
+      }
+      const prefix = key === '.' ? '' : `${key}/`;
+      const entries = new Map<string, boolean>();
+      for (const filePath of contents.keys()) {
+        if (filePath.startsWith(prefix)) {
+          const [name, ...rest] = filePath.slice(prefix.length).split('/');
+          entries.set(name, rest.length > 0 || entries.get(name) === true);
+        }
+      }
+      return [...entries]
+        .sort(([a], [b]) => (a < b ? -1 : 1))
+        .map(([name, isDirectory]) => entry(name, isDirectory));
+    },
+    statSync: filePath => {
+      const key = normalize(filePath);
+      if (contents.has(key)) {
+        return entry(key, false);
+      }
+      return isDir(key) ? entry(key, true) : undefined;
+    },
+    realpathSync: filePath => {
+      const key = normalize(filePath);
+      if (!contents.has(key) && !isDir(key)) {
+        throw notFound(filePath);
+      }
+      return key;
+    },
+  };
+}
+
+/**
+ * Normalizes a path to the keys of the file system.
+ *
+ * @param filePath path, relative to the root or absolute
+ * @returns path like `web/package.json`, or '.' for the root
+ */
+function normalize(filePath: string): string {
+  const normalized = path.posix.normalize(toSlash(filePath));
+  return normalized.replace(/^\/+/, '').replace(/\/+$/, '') || '.';
+}
+
+/**
+ * Creates a directory entry.
+ *
+ * @param name file name
+ * @param isDirectory whether it's a directory
+ * @returns directory entry
+ */
+function entry(name: string, isDirectory: boolean): DirEntry {
+  return {
+    name,
+    isFile: () => !isDirectory,
+    isDirectory: () => isDirectory,
+    isSymbolicLink: () => false,
+  };
+}
@@ -0,0 +1,154 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import {
+  metricLabels,
+  openMetricsSink,
+  pushMetrics,
+  recordMetric,
+  recordStats,
+  takeMetrics,
+} from './metrics.ts';
+
+describe('metrics', () => {
+  const labels = {repo: 'owner/repo', branch: 'main'};
+  let requests: [string, RequestInit | undefined][] = [];
+  const fakeFetch = (async (url: string, init?: RequestInit) => {
+    requests.push([url, init]);
+    return new Response('');
+  }) as unknown as typeof fetch;
+  beforeEach(() => {
+    requests = [];
+    takeMetrics();
+  });
+
+  it('records metrics', () => {
+    recordMetric('affected-packages', 3);
+    recordStats({
+      durations: {walk: 1500, match: 500, 'setup-read': 0, validate: 10},
+      counts: {walk: 1, match: 2, 'setup-read': 0, validate: 1},
+      total: 2100,
+    });
+    expect(takeMetrics()).to.deep.equal({
+      'affected-packages': 3,
+      'discovery-seconds': 2,
+    });
+    expect(takeMetrics()).to.deep.equal({});
+  });
+
+  it('skips the discovery time if nothing was searched', () => {
+    recordStats({durations: {walk: 0}, counts: {walk: 0}, total: 5});
+    expect(takeMetrics()).to.deep.equal({});
+  });
+
+  it('metricLabels', () => {
+    expect(
+      metricLabels({
+        GITHUB_REPOSITORY: 'owner/repo',
+        GITHUB_HEAD_REF: '',
+        GITHUB_REF_NAME: 'main',
+      }),
+    ).to.deep.equal(labels);
+    expect(metricLabels({CI_COMMIT_REF_NAME: 'dev'})).to.deep.equal({
+      repo: 'unknown',
+      branch: 'dev',
+    });
+  });
+
+  it('pushes to a Pushgateway', async () => {
+    recordMetric('affected-packages', 3);
+    recordMetric('cache-hit-rate', 0.5);
+    const sink = openMetricsSink('http://pushgateway:9091/', {
+      fetch: fakeFetch,
+    });
+    await pushMetrics(sink, labels);
+    expect(requests.length).to.equal(1);
+    const [url, init] = requests[0];
+    expect(url).to.equal(
+      'http://pushgateway:9091/metrics/job/custard/repo@base64/b3duZXIvcmVwbw/branch@base64/bWFpbg',
+    );
+    expect(init?.method).to.equal('PUT');
+    expect(init?.body).to.equal(
+      [
+        '# TYPE custard_affected_packages gauge',
+        'custard_affected_packages 3',
+        '# TYPE custard_cache_hit_rate gauge',
+        'custard_cache_hit_rate 0.5',
+        '',
+      ].join('\n'),
+    );
+  });
+
+  it('pushes to Cloud Monitoring', async () => {
+    recordMetric('validation-errors', 2);
+    const sink = openMetricsSink('monitoring://my-project', {
+      fetch: fakeFetch,
+      accessToken: () => 'token',
+    });
+    await pushMetrics(sink, labels);
+    const [url, init] = requests[0];
+    expect(url).to.equal(
+      'https://monitoring.googleapis.com/v3/projects/my-project/timeSeries',
+    );
+    const [series] = JSON.parse(`${init?.body}`).timeSeries;
+    expect(series.metric).to.deep.equal({
+      type: 'custom.googleapis.com/custard/validation_errors',
+      labels,
+    });
+    expect(series.resource).to.deep.equal({
+      type: 'global',
+      labels: {project_id: 'my-project'},
+    });
+    expect(series.points[0].value).to.deep.equal({doubleValue: 2});
+  });
+
+  it('skips pushing without metrics', async () => {
+    await pushMetrics(openMetricsSink('http://p', {fetch: fakeFetch}), labels);
+    expect(requests.length).to.equal(0);
+  });
+
+  it('warns on failures', async () => {
+    recordMetric('affected-packages', 1);
+    const failing = (async () =>
+      new Response('down', {status: 503})) as unknown as typeof fetch;
+    const sink = openMetricsSink('http://p', {fetch: failing});
+    // Metrics are best effort, the run doesn't fail.
+    await pushMetrics(sink, labels);
+  });
+
+  it('custom backends', async () => {
+    recordMetric('affected-packages', 1);
+    const pushed: string[] = [];
+    const sink = openMetricsSink('statsd://localhost', {
+      backends: {
+        'statsd:': location => async metrics => {
+          pushed.push(`${location} ${JSON.stringify(metrics)}`);
+        },
+      },
+    });
+    await pushMetrics(sink, labels);
+    expect(pushed).to.deep.equal([
+      'statsd://localhost {"affected-packages":1}',
+    ]);
+  });
+
+  it('unsupported sink', () => {
+    expect(() => openMetricsSink('statsd://localhost')).to.throw(
+      "unsupported metrics sink 'statsd://localhost', must be one of: http:, https:, monitoring:",
+    );
+  });
+});
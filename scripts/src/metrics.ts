@@ -0,0 +1,287 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Metrics of each run for CI dashboards, like how many packages were
+// affected or how often the results cache skipped a package.
+//
+// Commands record their metrics as they run, and the recorded metrics are
+// pushed once at the end of the run to a metrics sink:
+// - Prometheus, through a Pushgateway.
+// - Cloud Monitoring, as custom metrics.
+//
+// Every metric is labeled with the repository and branch, so dashboards can
+// compare them across repositories.
+
+import {execFileSync} from 'node:child_process';
+import {message} from './log.ts';
+import type {Stats} from './stats.ts';
+
+// Metrics recorded by the commands, by name.
+// - affected-packages: number of affected packages.
+// - discovery-seconds: time spent finding the affected packages.
+// - validation-errors: number of ci-setup validation errors.
+// - cache-hit-rate: ratio of the packages skipped by the results cache.
+export type RunMetrics = {[name: string]: number};
+
+export type MetricLabels = {
+  // Repository, like `owner/repo`.
+  repo: string;
+
+  // Branch the run is for.
+  branch: string;
+};
+
+// Pushes the metrics of a run.
+export type MetricsSink = (
+  metrics: RunMetrics,
+  labels: MetricLabels,
+) => Promise<void>;
+
+export type MetricsOptions = {
+  // Backends for other sink locations, by protocol, like `statsd:`.
+  backends?: {[protocol: string]: MetricsBackend};
+
+  // Dependencies, they can be replaced for testing.
+  fetch?: typeof fetch;
+  accessToken?: () => string;
+};
+
+// Opens a metrics sink from its location, like a Pushgateway URL.
+export type MetricsBackend = (
+  location: string,
+  options: MetricsOptions,
+) => MetricsSink;
+
+// Backends of the metrics sinks, by the protocol of the sink location.
+const metricsBackends: {[protocol: string]: MetricsBackend} = {
+  'http:': pushgatewaySink,
+  'https:': pushgatewaySink,
+  'monitoring:': cloudMonitoringSink,
+};
+
+// Environment variables with the repository and branch of each CI system,
+// in order of preference.
+const labelVariables: {repo: string[]; branch: string[]} = {
+  repo: [
+    'CUSTARD_METRICS_REPO',
+    'GITHUB_REPOSITORY',
+    'CI_PROJECT_PATH',
+    'CIRCLE_PROJECT_REPONAME',
+    'BUILDKITE_PIPELINE_SLUG',
+    'REPO_NAME',
+  ],
+  branch: [
+    'CUSTARD_METRICS_BRANCH',
+    'GITHUB_HEAD_REF',
+    'GITHUB_REF_NAME',
+    'CI_COMMIT_REF_NAME',
+    'CIRCLE_BRANCH',
+    'BUILDKITE_BRANCH',
+    'BRANCH_NAME',
+  ],
+};
+
+let recorded: RunMetrics = {};
+
+/**
+ * Records a metric of the current run, replacing any previous value.
+ *
+ * @param name metric name, like 'affected-packages'
+ * @param value metric value
+ */
+export function recordMetric(name: string, value: number) {
+  recorded[name] = value;
+}
+
+/**
+ * Records the discovery time from the timing stats, if any package was
+ * searched for.
+ *
+ * @param stats stats from `withStats`
+ */
+export function recordStats(stats: Stats) {
+  const phases = ['walk', 'match', 'setup-read'];
+  if (phases.some(phase => stats.counts[phase] > 0)) {
+    const ms = phases.reduce((sum, phase) => sum + stats.durations[phase], 0);
+    recordMetric('discovery-seconds', ms / 1000);
+  }
+}
+
+/**
+ * Gets the metrics recorded so far, and starts recording a new run.
+ *
+ * @returns recorded metrics
+ */
+export function takeMetrics(): RunMetrics {
+  const metrics = recorded;
+  recorded = {};
+  return metrics;
+}
+
+/**
+ * Gets the repository and branch of the run from the CI environment.
+ *
+ * @param env environment variables
+ * @returns labels, 'unknown' if not found
+ */
+export function metricLabels(env = process.env): MetricLabels {
+  const first = (names: string[]) =>
+    names.map(name => env[name]).find(value => value) || 'unknown';
+  return {
+    repo: first(labelVariables.repo),
+    branch: first(labelVariables.branch),
+  };
+}
+
+/**
+ * Opens a metrics sink.
+ *
+ * @param location Pushgateway URL, or monitoring://PROJECT_ID
+ * @param options backends for other locations, and dependencies for testing
+ * @returns metrics sink
+ */
+export function openMetricsSink(
+  location: string,
+  options: MetricsOptions = {},
+): MetricsSink {
+  const backends = {...metricsBackends, ...options.backends};
+  const protocol = location.match(/^([a-z][a-z0-9+.-]*:)\/\//)?.[1];
+  const backend = protocol === undefined ? undefined : backends[protocol];
+  if (!backend) {
+    throw new Error(
+      message(
+        'E043',
+        `unsupported metrics sink '${location}', must be one of: ${Object.keys(backends).join(', ')}`,
+      ),
+    );
+  }
+  return backend(location, options);
+}
+
+/**
+ * Pushes the recorded metrics, if any.
+ *
+ * Metrics are best effort, so a failed push is logged as a warning
+ * instead of failing the run.
+ *
+ * @param sink where to push the metrics
+ * @param labels repository and branch of the run
+ */
+export async function pushMetrics(sink: MetricsSink, labels: MetricLabels) {
+  const metrics = takeMetrics();
+  if (Object.keys(metrics).length === 0) {
+    return;
+  }
+  try {
+    await sink(metrics, labels);
+  } catch (e) {
+    console.error(message('W014', `Pushing metrics failed: ${e}`));
+  }
+}
+
+/**
+ * Opens a sink that pushes to a Prometheus Pushgateway.
+ *
+ * Metrics are gauges named like `custard_affected_packages`, grouped by
+ * repository and branch, so each push replaces the previous run's.
+ *
+ * @param location Pushgateway URL, like http://pushgateway:9091
+ * @param options dependencies, for testing
+ * @returns metrics sink
+ */
+function pushgatewaySink(
+  location: string,
+  options: MetricsOptions,
+): MetricsSink {
+  const fetchFn = options.fetch ?? fetch;
+  return async (metrics, labels) => {
+    // Base64 label values can have slashes, like in `owner/repo`.
+    const group = Object.entries(labels)
+      .map(
+        ([name, value]) =>
+          `${name}@base64/${Buffer.from(value).toString('base64url')}`,
+      )
+      .join('/');
+    const url = `${location.replace(/\/$/, '')}/metrics/job/custard/${group}`;
+    const body = Object.entries(metrics)
+      .map(([name, value]) => {
+        const metric = `custard_${name.replaceAll('-', '_')}`;
+        return `# TYPE ${metric} gauge\n${metric} ${value}\n`;
+      })
+      .join('');
+    const response = await fetchFn(url, {
+      method: 'PUT',
+      headers: {'content-type': 'text/plain; version=0.0.4'},
+      body,
+    });
+    if (!response.ok) {
+      throw new Error(`${url}: ${response.status} ${await response.text()}`);
+    }
+  };
+}
+
+/**
+ * Opens a sink that writes Cloud Monitoring custom metrics.
+ *
+ * Metrics are gauges named like `custard/affected_packages` under
+ * `custom.googleapis.com`, on the global resource of the project.
+ *
+ * @param location monitoring://PROJECT_ID
+ * @param options dependencies, for testing
+ * @returns metrics sink
+ */
+function cloudMonitoringSink(
+  location: string,
+  options: MetricsOptions,
+): MetricsSink {
+  const fetchFn = options.fetch ?? fetch;
+  const accessToken = options.accessToken ?? gcloudAccessToken;
+  const project = location.replace(/^monitoring:\/\//, '').replace(/\/$/, '');
+  return async (metrics, labels) => {
+    const endTime = new Date().toISOString();
+    const timeSeries = Object.entries(metrics).map(([name, value]) => ({
+      metric: {
+        type: `custom.googleapis.com/custard/${name.replaceAll('-', '_')}`,
+        labels,
+      },
+      resource: {type: 'global', labels: {project_id: project}},
+      points: [{interval: {endTime}, value: {doubleValue: value}}],
+    }));
+    const url = `https://monitoring.googleapis.com/v3/projects/${project}/timeSeries`;
+    const response = await fetchFn(url, {
+      method: 'POST',
+      headers: {
+        authorization: `Bearer ${accessToken()}`,
+        'content-type': 'application/json',
+      },
+      body: JSON.stringify({timeSeries}),
+    });
+    if (!response.ok) {
+      throw new Error(`${url}: ${response.status} ${await response.text()}`);
+    }
+  };
+}
+
+/**
+ * Gets an access token for Google Cloud APIs from the `gcloud` credentials.
+ *
+ * @returns OAuth access token
+ */
+function gcloudAccessToken(): string {
+  return execFileSync('gcloud', ['auth', 'print-access-token'], {
+    encoding: 'utf8',
+  }).trim();
+}
@@ -0,0 +1,233 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {allPackages} from './custard.ts';
+import type {Config} from './custard.ts';
+import {
+  circleciContinuation,
+  generatePipeline,
+  gitlabPipeline,
+  pipelineJobs,
+} from './pipelines.ts';
+import type {PipelineJob} from './pipelines.ts';
+
+describe('pipelines', () => {
+  const config: Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {
+      'test-command': null,
+      image: 'node:22',
+      timeout: null,
+      env: {NODE_ENV: 'test'},
+    },
+  };
+  const checkoutPath = testing.materialize({
+    'apps/web/package.json': '{}',
+    'apps/web/ci-setup.json': JSON.stringify({
+      'test-command': ['npm ci', 'npm test'],
+      timeout: '90s',
+      secrets: {TOKEN: 'projects/p/secrets/token'},
+    }),
+    'api/package.json': '{}',
+    'api/ci-setup.json': JSON.stringify({
+      'test-command': 'go test ./...',
+      image: 'golang:1.24',
+      env: {CGO_ENABLED: '0'},
+    }),
+    'docs/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const packages = ['apps/web', 'api', 'docs'];
+
+  it('pipelineJobs', () => {
+    expect(pipelineJobs(config, packages, checkoutPath)).to.deep.equal([
+      {
+        package: 'apps/web',
+        steps: ['npm ci', 'npm test'],
+        env: {NODE_ENV: 'test'},
+        image: 'node:22',
+        timeout: 90000,
+      },
+      {
+        package: 'api',
+        steps: ['go test ./...'],
+        env: {NODE_ENV: 'test', CGO_ENABLED: '0'},
+        image: 'golang:1.24',
+        timeout: null,
+      },
+    ]);
+  });
+
+  it('pipelineJobs for all packages', () => {
+    const jobs = pipelineJobs(config, [allPackages], checkoutPath);
+    expect(jobs.map(job => job.package)).to.deep.equal(['api', 'apps/web']);
+  });
+
+  it('gitlab', () => {
+    const pipeline = generatePipeline('gitlab', config, packages, checkoutPath);
+    expect(pipeline).to.deep.equal({
+      'apps/web': {
+        image: 'node:22',
+        variables: {NODE_ENV: 'test'},
+        script: ['cd apps/web', 'npm ci', 'npm test'],
+        timeout: '2 minutes',
+      },
+      api: {
+        image: 'golang:1.24',
+        variables: {NODE_ENV: 'test', CGO_ENABLED: '0'},
+        script: ['cd api', 'go test ./...'],
+      },
+    });
+  });
+
+  it('gitlab reserved keys', () => {
+    const jobs = ['pages', '.github', 'web'].map(pkg => ({
+      package: pkg,
+      steps: ['make'],
+      env: {},
+      image: 'debian',
+      timeout: null,
+    }));
+    expect(Object.keys(gitlabPipeline(jobs))).to.deep.equal([
+      'custard:pages',
+      'custard:.github',
+      'web',
+    ]);
+  });
+
+  it('gitlab without packages', () => {
+    const pipeline = generatePipeline('gitlab', config, ['docs'], checkoutPath);
+    expect(Object.keys(pipeline)).to.deep.equal(['no-affected-packages']);
+  });
+
+  it('circleci', () => {
+    const options = {continuationKey: 'key'};
+    const payload = generatePipeline(
+      'circleci',
+      config,
+      packages,
+      checkoutPath,
+      options,
+    );
+    expect(payload['continuation-key']).to.equal('key');
+    const configuration = JSON.parse(payload.configuration);
+    expect(configuration.workflows).to.deep.equal({
+      custard: {jobs: ['apps-web', 'api']},
+    });
+    expect(configuration.jobs['apps-web']).to.deep.equal({
+      docker: [{image: 'node:22'}],
+      environment: {NODE_ENV: 'test'},
+      steps: [
+        'checkout',
+        {
+          run: {
+            name: 'apps/web: npm ci',
+            command: 'npm ci',
+            working_directory: 'apps/web',
+            no_output_timeout: '2m',
+          },
+        },
+        {
+          run: {
+            name: 'apps/web: npm test',
+            command: 'npm test',
+            working_directory: 'apps/web',
+            no_output_timeout: '2m',
+          },
+        },
+      ],
+    });
+  });
+
+  it('circleci job names are unique', () => {
+    const job = {steps: ['make'], env: {}, image: 'gcc', timeout: null};
+    const jobs = [
+      {...job, package: 'a/b'},
+      {...job, package: 'a-b'},
+    ];
+    const {configuration} = circleciContinuation(jobs);
+    expect(Object.keys(JSON.parse(configuration).jobs)).to.deep.equal([
+      'a-b',
+      'a-b-2',
+    ]);
+  });
+
+  it('circleci without packages', () => {
+    const payload = generatePipeline('circleci', config, [], checkoutPath);
+    const configuration = JSON.parse(payload.configuration);
+    expect(configuration.workflows.custard.jobs).to.deep.equal([
+      'no-affected-packages',
+    ]);
+  });
+
+  it('buildkite', () => {
+    const pipeline = generatePipeline(
+      'buildkite',
+      config,
+      packages,
+      checkoutPath,
+    );
+    expect(pipeline.steps).to.deep.equal([
+      {
+        label: 'apps/web',
+        key: 'apps-web',
+        command: ['cd apps/web', 'npm ci', 'npm test'],
+        env: {NODE_ENV: 'test'},
+        plugins: [{'docker#v5.12.0': {image: 'node:22'}}],
+        timeout_in_minutes: 2,
+      },
+      {
+        label: 'api',
+        key: 'api',
+        command: ['cd api', 'go test ./...'],
+        env: {NODE_ENV: 'test', CGO_ENABLED: '0'},
+        plugins: [{'docker#v5.12.0': {image: 'golang:1.24'}}],
+      },
+    ]);
+  });
+
+  it('buildkite without packages', () => {
+    const pipeline = generatePipeline('buildkite', config, [], checkoutPath);
+    expect(pipeline.steps.length).to.equal(1);
+    expect(pipeline.steps[0].label).to.equal('No affected packages');
+  });
+
+  it('custom generator', () => {
+    const options = {
+      generators: {
+        jenkins: (jobs: PipelineJob[]) => jobs.map(job => job.package),
+      },
+    };
+    const pipeline = generatePipeline(
+      'jenkins',
+      config,
+      ['apps/web'],
+      checkoutPath,
+      options,
+    );
+    expect(pipeline).to.deep.equal(['apps/web']);
+  });
+
+  it('unknown generator', () => {
+    expect(() =>
+      generatePipeline('jenkins', config, [], checkoutPath),
+    ).to.throw(
+      "unknown pipeline generator 'jenkins', must be one of: gitlab, circleci, buildkite",
+    );
+  });
+});
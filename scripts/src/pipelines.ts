@@ -0,0 +1,327 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Dynamic CI config generation, a job for each affected package that runs
+// its ci-setup command:
+// - GitLab, a child pipeline to trigger from the parent pipeline.
+// - CircleCI, a continuation payload for the setup workflow.
+// - Buildkite, steps for `buildkite-agent pipeline upload`.
+//
+// The generated configs are JSON, which is also valid YAML.
+// Secrets are never written to the configs, the jobs get them from the CI.
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+
+import {expandAllPackages, loadPackage, parseDuration} from './custard.ts';
+import type {Config} from './custard.ts';
+import {message} from './log.ts';
+
+export type PipelineOptions = {
+  // The ci-setup field with the command to run, defaults to 'test-command'.
+  field?: string;
+
+  // Image to run the jobs in when the ci-setup has no `image`.
+  image?: string;
+
+  // CircleCI continuation key, defaults to CIRCLE_CONTINUATION_KEY.
+  continuationKey?: string;
+
+  // Generators for other CI systems, by name.
+  generators?: {[name: string]: PipelineGenerator};
+};
+
+// A package job, from its resolved ci-setup.
+export type PipelineJob = {
+  // Package path, relative to the checkout path.
+  package: string;
+
+  // Commands to run in the package directory, in order.
+  steps: string[];
+
+  // Environment variables from the ci-setup `env`.
+  env: {[name: string]: string};
+
+  // Image from the ci-setup `image`, or the default image.
+  image: string;
+
+  // Timeout from the ci-setup `timeout`, in milliseconds, if any.
+  timeout: number | null;
+};
+
+// Creates the CI config to run the package jobs.
+// An empty list of jobs still needs a valid config, since the CI systems
+// reject empty pipelines.
+export type PipelineGenerator = (
+  jobs: PipelineJob[],
+  options: PipelineOptions,
+) => any;
+
+// Generators for the `pipeline` command, by CI system.
+export const pipelineGenerators: Readonly<{
+  [name: string]: PipelineGenerator;
+}> = {
+  gitlab: gitlabPipeline,
+  circleci: circleciContinuation,
+  buildkite: buildkitePipeline,
+};
+
+// Image for the jobs when neither the ci-setup nor the options set one.
+const defaultImage = 'ubuntu:24.04';
+
+// Buildkite plugin to run the steps in the job image.
+const buildkiteDockerPlugin = 'docker#v5.12.0';
+
+/**
+ * Generates a dynamic CI config to run the given packages.
+ *
+ * Packages without a command are skipped.
+ *
+ * @param name CI system, one of the `pipelineGenerators` or the options'
+ *   `generators`
+ * @param config config object
+ * @param packages package paths, relative to the checkout path, or the all
+ *   packages marker
+ * @param checkoutPath path to the repository checkout
+ * @param options how to create the jobs
+ * @returns CI config, or payload for CircleCI
+ */
+export function generatePipeline(
+  name: string,
+  config: Config,
+  packages: string[],
+  checkoutPath = '.',
+  options: PipelineOptions = {},
+): any {
+  const generators = {...pipelineGenerators, ...options.generators};
+  const generator = generators[name];
+  if (!generator) {
+    throw new Error(
+      message(
+        'E039',
+        `unknown pipeline generator '${name}', must be one of: ${Object.keys(generators).join(', ')}`,
+      ),
+    );
+  }
+  return generator(
+    pipelineJobs(config, packages, checkoutPath, options),
+    options,
+  );
+}
+
+/**
+ * Gets the jobs of the packages from their resolved ci-setup.
+ *
+ * @param config config object
+ * @param packages package paths, relative to the checkout path, or the all
+ *   packages marker
+ * @param checkoutPath path to the repository checkout
+ * @param options how to create the jobs
+ * @returns a job for each package with a command
+ */
+export function pipelineJobs(
+  config: Config,
+  packages: string[],
+  checkoutPath = '.',
+  options: PipelineOptions = {},
+): PipelineJob[] {
+  const field = options.field ?? 'test-command';
+  const jobs: PipelineJob[] = [];
+  for (const pkg of expandAllPackages(config, packages, checkoutPath)) {
+    const {ciSetup} = loadPackage(config, pkg, checkoutPath);
+    const command = ciSetup[field];
+    if (!command || command.length === 0) {
+      continue;
+    }
+    jobs.push({
+      package: pkg,
+      steps: Array.isArray(command) ? command : [command],
+      env: {...ciSetup.env},
+      image: ciSetup.image || options.image || defaultImage,
+      timeout: ciSetup.timeout ? parseDuration(ciSetup.timeout) : null,
+    });
+  }
+  return jobs;
+}
+
+// Top-level keys of a GitLab CI config that are not jobs, and `pages`,
+// which deploys GitLab Pages.
+const gitlabReservedKeys = [
+  'after_script',
+  'before_script',
+  'cache',
+  'default',
+  'image',
+  'include',
+  'pages',
+  'services',
+  'stages',
+  'types',
+  'variables',
+  'workflow',
+];
+
+/**
+ * Creates a GitLab child pipeline, with a job for each package.
+ *
+ * Jobs are named after the package path, and run in parallel.
+ * Paths that are reserved keys, or that start with a dot, which hides the
+ * job, get a `custard:` prefix, like `custard:pages`.
+ *
+ * @param jobs package jobs
+ * @returns GitLab CI config
+ */
+export function gitlabPipeline(jobs: PipelineJob[]): any {
+  if (jobs.length === 0) {
+    return {
+      'no-affected-packages': {script: ['echo "No affected packages."']},
+    };
+  }
+  const pipeline: any = {};
+  for (const job of jobs) {
+    const name =
+      gitlabReservedKeys.includes(job.package) || job.package.startsWith('.')
+        ? `custard:${job.package}`
+        : job.package;
+    pipeline[name] = {
+      image: job.image,
+      variables: job.env,
+      script: [`cd ${shellQuote(job.package)}`, ...job.steps],
+      ...(job.timeout === null
+        ? {}
+        : {timeout: `${Math.ceil(job.timeout / 60000)} minutes`}),
+    };
+  }
+  return pipeline;
+}
+
+/**
+ * Creates a CircleCI continuation payload, with a job for each package.
+ *
+ * Job names only have letters, digits, and dashes, so they are derived
+ * from the package path, and the run steps are named after it.
+ *
+ * @param jobs package jobs
+ * @param options continuation key
+ * @returns payload for the CircleCI continuation API
+ */
+export function circleciContinuation(
+  jobs: PipelineJob[],
+  options: PipelineOptions = {},
+): any {
+  const jobName = jobNamer();
+  const circleJobs: any = {};
+  for (const job of jobs) {
+    circleJobs[jobName(job.package)] = {
+      docker: [{image: job.image}],
+      environment: job.env,
+      steps: [
+        'checkout',
+        ...job.steps.map(step => ({
+          run: {
+            name: `${job.package}: ${step}`,
+            command: step,
+            working_directory: job.package,
+            ...(job.timeout === null
+              ? {}
+              : {no_output_timeout: `${Math.ceil(job.timeout / 60000)}m`}),
+          },
+        })),
+      ],
+    };
+  }
+  if (jobs.length === 0) {
+    circleJobs['no-affected-packages'] = {
+      docker: [{image: options.image || defaultImage}],
+      steps: [{run: 'echo "No affected packages."'}],
+    };
+  }
+  const configuration = {
+    version: 2.1,
+    jobs: circleJobs,
+    workflows: {custard: {jobs: Object.keys(circleJobs)}},
+  };
+  return {
+    'continuation-key':
+      options.continuationKey ?? process.env.CIRCLE_CONTINUATION_KEY ?? '',
+    configuration: JSON.stringify(configuration),
+  };
+}
+
+/**
+ * Creates a Buildkite pipeline, with a command step for each package.
+ *
+ * Steps run in parallel in the job image with the Docker plugin, and their
+ * keys are derived from the package path, like CircleCI job names.
+ *
+ * @param jobs package jobs
+ * @returns Buildkite pipeline
+ */
+export function buildkitePipeline(jobs: PipelineJob[]): any {
+  if (jobs.length === 0) {
+    return {
+      steps: [
+        {
+          label: 'No affected packages',
+          command: 'echo "No affected packages."',
+        },
+      ],
+    };
+  }
+  const jobName = jobNamer();
+  return {
+    steps: jobs.map(job => ({
+      label: job.package,
+      key: jobName(job.package),
+      command: [`cd ${shellQuote(job.package)}`, ...job.steps],
+      env: job.env,
+      plugins: [{[buildkiteDockerPlugin]: {image: job.image}}],
+      ...(job.timeout === null
+        ? {}
+        : {timeout_in_minutes: Math.ceil(job.timeout / 60000)}),
+    })),
+  };
+}
+
+/**
+ * Creates a function that derives unique job names from package paths,
+ * with only letters, digits, and dashes.
+ *
+ * @returns function from a package path to its job name
+ */
+function jobNamer(): (pkg: string) => string {
+  const names = new Set<string>();
+  return pkg => {
+    const base = pkg.replace(/[^A-Za-z0-9]+/g, '-').replace(/^-|-$/g, '');
+    let name = base || 'root';
+    for (let i = 2; names.has(name); i++) {
+      name = `${base}-${i}`;
+    }
+    names.add(name);
+    return name;
+  };
+}
+
+/**
+ * Quotes a path for a shell command, if it needs it.
+ *
+ * @param text path to quote
+ * @returns path to use in a shell command
+ */
+function shellQuote(text: string): string {
+  return /^[\w@%+=:,./-]+$/.test(text)
+    ? text
+    : `'${text.replaceAll("'", "'\\''")}'`;
+}
@@ -0,0 +1,104 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {commentBody, commentMarker, upsertComment} from './pr-comment.ts';
+
+/**
+ * Creates a fake GitHub client with the given existing comments.
+ *
+ * @param comments existing pull request comments
+ * @returns fake client, and the list of write requests made to it
+ */
+function fakeClient(comments: {id: number; body: string}[]) {
+  const {client, calls} = testing.fakeGitHubClient({id: 99}, comments);
+  const writes = () => calls.filter(call => call.method !== 'GET');
+  return {client, writes};
+}
+
+describe('pr comment', () => {
+  const packages = [{path: 'a', reasons: ['a/x.js changed']}];
+
+  it('comment body', () => {
+    const body = commentBody(packages, ["'match' must be string"]);
+    expect(body.split('\n')).to.deep.equal([
+      commentMarker,
+      '## 🍮 Affected packages',
+      '',
+      '| Package | Reasons |',
+      '| --- | --- |',
+      '| `a` | a/x.js changed |',
+      '',
+      '### ❌ Validation errors',
+      '',
+      "- 'match' must be string",
+      '',
+    ]);
+  });
+
+  it('comment body in plain log style', () => {
+    const style = process.env.CUSTARD_LOG_STYLE;
+    process.env.CUSTARD_LOG_STYLE = 'plain';
+    try {
+      const body = commentBody(packages, ["'match' must be string"]);
+      expect(body).to.include('### ERROR CUSTARD-E058: Validation errors');
+    } finally {
+      if (style === undefined) {
+        delete process.env.CUSTARD_LOG_STYLE;
+      } else {
+        process.env.CUSTARD_LOG_STYLE = style;
+      }
+    }
+  });
+
+  it('creates a comment', async () => {
+    const {client, writes} = fakeClient([{id: 1, body: 'LGTM'}]);
+    const body = commentBody(packages);
+    const result = await upsertComment(client, 'o/r', 7, body);
+    expect(result).to.deep.equal({id: 99, action: 'created'});
+    expect(writes()).to.deep.equal([
+      {method: 'POST', path: '/repos/o/r/issues/7/comments', body: {body}},
+    ]);
+  });
+
+  it('updates the existing comment', async () => {
+    const {client, writes} = fakeClient([
+      {id: 1, body: 'LGTM'},
+      {id: 2, body: `${commentMarker}\nold`},
+    ]);
+    const body = commentBody(packages);
+    const result = await upsertComment(client, 'o/r', 7, body);
+    expect(result).to.deep.equal({id: 2, action: 'updated'});
+    expect(writes()).to.deep.equal([
+      {method: 'PATCH', path: '/repos/o/r/issues/comments/2', body: {body}},
+    ]);
+  });
+
+  it('leaves an unchanged comment alone', async () => {
+    const body = commentBody(packages);
+    const {client, writes} = fakeClient([{id: 2, body}]);
+    const result = await upsertComment(client, 'o/r', 7, body);
+    expect(result).to.deep.equal({id: 2, action: 'unchanged'});
+    expect(writes()).to.deep.equal([]);
+  });
+
+  it('adds the marker to custom bodies', async () => {
+    const {client, writes} = fakeClient([]);
+    await upsertComment(client, 'o/r', 7, 'custom');
+    expect(writes()[0].body).to.deep.equal({body: `${commentMarker}\ncustom`});
+  });
+});
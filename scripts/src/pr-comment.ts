@@ -0,0 +1,99 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Pull request comment with the affected packages, so reviewers can see
+// what CI is going to test without digging through the logs.
+//
+// There is a single comment per pull request, identified by a hidden
+// marker, and it's updated in place on every push.
+
+import type {AffectedPackage} from './custard.ts';
+import type {GitHubClient} from './github.ts';
+import {stepSummary} from './github-actions.ts';
+import {message} from './log.ts';
+
+// Hidden marker to find the comment again, it's not rendered.
+export const commentMarker = '<!-- custard:affected-packages -->';
+
+export type CommentResult = {
+  // Comment ID.
+  id: number;
+
+  // What was done: created, updated, or unchanged.
+  action: 'created' | 'updated' | 'unchanged';
+};
+
+/**
+ * Creates the comment body for the affected packages.
+ *
+ * @param packages affected packages with their reasons
+ * @param errors config and ci-setup validation errors
+ * @returns comment markdown
+ */
+export function commentBody(
+  packages: AffectedPackage[],
+  errors: string[] = [],
+): string {
+  const lines = [commentMarker, stepSummary(packages)];
+  if (errors.length > 0) {
+    lines.push(`### ${message('E058', 'Validation errors')}`, '');
+    lines.push(...errors.map(error => `- ${error}`), '');
+  }
+  return lines.join('\n');
+}
+
+/**
+ * Creates or updates the Custard comment on a pull request.
+ *
+ * The comment is only updated if its body changed, so re-runs don't
+ * notify reviewers again.
+ *
+ * @param client GitHub client
+ * @param repo repository, like owner/name
+ * @param pullNumber pull request number
+ * @param body comment markdown, must include the comment marker
+ * @returns comment ID and what was done
+ */
+export async function upsertComment(
+  client: GitHubClient,
+  repo: string,
+  pullNumber: number,
+  body: string,
+): Promise<CommentResult> {
+  if (!body.includes(commentMarker)) {
+    body = `${commentMarker}\n${body}`;
+  }
+  const comments = client.paginate(
+    `/repos/${repo}/issues/${pullNumber}/comments`,
+  );
+  for await (const comment of comments) {
+    if (!comment.body?.includes(commentMarker)) {
+      continue;
+    }
+    if (comment.body === body) {
+      return {id: comment.id, action: 'unchanged'};
+    }
+    const commentPath = `/repos/${repo}/issues/comments/${comment.id}`;
+    await client.request('PATCH', commentPath, {body});
+    return {id: comment.id, action: 'updated'};
+  }
+  const comment = await client.request(
+    'POST',
+    `/repos/${repo}/issues/${pullNumber}/comments`,
+    {body},
+  );
+  return {id: comment.id, action: 'created'};
+}
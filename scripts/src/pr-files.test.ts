@@ -0,0 +1,105 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import type {Config} from './custard.ts';
+import {githubClient} from './github.ts';
+import {affectedPullRequest, pullRequestFiles} from './pr-files.ts';
+
+/**
+ * Creates a fake GitHub client for a pull request.
+ *
+ * @param changedFiles number of changed files of the pull request
+ * @param files changed files listed by the API
+ * @returns fake client, and a function that returns the paths requested
+ */
+function fakeClient(changedFiles: number, files: any[]) {
+  const {client, calls} = testing.fakeGitHubClient(
+    {changed_files: changedFiles},
+    files,
+  );
+  return {client, paths: () => calls.map(call => call.path)};
+}
+
+describe('pr files', () => {
+  it('lists the changed files', async () => {
+    const {client, paths} = fakeClient(3, [
+      {filename: 'a/x.js'},
+      {filename: 'b/y.js', previous_filename: 'a/y.js'},
+    ]);
+    const files = await pullRequestFiles(client, 'owner/repo', 7);
+    expect(files).to.deep.equal(['a/x.js', 'a/y.js', 'b/y.js']);
+    expect(paths()).to.deep.equal([
+      '/repos/owner/repo/pulls/7',
+      '/repos/owner/repo/pulls/7/files?per_page=100',
+    ]);
+  });
+
+  it('follows the pagination', async () => {
+    const page = (names: string[], next?: string) =>
+      new Response(JSON.stringify(names.map(filename => ({filename}))), {
+        headers: next ? {link: `<${next}>; rel="next"`} : {},
+      });
+    const responses = [
+      new Response(JSON.stringify({changed_files: 3})),
+      page(['a.js', 'b.js'], 'https://api.github.com/next'),
+      page(['c.js']),
+    ];
+    const fetch = async () => responses.shift() as Response;
+    const client = githubClient({
+      fetch: fetch as unknown as typeof globalThis.fetch,
+    });
+    const files = await pullRequestFiles(client, 'owner/repo', 7);
+    expect(files).to.deep.equal(['a.js', 'b.js', 'c.js']);
+  });
+
+  it('too many files', async () => {
+    const {client} = fakeClient(3001, []);
+    let error = '';
+    try {
+      await pullRequestFiles(client, 'owner/repo', 7);
+    } catch (e) {
+      error = `${e}`;
+    }
+    expect(error).to.contain('changed 3001 files');
+  });
+
+  it('affected packages', async () => {
+    const config: Config = {'package-file': 'package.json'};
+    const checkoutPath = testing.materialize({
+      'a/package.json': '{}',
+      'b/package.json': '{}',
+    });
+    try {
+      const {client} = fakeClient(1, [{filename: 'b/index.js'}]);
+      const packages = await affectedPullRequest(
+        config,
+        client,
+        'owner/repo',
+        7,
+        checkoutPath,
+      );
+      expect(packages).to.deep.equal([
+        {path: 'b', reasons: ['b/index.js changed']},
+      ]);
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+  });
+});
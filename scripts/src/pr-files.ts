@@ -0,0 +1,86 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Changed files of a pull request from the GitHub API, so shallow clones
+// without the base commit still get the affected packages right.
+
+import {affectedDetailed} from './custard.ts';
+import type {AffectedPackage, Config} from './custard.ts';
+import type {GitHubClient} from './github.ts';
+import {message} from './log.ts';
+
+// The API lists at most this many files of a pull request.
+export const maxListedFiles = 3000;
+
+/**
+ * Lists the files changed in a pull request, following the pagination.
+ *
+ * Renamed files list both the old and the new path, so both the old and
+ * the new packages are affected, like `git diff --no-renames`.
+ *
+ * @param client GitHub client
+ * @param repo repository, like owner/name
+ * @param pullNumber pull request number
+ * @returns changed file paths, relative to the repository root
+ */
+export async function pullRequestFiles(
+  client: GitHubClient,
+  repo: string,
+  pullNumber: number,
+): Promise<string[]> {
+  const pullPath = `/repos/${repo}/pulls/${pullNumber}`;
+  const pull = await client.request('GET', pullPath);
+  if (pull.changed_files > maxListedFiles) {
+    // A partial list would miss affected packages, use git instead.
+    throw new Error(
+      message(
+        'E034',
+        `pull request ${repo}#${pullNumber} changed ${pull.changed_files} files, the GitHub API only lists ${maxListedFiles}, get the diffs with git instead`,
+      ),
+    );
+  }
+  const files = new Set<string>();
+  const pages = client.paginate(`${pullPath}/files?per_page=100`);
+  for await (const file of pages) {
+    if (file.previous_filename) {
+      files.add(file.previous_filename);
+    }
+    files.add(file.filename);
+  }
+  return [...files];
+}
+
+/**
+ * Finds the affected packages of a pull request, with the changed files
+ * from the GitHub API.
+ *
+ * @param config config object
+ * @param client GitHub client
+ * @param repo repository, like owner/name
+ * @param pullNumber pull request number
+ * @param checkoutPath path to the repository checkout
+ * @returns affected packages with their reasons
+ */
+export async function affectedPullRequest(
+  config: Config,
+  client: GitHubClient,
+  repo: string,
+  pullNumber: number,
+  checkoutPath = '.',
+): Promise<AffectedPackage[]> {
+  const diffs = await pullRequestFiles(client, repo, pullNumber);
+  return affectedDetailed(config, diffs, checkoutPath);
+}
@@ -0,0 +1,134 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as path from 'node:path';
+import {junitReport, sarifReport, setupErrorsReport} from './reports.ts';
+import type {SetupError} from './custard.ts';
+
+const checkoutPath = path.join('repo');
+const errors: SetupError[] = [
+  {
+    path: path.join('repo', 'a', 'ci-setup.json'),
+    field: 'archived',
+    kind: 'invalid-type',
+    message: '\'archived\' must be boolean, got: "yes"',
+    line: 3,
+    column: 5,
+  },
+  {
+    path: path.join('repo', 'b', 'ci-setup.json'),
+    field: null,
+    kind: 'parse-error',
+    message: 'invalid JSON: <eof>',
+    line: null,
+    column: null,
+  },
+];
+
+const warning: SetupError = {
+  path: path.join('repo', 'c', 'ci-setup.json'),
+  field: 'node-image',
+  kind: 'deprecated-field',
+  message: "'node-image' is deprecated, use 'node-version' instead",
+  line: 2,
+  column: 3,
+};
+
+describe('setupErrorsReport', () => {
+  it('text', () => {
+    expect(setupErrorsReport('text', errors)).to.equal(
+      [
+        `${errors[0].path}:3:5: 'archived' must be boolean, got: "yes"`,
+        `${errors[1].path}: invalid JSON: <eof>`,
+      ].join('\n'),
+    );
+  });
+});
+
+describe('junitReport', () => {
+  it('a test case per file', () => {
+    expect(junitReport(errors, checkoutPath)).to.equal(
+      [
+        '<?xml version="1.0" encoding="UTF-8"?>',
+        '<testsuites tests="2" failures="2">',
+        '  <testsuite name="custard validate" tests="2" failures="2">',
+        '    <testcase classname="ci-setup" name="a/ci-setup.json">',
+        '      <failure type="invalid-type" message="&apos;archived&apos; must be boolean, got: &quot;yes&quot;">a/ci-setup.json:3:5: &apos;archived&apos; must be boolean, got: &quot;yes&quot;</failure>',
+        '    </testcase>',
+        '    <testcase classname="ci-setup" name="b/ci-setup.json">',
+        '      <failure type="parse-error" message="invalid JSON: &lt;eof&gt;">b/ci-setup.json: invalid JSON: &lt;eof&gt;</failure>',
+        '    </testcase>',
+        '  </testsuite>',
+        '</testsuites>',
+        '',
+      ].join('\n'),
+    );
+  });
+
+  it('no warnings', () => {
+    expect(junitReport([warning], checkoutPath)).to.contain(
+      '<testcase classname="ci-setup" name="ci-setup files"/>',
+    );
+  });
+
+  it('no errors', () => {
+    expect(junitReport([])).to.contain(
+      '<testcase classname="ci-setup" name="ci-setup files"/>',
+    );
+  });
+});
+
+describe('sarifReport', () => {
+  it('results with locations', () => {
+    const sarif = sarifReport(errors, checkoutPath);
+    expect(sarif.version).to.equal('2.1.0');
+    const run = sarif.runs[0];
+    expect(run.tool.driver.rules.map(rule => rule.id)).to.deep.equal([
+      'invalid-type',
+      'parse-error',
+    ]);
+    expect(run.results).to.deep.equal([
+      {
+        ruleId: 'invalid-type',
+        level: 'error',
+        message: {text: '\'archived\' must be boolean, got: "yes"'},
+        locations: [
+          {
+            physicalLocation: {
+              artifactLocation: {uri: 'a/ci-setup.json'},
+              region: {startLine: 3, startColumn: 5},
+            },
+          },
+        ],
+      },
+      {
+        ruleId: 'parse-error',
+        level: 'error',
+        message: {text: 'invalid JSON: <eof>'},
+        locations: [
+          {physicalLocation: {artifactLocation: {uri: 'b/ci-setup.json'}}},
+        ],
+      },
+    ]);
+  });
+
+  it('warnings', () => {
+    const [result] = sarifReport([warning], checkoutPath).runs[0].results;
+    expect(result.ruleId).to.equal('deprecated-field');
+    expect(result.level).to.equal('warning');
+  });
+});
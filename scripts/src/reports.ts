@@ -0,0 +1,204 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Reports of the ci-setup validation errors for CI systems:
+// - JUnit XML, so CI shows each invalid file as a failed test.
+// - SARIF, so GitHub code scanning annotates the lines of the invalid fields.
+
+import * as path from 'node:path';
+import {toSlash, version} from './custard.ts';
+import type {SetupError} from './custard.ts';
+
+// Formats of the `validate` command reports, see `setupErrorsReport`.
+export const reportFormats = ['text', 'junit', 'sarif'];
+
+/**
+ * Formats the validation errors in one of the report formats.
+ *
+ * @param format one of: text, junit, sarif
+ * @param errors validation errors
+ * @param checkoutPath path to the repository checkout, paths are relative to it
+ * @returns report
+ */
+export function setupErrorsReport(
+  format: string,
+  errors: SetupError[],
+  checkoutPath = '.',
+): string {
+  switch (format) {
+    case 'junit':
+      return junitReport(errors, checkoutPath);
+    case 'sarif':
+      return JSON.stringify(sarifReport(errors, checkoutPath), null, 2);
+    default:
+      return errors
+        .map(error => `${error.path}${position(error)}: ${error.message}`)
+        .join('\n');
+  }
+}
+
+/**
+ * Creates a JUnit XML report, with a test case for each file with errors.
+ *
+ * If there are no errors, there is a single passing test case, so CI
+ * doesn't report an empty test suite. JUnit has no warnings, so deprecated
+ * fields are left out.
+ *
+ * @param errors validation errors
+ * @param checkoutPath path to the repository checkout, paths are relative to it
+ * @returns JUnit XML document
+ */
+export function junitReport(errors: SetupError[], checkoutPath = '.'): string {
+  const files = new Map<string, SetupError[]>();
+  for (const error of errors.filter(error => !isWarning(error))) {
+    const file = relativePath(checkoutPath, error.path);
+    files.set(file, [...(files.get(file) || []), error]);
+  }
+  const testCases = [...files].map(([file, fileErrors]) =>
+    [
+      `    <testcase classname="ci-setup" name="${xmlEscape(file)}">`,
+      ...fileErrors.map(
+        error =>
+          `      <failure type="${error.kind}" message="${xmlEscape(
+            error.message,
+          )}">${xmlEscape(
+            `${file}${position(error)}: ${error.message}`,
+          )}</failure>`,
+      ),
+      '    </testcase>',
+    ].join('\n'),
+  );
+  if (testCases.length === 0) {
+    testCases.push(
+      '    <testcase classname="ci-setup" name="ci-setup files"/>',
+    );
+  }
+  const tests = Math.max(files.size, 1);
+  return [
+    '<?xml version="1.0" encoding="UTF-8"?>',
+    `<testsuites tests="${tests}" failures="${files.size}">`,
+    `  <testsuite name="custard validate" tests="${tests}" failures="${files.size}">`,
+    ...testCases,
+    '  </testsuite>',
+    '</testsuites>',
+    '',
+  ].join('\n');
+}
+
+/**
+ * Creates a SARIF report, with a rule for each kind of error.
+ *
+ * @param errors validation errors
+ * @param checkoutPath path to the repository checkout, paths are relative to it
+ * @returns SARIF log object
+ */
+export function sarifReport(errors: SetupError[], checkoutPath = '.') {
+  const kinds = [...new Set(errors.map(error => error.kind))];
+  return {
+    $schema: 'https://json.schemastore.org/sarif-2.1.0.json',
+    version: '2.1.0',
+    runs: [
+      {
+        tool: {
+          driver: {
+            name: 'custard',
+            version: version.replace(/^v/, ''),
+            informationUri: 'https://github.com/glasnt/trifle',
+            rules: kinds.map(kind => ({
+              id: kind,
+              shortDescription: {text: `ci-setup ${kind.replace('-', ' ')}`},
+            })),
+          },
+        },
+        results: errors.map(error => ({
+          ruleId: error.kind,
+          level: isWarning(error) ? 'warning' : 'error',
+          message: {text: error.message},
+          locations: [
+            {
+              physicalLocation: {
+                artifactLocation: {
+                  uri: relativePath(checkoutPath, error.path),
+                },
+                ...(error.line === null
+                  ? {}
+                  : {
+                      region: {
+                        startLine: error.line,
+                        startColumn: error.column ?? undefined,
+                      },
+                    }),
+              },
+            },
+          ],
+        })),
+      },
+    ],
+  };
+}
+
+/**
+ * Formats the position of an error in its file.
+ *
+ * @param error validation error
+ * @returns position like :3:5, or an empty string if it has no line
+ */
+function position(error: SetupError): string {
+  if (error.line === null) {
+    return '';
+  }
+  return error.column === null
+    ? `:${error.line}`
+    : `:${error.line}:${error.column}`;
+}
+
+/**
+ * Checks if an error is only a warning.
+ *
+ * Deprecated fields are only warnings, they don't fail the validation.
+ *
+ * @param error validation error
+ * @returns true if the error doesn't fail the validation
+ */
+function isWarning(error: SetupError): boolean {
+  return error.kind === 'deprecated-field';
+}
+
+/**
+ * Gets the path of a file in the report.
+ *
+ * @param checkoutPath path to the repository checkout
+ * @param filePath path to the file
+ * @returns path relative to the checkout path, with forward slashes
+ */
+function relativePath(checkoutPath: string, filePath: string): string {
+  return toSlash(path.relative(checkoutPath, filePath));
+}
+
+/**
+ * Escapes text for XML attributes and elements.
+ *
+ * @param text text to escape
+ * @returns escaped text
+ */
+function xmlEscape(text: string): string {
+  return text
+    .replaceAll('&', '&amp;')
+    .replaceAll('<', '&lt;')
+    .replaceAll('>', '&gt;')
+    .replaceAll('"', '&quot;')
+    .replaceAll("'", '&apos;');
+}
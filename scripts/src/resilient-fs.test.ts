@@ -0,0 +1,144 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import {findPackages, readFileAsync, withFileSystem} from './custard.ts';
+import type {FileSystem} from './custard.ts';
+import {memoryFileSystem} from './memory-fs.ts';
+import {
+  fileConcurrency,
+  resilientFileSystem,
+  resilientOptions,
+} from './resilient-fs.ts';
+
+describe('resilient-fs', () => {
+  const files = memoryFileSystem({
+    'web/package.json': '{}',
+    'web/ci-setup.json': '{}',
+    'api/go.mod': '',
+    'docs/README.md': '',
+  });
+
+  // Counts the calls of each operation, and fails the first `failures`.
+  const flaky = (failures: number, code = 'EAGAIN') => {
+    const calls: {[operation: string]: number} = {};
+    const call = (operation: string) => {
+      calls[operation] = (calls[operation] || 0) + 1;
+      if (failures > 0) {
+        failures--;
+        throw Object.assign(new Error(`${code}: ${operation}`), {code});
+      }
+    };
+    const base: FileSystem = {
+      existsSync: filePath => {
+        call('exists');
+        return files.existsSync(filePath);
+      },
+      readFileSync: (filePath, encoding) => {
+        call('read');
+        return files.readFileSync(filePath, encoding);
+      },
+      readdirSync: (dir, options) => {
+        call('readdir');
+        return files.readdirSync(dir, options);
+      },
+      statSync: (filePath, options) => {
+        call('stat');
+        return files.statSync(filePath, options);
+      },
+      realpathSync: filePath => {
+        call('realpath');
+        return files.realpathSync(filePath);
+      },
+    };
+    return {base, calls};
+  };
+
+  it('retries with backoff', () => {
+    const {base, calls} = flaky(2);
+    const waits: number[] = [];
+    const resilient = resilientFileSystem(base, {
+      backoffMs: 10,
+      sleep: ms => waits.push(ms),
+    });
+    expect(resilient.readFileSync('web/package.json', 'utf8')).to.equal('{}');
+    expect(calls.read).to.equal(3);
+    expect(waits).to.deep.equal([10, 20]);
+  });
+
+  it('retries concurrent reads', async () => {
+    const {base, calls} = flaky(2);
+    const waits: number[] = [];
+    const resilient = resilientFileSystem(base, {
+      backoffMs: 10,
+      sleep: ms => waits.push(ms),
+    });
+    const text = await readFileAsync(resilient, 'web/package.json');
+    expect(text).to.equal('{}');
+    expect(calls.read).to.equal(3);
+    expect(waits).to.deep.equal([10, 20]);
+  });
+
+  it('gives up after the retries', () => {
+    const {base} = flaky(5);
+    const resilient = resilientFileSystem(base, {retries: 2, sleep: () => {}});
+    expect(() => resilient.readFileSync('web/package.json', 'utf8')).to.throw(
+      'EAGAIN: read',
+    );
+  });
+
+  it('does not retry other errors', () => {
+    const {base, calls} = flaky(1, 'EACCES');
+    const resilient = resilientFileSystem(base, {sleep: () => {}});
+    expect(() => resilient.readFileSync('web/package.json', 'utf8')).to.throw(
+      'EACCES: read',
+    );
+    expect(calls.read).to.equal(1);
+  });
+
+  it('checks files from their directory listing', () => {
+    const {base, calls} = flaky(0);
+    const resilient = resilientFileSystem(base);
+    expect(resilient.existsSync('web/package.json')).to.be.true;
+    expect(resilient.existsSync('web/go.mod')).to.be.false;
+    expect(resilient.existsSync('web/ci-setup.json')).to.be.true;
+    expect(resilient.existsSync('missing/package.json')).to.be.false;
+    expect(calls).to.deep.equal({readdir: 2});
+  });
+
+  it('finds packages', () => {
+    const config = {'package-file': ['package.json', 'go.mod']};
+    const {base, calls} = flaky(0);
+    const resilient = withFileSystem(config, resilientFileSystem(base));
+    const packages = [...findPackages(resilient, '.', '.')];
+    expect(packages).to.deep.equal(['api', 'web']);
+    expect(calls.exists).to.be.undefined;
+  });
+
+  it('options from the environment', () => {
+    expect(resilientOptions({})).to.be.null;
+    expect(
+      resilientOptions({CUSTARD_FS_RETRIES: '5', CUSTARD_FS_BACKOFF: '1s'}),
+    ).to.deep.equal({retries: 5, backoffMs: 1000});
+    expect(() => resilientOptions({CUSTARD_FS_RETRIES: 'many'})).to.throw(
+      'CUSTARD_FS_RETRIES must be a non-negative integer, got: many',
+    );
+    expect(fileConcurrency({CUSTARD_FS_CONCURRENCY: '4'})).to.equal(4);
+    expect(() => fileConcurrency({CUSTARD_FS_CONCURRENCY: '0'})).to.throw(
+      'CUSTARD_FS_CONCURRENCY must be a positive integer, got: 0',
+    );
+  });
+});
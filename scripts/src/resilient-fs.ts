@@ -0,0 +1,290 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// File system for repositories mounted over the network, like NFS or FUSE,
+// where many small file operations get throttled.
+//
+// - Failed operations are retried with exponential backoff, for errors
+//   that go away on their own, like EAGAIN or ESTALE.
+// - Checking if a file exists reads its whole directory once instead, and
+//   later checks in the same directory reuse the listing. Finding packages
+//   checks many file names in every directory, like every package file and
+//   ci-setup file name, so this replaces a storm of stats with one listing.
+// - Files can be read concurrently, like by `validateSetupFiles`, and the
+//   reads are retried too.
+//
+// Listings are never refreshed, so use a new file system for each run.
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {setTimeout as delay} from 'node:timers/promises';
+import {parseDuration, readFileAsync} from './custard.ts';
+import type {DirEntry, FileStat, FileSystem} from './custard.ts';
+import {message} from './log.ts';
+
+export type ResilientOptions = {
+  // Times to retry a failed operation, defaults to 3.
+  retries?: number;
+
+  // Milliseconds to wait before the first retry, doubled on each retry,
+  // defaults to 100.
+  backoffMs?: number;
+
+  // Waits before retrying, it can be replaced for testing. By default,
+  // synchronous operations wait synchronously, and reads with
+  // `readFileAsync` wait without blocking.
+  sleep?: (ms: number) => void;
+};
+
+// Error codes of the operations worth retrying.
+export const retryableCodes = [
+  'EAGAIN',
+  'EBUSY',
+  'EIO',
+  'EMFILE',
+  'ENFILE',
+  'ESTALE',
+  'ETIMEDOUT',
+];
+
+/**
+ * Wraps a file system to retry failed operations and to batch the checks
+ * for files in the same directory.
+ *
+ * @param base file system to wrap, the OS file system by default
+ * @param options retries and backoff
+ * @returns file system for `withFileSystem`
+ */
+export function resilientFileSystem(
+  base: FileSystem = fs,
+  options: ResilientOptions = {},
+): FileSystem {
+  // Entries of each directory listed, or null if it's not a directory.
+  const listings = new Map<string, Map<string, DirEntry> | null>();
+  const list = (dir: string): Map<string, DirEntry> | null => {
+    const key = path.resolve(dir);
+    if (!listings.has(key)) {
+      try {
+        const entries = retrying(options, 'readdir', dir, () =>
+          base.readdirSync(dir, {withFileTypes: true}),
+        );
+        listings.set(key, new Map(entries.map(entry => [entry.name, entry])));
+      } catch (e) {
+        const code = (e as NodeJS.ErrnoException).code;
+        if (code !== 'ENOENT' && code !== 'ENOTDIR') {
+          throw e;
+        }
+        listings.set(key, null);
+      }
+    }
+    return listings.get(key)!;
+  };
+  const stat = (filePath: string): FileStat | undefined => {
+    const dir = path.dirname(filePath);
+    if (dir !== filePath && path.basename(filePath) !== '..') {
+      const listing = list(dir);
+      if (listing === null) {
+        return undefined;
+      }
+      const entry = listing.get(path.basename(filePath));
+      if (entry === undefined) {
+        return undefined;
+      }
+      if (!entry.isSymbolicLink() && !entry.isDirectory()) {
+        return entry;
+      }
+    }
+    // Symlinks are followed, and directories need their modification time.
+    return retrying(options, 'stat', filePath, () =>
+      base.statSync(filePath, {throwIfNoEntry: false}),
+    );
+  };
+
+  return {
+    existsSync: filePath => stat(filePath) !== undefined,
+    readFileSync: (filePath, encoding) =>
+      retrying(options, 'read', filePath, () =>
+        base.readFileSync(filePath, encoding),
+      ),
+    readFileAsync: (filePath, signal) =>
+      retryingAsync(options, 'read', filePath, () =>
+        readFileAsync(base, filePath, signal),
+      ),
+    readdirSync: dir => {
+      const listing = list(dir);
+      if (listing === null) {
+        // Fail like the wrapped file system.
+        return base.readdirSync(dir, {withFileTypes: true});
+      }
+      return [...listing.values()];
+    },
+    statSync: filePath => stat(filePath),
+    realpathSync: filePath =>
+      retrying(options, 'realpath', filePath, () =>
+        base.realpathSync(filePath),
+      ),
+  };
+}
+
+/**
+ * Gets the options for a resilient file system from the environment.
+ *
+ * - CUSTARD_FS_RETRIES: times to retry a failed operation, enables it.
+ * - CUSTARD_FS_BACKOFF: delay before the first retry, like 100ms or 1s.
+ *
+ * @param env environment variables
+ * @returns options, or null if not enabled
+ */
+export function resilientOptions(env = process.env): ResilientOptions | null {
+  if (!env.CUSTARD_FS_RETRIES) {
+    return null;
+  }
+  const retries = Number(env.CUSTARD_FS_RETRIES);
+  if (!Number.isInteger(retries) || retries < 0) {
+    throw new Error(
+      message(
+        'E045',
+        `CUSTARD_FS_RETRIES must be a non-negative integer, got: ${env.CUSTARD_FS_RETRIES}`,
+      ),
+    );
+  }
+  if (!env.CUSTARD_FS_BACKOFF) {
+    return {retries};
+  }
+  const backoffMs = parseDuration(env.CUSTARD_FS_BACKOFF);
+  if (backoffMs === null) {
+    throw new Error(
+      message(
+        'E045',
+        `CUSTARD_FS_BACKOFF must be a duration like 100ms or 1s, got: ${env.CUSTARD_FS_BACKOFF}`,
+      ),
+    );
+  }
+  return {retries, backoffMs};
+}
+
+/**
+ * Gets the maximum number of files read at the same time from the
+ * environment, with CUSTARD_FS_CONCURRENCY.
+ *
+ * @param env environment variables
+ * @returns maximum concurrent reads, or undefined for the default
+ */
+export function fileConcurrency(env = process.env): number | undefined {
+  if (!env.CUSTARD_FS_CONCURRENCY) {
+    return undefined;
+  }
+  const concurrency = Number(env.CUSTARD_FS_CONCURRENCY);
+  if (!Number.isInteger(concurrency) || concurrency < 1) {
+    throw new Error(
+      message(
+        'E045',
+        `CUSTARD_FS_CONCURRENCY must be a positive integer, got: ${env.CUSTARD_FS_CONCURRENCY}`,
+      ),
+    );
+  }
+  return concurrency;
+}
+
+/**
+ * Runs a file operation, retrying it with exponential backoff while it
+ * fails with a retryable error.
+ *
+ * @param options retries and backoff
+ * @param operation operation name, for the logs
+ * @param filePath path the operation is on, for the logs
+ * @param fn runs the operation
+ * @returns the operation's result
+ */
+function retrying<T>(
+  options: ResilientOptions,
+  operation: string,
+  filePath: string,
+  fn: () => T,
+): T {
+  const sleep = options.sleep ?? sleepSync;
+  for (let attempt = 0; ; attempt++) {
+    try {
+      return fn();
+    } catch (e) {
+      sleep(retryDelay(options, operation, filePath, attempt, e));
+    }
+  }
+}
+
+/**
+ * Runs an asynchronous file operation, retrying it like `retrying`, but
+ * without blocking while it waits.
+ *
+ * @param options retries and backoff
+ * @param operation operation name, for the logs
+ * @param filePath path the operation is on, for the logs
+ * @param fn runs the operation
+ * @returns the operation's result
+ */
+async function retryingAsync<T>(
+  options: ResilientOptions,
+  operation: string,
+  filePath: string,
+  fn: () => Promise<T>,
+): Promise<T> {
+  const sleep = options.sleep ?? delay;
+  for (let attempt = 0; ; attempt++) {
+    try {
+      return await fn();
+    } catch (e) {
+      await sleep(retryDelay(options, operation, filePath, attempt, e));
+    }
+  }
+}
+
+/**
+ * Gets how long to wait before retrying a failed operation.
+ *
+ * @param options retries and backoff
+ * @param operation operation name, for the logs
+ * @param filePath path the operation is on, for the logs
+ * @param attempt attempts that failed before this one
+ * @param e error of the failed attempt
+ * @returns milliseconds to wait
+ * @throws the error if it's not retryable, or there are no retries left
+ */
+function retryDelay(
+  options: ResilientOptions,
+  operation: string,
+  filePath: string,
+  attempt: number,
+  e: unknown,
+): number {
+  const retries = options.retries ?? 3;
+  const backoffMs = options.backoffMs ?? 100;
+  const code = (e as NodeJS.ErrnoException).code;
+  if (attempt >= retries || !retryableCodes.includes(code || '')) {
+    throw e;
+  }
+  const ms = backoffMs * 2 ** attempt;
+  console.debug(`Retrying ${operation} ${filePath} in ${ms}ms: ${code}`);
+  return ms;
+}
+
+/**
+ * Waits synchronously, since the file operations are synchronous.
+ *
+ * @param ms milliseconds to wait
+ */
+function sleepSync(ms: number) {
+  Atomics.wait(new Int32Array(new SharedArrayBuffer(4)), 0, 0, ms);
+}
@@ -0,0 +1,117 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {pathToFileURL} from 'node:url';
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import type {Config} from './custard.ts';
+import {openResultsCache, packageCacheKey} from './results-cache.ts';
+import type {CacheBackend, CachedResult} from './results-cache.ts';
+
+describe('results cache', () => {
+  const config: Config = {
+    'package-file': 'package.json',
+    'ci-setup-defaults': {'node-version': 20},
+  };
+  let checkoutPath = '';
+  beforeEach(() => {
+    checkoutPath = testing.materialize({
+      'a/package.json': '{}',
+      'a/index.js': 'console.log("a")',
+      'b/package.json': '{}',
+    });
+  });
+  afterEach(() => testing.cleanup(checkoutPath));
+  const result = {
+    package: 'a',
+    field: 'test-command',
+    duration: 10,
+    cachedAt: '2025-01-01T00:00:00.000Z',
+  };
+
+  it('local cache', () => {
+    const cache = openResultsCache(path.join(checkoutPath, '.cache'));
+    expect(cache.get('key')).to.be.null;
+    cache.put('key', result);
+    expect(cache.get('key')).to.deep.equal(result);
+    fs.writeFileSync(path.join(checkoutPath, '.cache', 'key.json'), '{"pack');
+    expect(cache.get('key')).to.be.null;
+  });
+
+  it('file URL', () => {
+    const dir = path.join(checkoutPath, '.cache');
+    openResultsCache(pathToFileURL(dir).href).put('key', result);
+    expect(openResultsCache(dir).get('key')).to.deep.equal(result);
+  });
+
+  it('custom backends', () => {
+    const results = new Map<string, CachedResult>();
+    const memory: CacheBackend = () => ({
+      get: key => results.get(key) ?? null,
+      put: (key, value) => results.set(key, value),
+    });
+    const backends = {'memory:': memory};
+    openResultsCache('memory://ci', backends).put('key', result);
+    expect(results.get('key')).to.deep.equal(result);
+  });
+
+  it('unsupported location', () => {
+    expect(() => openResultsCache('ftp://example.com/cache')).to.throw(
+      "unsupported results cache 'ftp://example.com/cache'",
+    );
+  });
+
+  it('packageCacheKey', () => {
+    const key = (pkg: string, field = 'test-command', cfg = config) =>
+      packageCacheKey(cfg, pkg, checkoutPath, field);
+    const before = key('a');
+    expect(key('a')).to.equal(before);
+    expect(key('b')).to.not.equal(before);
+    expect(key('a', 'lint-command')).to.not.equal(before);
+    const nodeVersion = {'ci-setup-defaults': {'node-version': 22}};
+    expect(key('a', 'test-command', {...config, ...nodeVersion})).to.not.equal(
+      before,
+    );
+    fs.writeFileSync(path.join(checkoutPath, 'a/index.js'), 'changed');
+    expect(key('a')).to.not.equal(before);
+  });
+
+  it('packageCacheKey with global files and dependencies', () => {
+    const npm: Config = {...config, dependencies: 'npm'};
+    fs.writeFileSync(
+      path.join(checkoutPath, 'a/package.json'),
+      '{"name": "a", "dependencies": {"b": "*"}}',
+    );
+    fs.writeFileSync(
+      path.join(checkoutPath, 'b/package.json'),
+      '{"name": "b"}',
+    );
+    const key = (pkg: string) =>
+      packageCacheKey(npm, pkg, checkoutPath, 'test-command');
+    const [a, b] = [key('a'), key('b')];
+    fs.writeFileSync(path.join(checkoutPath, 'b/index.js'), 'changed');
+    expect(key('a')).to.not.equal(a);
+    const [a2, b2] = [key('a'), key('b')];
+    fs.writeFileSync(path.join(checkoutPath, 'a/index.js'), 'changed');
+    expect(key('b')).to.equal(b2);
+    fs.writeFileSync(path.join(checkoutPath, 'package-lock.json'), '{}');
+    expect(key('a')).to.not.equal(a2);
+    expect(key('b')).to.not.equal(b2);
+    expect(b).to.not.equal(b2);
+  });
+});
@@ -0,0 +1,222 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Cache of the package results, so `exec` can skip the packages whose inputs
+// didn't change since they last passed, like on a retried CI run.
+//
+// Results are keyed by the package path, the ci-setup command field, a hash
+// of the package files, its resolved ci-setup, the global files, and the
+// files of the packages it depends on.
+// The cache can be a local directory, or a Cloud Storage bucket to share it
+// between CI runs.
+
+import * as crypto from 'node:crypto';
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {execFileSync} from 'node:child_process';
+import {fileURLToPath} from 'node:url';
+import {
+  configRoots,
+  dependencyEdges,
+  findPackages,
+  hashPackage,
+  loadPackage,
+} from './custard.ts';
+import type {Config} from './custard.ts';
+import {message} from './log.ts';
+
+export type CachedResult = {
+  // Path to the package, relative to the checkout path.
+  package: string;
+
+  // The ci-setup field with the command that ran, like 'test-command'.
+  field: string;
+
+  // How long the package took to run, in milliseconds.
+  duration: number;
+
+  // When the result was cached, as an ISO 8601 date.
+  cachedAt: string;
+};
+
+export type ResultsCache = {
+  // Gets a cached result, or null if there is none for the key.
+  get: (key: string) => CachedResult | null;
+
+  // Caches a result, replacing any previous result for the key.
+  put: (key: string, result: CachedResult) => void;
+};
+
+// Opens a results cache from its location, like a bucket URL.
+export type CacheBackend = (location: string) => ResultsCache;
+
+// Results cache backends, by the protocol of the cache location.
+// Locations without a protocol are local directories.
+const cacheBackends: {[protocol: string]: CacheBackend} = {
+  'file:': location => localCache(fileURLToPath(location)),
+  'gs:': storageCache,
+};
+
+/**
+ * Opens a results cache.
+ *
+ * @param location local directory, or URL like gs://bucket/prefix
+ * @param backends backends for other locations, by protocol, like `s3:`
+ * @returns results cache
+ */
+export function openResultsCache(
+  location: string,
+  backends: {[protocol: string]: CacheBackend} = {},
+): ResultsCache {
+  const protocol = location.match(/^([a-z][a-z0-9+.-]*:)\/\//)?.[1];
+  if (protocol === undefined) {
+    return localCache(location);
+  }
+  const allBackends = {...cacheBackends, ...backends};
+  const backend = allBackends[protocol];
+  if (!backend) {
+    throw new Error(
+      message(
+        'E038',
+        `unsupported results cache '${location}', must be a directory or one of: ${Object.keys(allBackends).join(', ')}`,
+      ),
+    );
+  }
+  return backend(location);
+}
+
+/**
+ * Computes the cache key of a package command.
+ *
+ * Any change to the package files or its resolved ci-setup, including the
+ * config defaults, changes the key. So does any change to the global files,
+ * like a root lockfile, or to the files of the packages it depends on,
+ * directly or transitively. Ignored files don't, see `hashPackage`.
+ *
+ * @param config config object
+ * @param pkg package path, relative to the checkout path
+ * @param checkoutPath path to the repository checkout
+ * @param field the ci-setup field with the command, like 'test-command'
+ * @param edges packages each package depends on, to reuse them between
+ *   packages, see `cacheDependencyEdges`
+ * @returns cache key
+ */
+export function packageCacheKey(
+  config: Config,
+  pkg: string,
+  checkoutPath: string,
+  field: string,
+  edges = cacheDependencyEdges(config, checkoutPath),
+): string {
+  const {ciSetup} = loadPackage(config, pkg, checkoutPath);
+  const files = hashPackage(config, pkg, checkoutPath);
+  const globalFiles = hashPackage(config, '.', checkoutPath);
+  const dependencies = new Set<string>();
+  const queue = [pkg];
+  while (queue.length > 0) {
+    for (const dependency of edges.get(queue.shift() || '') || []) {
+      if (dependency !== pkg && !dependencies.has(dependency)) {
+        dependencies.add(dependency);
+        queue.push(dependency);
+      }
+    }
+  }
+  const dependencyFiles = [...dependencies]
+    .sort()
+    .map(dependency => [
+      dependency,
+      hashPackage(config, dependency, checkoutPath),
+    ]);
+  const inputs = [pkg, field, files, ciSetup, globalFiles, dependencyFiles];
+  return crypto
+    .createHash('sha256')
+    .update(JSON.stringify(inputs))
+    .digest('hex');
+}
+
+/**
+ * Finds the dependencies between all the packages, for the cache keys.
+ *
+ * @param config config object
+ * @param checkoutPath path to the repository checkout
+ * @returns packages each package depends on, none without 'dependencies'
+ */
+export function cacheDependencyEdges(
+  config: Config,
+  checkoutPath: string,
+): Map<string, Set<string>> {
+  if (!config.dependencies) {
+    return new Map();
+  }
+  const packages = configRoots(config).flatMap(root => [
+    ...findPackages(config, root, checkoutPath),
+  ]);
+  return dependencyEdges(config, packages, checkoutPath);
+}
+
+/**
+ * Opens a results cache in a local directory, one file per key.
+ *
+ * @param dir path to the cache directory, created on the first result
+ * @returns results cache
+ */
+function localCache(dir: string): ResultsCache {
+  const file = (key: string) => path.join(dir, `${key}.json`);
+  return {
+    get: key => {
+      try {
+        return JSON.parse(fs.readFileSync(file(key), 'utf8'));
+      } catch {
+        // Not cached yet, or a truncated file, either way it has to run.
+        return null;
+      }
+    },
+    put: (key, result) => {
+      fs.mkdirSync(dir, {recursive: true});
+      fs.writeFileSync(file(key), JSON.stringify(result));
+    },
+  };
+}
+
+/**
+ * Opens a results cache in a Cloud Storage bucket, with gcloud.
+ *
+ * @param location bucket URL, like gs://bucket/prefix
+ * @returns results cache
+ */
+function storageCache(location: string): ResultsCache {
+  const url = (key: string) => `${location.replace(/\/$/, '')}/${key}.json`;
+  return {
+    get: key => {
+      try {
+        const data = execFileSync('gcloud', ['storage', 'cat', url(key)], {
+          encoding: 'utf8',
+          stdio: ['ignore', 'pipe', 'ignore'],
+        });
+        return JSON.parse(data);
+      } catch {
+        // Not cached yet, or not readable, either way it has to run.
+        return null;
+      }
+    },
+    put: (key, result) => {
+      execFileSync('gcloud', ['storage', 'cp', '-', url(key)], {
+        input: JSON.stringify(result),
+        stdio: ['pipe', 'ignore', 'inherit'],
+      });
+    },
+  };
+}
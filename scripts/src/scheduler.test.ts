@@ -0,0 +1,146 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import * as path from 'node:path';
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {parseMemory, validateCISetup} from './custard.ts';
+import type {Config} from './custard.ts';
+import {loadQuotas, scheduleResources} from './scheduler.ts';
+
+describe('scheduleResources', () => {
+  const config: Config = {'package-file': 'pkg.txt'};
+  const setup = (ciSetup: object) => JSON.stringify(ciSetup);
+  let checkoutPath = '';
+  before(() => {
+    checkoutPath = testing.materialize({
+      'gpu-a/pkg.txt': '',
+      'gpu-a/ci-setup.json': setup({resources: {gpu: 1, cpu: 4}}),
+      'gpu-b/pkg.txt': '',
+      'gpu-b/ci-setup.json': setup({resources: {gpu: 1, cpu: 4}, priority: 1}),
+      'big/pkg.txt': '',
+      'big/ci-setup.json': setup({
+        resources: {memory: '64Gi', regions: ['us-central1']},
+      }),
+      'small/pkg.txt': '',
+      'small/ci-setup.json': setup({resources: {memory: '512Mi'}}),
+      'plain/pkg.txt': '',
+    });
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('packs the packages within the quotas', () => {
+    const quotas = {
+      'us-central1': {gpu: 1, memory: '64Gi'},
+      'europe-west1': {memory: '1Gi', gpu: 0, packages: 2},
+    };
+    const packages = ['gpu-a', 'gpu-b', 'big', 'small', 'plain'];
+    expect(
+      scheduleResources(config, packages, quotas, checkoutPath),
+    ).to.deep.equal([
+      {
+        id: 'wave-0',
+        waitFor: [],
+        packages: ['gpu-b', 'big', 'plain', 'small'],
+        regions: {
+          'gpu-b': 'us-central1',
+          big: 'us-central1',
+          plain: 'us-central1',
+          small: 'europe-west1',
+        },
+      },
+      {
+        id: 'wave-1',
+        waitFor: ['wave-0'],
+        packages: ['gpu-a'],
+        regions: {'gpu-a': 'us-central1'},
+      },
+    ]);
+  });
+
+  it('no packages', () => {
+    expect(scheduleResources(config, [], {}, checkoutPath)).to.deep.equal([]);
+  });
+
+  it('all packages', () => {
+    const unlimited = scheduleResources(
+      config,
+      ['*'],
+      {'us-central1': {}},
+      checkoutPath,
+    );
+    expect(unlimited.map(wave => wave.packages.sort())).to.deep.equal([
+      ['big', 'gpu-a', 'gpu-b', 'plain', 'small'],
+    ]);
+  });
+
+  it("packages that don't fit", () => {
+    const quotas = {'us-central1': {memory: '32Gi'}, 'europe-west1': {}};
+    expect(() =>
+      scheduleResources(config, ['big'], quotas, checkoutPath),
+    ).to.throw(
+      "package 'big' doesn't fit in the quota of any of its regions: " +
+        '{"memory":"64Gi","regions":["us-central1"]}',
+    );
+  });
+});
+
+describe('loadQuotas', () => {
+  let dir = '';
+  before(() => {
+    dir = testing.materialize({
+      'quotas.jsonc': '{\n  // Regional quota.\n  "us-central1": {"cpu": 8}\n}',
+      'invalid.json': '{"us-central1": {"memory": "lots"}}',
+      'unknown.json': '{"us-central1": {"tpu": 1}}',
+    });
+  });
+  after(() => testing.cleanup(dir));
+
+  it('loads the quotas', () => {
+    expect(loadQuotas(path.join(dir, 'quotas.jsonc'))).to.deep.equal({
+      'us-central1': {cpu: 8},
+    });
+  });
+
+  it('invalid quotas', () => {
+    expect(() => loadQuotas(path.join(dir, 'invalid.json'))).to.throw(
+      '\'memory\' must be an amount like 96Gi, got: "lots"',
+    );
+    expect(() => loadQuotas(path.join(dir, 'unknown.json'))).to.throw(
+      "'tpu' is not a valid field",
+    );
+  });
+});
+
+describe('resources', () => {
+  it('parseMemory', () => {
+    expect(parseMemory('512Mi')).to.equal(512 * 2 ** 20);
+    expect(parseMemory('2G')).to.equal(2e9);
+    expect(parseMemory('1.5Ki')).to.equal(1536);
+    expect(parseMemory('100')).to.equal(100);
+    expect(parseMemory('4gb')).to.be.null;
+  });
+
+  it('validation', () => {
+    const config: Config = {'package-file': 'pkg.txt'};
+    const valid = {resources: {cpu: 0.5, memory: '1Gi', regions: ['eu']}};
+    expect(validateCISetup(config, valid)).to.deep.equal([]);
+    const invalid = {resources: {cpu: -1, memory: '1 GB'}};
+    expect(validateCISetup(config, invalid)).to.deep.equal([
+      '\'resources\' must be resources with cpu, memory like 4Gi, gpu, or regions, got: {"cpu":-1,"memory":"1 GB"}',
+    ]);
+  });
+});
@@ -0,0 +1,225 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Resource-aware scheduling, so deploying many packages at once doesn't go
+// over the quotas of a region, like its CPUs or GPUs.
+//
+// Each package declares the resources it needs in its ci-setup
+// `resources`, and the packages are packed into waves where each region
+// stays within its quota. Each wave waits for the previous one, like the
+// waves of `planBuilds`.
+
+import {
+  expandAllPackages,
+  loadJsonc,
+  loadPackage,
+  parseMemory,
+  schedulingOrder,
+} from './custard.ts';
+import type {BuildWave, Config} from './custard.ts';
+import {message} from './log.ts';
+
+// Quota of a region, every resource is unlimited by default.
+export type RegionQuota = {
+  // CPUs in use at the same time.
+  cpu?: number;
+
+  // Memory in use at the same time, like '96Gi'.
+  memory?: string;
+
+  // GPUs in use at the same time.
+  gpu?: number;
+
+  // Packages running at the same time.
+  packages?: number;
+};
+
+// Quota of each region, by region name.
+export type Quotas = {[region: string]: RegionQuota};
+
+// Wave of packages, like the waves of `planBuilds`, with the packages in
+// scheduling order.
+export type ScheduledWave = BuildWave & {
+  // Region each package of the wave runs in.
+  regions: {[pkg: string]: string};
+};
+
+// Amounts of each resource, with memory in bytes.
+type Usage = {cpu: number; memory: number; gpu: number; packages: number};
+
+/**
+ * Loads the quota of each region from a JSON or JSONC file.
+ *
+ * @param filePath path to the quotas file
+ * @returns quotas, by region
+ */
+export function loadQuotas(filePath: string): Quotas {
+  const quotas = loadJsonc(filePath);
+  if (typeof quotas !== 'object' || quotas === null || Array.isArray(quotas)) {
+    throw new Error(
+      message('E046', `quotas must be an object by region, got: ${filePath}`),
+    );
+  }
+  for (const [region, quota] of Object.entries(quotas)) {
+    const error = quotaError(quota);
+    if (error) {
+      throw new Error(
+        message(
+          'E046',
+          `invalid quota for '${region}' in ${filePath}: ${error}`,
+        ),
+      );
+    }
+  }
+  return quotas as Quotas;
+}
+
+/**
+ * Packs the packages into waves, so the packages of a wave fit in the
+ * quotas of their regions.
+ *
+ * Packages are placed in scheduling order, see `schedulingOrder`, each in
+ * the first wave with room in one of its regions, trying its regions in
+ * order. Packages without `resources` only count towards the `packages`
+ * quota, and packages without `regions` can run in any region.
+ *
+ * @param config config object
+ * @param packages package paths, or the all packages marker
+ * @param quotas quota of each region
+ * @param checkoutPath path to the repository checkout
+ * @returns waves, in order
+ */
+export function scheduleResources(
+  config: Config,
+  packages: string[],
+  quotas: Quotas,
+  checkoutPath = '.',
+): ScheduledWave[] {
+  const paths = expandAllPackages(config, packages, checkoutPath);
+  const limits = new Map(
+    Object.entries(quotas).map(([region, quota]) => [region, limit(quota)]),
+  );
+  const waves: {wave: ScheduledWave; used: Map<string, Usage>}[] = [];
+  for (const pkg of schedulingOrder(config, paths, checkoutPath)) {
+    const {resources} = loadPackage(config, pkg, checkoutPath).ciSetup;
+    const needs: Usage = {
+      cpu: resources?.cpu ?? 0,
+      memory: resources?.memory ? (parseMemory(resources.memory) ?? 0) : 0,
+      gpu: resources?.gpu ?? 0,
+      packages: 1,
+    };
+    const regions = (resources?.regions ?? [...limits.keys()]).filter(
+      region => limits.has(region) && fits(needs, none(), limits.get(region)!),
+    );
+    if (regions.length === 0) {
+      throw new Error(
+        message(
+          'E047',
+          `package '${pkg}' doesn't fit in the quota of any of its regions: ${JSON.stringify(resources ?? {})}`,
+        ),
+      );
+    }
+    const place = (used: Map<string, Usage>) =>
+      regions.find(region =>
+        fits(needs, used.get(region) ?? none(), limits.get(region)!),
+      );
+    let target = waves.find(({used}) => place(used) !== undefined);
+    if (!target) {
+      const id = `wave-${waves.length}`;
+      const waitFor = waves.length > 0 ? [waves.at(-1)!.wave.id] : [];
+      const wave: ScheduledWave = {id, waitFor, packages: [], regions: {}};
+      target = {wave, used: new Map()};
+      waves.push(target);
+    }
+    const region = place(target.used)!;
+    const used = target.used.get(region) ?? none();
+    target.used.set(region, {
+      cpu: used.cpu + needs.cpu,
+      memory: used.memory + needs.memory,
+      gpu: used.gpu + needs.gpu,
+      packages: used.packages + needs.packages,
+    });
+    target.wave.packages.push(pkg);
+    target.wave.regions[pkg] = region;
+  }
+  return waves.map(({wave}) => wave);
+}
+
+/**
+ * Checks a region's quota.
+ *
+ * @param quota quota to check
+ * @returns the error, or null if it's valid
+ */
+/* eslint-disable @typescript-eslint/no-explicit-any */
+function quotaError(quota: any): string | null {
+  if (typeof quota !== 'object' || quota === null || Array.isArray(quota)) {
+    return `must be an object, got: ${JSON.stringify(quota)}`;
+  }
+  for (const [key, value] of Object.entries(quota)) {
+    if (key === 'memory') {
+      if (typeof value !== 'string' || parseMemory(value) === null) {
+        return `'memory' must be an amount like 96Gi, got: ${JSON.stringify(value)}`;
+      }
+    } else if (['cpu', 'gpu', 'packages'].includes(key)) {
+      if (typeof value !== 'number' || value < 0) {
+        return `'${key}' must be a non-negative number, got: ${JSON.stringify(value)}`;
+      }
+    } else {
+      return `'${key}' is not a valid field`;
+    }
+  }
+  return null;
+}
+/* eslint-enable @typescript-eslint/no-explicit-any */
+
+/**
+ * Gets the limit of each resource of a quota.
+ *
+ * @param quota region's quota
+ * @returns limits, Infinity for unlimited resources
+ */
+function limit(quota: RegionQuota): Usage {
+  return {
+    cpu: quota.cpu ?? Infinity,
+    memory: quota.memory ? (parseMemory(quota.memory) ?? Infinity) : Infinity,
+    gpu: quota.gpu ?? Infinity,
+    packages: quota.packages ?? Infinity,
+  };
+}
+
+/**
+ * Checks if a package fits in a region.
+ *
+ * @param needs resources the package needs
+ * @param used resources already in use in the region
+ * @param limits limits of the region
+ * @returns true if every resource stays within its limit
+ */
+function fits(needs: Usage, used: Usage, limits: Usage): boolean {
+  return (['cpu', 'memory', 'gpu', 'packages'] as const).every(
+    key => used[key] + needs[key] <= limits[key],
+  );
+}
+
+/**
+ * Gets the usage of a region with nothing running.
+ *
+ * @returns zero of every resource
+ */
+function none(): Usage {
+  return {cpu: 0, memory: 0, gpu: 0, packages: 0};
+}
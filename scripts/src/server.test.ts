@@ -0,0 +1,294 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import * as crypto from 'node:crypto';
+import type {AddressInfo} from 'node:net';
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {
+  parseWebhook,
+  processWebhook,
+  verifyWebhook,
+  webhookServer,
+} from './server.ts';
+import type {WebhookResult} from './server.ts';
+import type {Config} from './custard.ts';
+
+const nullSha = '0000000000000000000000000000000000000000';
+
+describe('parseWebhook', () => {
+  it('github push', () => {
+    const headers = {'x-github-event': 'push'};
+    const payload = {
+      before: 'b',
+      after: 'h',
+      repository: {full_name: 'owner/repo'},
+    };
+    expect(parseWebhook(headers, payload)).to.deep.equal({
+      provider: 'github',
+      event: 'push',
+      repository: 'owner/repo',
+      base: 'b',
+      head: 'h',
+    });
+    expect(parseWebhook(headers, {...payload, deleted: true})).equals(null);
+  });
+
+  it('github pull request', () => {
+    const headers = {'x-github-event': 'pull_request'};
+    const payload = {
+      action: 'synchronize',
+      pull_request: {base: {sha: 'b'}, head: {sha: 'h'}},
+      repository: {full_name: 'owner/repo'},
+    };
+    expect(parseWebhook(headers, payload)).to.deep.include({
+      event: 'pull_request',
+      base: 'b',
+      head: 'h',
+      mergeBase: true,
+    });
+    expect(parseWebhook(headers, {...payload, action: 'closed'})).equals(null);
+    expect(parseWebhook({'x-github-event': 'ping'}, {})).equals(null);
+  });
+
+  it('gitlab push', () => {
+    const headers = {'x-gitlab-event': 'Push Hook'};
+    const payload = {
+      before: nullSha,
+      after: 'h',
+      project: {path_with_namespace: 'group/repo'},
+    };
+    expect(parseWebhook(headers, payload)).to.deep.equal({
+      provider: 'gitlab',
+      event: 'push',
+      repository: 'group/repo',
+      base: 'h~1',
+      head: 'h',
+    });
+  });
+
+  it('gitlab merge request', () => {
+    const headers = {'x-gitlab-event': 'Merge Request Hook'};
+    const payload = {
+      object_attributes: {
+        action: 'update',
+        target_branch: 'main',
+        last_commit: {id: 'h'},
+      },
+      project: {path_with_namespace: 'group/repo'},
+    };
+    expect(parseWebhook(headers, payload)).to.deep.include({
+      event: 'merge_request',
+      base: 'origin/main',
+      head: 'h',
+      mergeBase: true,
+    });
+    const merged = {object_attributes: {action: 'merge'}};
+    expect(parseWebhook(headers, merged)).equals(null);
+  });
+
+  it('unsupported webhook', () => {
+    expect(() => parseWebhook({}, {})).to.throw('unsupported webhook');
+  });
+});
+
+describe('verifyWebhook', () => {
+  const body = '{"action":"opened"}';
+  const signature = `sha256=${crypto
+    .createHmac('sha256', 'secret')
+    .update(body)
+    .digest('hex')}`;
+
+  it('github signature', () => {
+    const headers = {'x-hub-signature-256': signature};
+    expect(verifyWebhook(headers, body, 'secret')).equals(true);
+    expect(verifyWebhook(headers, body, 'other')).equals(false);
+    expect(verifyWebhook(headers, `${body} `, 'secret')).equals(false);
+  });
+
+  it('gitlab token', () => {
+    const headers = {'x-gitlab-token': 'secret'};
+    expect(verifyWebhook(headers, body, 'secret')).equals(true);
+    expect(verifyWebhook(headers, body, 'other')).equals(false);
+  });
+
+  it('unsigned', () => {
+    expect(verifyWebhook({}, body, 'secret')).equals(false);
+  });
+});
+
+describe('processWebhook', () => {
+  const config: Config = {'package-file': 'package.json'};
+  const checkoutPath = testing.materialize({
+    'a/package.json': '{}',
+    'b/package.json': '{}',
+  });
+  after(() => testing.cleanup(checkoutPath));
+  const event = {
+    provider: 'github',
+    event: 'push',
+    repository: 'owner/repo',
+    base: 'b',
+    head: 'h',
+  };
+  const vcs = {diff: () => ['a/index.js', 'c/package.json']};
+
+  it('sends the results', async () => {
+    const requests: [string, RequestInit | undefined][] = [];
+    const fakeFetch = async (url: string, init?: RequestInit) => {
+      requests.push([url, init]);
+      return new Response('{}');
+    };
+    const results: WebhookResult[] = [];
+    const result = await processWebhook(
+      {
+        config,
+        checkoutPath,
+        vcs,
+        callbackUrl: 'https://example.com/affected',
+        cloudBuildTrigger: 'projects/p/locations/global/triggers/t',
+        onResult: result => {
+          results.push(result);
+        },
+        fetch: fakeFetch as unknown as typeof fetch,
+        accessToken: () => 'token',
+      },
+      event,
+    );
+    expect(result).to.deep.equal({
+      ...event,
+      packages: [{path: 'a', reasons: ['a/index.js changed']}],
+      removed: ['c'],
+    });
+    expect(results).to.deep.equal([result]);
+    expect(requests.map(([url]) => url)).to.deep.equal([
+      'https://example.com/affected',
+      'https://cloudbuild.googleapis.com/v1/projects/p/locations/global/triggers/t:run',
+    ]);
+    expect(JSON.parse(`${requests[0][1]?.body}`)).to.deep.equal(result);
+    expect(JSON.parse(`${requests[1][1]?.body}`)).to.deep.equal({
+      source: {commitSha: 'h', substitutions: {_CUSTARD_PACKAGES: 'a'}},
+    });
+  });
+
+  it('callback failure', async () => {
+    const fakeFetch = async () => new Response('', {status: 500});
+    let error = '';
+    try {
+      await processWebhook(
+        {
+          config,
+          checkoutPath,
+          vcs,
+          callbackUrl: 'https://example.com/affected',
+          fetch: fakeFetch as typeof fetch,
+        },
+        event,
+      );
+    } catch (e) {
+      error = `${e}`;
+    }
+    expect(error).to.contain('callback https://example.com/affected failed');
+  });
+
+  it('invalid revisions', async () => {
+    for (const base of ['--upload-pack=touch x', 'origin/a..b', 'main']) {
+      let error = '';
+      try {
+        const head = 'a'.repeat(40);
+        await processWebhook({config, checkoutPath}, {...event, base, head});
+      } catch (e) {
+        error = `${e}`;
+      }
+      expect(error).to.contain('invalid webhook revision');
+    }
+  });
+});
+
+describe('webhookServer', () => {
+  const config: Config = {'package-file': 'package.json'};
+  const checkoutPath = testing.materialize({'a/package.json': '{}'});
+  after(() => testing.cleanup(checkoutPath));
+
+  it('requires a secret', () => {
+    const secret = process.env.CUSTARD_WEBHOOK_SECRET;
+    delete process.env.CUSTARD_WEBHOOK_SECRET;
+    try {
+      expect(() => webhookServer({config, checkoutPath})).to.throw(
+        'a webhook secret is required',
+      );
+    } finally {
+      if (secret !== undefined) {
+        process.env.CUSTARD_WEBHOOK_SECRET = secret;
+      }
+    }
+  });
+
+  it('processes verified webhooks', async () => {
+    let onResult = (_result: WebhookResult) => {};
+    const processed = new Promise<WebhookResult>(
+      resolve => (onResult = resolve),
+    );
+    const server = webhookServer({
+      config: () => config,
+      checkoutPath,
+      secret: 'secret',
+      vcs: {diff: () => ['a/index.js']},
+      onResult: result => onResult(result),
+    });
+    await new Promise<void>(resolve => server.listen(0, resolve));
+    try {
+      const {port} = server.address() as AddressInfo;
+      const url = `http://localhost:${port}`;
+      const post = (headers: {[k: string]: string}, body: string) =>
+        fetch(url, {method: 'POST', headers, body});
+
+      const body = JSON.stringify({
+        before: 'b',
+        after: 'h',
+        repository: {full_name: 'owner/repo'},
+      });
+      const unsigned = await post({'x-github-event': 'push'}, body);
+      expect(unsigned.status).equals(401);
+
+      const ignored = await post(
+        {'x-gitlab-event': 'Note Hook', 'x-gitlab-token': 'secret'},
+        '{}',
+      );
+      expect(ignored.status).equals(202);
+      expect(await ignored.json()).to.deep.equal({ignored: true});
+
+      const signature = crypto
+        .createHmac('sha256', 'secret')
+        .update(body)
+        .digest('hex');
+      const accepted = await post(
+        {
+          'x-github-event': 'push',
+          'x-hub-signature-256': `sha256=${signature}`,
+        },
+        body,
+      );
+      expect(accepted.status).equals(202);
+      // Webhooks are processed in the background.
+      const result = await processed;
+      expect(result.head).equals('h');
+      expect(result.packages.map(pkg => pkg.path)).to.deep.equal(['a']);
+    } finally {
+      server.close();
+    }
+  });
+});
@@ -0,0 +1,430 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Webhook server, to run Custard as a standing service instead of once in
+// every CI job. It receives GitHub and GitLab webhooks for pushes and pull
+// or merge requests, finds the affected packages, and sends them to a
+// callback URL or a Cloud Build trigger.
+
+/* eslint-disable @typescript-eslint/no-explicit-any */
+
+import * as crypto from 'node:crypto';
+import * as http from 'node:http';
+import {execFile} from 'node:child_process';
+import {promisify} from 'node:util';
+import {affectedDetailed, removedPackages} from './custard.ts';
+import type {AffectedPackage, Config} from './custard.ts';
+import {eventDiffs, eventRefs} from './github-actions.ts';
+import {gitCli} from './vcs.ts';
+import type {VCS} from './vcs.ts';
+import {message} from './log.ts';
+
+export type WebhookEvent = {
+  // Where the webhook came from, github or gitlab.
+  provider: string;
+
+  // Event name, like push or pull_request.
+  event: string;
+
+  // Repository full name, like owner/repo.
+  repository: string;
+
+  // Commit to compare against.
+  base: string;
+
+  // Commit being tested.
+  head: string;
+
+  // Whether to compare against the merge base, see `EventRefs`.
+  mergeBase?: boolean;
+};
+
+export type WebhookResult = WebhookEvent & {
+  // Affected packages with their reasons.
+  packages: AffectedPackage[];
+
+  // Removed packages, to tear down their deployments.
+  removed: string[];
+};
+
+export type ServerOptions = {
+  // Config object, or a function that returns the latest config,
+  // like the `config` function of `watchConfig`.
+  config: Config | (() => Config);
+
+  // Path to the repository checkout, defaults to the current directory.
+  checkoutPath?: string;
+
+  // Secret to verify the webhooks, defaults to CUSTARD_WEBHOOK_SECRET.
+  // GitHub signs the payloads with it, and GitLab sends it as a token.
+  // The server refuses to start without one, since the webhook commits
+  // and branches are fetched and checked out.
+  secret?: string;
+
+  // Version control provider, defaults to git, fetching the commits from
+  // the origin remote and checking out the head commit first.
+  vcs?: VCS;
+
+  // URL to POST the results to, as JSON.
+  callbackUrl?: string;
+
+  // Cloud Build trigger to run with the affected packages, like
+  // projects/my-project/locations/global/triggers/my-trigger.
+  cloudBuildTrigger?: string;
+
+  // Called with the results, after the callback URL and the trigger.
+  onResult?: (result: WebhookResult) => void | Promise<void>;
+
+  // Dependencies, they can be replaced for testing.
+  fetch?: typeof fetch;
+  accessToken?: () => string | Promise<string>;
+};
+
+// Pull and merge request actions that change the commits.
+const githubActions = ['opened', 'synchronize', 'reopened'];
+const gitlabActions = ['open', 'update', 'reopen'];
+
+// Pushes to a new branch have no previous commit.
+const nullSha = '0000000000000000000000000000000000000000';
+
+const execFileAsync = promisify(execFile);
+
+/**
+ * Gets the commits to compare from a webhook payload.
+ *
+ * @param headers request headers, to know the provider and event
+ * @param payload webhook payload
+ * @returns the event, or null if it doesn't change any commits,
+ *   like closing a pull request or a ping
+ */
+export function parseWebhook(
+  headers: http.IncomingHttpHeaders,
+  payload: any,
+): WebhookEvent | null {
+  const githubEvent = headers['x-github-event'];
+  if (typeof githubEvent === 'string') {
+    if (
+      !['push', 'pull_request', 'merge_group'].includes(githubEvent) ||
+      (githubEvent === 'pull_request' &&
+        !githubActions.includes(payload.action)) ||
+      (githubEvent === 'push' && payload.deleted)
+    ) {
+      return null;
+    }
+    return {
+      provider: 'github',
+      event: githubEvent,
+      repository: payload.repository?.full_name || '',
+      ...eventRefs(githubEvent, payload),
+    };
+  }
+  const gitlabEvent = headers['x-gitlab-event'];
+  if (typeof gitlabEvent === 'string') {
+    const repository = payload.project?.path_with_namespace || '';
+    if (gitlabEvent === 'Push Hook' && payload.after !== nullSha) {
+      return {
+        provider: 'gitlab',
+        event: 'push',
+        repository,
+        base:
+          payload.before === nullSha ? `${payload.after}~1` : payload.before,
+        head: payload.after,
+      };
+    }
+    const mergeRequest = payload.object_attributes || {};
+    if (
+      gitlabEvent === 'Merge Request Hook' &&
+      gitlabActions.includes(mergeRequest.action)
+    ) {
+      return {
+        provider: 'gitlab',
+        event: 'merge_request',
+        repository,
+        base: `origin/${mergeRequest.target_branch}`,
+        head: mergeRequest.last_commit.id,
+        mergeBase: true,
+      };
+    }
+    return null;
+  }
+  throw new Error(
+    message(
+      'E031',
+      'unsupported webhook, expected an X-GitHub-Event or X-Gitlab-Event header',
+    ),
+  );
+}
+
+/**
+ * Verifies that a webhook comes from the provider.
+ *
+ * @param headers request headers
+ * @param body raw request body
+ * @param secret webhook secret
+ * @returns true if the signature or token matches the secret
+ */
+export function verifyWebhook(
+  headers: http.IncomingHttpHeaders,
+  body: string,
+  secret: string,
+): boolean {
+  const signature = headers['x-hub-signature-256'];
+  if (typeof signature === 'string') {
+    const hmac = crypto.createHmac('sha256', secret).update(body);
+    return safeEqual(signature, `sha256=${hmac.digest('hex')}`);
+  }
+  const token = headers['x-gitlab-token'];
+  if (typeof token === 'string') {
+    return safeEqual(token, secret);
+  }
+  return false;
+}
+
+/**
+ * Compares two strings in constant time, to not leak the secret.
+ *
+ * @param a first string
+ * @param b second string
+ * @returns true if they are equal
+ */
+function safeEqual(a: string, b: string): boolean {
+  const bufferA = Buffer.from(a);
+  const bufferB = Buffer.from(b);
+  return (
+    bufferA.length === bufferB.length &&
+    crypto.timingSafeEqual(bufferA, bufferB)
+  );
+}
+
+/**
+ * Finds the affected packages of a webhook event, and sends them to the
+ * callback URL, the Cloud Build trigger, and `onResult`.
+ *
+ * @param options server options
+ * @param event webhook event
+ * @returns affected and removed packages
+ */
+export async function processWebhook(
+  options: ServerOptions,
+  event: WebhookEvent,
+): Promise<WebhookResult> {
+  const config =
+    typeof options.config === 'function' ? options.config() : options.config;
+  const checkoutPath = options.checkoutPath ?? '.';
+  const vcs = options.vcs ?? (await syncedGit(checkoutPath, event));
+  const fetchFn = options.fetch ?? fetch;
+
+  const diffs = eventDiffs(vcs, event);
+  const result = {
+    ...event,
+    packages: affectedDetailed(config, diffs, checkoutPath),
+    removed: removedPackages(config, diffs, checkoutPath),
+  };
+  console.info(
+    message(
+      'I004',
+      `${event.repository} ${event.event} ${event.head}: ${result.packages.length} packages affected`,
+    ),
+  );
+
+  if (options.callbackUrl) {
+    const response = await fetchFn(options.callbackUrl, {
+      method: 'POST',
+      headers: {'content-type': 'application/json'},
+      body: JSON.stringify(result),
+    });
+    if (!response.ok) {
+      throw new Error(
+        `callback ${options.callbackUrl} failed: ${response.status} ${response.statusText}`,
+      );
+    }
+  }
+  if (options.cloudBuildTrigger && result.packages.length > 0) {
+    const accessToken = options.accessToken ?? gcloudAccessToken;
+    const url = `https://cloudbuild.googleapis.com/v1/${options.cloudBuildTrigger}:run`;
+    const response = await fetchFn(url, {
+      method: 'POST',
+      headers: {
+        authorization: `Bearer ${await accessToken()}`,
+        'content-type': 'application/json',
+      },
+      body: JSON.stringify({
+        source: {
+          commitSha: event.head,
+          substitutions: {
+            _CUSTARD_PACKAGES: result.packages.map(pkg => pkg.path).join(','),
+          },
+        },
+      }),
+    });
+    if (!response.ok) {
+      throw new Error(
+        `running ${options.cloudBuildTrigger} failed: ${response.status} ${await response.text()}`,
+      );
+    }
+  }
+  await options.onResult?.(result);
+  return result;
+}
+
+/**
+ * Creates a webhook server.
+ *
+ * Webhooks are verified and acknowledged right away, and processed one at
+ * a time in the background, since they share the same checkout.
+ * Failures are logged, and the server keeps running.
+ *
+ * @param options server options, a secret is required
+ * @returns HTTP server, call `listen` to start it
+ */
+export function webhookServer(options: ServerOptions): http.Server {
+  const secret = options.secret ?? process.env.CUSTARD_WEBHOOK_SECRET;
+  if (!secret) {
+    throw new Error(
+      message(
+        'E050',
+        'a webhook secret is required, set CUSTARD_WEBHOOK_SECRET',
+      ),
+    );
+  }
+  let queue = Promise.resolve();
+  return http.createServer((request, response) => {
+    const reply = (status: number, body: any) => {
+      response.writeHead(status, {'content-type': 'application/json'});
+      response.end(JSON.stringify(body));
+    };
+    if (request.method !== 'POST') {
+      return reply(405, {error: 'only POST requests are supported'});
+    }
+    const chunks: Buffer[] = [];
+    request.on('data', chunk => chunks.push(chunk));
+    request.on('end', () => {
+      const body = Buffer.concat(chunks).toString();
+      if (!verifyWebhook(request.headers, body, secret)) {
+        return reply(401, {error: 'invalid webhook signature'});
+      }
+      let event: WebhookEvent | null;
+      try {
+        event = parseWebhook(request.headers, JSON.parse(body));
+      } catch (e) {
+        return reply(400, {error: `${e}`});
+      }
+      if (event === null) {
+        return reply(202, {ignored: true});
+      }
+      const accepted = event;
+      queue = queue
+        .then(() => processWebhook(options, accepted))
+        .then(
+          () => {},
+          e =>
+            console.error(
+              message('E032', `processing ${accepted.head} failed: ${e}`),
+            ),
+        );
+      reply(202, accepted);
+    });
+  });
+}
+
+/**
+ * Gets the diffs with git, fetching the commits from origin first.
+ *
+ * Packages are found in the checkout, so it also checks out the head
+ * commit, for the packages to be the ones at that commit.
+ * Git runs asynchronously, so the server keeps answering webhooks while
+ * the commits are fetched.
+ *
+ * The revisions come from the webhook payloads, so they must be commit
+ * hashes or `origin/<branch>`, and are never taken as git options.
+ *
+ * @param repo path to the repository
+ * @param event webhook event, with the commits to fetch
+ * @returns version control provider
+ */
+async function syncedGit(repo: string, event: WebhookEvent): Promise<VCS> {
+  // Fetch the commits, or the target branch of merge requests.
+  const refs = new Set<string>();
+  for (const rev of [event.base, event.head]) {
+    refs.add(await fetchRef(repo, rev));
+  }
+  await execFileAsync(
+    'git',
+    ['fetch', '--quiet', 'origin', '--end-of-options', ...refs],
+    {cwd: repo},
+  );
+  await execFileAsync(
+    'git',
+    ['switch', '--quiet', '--detach', '--end-of-options', event.head],
+    {cwd: repo},
+  );
+  return gitCli(repo);
+}
+
+/**
+ * Gets what to fetch for a webhook revision.
+ *
+ * @param repo path to the repository
+ * @param rev a commit hash, optionally with `~1`, or `origin/<branch>`
+ * @returns commit hash or branch name to fetch
+ */
+async function fetchRef(repo: string, rev: string): Promise<string> {
+  const commit = rev.replace(/~1$/, '');
+  if (/^[0-9a-f]{40}$/.test(commit)) {
+    return commit;
+  }
+  const branch = rev.match(/^origin\/(.+)$/);
+  if (branch && (await isBranchName(repo, branch[1]))) {
+    return branch[1];
+  }
+  throw new Error(
+    message(
+      'E051',
+      `invalid webhook revision, expected a commit hash or a branch: ${JSON.stringify(rev)}`,
+    ),
+  );
+}
+
+/**
+ * Checks a branch name with `git check-ref-format`.
+ *
+ * @param repo path to the repository
+ * @param branch branch name
+ * @returns true if it's a valid branch name
+ */
+async function isBranchName(repo: string, branch: string): Promise<boolean> {
+  try {
+    await execFileAsync('git', ['check-ref-format', `refs/heads/${branch}`], {
+      cwd: repo,
+    });
+    return true;
+  } catch {
+    return false;
+  }
+}
+
+/**
+ * Gets an access token for Google Cloud APIs from the `gcloud` credentials.
+ *
+ * @returns OAuth access token
+ */
+async function gcloudAccessToken(): Promise<string> {
+  const {stdout} = await execFileAsync('gcloud', [
+    'auth',
+    'print-access-token',
+  ]);
+  return stdout.trim();
+}
@@ -0,0 +1,111 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {formatStats, timed, withStats, withStatsAsync} from './stats.ts';
+import {affected} from './custard.ts';
+import type {Config} from './custard.ts';
+
+function sleep(ms: number) {
+  const end = performance.now() + ms;
+  while (performance.now() < end) {
+    // Busy wait, phases are synchronous.
+  }
+}
+
+describe('withStats', () => {
+  it('nested phases', () => {
+    const {result, stats} = withStats(() =>
+      timed('walk', () => {
+        sleep(20);
+        timed('setup-read', () => sleep(20));
+        timed('setup-read', () => sleep(20));
+        return 'done';
+      }),
+    );
+    expect(result).equals('done');
+    expect(stats.counts).to.deep.include({walk: 1, 'setup-read': 2});
+    expect(stats.durations['setup-read']).to.be.at.least(40);
+    // The walk time excludes the nested setup-read time.
+    expect(stats.durations.walk + stats.durations['setup-read']).to.be.at.most(
+      stats.total,
+    );
+  });
+
+  it('asynchronous phases', async () => {
+    const {result, stats} = await withStatsAsync(async () => {
+      timed('walk', () => {});
+      await new Promise(resolve => setImmediate(resolve));
+      timed('validate', () => {});
+      return 'done';
+    });
+    expect(result).equals('done');
+    expect(stats.counts).to.deep.include({walk: 1, validate: 1});
+    // Phases after it finishes are not timed.
+    timed('walk', () => {});
+    expect(stats.counts.walk).equals(1);
+  });
+
+  it('outside withStats', () => {
+    expect(timed('walk', () => 1)).equals(1);
+    const {stats} = withStats(() => {});
+    expect(stats.counts.walk).equals(0);
+  });
+
+  it('emits spans', () => {
+    const spans: string[] = [];
+    const tracer = {
+      startSpan: (name: string) => ({end: () => spans.push(name)}),
+    };
+    withStats(() => timed('walk', () => timed('validate', () => {})), tracer);
+    expect(spans).to.deep.equal(['custard.validate', 'custard.walk']);
+  });
+
+  it('affected packages', () => {
+    const config: Config = {'package-file': 'package.json'};
+    const checkoutPath = testing.materialize({
+      'a/package.json': '{}',
+      'a/ci-setup.json': '{}',
+      'b/package.json': '{}',
+    });
+    try {
+      const {result, stats} = withStats(() =>
+        affected(config, ['a/index.js'], checkoutPath),
+      );
+      expect(result).to.deep.equal(['a']);
+      expect(stats.counts.match).equals(1);
+      expect(stats.counts['setup-read']).to.be.at.least(1);
+      // Finding packages reads the ci-setup files, loading them validates.
+      expect(stats.counts.validate).equals(0);
+    } finally {
+      testing.cleanup(checkoutPath);
+    }
+  });
+});
+
+describe('formatStats', () => {
+  it('one line', () => {
+    const stats = {
+      durations: {walk: 120.4, match: 2.6},
+      counts: {walk: 1, match: 3},
+      total: 130,
+    };
+    expect(formatStats(stats)).equals(
+      'walk 120ms (1), match 3ms (3), total 130ms',
+    );
+  });
+});
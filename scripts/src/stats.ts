@@ -0,0 +1,184 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Timing instrumentation, to find out where the time goes when finding
+// packages in large repositories.
+//
+// Phases are only timed inside `withStats` or `withStatsAsync`, otherwise
+// `timed` just calls the function. The time of a phase excludes the phases
+// nested in it, so the durations of all phases add up to at most the total.
+
+export type Stats = {
+  // Milliseconds spent in each phase, like walk, match, setup-read, and
+  // validate.
+  durations: {[phase: string]: number};
+
+  // Number of times each phase ran.
+  counts: {[phase: string]: number};
+
+  // Milliseconds of the whole measured function.
+  total: number;
+};
+
+// The part of an OpenTelemetry tracer used to emit spans, so
+// `trace.getTracer('custard')` can be passed without depending on it.
+export type Tracer = {
+  startSpan: (name: string) => {end: () => void};
+};
+
+// Phases timed while finding the affected packages, in the order they run.
+export const phases = ['walk', 'match', 'setup-read', 'validate'];
+
+type Collector = {
+  stats: Stats;
+  tracer?: Tracer;
+
+  // Time spent in nested phases, for each phase currently running.
+  nested: number[];
+};
+
+let collector: Collector | null = null;
+
+/**
+ * Runs a function, timing the phases that run inside it.
+ *
+ * @param fn function to measure, like finding the affected packages
+ * @param tracer OpenTelemetry tracer to emit a span for each phase
+ * @returns the function's result, and the time spent in each phase
+ */
+export function withStats<T>(
+  fn: () => T,
+  tracer?: Tracer,
+): {result: T; stats: Stats} {
+  const previous = collector;
+  const stats = emptyStats();
+  collector = {stats, tracer, nested: []};
+  const start = performance.now();
+  try {
+    const result = fn();
+    return {result, stats};
+  } finally {
+    stats.total = performance.now() - start;
+    collector = previous;
+  }
+}
+
+/**
+ * Runs an asynchronous function, timing the phases that run until it
+ * finishes, like `withStats`.
+ *
+ * Phases of anything else that runs in the meantime are timed too, so
+ * only measure one function at a time.
+ *
+ * @param fn function to measure, like validating the setup files
+ * @param tracer OpenTelemetry tracer to emit a span for each phase
+ * @returns the function's result, and the time spent in each phase
+ */
+export async function withStatsAsync<T>(
+  fn: () => Promise<T>,
+  tracer?: Tracer,
+): Promise<{result: T; stats: Stats}> {
+  const previous = collector;
+  const stats = emptyStats();
+  collector = {stats, tracer, nested: []};
+  const start = performance.now();
+  try {
+    const result = await fn();
+    return {result, stats};
+  } finally {
+    stats.total = performance.now() - start;
+    collector = previous;
+  }
+}
+
+/**
+ * Times a phase, if running inside `withStats`.
+ *
+ * @param phase name of the phase
+ * @param fn function that runs the phase
+ * @returns the function's result
+ */
+export function timed<T>(phase: string, fn: () => T): T {
+  const current = collector;
+  if (current === null) {
+    return fn();
+  }
+  const span = current.tracer?.startSpan(`custard.${phase}`);
+  current.nested.push(0);
+  const start = performance.now();
+  try {
+    return fn();
+  } finally {
+    const elapsed = performance.now() - start;
+    const nested = current.nested.pop() || 0;
+    const {durations, counts} = current.stats;
+    durations[phase] = (durations[phase] || 0) + elapsed - nested;
+    counts[phase] = (counts[phase] || 0) + 1;
+    if (current.nested.length > 0) {
+      current.nested[current.nested.length - 1] += elapsed;
+    }
+    span?.end();
+  }
+}
+
+/**
+ * Times each step of an iterator as a phase, if running inside `withStats`.
+ *
+ * Only the time to produce each value is counted, not the time the caller
+ * spends on it before asking for the next one.
+ *
+ * @param phase name of the phase
+ * @param iterator iterator that runs the phase, like a directory walk
+ * @returns generator with the same values
+ */
+export function* timedIter<T>(
+  phase: string,
+  iterator: Iterator<T>,
+): Generator<T> {
+  while (true) {
+    const next = timed(phase, () => iterator.next());
+    if (next.done) {
+      return;
+    }
+    yield next.value;
+  }
+}
+
+/**
+ * Creates stats with no time spent in any phase yet.
+ *
+ * @returns empty stats
+ */
+function emptyStats(): Stats {
+  return {
+    durations: Object.fromEntries(phases.map(phase => [phase, 0])),
+    counts: Object.fromEntries(phases.map(phase => [phase, 0])),
+    total: 0,
+  };
+}
+
+/**
+ * Formats the stats in a single line, for the logs.
+ *
+ * @param stats stats from `withStats`
+ * @returns durations of each phase, like "walk 120ms (1), match 3ms (4)"
+ */
+export function formatStats(stats: Stats): string {
+  const durations = Object.entries(stats.durations).map(
+    ([phase, ms]) => `${phase} ${Math.round(ms)}ms (${stats.counts[phase]})`,
+  );
+  return [...durations, `total ${Math.round(stats.total)}ms`].join(', ');
+}
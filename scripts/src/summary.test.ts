@@ -0,0 +1,101 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {parseCodeowners} from './codeowners.ts';
+import type {Config} from './custard.ts';
+import {affectedSummary, summaryLinkBase} from './summary.ts';
+
+describe('affectedSummary', () => {
+  const config: Config = {'package-file': 'pkg.txt'};
+  const checkoutPath = testing.materialize({
+    'api/pkg.txt': '',
+    'api/ci-setup.json': '{"estimated-duration": "1h"}',
+    'web/pkg.txt': '',
+    'web/ci-setup.json': '{"estimated-duration": "15m30s"}',
+    'tools/pkg.txt': '',
+  });
+  after(() => testing.cleanup(checkoutPath));
+
+  it('table', () => {
+    const packages = [
+      {path: 'api', reasons: ['api/main.py changed', 'a|b changed']},
+      {path: 'web', reasons: ['web/app.ts changed']},
+      {path: 'tools', reasons: ['tools/run.sh changed']},
+    ];
+    const owners = parseCodeowners('/api/ @org/api\n/web/ @org/web @alice\n');
+    const linkBase = 'https://github.com/owner/repo/blob/main';
+    const summary = affectedSummary(config, packages, checkoutPath, {
+      owners,
+      linkBase,
+    });
+    expect(summary).to.equal(
+      [
+        '## 🍮 Affected packages',
+        '',
+        '3 packages affected, with an estimated duration of 1h15m30s in total.',
+        '',
+        '| Package | Reasons | Owners | Estimated duration | Setup file |',
+        '| --- | --- | --- | --- | --- |',
+        '| `api` | api/main.py changed<br>a\\|b changed | @org/api | 1h | ' +
+          `[api/ci-setup.json](${linkBase}/api/ci-setup.json) |`,
+        '| `web` | web/app.ts changed | @org/web @alice | 15m30s | ' +
+          `[web/ci-setup.json](${linkBase}/web/ci-setup.json) |`,
+        '| `tools` | tools/run.sh changed |  |  |  |',
+        '',
+      ].join('\n'),
+    );
+  });
+
+  it('without links', () => {
+    const packages = [{path: 'web', reasons: ['web/app.ts changed']}];
+    const summary = affectedSummary(config, packages, checkoutPath);
+    expect(summary).to.include(
+      '| `web` | web/app.ts changed |  | 15m30s | `web/ci-setup.json` |',
+    );
+    expect(summary).to.include('1 package affected, with an estimated');
+  });
+
+  it('all packages', () => {
+    const packages = [{path: '*', reasons: ['go.work changed']}];
+    const summary = affectedSummary(config, packages, checkoutPath);
+    expect(summary).to.include('All packages affected.\n');
+    expect(summary).to.include('| All packages | go.work changed |  |  |  |');
+  });
+
+  it('no packages', () => {
+    expect(affectedSummary(config, [], checkoutPath)).to.equal(
+      '## 🍮 Affected packages\n\nNo packages affected.\n',
+    );
+  });
+});
+
+describe('summaryLinkBase', () => {
+  it('from the environment', () => {
+    const base = summaryLinkBase({CUSTARD_LINK_BASE: 'https://x/blob/main/'});
+    expect(base).to.equal('https://x/blob/main');
+    const github = {
+      GITHUB_SERVER_URL: 'https://github.com',
+      GITHUB_REPOSITORY: 'owner/repo',
+      GITHUB_SHA: 'abc123',
+    };
+    expect(summaryLinkBase(github)).to.equal(
+      'https://github.com/owner/repo/blob/abc123',
+    );
+    expect(summaryLinkBase({})).to.be.undefined;
+  });
+});
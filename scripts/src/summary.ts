@@ -0,0 +1,156 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Markdown summary of the affected packages, ready to post as a pull
+// request comment, see `upsertComment`.
+//
+// Each package gets a row with why it's affected, its owners from the
+// CODEOWNERS file, its ci-setup `estimated-duration`, and a link to its
+// ci-setup file, so reviewers don't have to look them up.
+
+import {ownersFor} from './codeowners.ts';
+import type {CodeownersRule} from './codeowners.ts';
+import {
+  allPackages,
+  loadPackage,
+  parseDuration,
+  setupFilePath,
+} from './custard.ts';
+import type {AffectedPackage, Config} from './custard.ts';
+import {codeCell, escapeCell, stepSummary} from './github-actions.ts';
+import type {SummaryColumn} from './github-actions.ts';
+
+export type SummaryOptions = {
+  // CODEOWNERS rules for the owners column, see `loadCodeowners`.
+  owners?: CodeownersRule[];
+
+  // URL the setup file paths are relative to, to link them, like
+  // `https://github.com/owner/repo/blob/main`, see `summaryLinkBase`.
+  linkBase?: string;
+};
+
+/**
+ * Creates a markdown summary of the affected packages.
+ *
+ * @param config config object
+ * @param packages affected packages with their reasons, see
+ *   `affectedDetailed`
+ * @param checkoutPath path to the repository checkout
+ * @param options owners and links
+ * @returns summary markdown
+ */
+export function affectedSummary(
+  config: Config,
+  packages: AffectedPackage[],
+  checkoutPath = '.',
+  options: SummaryOptions = {},
+): string {
+  const durations = new Map(
+    packages
+      .filter(pkg => pkg.path !== allPackages)
+      .map(pkg => [
+        pkg.path,
+        loadPackage(config, pkg.path, checkoutPath).ciSetup[
+          'estimated-duration'
+        ],
+      ]),
+  );
+  const total = [...durations.values()].reduce(
+    (sum, duration) => sum + (duration ? (parseDuration(duration) ?? 0) : 0),
+    0,
+  );
+  // The row of all packages has no owners, duration, or setup file.
+  const column = (heading: string, cell: (pkg: string) => string) => ({
+    heading,
+    cell: (pkg: AffectedPackage) =>
+      pkg.path === allPackages ? '' : cell(pkg.path),
+  });
+  const columns: SummaryColumn[] = [
+    column('Owners', pkg =>
+      ownersFor(options.owners ?? [], pkg).map(escapeCell).join(' '),
+    ),
+    column('Estimated duration', pkg => escapeCell(durations.get(pkg) ?? '')),
+    column('Setup file', pkg => {
+      const setupFile = setupFilePath(config, pkg, checkoutPath);
+      return setupFile === null ? '' : setupLink(setupFile, options.linkBase);
+    }),
+  ];
+  const count = packages.some(pkg => pkg.path === allPackages)
+    ? 'All packages'
+    : packages.length === 1
+      ? '1 package'
+      : `${packages.length} packages`;
+  const description =
+    total > 0
+      ? `${count} affected, with an estimated duration of ${formatDuration(total)} in total.`
+      : `${count} affected.`;
+  return stepSummary(packages, columns, description);
+}
+
+/**
+ * Gets the URL to link the setup files from the environment.
+ *
+ * - CUSTARD_LINK_BASE: URL the paths are relative to.
+ * - Otherwise, on GitHub Actions, the commit being built.
+ *
+ * @param env environment variables
+ * @returns URL, or undefined to not link the setup files
+ */
+export function summaryLinkBase(env = process.env): string | undefined {
+  if (env.CUSTARD_LINK_BASE) {
+    return env.CUSTARD_LINK_BASE.replace(/\/$/, '');
+  }
+  const {GITHUB_SERVER_URL, GITHUB_REPOSITORY, GITHUB_SHA} = env;
+  if (GITHUB_SERVER_URL && GITHUB_REPOSITORY && GITHUB_SHA) {
+    return `${GITHUB_SERVER_URL}/${GITHUB_REPOSITORY}/blob/${GITHUB_SHA}`;
+  }
+  return undefined;
+}
+
+/**
+ * Creates the markdown for a setup file.
+ *
+ * @param setupFile path to the setup file, relative to the checkout path
+ * @param linkBase URL the path is relative to, if any
+ * @returns link to the file, or the path if there is no URL
+ */
+function setupLink(setupFile: string, linkBase?: string): string {
+  if (!linkBase) {
+    return codeCell(setupFile);
+  }
+  const encoded = setupFile.split('/').map(encodeURIComponent).join('/');
+  return `[${escapeCell(setupFile)}](${linkBase}/${encoded})`;
+}
+
+/**
+ * Formats a duration, like 1h5m or 45s.
+ *
+ * @param ms duration in milliseconds
+ * @returns duration with hours, minutes, and seconds
+ */
+function formatDuration(ms: number): string {
+  const seconds = Math.round(ms / 1000);
+  const parts: [number, string][] = [
+    [Math.floor(seconds / 3600), 'h'],
+    [Math.floor((seconds % 3600) / 60), 'm'],
+    [seconds % 60, 's'],
+  ];
+  const text = parts
+    .filter(([value]) => value > 0)
+    .map(([value, unit]) => `${value}${unit}`)
+    .join('');
+  return text || '0s';
+}
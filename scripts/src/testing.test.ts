@@ -0,0 +1,40 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import * as path from 'node:path';
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+
+describe('materialize', () => {
+  it('round trip', () => {
+    const tree = {
+      'pkg/package.json': '{}',
+      'pkg/src/index.js': 'console.log("hello")',
+      'empty/': '',
+    };
+    const root = testing.materialize(tree);
+    try {
+      expect(testing.snapshot(root)).to.deep.equal(tree);
+    } finally {
+      testing.cleanup(root);
+    }
+  });
+
+  it('snapshot checked-in test data', () => {
+    const tree = testing.snapshot(path.join('test', 'ci-setup', 'custom-name'));
+    expect(Object.keys(tree)).to.deep.equal(['my-setup.json']);
+  });
+});
@@ -0,0 +1,210 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Test helpers for Custard and for tools built on top of it.
+// These are not used by the Custard script itself.
+
+import * as fs from 'node:fs';
+import * as os from 'node:os';
+import * as path from 'node:path';
+import {execFileSync} from 'node:child_process';
+import type {GitHubClient} from './github.ts';
+
+// A file tree, mapping relative file paths to their contents.
+// Paths ending with a slash create empty directories.
+export type FileTree = {[path: string]: string};
+
+// Request made to a fake GitHub client, paginated ones are GETs.
+export type GitHubCall = {method: string; path: string; body?: unknown};
+
+// Changes to commit to a git repository.
+export type GitChanges = {
+  // Files to create or overwrite.
+  write?: FileTree;
+
+  // Files or directories to remove.
+  remove?: string[];
+
+  // Files or directories to move, from the old path to the new path.
+  move?: {[from: string]: string};
+};
+
+/**
+ * Writes a file tree into a new temporary directory.
+ *
+ * This keeps tests independent from the checked-in test data layout,
+ * and from the working directory the tests are run from.
+ * Pass the returned directory as the checkout path.
+ *
+ * @param tree files to create
+ * @returns path to the temporary directory
+ */
+export function materialize(tree: FileTree): string {
+  const root = fs.mkdtempSync(path.join(os.tmpdir(), 'custard-'));
+  for (const [filepath, contents] of Object.entries(tree)) {
+    const fullPath = path.join(root, filepath);
+    if (filepath.endsWith('/')) {
+      fs.mkdirSync(fullPath, {recursive: true});
+      continue;
+    }
+    fs.mkdirSync(path.dirname(fullPath), {recursive: true});
+    fs.writeFileSync(fullPath, contents);
+  }
+  return root;
+}
+
+/**
+ * Reads a directory into a file tree.
+ *
+ * This is the inverse of `materialize`, useful to snapshot an existing
+ * test data directory.
+ *
+ * @param root directory to read
+ * @returns file tree relative to the root directory
+ */
+export function snapshot(root: string): FileTree {
+  const tree: FileTree = {};
+  const files = fs.readdirSync(root, {withFileTypes: true, recursive: true});
+  for (const file of files) {
+    const fullPath = path.join(file.parentPath, file.name);
+    const filepath = path.relative(root, fullPath).split(path.sep).join('/');
+    if (file.isDirectory()) {
+      if (fs.readdirSync(fullPath).length === 0) {
+        tree[`${filepath}/`] = '';
+      }
+    } else {
+      tree[filepath] = fs.readFileSync(fullPath, 'utf8');
+    }
+  }
+  return tree;
+}
+
+/**
+ * Creates a git repository in a new temporary directory.
+ *
+ * The file tree is committed as the initial commit.
+ *
+ * @param tree files to create
+ * @returns path to the repository
+ */
+export function gitInit(tree: FileTree): string {
+  const root = materialize(tree);
+  git(root, 'init', '--quiet', '--initial-branch=main');
+  git(root, 'add', '--all');
+  git(root, 'commit', '--quiet', '--allow-empty', '--message=initial commit');
+  return root;
+}
+
+/**
+ * Commits changes to a git repository.
+ *
+ * @param root path to the repository
+ * @param changes changes to commit
+ * @param message commit message
+ * @returns the commit hash
+ */
+export function gitCommit(
+  root: string,
+  changes: GitChanges,
+  message = 'changes',
+): string {
+  for (const [from, to] of Object.entries(changes.move || {})) {
+    fs.mkdirSync(path.dirname(path.join(root, to)), {recursive: true});
+    git(root, 'mv', from, to);
+  }
+  for (const filepath of changes.remove || []) {
+    git(root, 'rm', '--quiet', '-r', filepath);
+  }
+  for (const [filepath, contents] of Object.entries(changes.write || {})) {
+    const fullPath = path.join(root, filepath);
+    fs.mkdirSync(path.dirname(fullPath), {recursive: true});
+    fs.writeFileSync(fullPath, contents);
+  }
+  git(root, 'add', '--all');
+  git(root, 'commit', '--quiet', '--allow-empty', `--message=${message}`);
+  return git(root, 'rev-parse', 'HEAD');
+}
+
+/**
+ * Lists the files changed between two refs, like CI does.
+ *
+ * Renames are listed as a removed and an added file, so both the old
+ * and the new packages are affected.
+ *
+ * @param root path to the repository
+ * @param base base ref
+ * @param head head ref
+ * @returns changed files, relative to the repository root
+ */
+export function gitDiff(root: string, base: string, head = 'HEAD'): string[] {
+  const diffs = git(root, 'diff', '--name-only', '--no-renames', base, head);
+  return diffs.split('\n').filter(diff => diff !== '');
+}
+
+/**
+ * Runs a git command with a fixed identity, independent of the user config.
+ *
+ * @param root path to the repository
+ * @param args git arguments
+ * @returns the command output, trimmed
+ */
+function git(root: string, ...args: string[]): string {
+  const identity = {
+    GIT_AUTHOR_NAME: 'custard',
+    GIT_AUTHOR_EMAIL: 'custard@example.com',
+    GIT_COMMITTER_NAME: 'custard',
+    GIT_COMMITTER_EMAIL: 'custard@example.com',
+  };
+  return execFileSync('git', ['-c', 'commit.gpgsign=false', ...args], {
+    cwd: root,
+    env: {...process.env, ...identity},
+    encoding: 'utf8',
+  }).trim();
+}
+
+/**
+ * Removes a directory created by `materialize`.
+ *
+ * @param root path to the temporary directory
+ */
+export function cleanup(root: string) {
+  fs.rmSync(root, {recursive: true, force: true});
+}
+
+/**
+ * Creates a fake GitHub client, for tools that use the GitHub API.
+ *
+ * @param response response to every request
+ * @param items items of every paginated response
+ * @returns fake client, and the requests made to it, in order
+ */
+export function fakeGitHubClient(
+  response: unknown,
+  items: unknown[] = [],
+): {client: GitHubClient; calls: GitHubCall[]} {
+  const calls: GitHubCall[] = [];
+  const client: GitHubClient = {
+    request: async (method, path, body) => {
+      calls.push(body === undefined ? {method, path} : {method, path, body});
+      return response;
+    },
+    paginate: async function* (path) {
+      calls.push({method: 'GET', path});
+      yield* items;
+    },
+  };
+  return {client, calls};
+}
@@ -0,0 +1,176 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import {execFileSync} from 'node:child_process';
+import {expect} from 'chai';
+import * as testing from './testing.ts';
+import {
+  fileList,
+  gitCli,
+  gitHistory,
+  gitLocal,
+  gitNative,
+  gitStatus,
+  vcsProvider,
+} from './vcs.ts';
+
+describe('vcs', () => {
+  const tree = {
+    'README.md': '# Samples',
+    'a/index.js': 'a'.repeat(1000),
+    'b/index.js': '',
+    'c/nested/index.js': '',
+  };
+  let repo = '';
+  beforeEach(() => {
+    repo = testing.gitInit(tree);
+    testing.gitCommit(repo, {write: {'a/index.js': 'a'.repeat(999) + 'b'}});
+    testing.gitCommit(repo, {move: {'b/index.js': 'b/moved.js'}});
+    testing.gitCommit(repo, {remove: ['c'], write: {'d/new.js': ''}});
+  });
+  afterEach(() => testing.cleanup(repo));
+
+  const revisions = [
+    ['main~1', 'main'],
+    ['main~3', 'HEAD'],
+    ['HEAD^', 'main~2'],
+  ];
+
+  for (const [base, head] of revisions) {
+    it(`git-native ${base}..${head}`, () => {
+      const expected = testing.gitDiff(repo, base, head);
+      expect(gitNative(repo).diff(base, head)).to.deep.equal(expected);
+      expect(gitCli(repo).diff(base, head)).to.deep.equal(expected);
+    });
+  }
+
+  it('git-native packfiles', () => {
+    execFileSync('git', ['gc', '--quiet', '--aggressive'], {cwd: repo});
+    for (const [base, head] of revisions) {
+      const expected = testing.gitDiff(repo, base, head);
+      expect(gitNative(repo).diff(base, head)).to.deep.equal(expected);
+    }
+  });
+
+  it('git-native commit hashes and tags', () => {
+    const base = testing.gitCommit(repo, {write: {'e/index.js': ''}});
+    const identity = ['-c', 'user.name=test', '-c', 'user.email=test@test'];
+    const tag = ['tag', '--annotate', 'v1', '--message', 'v1', base];
+    execFileSync('git', [...identity, ...tag], {cwd: repo});
+    testing.gitCommit(repo, {write: {'a/index.js': 'changed'}});
+    expect(gitNative(repo).diff(base, 'HEAD')).to.deep.equal(['a/index.js']);
+    expect(gitNative(repo).diff('v1', 'HEAD')).to.deep.equal(['a/index.js']);
+    expect(gitNative(repo).diff(base.slice(0, 7), 'HEAD')).to.deep.equal([
+      'a/index.js',
+    ]);
+  });
+
+  it('merge base', () => {
+    const fork = testing.gitCommit(repo, {write: {'e/index.js': ''}});
+    testing.gitCommit(repo, {write: {'a/index.js': 'main'}});
+    const identity = ['-c', 'user.name=test', '-c', 'user.email=test@test'];
+    execFileSync('git', ['switch', '--quiet', '-c', 'feature', fork], {
+      cwd: repo,
+    });
+    testing.gitCommit(repo, {write: {'f/index.js': ''}});
+    execFileSync('git', [...identity, 'merge', '--quiet', 'main'], {
+      cwd: repo,
+    });
+    testing.gitCommit(repo, {write: {'g/index.js': ''}});
+    const main = execFileSync('git', ['rev-parse', 'main'], {
+      cwd: repo,
+      encoding: 'utf8',
+    }).trim();
+    expect(gitCli(repo).mergeBase?.(fork, 'HEAD')).to.equal(fork);
+    expect(gitNative(repo).mergeBase?.('main', 'HEAD')).to.equal(main);
+    expect(gitNative(repo).mergeBase?.('main~1', 'feature')).to.equal(fork);
+    expect(gitNative(repo).mergeBase?.('main', 'HEAD~2')).to.equal(fork);
+  });
+
+  it('git-native unknown revision', () => {
+    expect(() => gitNative(repo).diff('missing', 'HEAD')).to.throw(
+      'unknown revision: missing',
+    );
+  });
+
+  it('git history', () => {
+    expect(gitHistory(repo, '1d')).to.deep.equal([
+      ['a/index.js'],
+      ['b/index.js', 'b/moved.js'],
+      ['c/nested/index.js', 'd/new.js'],
+    ]);
+  });
+
+  it('git history of the last commits', () => {
+    expect(gitHistory(repo, '2')).to.deep.equal([
+      ['b/index.js', 'b/moved.js'],
+      ['c/nested/index.js', 'd/new.js'],
+    ]);
+    expect(gitHistory(repo, 'HEAD~2..HEAD~1')).to.deep.equal([
+      ['b/index.js', 'b/moved.js'],
+    ]);
+  });
+
+  it('git status', () => {
+    fs.writeFileSync(path.join(repo, 'a/index.js'), 'modified');
+    fs.writeFileSync(path.join(repo, 'e.js'), 'staged');
+    fs.mkdirSync(path.join(repo, 'f/g'), {recursive: true});
+    fs.writeFileSync(path.join(repo, 'f/g/untracked.js'), '');
+    fs.rmSync(path.join(repo, 'd/new.js'));
+    execFileSync('git', ['add', 'e.js'], {cwd: repo});
+    execFileSync('git', ['mv', 'b/moved.js', 'b/renamed.js'], {cwd: repo});
+    expect(gitStatus(repo).sort()).to.deep.equal([
+      'a/index.js',
+      'b/moved.js',
+      'b/renamed.js',
+      'd/new.js',
+      'e.js',
+      'f/g/untracked.js',
+    ]);
+  });
+
+  it('git local', () => {
+    fs.writeFileSync(path.join(repo, 'README.md'), 'modified');
+    fs.writeFileSync(path.join(repo, 'a/index.js'), 'modified');
+    expect(gitLocal(repo).diff('HEAD~1', 'HEAD')).to.deep.equal([
+      'README.md',
+      'a/index.js',
+      'c/nested/index.js',
+      'd/new.js',
+    ]);
+    expect(vcsProvider('git-local', repo).diff('HEAD', 'HEAD')).to.deep.equal(
+      ['README.md', 'a/index.js'],
+    );
+  });
+
+  it('file list', () => {
+    const dir = testing.materialize({'diffs.txt': 'a/index.js\n\nb/x.js\n'});
+    try {
+      const diffs = fileList(path.join(dir, 'diffs.txt')).diff('', '');
+      expect(diffs).to.deep.equal(['a/index.js', 'b/x.js']);
+    } finally {
+      testing.cleanup(dir);
+    }
+  });
+
+  it('unknown provider', () => {
+    expect(() => vcsProvider('svn')).to.throw(
+      "unknown VCS provider 'svn', must be one of: git, git-local, git-native, hg, file",
+    );
+  });
+});
@@ -0,0 +1,768 @@
+/*
+ Copyright 2025 Google LLC
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+      https://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+ */
+
+// Version control providers, to get the diffs from any source control.
+// Custard itself only needs a list of files, these are a convenience
+// to get that list the same way on every CI.
+
+import * as fs from 'node:fs';
+import * as path from 'node:path';
+import * as zlib from 'node:zlib';
+import {execFileSync} from 'node:child_process';
+import {message} from './log.ts';
+
+export type VCS = {
+  // Lists the files changed between two revisions,
+  // relative to the repository root.
+  diff: (base: string, head: string) => string[];
+
+  // Finds the commit where head forked from base, to diff a branch
+  // without the changes made to base since, like `git diff base...head`.
+  mergeBase?: (base: string, head: string) => string;
+};
+
+/**
+ * Gets a version control provider by name.
+ *
+ * @param name one of: git, git-local, git-native, hg, file
+ * @param location repository path, or the diffs file path for `file`
+ * @returns version control provider
+ */
+export function vcsProvider(name: string, location = '.'): VCS {
+  switch (name) {
+    case 'git':
+      return gitCli(location);
+    case 'git-local':
+      return gitLocal(location);
+    case 'git-native':
+      return gitNative(location);
+    case 'hg':
+      return mercurial(location);
+    case 'file':
+      return fileList(location);
+    default:
+      throw new Error(
+        message(
+          'E015',
+          `unknown VCS provider '${name}', must be one of: git, git-local, git-native, hg, file`,
+        ),
+      );
+  }
+}
+
+/**
+ * Gets the diffs with the git command line.
+ *
+ * Renames are listed as a removed and an added file, so both the old
+ * and the new packages are affected.
+ *
+ * @param repo path to the repository
+ * @returns version control provider
+ */
+export function gitCli(repo = '.'): VCS {
+  return {
+    diff: (base, head) =>
+      lines(
+        execFileSync(
+          'git',
+          ['diff', '--name-only', '--no-renames', base, head],
+          {cwd: repo, encoding: 'utf8'},
+        ),
+      ),
+    mergeBase: (base, head) =>
+      execFileSync('git', ['merge-base', base, head], {
+        cwd: repo,
+        encoding: 'utf8',
+      }).trim(),
+  };
+}
+
+/**
+ * Gets the diffs with the git command line, including the local changes
+ * that are not committed yet, see `gitStatus`.
+ *
+ * This is for local runs, to get the same affected packages before pushing
+ * as CI gets after.
+ *
+ * @param repo path to the repository
+ * @returns version control provider
+ */
+export function gitLocal(repo = '.'): VCS {
+  const git = gitCli(repo);
+  return {
+    diff: (base, head) =>
+      [...new Set([...git.diff(base, head), ...gitStatus(repo)])].sort(),
+    mergeBase: git.mergeBase,
+  };
+}
+
+/**
+ * Lists the local changes that are not committed yet, with the git command
+ * line.
+ *
+ * It includes the staged, modified, deleted, and untracked files, but not
+ * the ignored ones. Renames are listed as a removed and an added file.
+ *
+ * @param repo path to the repository
+ * @returns changed files, relative to the repository root
+ */
+export function gitStatus(repo = '.'): string[] {
+  const output = execFileSync(
+    'git',
+    [
+      'status',
+      '--porcelain=v1',
+      '-z',
+      '--untracked-files=all',
+      '--no-renames',
+    ],
+    {cwd: repo, encoding: 'utf8'},
+  );
+  // Each entry is `XY path`, where XY are the staged and unstaged status.
+  return output
+    .split('\0')
+    .filter(entry => entry !== '')
+    .map(entry => entry.slice(3));
+}
+
+/**
+ * Reads files at a revision with the git command line.
+ *
+ * @param repo path to the repository
+ * @param rev revision to read the files at, like the base commit
+ * @returns reader for files relative to the repository root, which returns
+ *   null if the file does not exist at the revision
+ */
+export function gitShow(
+  repo: string,
+  rev: string,
+): (file: string) => string | null {
+  return file => {
+    try {
+      return execFileSync('git', ['show', `${rev}:${file}`], {
+        cwd: repo,
+        encoding: 'utf8',
+        stdio: ['ignore', 'pipe', 'ignore'],
+      });
+    } catch {
+      return null;
+    }
+  };
+}
+
+/**
+ * Gets the diffs of each commit merged into HEAD, with the git command line.
+ *
+ * Only first parent commits are listed, so each merged pull request is
+ * a single commit, compared against the previous commit in the branch.
+ *
+ * @param repo path to the repository
+ * @param since how far back to go: a duration like 30d, 2w, 6m, 1y,
+ *   a number of commits like 100, a commit range like v1.0..HEAD,
+ *   or any date git understands
+ * @returns diffs of each commit, oldest first
+ */
+export function gitHistory(repo: string, since: string): string[][] {
+  const units: {[unit: string]: string} = {
+    d: 'days',
+    w: 'weeks',
+    m: 'months',
+    y: 'years',
+  };
+  const duration = since.match(/^(\d+)([dwmy])$/);
+  const date = duration ? `${duration[1]} ${units[duration[2]]} ago` : since;
+  let range = [`--since=${date}`];
+  if (/^\d+$/.test(since)) {
+    range = [`--max-count=${since}`];
+  } else if (since.includes('..')) {
+    // The revisions end at `--`, so a range is never taken as a path.
+    range = [since, '--'];
+  }
+  const args = [
+    'log',
+    '--first-parent',
+    '--reverse',
+    '--format=%H %P',
+    ...range,
+  ];
+  const commits = lines(
+    execFileSync('git', args, {cwd: repo, encoding: 'utf8'}),
+  );
+  const git = gitCli(repo);
+  // The root commit has no parent to compare against.
+  return commits
+    .map(line => line.split(' '))
+    .filter(([, parent]) => parent)
+    .map(([commit, parent]) => git.diff(parent, commit));
+}
+
+/**
+ * Gets the diffs with the Mercurial command line.
+ *
+ * @param repo path to the repository
+ * @returns version control provider
+ */
+export function mercurial(repo = '.'): VCS {
+  return {
+    diff: (base, head) =>
+      lines(
+        execFileSync(
+          'hg',
+          ['status', '--no-status', '--rev', base, '--rev', head],
+          {cwd: repo, encoding: 'utf8'},
+        ),
+      ),
+    mergeBase: (base, head) => {
+      // Quoted as revset strings, so they are always revision names.
+      const revset = `ancestor(${JSON.stringify(base)}, ${JSON.stringify(head)})`;
+      return execFileSync(
+        'hg',
+        ['log', '--rev', revset, '--template', '{node}'],
+        {cwd: repo, encoding: 'utf8'},
+      ).trim();
+    },
+  };
+}
+
+/**
+ * Reads the diffs from a file, one per line.
+ *
+ * The revisions are ignored, the file already has the diffs.
+ *
+ * @param filePath path to the diffs file
+ * @returns version control provider
+ */
+export function fileList(filePath: string): VCS {
+  return {
+    diff: () => lines(fs.readFileSync(filePath, 'utf8')),
+  };
+}
+
+/**
+ * Gets the diffs by reading the git objects directly.
+ *
+ * This works without a git binary, like in distroless CI containers.
+ * It supports loose objects, packfiles, and revisions like branch names,
+ * tags, commit hashes, `HEAD`, and `<rev>~<n>` or `<rev>^`.
+ *
+ * @param repo path to the repository
+ * @returns version control provider
+ */
+export function gitNative(repo = '.'): VCS {
+  const gitDir = findGitDir(repo);
+  const objects = gitObjects(gitDir);
+  return {
+    diff: (base, head) => {
+      const baseCommit = resolveRev(gitDir, objects, base);
+      const headCommit = resolveRev(gitDir, objects, head);
+      const baseTree = commitTree(objects, baseCommit);
+      const headTree = commitTree(objects, headCommit);
+      return diffTrees(objects, baseTree, headTree, '').sort();
+    },
+    mergeBase: (base, head) => {
+      const baseCommit = resolveRev(gitDir, objects, base);
+      const headCommit = resolveRev(gitDir, objects, head);
+      const commit = commonAncestor(objects, baseCommit, headCommit);
+      if (commit === null) {
+        throw new Error(
+          message('E052', `'${base}' and '${head}' have no common commits`),
+        );
+      }
+      return commit;
+    },
+  };
+}
+
+/**
+ * Splits command output into its non-empty lines.
+ *
+ * @param text command output
+ * @returns lines with text
+ */
+function lines(text: string): string[] {
+  return text.split('\n').filter(line => line.trim() !== '');
+}
+
+/**
+ * Finds the git directory of a repository, including worktrees.
+ *
+ * @param repo path to the repository
+ * @returns path to the git directory
+ */
+function findGitDir(repo: string): string {
+  const dotGit = path.join(repo, '.git');
+  if (fs.statSync(dotGit).isFile()) {
+    // Worktrees and submodules have a file pointing to the git directory.
+    const gitdir = fs.readFileSync(dotGit, 'utf8').match(/^gitdir: (.*)$/m);
+    if (!gitdir) {
+      throw new Error(message('E016', `invalid .git file: ${dotGit}`));
+    }
+    return path.resolve(repo, gitdir[1].trim());
+  }
+  return dotGit;
+}
+
+/**
+ * Resolves a revision into a commit hash.
+ *
+ * @param gitDir path to the git directory
+ * @param objects git object reader
+ * @param rev revision to resolve
+ * @returns commit hash
+ */
+function resolveRev(gitDir: string, objects: GitObjects, rev: string): string {
+  const ancestor = rev.match(/^(.+?)(~(\d*)|\^)$/);
+  if (ancestor) {
+    let commit = resolveRev(gitDir, objects, ancestor[1]);
+    const generations = ancestor[2] === '^' ? 1 : Number(ancestor[3] || 1);
+    for (let i = 0; i < generations; i++) {
+      const parent = commitParent(objects, commit);
+      if (!parent) {
+        throw new Error(message('E017', `revision '${rev}' has no parent`));
+      }
+      commit = parent;
+    }
+    return commit;
+  }
+  if (/^[0-9a-f]{40}$/.test(rev)) {
+    return rev;
+  }
+  const refs = [rev, `refs/${rev}`, `refs/heads/${rev}`, `refs/tags/${rev}`];
+  refs.push(`refs/remotes/${rev}`);
+  for (const ref of refs) {
+    const sha = readRef(gitDir, ref);
+    if (sha) {
+      return peel(objects, sha);
+    }
+  }
+  const abbreviated = /^[0-9a-f]{4,39}$/.test(rev) && objects.expand(rev);
+  if (abbreviated) {
+    return abbreviated;
+  }
+  throw new Error(message('E018', `unknown revision: ${rev}`));
+}
+
+/**
+ * Reads a ref, following symbolic refs like HEAD.
+ *
+ * @param gitDir path to the git directory
+ * @param ref ref name
+ * @returns object hash, or null if the ref does not exist
+ */
+function readRef(gitDir: string, ref: string): string | null {
+  const refPath = path.join(gitDir, ref);
+  if (fs.existsSync(refPath) && fs.statSync(refPath).isFile()) {
+    const value = fs.readFileSync(refPath, 'utf8').trim();
+    const symbolic = value.match(/^ref: (.*)$/);
+    return symbolic ? readRef(gitDir, symbolic[1]) : value;
+  }
+  const packedRefs = path.join(gitDir, 'packed-refs');
+  if (fs.existsSync(packedRefs)) {
+    for (const line of fs.readFileSync(packedRefs, 'utf8').split('\n')) {
+      const [sha, name] = line.split(' ');
+      if (name === ref) {
+        return sha;
+      }
+    }
+  }
+  return null;
+}
+
+type TreeEntry = {name: string; isTree: boolean; sha: string};
+
+/**
+ * Lists the files that differ between two trees.
+ *
+ * @param objects git object reader
+ * @param base base tree hash, or null if the tree does not exist
+ * @param head head tree hash, or null if the tree does not exist
+ * @param prefix path of the trees, relative to the repository root
+ * @returns changed files
+ */
+function diffTrees(
+  objects: GitObjects,
+  base: string | null,
+  head: string | null,
+  prefix: string,
+): string[] {
+  if (base === head) {
+    return [];
+  }
+  const baseEntries = base ? readTree(objects, base) : new Map();
+  const headEntries = head ? readTree(objects, head) : new Map();
+  const names = new Set([...baseEntries.keys(), ...headEntries.keys()]);
+  const diffs = [];
+  for (const name of names) {
+    const a: TreeEntry | undefined = baseEntries.get(name);
+    const b: TreeEntry | undefined = headEntries.get(name);
+    if (a && b && a.sha === b.sha && a.isTree === b.isTree) {
+      continue;
+    }
+    const filepath = prefix ? `${prefix}/${name}` : name;
+    // A path can change from a file into a directory, or the other way.
+    const aFile = a && !a.isTree ? a : undefined;
+    const bFile = b && !b.isTree ? b : undefined;
+    if (aFile || bFile) {
+      diffs.push(filepath);
+    }
+    const aTree = a && a.isTree ? a.sha : null;
+    const bTree = b && b.isTree ? b.sha : null;
+    if (aTree || bTree) {
+      diffs.push(...diffTrees(objects, aTree, bTree, filepath));
+    }
+  }
+  return diffs;
+}
+
+type GitObject = {type: string; data: Buffer};
+
+type GitObjects = {
+  // Reads an object by its hash.
+  read: (sha: string) => GitObject;
+  // Expands an abbreviated hash, or null if not found.
+  expand: (prefix: string) => string | null;
+};
+
+/**
+ * Creates a reader for git objects, from loose object files and packfiles.
+ *
+ * @param gitDir path to the git directory
+ * @returns git object reader
+ */
+function gitObjects(gitDir: string): GitObjects {
+  const objectsDir = path.join(gitDir, 'objects');
+  // Packfiles are read once, on the first object found in them.
+  let packs: {pack: string; index: Buffer; data?: Buffer}[] | undefined;
+
+  const packFiles = () => {
+    if (!packs) {
+      const packDir = path.join(objectsDir, 'pack');
+      const names = fs.existsSync(packDir) ? fs.readdirSync(packDir) : [];
+      packs = names
+        .filter(name => name.endsWith('.idx'))
+        .map(name => ({
+          pack: path.join(packDir, name.replace(/\.idx$/, '.pack')),
+          index: fs.readFileSync(path.join(packDir, name)),
+        }));
+    }
+    return packs;
+  };
+
+  const read = (sha: string): GitObject => {
+    const loose = path.join(objectsDir, sha.slice(0, 2), sha.slice(2));
+    if (fs.existsSync(loose)) {
+      const raw = zlib.inflateSync(fs.readFileSync(loose));
+      const header = raw.indexOf(0);
+      const [type] = raw.subarray(0, header).toString().split(' ');
+      return {type, data: raw.subarray(header + 1)};
+    }
+    for (const pack of packFiles()) {
+      const offset = packOffset(pack.index, sha);
+      if (offset !== null) {
+        pack.data ??= fs.readFileSync(pack.pack);
+        return readPacked(read, pack.data, offset);
+      }
+    }
+    throw new Error(message('E019', `git object not found: ${sha}`));
+  };
+
+  const expand = (prefix: string): string | null => {
+    const dir = path.join(objectsDir, prefix.slice(0, 2));
+    if (fs.existsSync(dir)) {
+      const file = fs
+        .readdirSync(dir)
+        .find(name => name.startsWith(prefix.slice(2)));
+      if (file) {
+        return prefix.slice(0, 2) + file;
+      }
+    }
+    for (const {index} of packFiles()) {
+      const count = index.readUInt32BE(8 + 255 * 4);
+      const shas = 8 + 256 * 4;
+      for (let i = 0; i < count; i++) {
+        const sha = index.toString('hex', shas + i * 20, shas + i * 20 + 20);
+        if (sha.startsWith(prefix)) {
+          return sha;
+        }
+      }
+    }
+    return null;
+  };
+
+  return {read, expand};
+}
+
+/**
+ * Follows annotated tags to the commit they point to.
+ *
+ * @param objects git object reader
+ * @param sha object hash
+ * @returns commit hash
+ */
+function peel(objects: GitObjects, sha: string): string {
+  const {type, data} = objects.read(sha);
+  if (type === 'tag') {
+    const object = data.toString().match(/^object ([0-9a-f]{40})$/m);
+    return object ? peel(objects, object[1]) : sha;
+  }
+  return sha;
+}
+
+/**
+ * Reads the header of a commit, with its tree and parents.
+ *
+ * @param objects git object reader
+ * @param sha commit hash
+ * @returns commit header
+ */
+function commitHeader(objects: GitObjects, sha: string): string {
+  const {type, data} = objects.read(sha);
+  if (type !== 'commit') {
+    throw new Error(message('E020', `not a commit: ${sha}`));
+  }
+  const text = data.toString();
+  return text.slice(0, text.indexOf('\n\n'));
+}
+
+/**
+ * Gets the tree of a commit.
+ *
+ * @param objects git object reader
+ * @param sha commit hash
+ * @returns tree hash
+ */
+function commitTree(objects: GitObjects, sha: string): string {
+  const tree = commitHeader(objects, sha).match(/^tree ([0-9a-f]{40})$/m);
+  if (!tree) {
+    throw new Error(message('E020', `not a commit: ${sha}`));
+  }
+  return tree[1];
+}
+
+/**
+ * Gets the first parent of a commit.
+ *
+ * @param objects git object reader
+ * @param sha commit hash
+ * @returns parent commit hash, or null for a root commit
+ */
+function commitParent(objects: GitObjects, sha: string): string | null {
+  const parent = commitHeader(objects, sha).match(/^parent ([0-9a-f]{40})$/m);
+  return parent ? parent[1] : null;
+}
+
+/**
+ * Gets all the parents of a commit, like both sides of a merge.
+ *
+ * @param objects git object reader
+ * @param sha commit hash
+ * @returns parent commit hashes, in order
+ */
+function commitParents(objects: GitObjects, sha: string): string[] {
+  const header = commitHeader(objects, sha);
+  return [...header.matchAll(/^parent ([0-9a-f]{40})$/gm)].map(m => m[1]);
+}
+
+/**
+ * Finds the closest common ancestor of two commits.
+ *
+ * Both histories are walked one commit at a time, breadth first, so only
+ * the commits since the fork are read.
+ *
+ * @param objects git object reader
+ * @param a first commit hash
+ * @param b second commit hash
+ * @returns common ancestor, or null if the histories are unrelated
+ */
+function commonAncestor(
+  objects: GitObjects,
+  a: string,
+  b: string,
+): string | null {
+  const seen = [new Set([a]), new Set([b])];
+  const queues = [[a], [b]];
+  while (queues[0].length > 0 || queues[1].length > 0) {
+    for (const side of [0, 1]) {
+      const commit = queues[side].shift();
+      if (commit === undefined) {
+        continue;
+      }
+      if (seen[1 - side].has(commit)) {
+        return commit;
+      }
+      for (const parent of commitParents(objects, commit)) {
+        if (!seen[side].has(parent)) {
+          seen[side].add(parent);
+          queues[side].push(parent);
+        }
+      }
+    }
+  }
+  return null;
+}
+
+/**
+ * Reads a tree object.
+ *
+ * @param objects git object reader
+ * @param sha tree hash
+ * @returns entries by name
+ */
+function readTree(objects: GitObjects, sha: string): Map<string, TreeEntry> {
+  const {data} = objects.read(sha);
+  const entries = new Map<string, TreeEntry>();
+  let pos = 0;
+  while (pos < data.length) {
+    const space = data.indexOf(0x20, pos);
+    const nul = data.indexOf(0, space);
+    const mode = data.toString('utf8', pos, space);
+    const name = data.toString('utf8', space + 1, nul);
+    const entrySha = data.toString('hex', nul + 1, nul + 21);
+    entries.set(name, {name, isTree: mode === '40000', sha: entrySha});
+    pos = nul + 21;
+  }
+  return entries;
+}
+
+/**
+ * Reads an object from a packfile, resolving deltas.
+ *
+ * @param read reads base objects referenced by hash
+ * @param pack packfile contents
+ * @param offset object offset in the packfile
+ * @returns object type and contents
+ */
+function readPacked(
+  read: (sha: string) => GitObject,
+  pack: Buffer,
+  offset: number,
+): GitObject {
+  const types = ['', 'commit', 'tree', 'blob', 'tag', '', 'ofs', 'ref'];
+  let pos = offset;
+  let byte = pack[pos++];
+  const type = types[(byte >> 4) & 7];
+  while (byte & 0x80) {
+    byte = pack[pos++];
+  }
+  if (type === 'ofs') {
+    byte = pack[pos++];
+    let distance = byte & 0x7f;
+    while (byte & 0x80) {
+      byte = pack[pos++];
+      distance = ((distance + 1) << 7) | (byte & 0x7f);
+    }
+    const base = readPacked(read, pack, offset - distance);
+    const delta = zlib.inflateSync(pack.subarray(pos));
+    return {type: base.type, data: applyDelta(base.data, delta)};
+  }
+  if (type === 'ref') {
+    const base = read(pack.toString('hex', pos, pos + 20));
+    const delta = zlib.inflateSync(pack.subarray(pos + 20));
+    return {type: base.type, data: applyDelta(base.data, delta)};
+  }
+  return {type, data: zlib.inflateSync(pack.subarray(pos))};
+}
+
+/**
+ * Finds the offset of an object in a version 2 pack index.
+ *
+ * @param index pack index contents
+ * @param sha object hash
+ * @returns offset in the packfile, or null if not in this pack
+ */
+function packOffset(index: Buffer, sha: string): number | null {
+  const fanout = 8;
+  const first = parseInt(sha.slice(0, 2), 16);
+  const count = index.readUInt32BE(fanout + 255 * 4);
+  let lo = first === 0 ? 0 : index.readUInt32BE(fanout + (first - 1) * 4);
+  let hi = index.readUInt32BE(fanout + first * 4);
+  const shas = fanout + 256 * 4;
+  const target = Buffer.from(sha, 'hex');
+  while (lo < hi) {
+    const mid = (lo + hi) >> 1;
+    const start = shas + mid * 20;
+    const cmp = index.compare(target, 0, 20, start, start + 20);
+    if (cmp === 0) {
+      const offsets = shas + count * 24;
+      const offset = index.readUInt32BE(offsets + mid * 4);
+      if (offset & 0x80000000) {
+        // Large offsets are stored in a separate 64-bit table.
+        const large = offsets + count * 4 + (offset & 0x7fffffff) * 8;
+        return Number(index.readBigUInt64BE(large));
+      }
+      return offset;
+    }
+    if (cmp > 0) {
+      hi = mid;
+    } else {
+      lo = mid + 1;
+    }
+  }
+  return null;
+}
+
+/**
+ * Applies a git delta to a base object.
+ *
+ * @param base base object contents
+ * @param delta delta instructions
+ * @returns resulting object contents
+ */
+function applyDelta(base: Buffer, delta: Buffer): Buffer {
+  let pos = 0;
+  const varint = () => {
+    let value = 0;
+    let shift = 0;
+    let byte;
+    do {
+      byte = delta[pos++];
+      value |= (byte & 0x7f) << shift;
+      shift += 7;
+    } while (byte & 0x80);
+    return value;
+  };
+  varint(); // base size
+  const result = Buffer.alloc(varint());
+  let out = 0;
+  while (pos < delta.length) {
+    const op = delta[pos++];
+    if (op & 0x80) {
+      // Copy from the base object.
+      let copyOffset = 0;
+      let copySize = 0;
+      for (let i = 0; i < 4; i++) {
+        if (op & (1 << i)) {
+          copyOffset |= delta[pos++] << (8 * i);
+        }
+      }
+      for (let i = 0; i < 3; i++) {
+        if (op & (1 << (4 + i))) {
+          copySize |= delta[pos++] << (8 * i);
+        }
+      }
+      copyOffset >>>= 0;
+      copySize = copySize || 0x10000;
+      base.copy(result, out, copyOffset, copyOffset + copySize);
+      out += copySize;
+    } else {
+      // Insert new data.
+      delta.copy(result, out, pos, pos + op);
+      out += op;
+      pos += op;
+    }
+  }
+  return result;
+}